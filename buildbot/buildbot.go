@@ -1,6 +1,7 @@
 package buildbot
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -44,6 +45,14 @@ type Buildbot struct {
 	// A comma-separated list of worker names and passwords (e.g. 'worker1,pass1,worker2,pass2')
 	WorkersList string
 
+	// Absolute path to a JSON file where the worker passwords are written
+	// (optional). master.cfg and the workers read them from there instead
+	// of keeping them in WorkDir.
+	WorkerPasswordsFile string
+
+	// Shown in the web UI (optional, default: 'Buildbot')
+	Title string
+
 	WWWProtocol string
 	WWWHost     string
 	wwwPort     int
@@ -118,12 +127,57 @@ func (bb *Buildbot) createWorkers() error {
 		if err != nil {
 			return fmt.Errorf("buildbot-worker create-worker %s: %v", w.name, err)
 		}
+		if bb.WorkerPasswordsFile != "" {
+			if err := bb.readWorkerPassword(w); err != nil {
+				return err
+			}
+		}
 		_ = os.WriteFile(filepath.Join(bb.WorkDir, w.name, "info", "admin"), []byte("Administrator <admin@"+bb.WWWHost+">"), 0644)
 		_ = os.WriteFile(filepath.Join(bb.WorkDir, w.name, "info", "host"), []byte(bb.WWWHost), 0644)
 	}
 	return nil
 }
 
+// readWorkerPassword makes buildbot.tac of the worker read its password
+// from WorkerPasswordsFile.
+func (bb *Buildbot) readWorkerPassword(w worker) error {
+	path := filepath.Join(bb.WorkDir, w.name, "buildbot.tac")
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("os.ReadFile('%s'): %v", path, err)
+	}
+	line := fmt.Sprintf("passwd = '%s'\n", w.password)
+	if !strings.Contains(string(bytes), line) {
+		return fmt.Errorf("%s does not set the password", path)
+	}
+	tac := strings.Replace(string(bytes), line, fmt.Sprintf("import json\nwith open(%s) as f:\n    passwd = json.load(f)[%s]\n",
+		strconv.Quote(bb.WorkerPasswordsFile), strconv.Quote(w.name)), 1)
+	err = os.WriteFile(path, []byte(tac), 0600)
+	if err != nil {
+		return fmt.Errorf("os.WriteFile('%s'): %v", path, err)
+	}
+	return nil
+}
+
+// writeWorkerPasswords replaces WorkerPasswordsFile through a temporary
+// file, so that readers never see half of it.
+func (bb *Buildbot) writeWorkerPasswords() error {
+	passwords := make(map[string]string)
+	for _, w := range bb.workers {
+		passwords[w.name] = w.password
+	}
+	bytes, err := json.Marshal(passwords)
+	if err != nil {
+		return err
+	}
+	tmp := bb.WorkerPasswordsFile + ".tmp"
+	err = os.WriteFile(tmp, bytes, 0600)
+	if err != nil {
+		return fmt.Errorf("os.WriteFile('%s'): %v", tmp, err)
+	}
+	return os.Rename(tmp, bb.WorkerPasswordsFile)
+}
+
 func (bb *Buildbot) writeConfig(w io.Writer, gps []*gerrit.Project) {
 	fmt.Fprint(w, `from buildbot.plugins import *
 from buildbot.reporters.gerrit import GerritStatusPush
@@ -155,7 +209,12 @@ c['buildbotNetUsageData'] = None
 	fmt.Fprintf(w, "c['buildbotURL'] = '%s://%s:%d/'\n", bb.WWWProtocol, bb.WWWHost, bb.PublicPort)
 	fmt.Fprintf(w, "c['db'] = {'db_url': '%s'}\n", bb.dbURL)
 	fmt.Fprintf(w, "c['protocols'] = {'pb': {'port': 'tcp:%d:interface=%s'}}\n", bb.pbPort, bb.pbHost)
-	fmt.Fprint(w, "c['title'] = 'Buildbot'\n")
+	title := bb.Title
+	if title == "" {
+		title = "Buildbot"
+	}
+	// A quoted Go string is also a valid Python string literal.
+	fmt.Fprintf(w, "c['title'] = %s\n", strconv.Quote(title))
 	fmt.Fprintf(w, "c['titleURL'] = '%s://%s:%d/'\n", bb.WWWProtocol, bb.WWWHost, bb.PublicPort)
 	fmt.Fprintf(w, `
 c['www'] = dict(port="tcp:%d:interface=%s",
@@ -172,8 +231,15 @@ c['services'] = []
 c['workers'] = []
 
 `)
+	if bb.WorkerPasswordsFile != "" {
+		fmt.Fprintf(w, "import json\nwith open(%s) as f:\n    worker_passwords = json.load(f)\n", strconv.Quote(bb.WorkerPasswordsFile))
+	}
 	for _, worker := range bb.workers {
-		fmt.Fprintf(w, "c['workers'].append(worker.Worker('%s', '%s', keepalive_interval=60))\n", worker.name, worker.password)
+		password := fmt.Sprintf("'%s'", worker.password)
+		if bb.WorkerPasswordsFile != "" {
+			password = fmt.Sprintf("worker_passwords[%s]", strconv.Quote(worker.name))
+		}
+		fmt.Fprintf(w, "c['workers'].append(worker.Worker('%s', %s, keepalive_interval=60))\n", worker.name, password)
 	}
 	if len(gps) == 0 {
 		fmt.Fprintf(w, `
@@ -450,6 +516,11 @@ func (bb *Buildbot) startWorkers() error {
 }
 
 func (bb *Buildbot) RewriteConfig(gps []*gerrit.Project) error {
+	if bb.WorkerPasswordsFile != "" {
+		if err := bb.writeWorkerPasswords(); err != nil {
+			return err
+		}
+	}
 	var b strings.Builder
 	bb.writeConfig(&b, gps)
 	path := filepath.Join(bb.WorkDir, "master", "master.cfg")
@@ -467,6 +538,41 @@ func (bb *Buildbot) RewriteConfig(gps []*gerrit.Project) error {
 	return nil
 }
 
+// SetWorkersList replaces the workers for the next RewriteConfig, e.g.
+// after their passwords have been changed by ReplaceWorkers elsewhere.
+func (bb *Buildbot) SetWorkersList(list string) error {
+	bb.WorkersList = list
+	bb.workers = nil
+	return bb.parseWorkersList()
+}
+
+// ReplaceWorkers recreates the workers from WorkersList, e.g. with new
+// passwords, rewrites master.cfg and starts the workers again. They keep
+// trying to connect until the master is restarted with the new config.
+func (bb *Buildbot) ReplaceWorkers(gps []*gerrit.Project) error {
+	err := bb.SetWorkersList(bb.WorkersList)
+	if err != nil {
+		return err
+	}
+	err = bb.stopWorkers()
+	if err != nil {
+		log.Printf("%v", err)
+	}
+	err = bb.purgeWorkers()
+	if err != nil {
+		return err
+	}
+	err = bb.createWorkers()
+	if err != nil {
+		return err
+	}
+	err = bb.RewriteConfig(gps)
+	if err != nil {
+		return err
+	}
+	return bb.startWorkers()
+}
+
 func (bb *Buildbot) Restart() error {
 	restartCmd := exec.Command(bb.BinPath, "restart", "master")
 	restartCmd.Dir = bb.WorkDir
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Client calls the JSON API of the portal with an API token.
+type Client struct {
+	BaseURL string // e.g. https://nsbox.local:9440
+	Token   string
+	HTTP    *http.Client
+}
+
+// APIError is the error object returned by the portal.
+type APIError struct {
+	Status  int             `json:"-"`
+	Code    string          `json:"code"`
+	Message string          `json:"message"`
+	Details json.RawMessage `json:"details,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s (%d %s)", e.Message, e.Status, e.Code)
+}
+
+// NewClient trusts the certificates in caFile in addition to the system
+// ones. nsbox uses a self-signed certificate unless it was given another.
+func NewClient(baseURL, token, caFile string) (*Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &Client{
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		Token:   token,
+		HTTP:    &http.Client{Transport: transport, Timeout: 5 * time.Minute},
+	}, nil
+}
+
+// Do sends in as JSON, unless it is nil, and returns the raw response body.
+// If out is not nil, the body is also decoded into it. Error responses are
+// returned as *APIError.
+func (c *Client) Do(method, path string, in, out any) ([]byte, error) {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.BaseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		var e struct {
+			Error *APIError `json:"error"`
+		}
+		if err := json.Unmarshal(data, &e); err != nil || e.Error == nil {
+			// Not from the portal, e.g. httpd.
+			return nil, &APIError{Status: resp.StatusCode, Code: "http", Message: resp.Status}
+		}
+		e.Error.Status = resp.StatusCode
+		return nil, e.Error
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			return nil, fmt.Errorf("error decoding response: %v", err)
+		}
+	}
+	return data, nil
+}
+
+// The types below mirror the responses of /api/v1. See
+// /api/v1/openapi.json for the full description.
+
+type User struct {
+	Username  string    `json:"username"`
+	FirstName string    `json:"first_name"`
+	LastName  string    `json:"last_name"`
+	Email     string    `json:"email"`
+	Enabled   bool      `json:"enabled"`
+	Accounts  []Account `json:"accounts,omitempty"`
+}
+
+type Account struct {
+	System string `json:"system"`
+	Name   string `json:"name,omitempty"`
+	Email  string `json:"email,omitempty"`
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type CreatedUser struct {
+	Username     string `json:"username"`
+	Provisioning string `json:"provisioning"`
+	Password     string `json:"password,omitempty"`
+	SentTo       string `json:"sent_to,omitempty"`
+	EmailError   string `json:"email_error,omitempty"`
+}
+
+type Group struct {
+	Name        string        `json:"name"`
+	Description string        `json:"description,omitempty"`
+	Members     []string      `json:"members"`
+	Drift       []*GroupDrift `json:"drift,omitempty"`
+}
+
+type GroupDrift struct {
+	System       string   `json:"system"`
+	InSync       bool     `json:"in_sync"`
+	MissingGroup bool     `json:"missing_group,omitempty"`
+	Missing      []string `json:"missing,omitempty"`
+	Extra        []string `json:"extra,omitempty"`
+	Error        string   `json:"error,omitempty"`
+}
+
+type Project struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+type ServiceStatus struct {
+	Name   string `json:"name"`
+	Up     bool   `json:"up"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type Build struct {
+	ID        int        `json:"id"`
+	Builder   string     `json:"builder"`
+	Number    int        `json:"number"`
+	State     string     `json:"state"`
+	Result    string     `json:"result,omitempty"`
+	Started   time.Time  `json:"started"`
+	Completed *time.Time `json:"completed,omitempty"`
+	URL       string     `json:"url"`
+}
+
+// Result is the outcome of an operation in one system.
+type Result struct {
+	System  string `json:"system"`
+	Message string `json:"message,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type Results struct {
+	Results []Result `json:"results"`
+}
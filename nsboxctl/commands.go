@@ -0,0 +1,417 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func usersList(c *Client, args []string) error {
+	if _, _, err := parseArgs("users list", args, 0, nil); err != nil {
+		return err
+	}
+	var resp struct {
+		Users []*User `json:"users"`
+	}
+	data, err := c.Do(http.MethodGet, "/api/v1/users", nil, &resp)
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		printJSON(data)
+		return nil
+	}
+	t := newTable()
+	fmt.Fprintln(t, "USERNAME\tNAME\tEMAIL\tENABLED")
+	for _, u := range resp.Users {
+		fmt.Fprintf(t, "%s\t%s %s\t%s\t%t\n", u.Username, u.FirstName, u.LastName, u.Email, u.Enabled)
+	}
+	return t.Flush()
+}
+
+func usersGet(c *Client, args []string) error {
+	pos, _, err := parseArgs("users get", args, 1, nil)
+	if err != nil {
+		return err
+	}
+	var user User
+	data, err := c.Do(http.MethodGet, "/api/v1/users/"+url.PathEscape(pos[0]), nil, &user)
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		printJSON(data)
+		return nil
+	}
+	t := newTable()
+	fmt.Fprintln(t, "SYSTEM\tNAME\tEMAIL\tSTATUS")
+	for _, a := range user.Accounts {
+		if a.Error != "" {
+			fmt.Fprintf(t, "%s\tError: %s\t\t\n", a.System, a.Error)
+		} else {
+			fmt.Fprintf(t, "%s\t%s\t%s\t%s\n", a.System, a.Name, a.Email, a.Status)
+		}
+	}
+	return t.Flush()
+}
+
+func usersCreate(c *Client, args []string) error {
+	var req struct {
+		Username  string   `json:"username"`
+		FirstName string   `json:"first_name"`
+		LastName  string   `json:"last_name"`
+		Email     string   `json:"email,omitempty"`
+		Groups    []string `json:"groups,omitempty"`
+		Delivery  string   `json:"delivery,omitempty"`
+	}
+	var groups string
+	_, _, err := parseArgs("users create", args, 0, func(fs *flag.FlagSet) {
+		fs.StringVar(&req.Username, "username", "", "")
+		fs.StringVar(&req.FirstName, "first_name", "", "")
+		fs.StringVar(&req.LastName, "last_name", "", "")
+		fs.StringVar(&req.Email, "email", "", "Email address (default: from the template of the portal)")
+		fs.StringVar(&groups, "groups", "", "Comma-separated groups to add the user to")
+		fs.StringVar(&req.Delivery, "delivery", "show", "How to hand over the initial password: show, email_password or email_link")
+	})
+	if err != nil {
+		return err
+	}
+	for _, g := range strings.Split(groups, ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			req.Groups = append(req.Groups, g)
+		}
+	}
+	var created CreatedUser
+	data, err := c.Do(http.MethodPost, "/api/v1/users", &req, &created)
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		printJSON(data)
+		return nil
+	}
+	fmt.Printf("Created user %s (provisioning %s)\n", created.Username, created.Provisioning)
+	if created.SentTo != "" {
+		fmt.Printf("Onboarding email sent to %s\n", created.SentTo)
+	}
+	if created.EmailError != "" {
+		fmt.Printf("Failed to send the onboarding email: %s\n", created.EmailError)
+	}
+	if created.Password != "" {
+		fmt.Printf("Initial password: %s\n", created.Password)
+	}
+	return nil
+}
+
+func usersUpdate(c *Client, args []string) error {
+	var firstName, lastName, email string
+	pos, fs, err := parseArgs("users update", args, 1, func(fs *flag.FlagSet) {
+		fs.StringVar(&firstName, "first_name", "", "")
+		fs.StringVar(&lastName, "last_name", "", "")
+		fs.StringVar(&email, "email", "", "")
+	})
+	if err != nil {
+		return err
+	}
+	// Only the flags that are given are changed.
+	req := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		req[f.Name] = f.Value.String()
+	})
+	if len(req) == 0 {
+		return fmt.Errorf("nothing to update")
+	}
+	var results Results
+	data, err := c.Do(http.MethodPatch, "/api/v1/users/"+url.PathEscape(pos[0]), req, &results)
+	if err != nil {
+		return err
+	}
+	printResponse(data, &results)
+	return nil
+}
+
+func userAction(action string) func(c *Client, args []string) error {
+	return func(c *Client, args []string) error {
+		pos, _, err := parseArgs("users "+action, args, 1, nil)
+		if err != nil {
+			return err
+		}
+		var results Results
+		data, err := c.Do(http.MethodPost, "/api/v1/users/"+url.PathEscape(pos[0])+"/"+action, nil, &results)
+		if err != nil {
+			return err
+		}
+		printResponse(data, &results)
+		return nil
+	}
+}
+
+func usersDelete(c *Client, args []string) error {
+	pos, _, err := parseArgs("users delete", args, 1, nil)
+	if err != nil {
+		return err
+	}
+	var results Results
+	data, err := c.Do(http.MethodDelete, "/api/v1/users/"+url.PathEscape(pos[0]), nil, &results)
+	if err != nil {
+		return err
+	}
+	printResponse(data, &results)
+	return nil
+}
+
+func groupsList(c *Client, args []string) error {
+	if _, _, err := parseArgs("groups list", args, 0, nil); err != nil {
+		return err
+	}
+	var resp struct {
+		Groups []*Group `json:"groups"`
+	}
+	data, err := c.Do(http.MethodGet, "/api/v1/groups", nil, &resp)
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		printJSON(data)
+		return nil
+	}
+	t := newTable()
+	fmt.Fprintln(t, "NAME\tMEMBERS\tDESCRIPTION")
+	for _, g := range resp.Groups {
+		fmt.Fprintf(t, "%s\t%d\t%s\n", g.Name, len(g.Members), g.Description)
+	}
+	return t.Flush()
+}
+
+func groupsGet(c *Client, args []string) error {
+	pos, _, err := parseArgs("groups get", args, 1, nil)
+	if err != nil {
+		return err
+	}
+	var group Group
+	data, err := c.Do(http.MethodGet, "/api/v1/groups/"+url.PathEscape(pos[0]), nil, &group)
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		printJSON(data)
+		return nil
+	}
+	fmt.Printf("Name:        %s\n", group.Name)
+	fmt.Printf("Description: %s\n", group.Description)
+	fmt.Printf("Members:     %s\n\n", strings.Join(group.Members, ", "))
+	t := newTable()
+	fmt.Fprintln(t, "SYSTEM\tDRIFT")
+	for _, d := range group.Drift {
+		fmt.Fprintf(t, "%s\t%s\n", d.System, d.summary())
+	}
+	return t.Flush()
+}
+
+func (d *GroupDrift) summary() string {
+	switch {
+	case d.Error != "":
+		return "Error: " + d.Error
+	case d.MissingGroup:
+		return "group does not exist"
+	case d.InSync:
+		return "in sync"
+	}
+	var parts []string
+	if len(d.Missing) > 0 {
+		parts = append(parts, "missing members: "+strings.Join(d.Missing, ", "))
+	}
+	if len(d.Extra) > 0 {
+		parts = append(parts, "unexpected members: "+strings.Join(d.Extra, ", "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+func groupsCreate(c *Client, args []string) error {
+	var description string
+	pos, _, err := parseArgs("groups create", args, 1, func(fs *flag.FlagSet) {
+		fs.StringVar(&description, "description", "", "")
+	})
+	if err != nil {
+		return err
+	}
+	req := map[string]string{"name": pos[0], "description": description}
+	var results Results
+	data, err := c.Do(http.MethodPost, "/api/v1/groups", req, &results)
+	if err != nil {
+		return err
+	}
+	printResponse(data, &results)
+	return nil
+}
+
+// groupOperation runs an operation on a group, or on a member of a group if
+// the path has a placeholder for it.
+func groupOperation(cmd, method, path string, nargs int) func(c *Client, args []string) error {
+	return func(c *Client, args []string) error {
+		pos, _, err := parseArgs(cmd, args, nargs, nil)
+		if err != nil {
+			return err
+		}
+		p := "/api/v1/groups/" + url.PathEscape(pos[0]) + path
+		if nargs == 2 {
+			p += url.PathEscape(pos[1])
+		}
+		var results Results
+		data, err := c.Do(method, p, nil, &results)
+		if err != nil {
+			return err
+		}
+		printResponse(data, &results)
+		return nil
+	}
+}
+
+var (
+	groupsDelete       = groupOperation("groups delete", http.MethodDelete, "", 1)
+	groupsSync         = groupOperation("groups sync", http.MethodPost, "/sync", 1)
+	groupsAddMember    = groupOperation("groups add-member", http.MethodPut, "/members/", 2)
+	groupsRemoveMember = groupOperation("groups remove-member", http.MethodDelete, "/members/", 2)
+)
+
+func projectsList(c *Client, args []string) error {
+	if _, _, err := parseArgs("projects list", args, 0, nil); err != nil {
+		return err
+	}
+	var resp struct {
+		Projects []*Project `json:"projects"`
+	}
+	data, err := c.Do(http.MethodGet, "/api/v1/projects", nil, &resp)
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		printJSON(data)
+		return nil
+	}
+	t := newTable()
+	fmt.Fprintln(t, "NAME\tDESCRIPTION")
+	for _, p := range resp.Projects {
+		fmt.Fprintf(t, "%s\t%s\n", p.Name, p.Description)
+	}
+	return t.Flush()
+}
+
+func projectsCreate(c *Client, args []string) error {
+	var description string
+	pos, _, err := parseArgs("projects create", args, 1, func(fs *flag.FlagSet) {
+		fs.StringVar(&description, "description", "", "")
+	})
+	if err != nil {
+		return err
+	}
+	var project Project
+	data, err := c.Do(http.MethodPost, "/api/v1/projects", &Project{Name: pos[0], Description: description}, &project)
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		printJSON(data)
+		return nil
+	}
+	fmt.Printf("Created project %s\n", project.Name)
+	return nil
+}
+
+func buildsList(c *Client, args []string) error {
+	var limit int
+	if _, _, err := parseArgs("builds list", args, 0, func(fs *flag.FlagSet) {
+		fs.IntVar(&limit, "limit", 20, "Number of builds")
+	}); err != nil {
+		return err
+	}
+	var resp struct {
+		Builds []*Build `json:"builds"`
+	}
+	data, err := c.Do(http.MethodGet, "/api/v1/builds?limit="+strconv.Itoa(limit), nil, &resp)
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		printJSON(data)
+		return nil
+	}
+	t := newTable()
+	fmt.Fprintln(t, "ID\tBUILDER\tNUMBER\tRESULT\tSTARTED\tSTATE")
+	for _, b := range resp.Builds {
+		fmt.Fprintf(t, "%d\t%s\t%d\t%s\t%s\t%s\n", b.ID, b.Builder, b.Number, b.result(),
+			b.Started.Local().Format(time.RFC3339), b.State)
+	}
+	return t.Flush()
+}
+
+func (b *Build) result() string {
+	if b.Completed == nil {
+		return "running"
+	}
+	return b.Result
+}
+
+func buildsGet(c *Client, args []string) error {
+	pos, _, err := parseArgs("builds get", args, 1, nil)
+	if err != nil {
+		return err
+	}
+	var b Build
+	data, err := c.Do(http.MethodGet, "/api/v1/builds/"+url.PathEscape(pos[0]), nil, &b)
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		printJSON(data)
+		return nil
+	}
+	fmt.Printf("Build:     %s #%d (id %d)\n", b.Builder, b.Number, b.ID)
+	fmt.Printf("Result:    %s\n", b.result())
+	fmt.Printf("State:     %s\n", b.State)
+	fmt.Printf("Started:   %s\n", b.Started.Local().Format(time.RFC3339))
+	if b.Completed != nil {
+		fmt.Printf("Completed: %s\n", b.Completed.Local().Format(time.RFC3339))
+	}
+	fmt.Printf("URL:       %s\n", b.URL)
+	return nil
+}
+
+func status(c *Client, args []string) error {
+	if _, _, err := parseArgs("status", args, 0, nil); err != nil {
+		return err
+	}
+	var resp struct {
+		Services []*ServiceStatus `json:"services"`
+	}
+	data, err := c.Do(http.MethodGet, "/api/v1/status", nil, &resp)
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		printJSON(data)
+		return nil
+	}
+	t := newTable()
+	fmt.Fprintln(t, "SERVICE\tSTATUS\tDETAIL")
+	down := 0
+	for _, s := range resp.Services {
+		state := "up"
+		if !s.Up {
+			state = "DOWN"
+			down++
+		}
+		fmt.Fprintf(t, "%s\t%s\t%s\n", s.Name, state, s.Detail)
+	}
+	if err := t.Flush(); err != nil {
+		return err
+	}
+	if down > 0 {
+		return fmt.Errorf("%d service(s) down", down)
+	}
+	return nil
+}
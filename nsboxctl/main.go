@@ -0,0 +1,204 @@
+// nsboxctl manages an nsbox through the JSON API of its portal.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+var portalURL = flag.String("url", "", "URL of the portal (default: $NSBOX_URL, or https://nsbox.local:9440)")
+var tokenFile = flag.String("token_file", "", "File containing the API token (default: $NSBOX_TOKEN, or ~/.config/nsboxctl/token)")
+var caFile = flag.String("ca_file", "", "PEM file of a certificate to trust, e.g. ${workdir}/certs/nsbox.crt for the default self-signed one")
+var output = flag.String("output", "table", "Output format: table or json")
+
+type command struct {
+	name    string
+	usage   string
+	summary string
+	run     func(c *Client, args []string) error
+}
+
+var commands = []*command{
+	{"users list", "", "List users", usersList},
+	{"users get", "<username>", "Show a user and their accounts", usersGet},
+	{"users create", "-username U -first_name F -last_name L [-email E] [-groups G1,G2] [-delivery D]", "Create a user in every system", usersCreate},
+	{"users update", "<username> [-first_name F] [-last_name L] [-email E]", "Change the name or the email of a user", usersUpdate},
+	{"users disable", "<username>", "Disable a user", userAction("disable")},
+	{"users enable", "<username>", "Enable a user", userAction("enable")},
+	{"users reset-password", "<username>", "Email a user a link to set a new password", userAction("reset-password")},
+	{"users delete", "<username>", "Delete a user", usersDelete},
+	{"groups list", "", "List groups", groupsList},
+	{"groups get", "<name>", "Show a group and its drift in every system", groupsGet},
+	{"groups create", "<name> [-description D]", "Create a group in every system", groupsCreate},
+	{"groups delete", "<name>", "Delete a group", groupsDelete},
+	{"groups add-member", "<name> <username>", "Add a member to a group", groupsAddMember},
+	{"groups remove-member", "<name> <username>", "Remove a member from a group", groupsRemoveMember},
+	{"groups sync", "<name>", "Fix the drift of a group", groupsSync},
+	{"projects list", "", "List Gerrit projects", projectsList},
+	{"projects create", "<name> [-description D]", "Create a Gerrit project", projectsCreate},
+	{"builds list", "[-limit N]", "List the latest builds", buildsList},
+	{"builds get", "<id>", "Show a build", buildsGet},
+	{"status", "", "Check the services", status},
+}
+
+func usage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "Usage: nsboxctl [flags] <command> [args]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %s %s\n    \t%s\n", c.name, c.usage, c.summary)
+	}
+	fmt.Fprintf(w, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if *output != "table" && *output != "json" {
+		fatalf("-output must be table or json")
+	}
+
+	cmd, args := findCommand(flag.Args())
+	if cmd == nil {
+		usage()
+		os.Exit(2)
+	}
+
+	client, err := newClient()
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if err := cmd.run(client, args); err != nil {
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && len(apiErr.Details) > 0 {
+			// Partial failures come with the result in every system.
+			var results []Result
+			if json.Unmarshal(apiErr.Details, &results) == nil && len(results) > 0 {
+				printResults(results)
+			}
+		}
+		fatalf("%v", err)
+	}
+}
+
+// findCommand matches the longest command name, so that "users list" wins
+// over a hypothetical "users".
+func findCommand(args []string) (*command, []string) {
+	var best *command
+	bestLen := 0
+	for _, c := range commands {
+		words := strings.Fields(c.name)
+		if len(words) > len(args) || len(words) <= bestLen {
+			continue
+		}
+		match := true
+		for i, w := range words {
+			if args[i] != w {
+				match = false
+				break
+			}
+		}
+		if match {
+			best, bestLen = c, len(words)
+		}
+	}
+	if best == nil {
+		return nil, nil
+	}
+	return best, args[bestLen:]
+}
+
+func newClient() (*Client, error) {
+	url := *portalURL
+	if url == "" {
+		url = os.Getenv("NSBOX_URL")
+	}
+	if url == "" {
+		url = "https://nsbox.local:9440"
+	}
+
+	token := os.Getenv("NSBOX_TOKEN")
+	path := *tokenFile
+	if path == "" && token == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(home, ".config", "nsboxctl", "token")
+	}
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("no API token: %v (create one on the profile page of the portal)", err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	return NewClient(url, token, *caFile)
+}
+
+func fatalf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "nsboxctl: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+// parseArgs parses the flags of a command, which may come before or after
+// its positional arguments, and checks the number of the latter.
+func parseArgs(cmd string, args []string, nargs int, define func(fs *flag.FlagSet)) ([]string, *flag.FlagSet, error) {
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	if define != nil {
+		define(fs)
+	}
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, nil, err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(positional) != nargs {
+		return nil, nil, fmt.Errorf("%s takes %d argument(s), got %d", cmd, nargs, len(positional))
+	}
+	return positional, fs, nil
+}
+
+// newTable returns a writer for tab-separated columns.
+func newTable() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+}
+
+// printJSON writes the response as it came from the portal.
+func printJSON(data []byte) {
+	os.Stdout.Write(data)
+}
+
+func printResults(results []Result) {
+	t := newTable()
+	fmt.Fprintln(t, "SYSTEM\tRESULT")
+	for _, r := range results {
+		if r.Error != "" {
+			fmt.Fprintf(t, "%s\tError: %s\n", r.System, r.Error)
+		} else {
+			fmt.Fprintf(t, "%s\t%s\n", r.System, r.Message)
+		}
+	}
+	t.Flush()
+}
+
+// printResponse prints the response of an operation that returns results.
+func printResponse(data []byte, results *Results) {
+	if *output == "json" {
+		printJSON(data)
+		return
+	}
+	printResults(results.Results)
+}
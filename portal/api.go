@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+/*
+The JSON API lives under /api/v1 and is described by the route table in
+apiv1.go, which is also where /api/v1/openapi.json is generated from. httpd
+does not ask for an OpenID Connect login on /api/; clients authenticate with
+"Authorization: Bearer <token>" using a token created on the profile page,
+and act with the realm roles their user has in Keycloak at the time of the
+request.
+*/
+
+const apiPrefix = "/api/"
+
+// APIError is the error object of every failed API request:
+//
+//	{"error": {"code": "not_found", "message": "...", "details": ...}}
+type APIError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Details any    `json:"details,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+func apiErrorf(status int, code, format string, args ...any) *APIError {
+	return &APIError{Status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+type APIErrorResponse struct {
+	Error *APIError `json:"error"`
+}
+
+// toAPIError maps the errors of the rest of the portal to API errors.
+func toAPIError(err error) *APIError {
+	var apiErr *APIError
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr
+	case isNotFound(err), errors.Is(err, ErrNoSuchTeam):
+		return apiErrorf(http.StatusNotFound, "not_found", "%v", err)
+	case errors.Is(err, ErrMissingRoles):
+		return apiErrorf(http.StatusForbidden, "forbidden", "%v", err)
+	case errors.Is(err, ErrGroupExists):
+		return apiErrorf(http.StatusConflict, "conflict", "%v", err)
+	default:
+		return apiErrorf(http.StatusInternalServerError, "internal", "%v", err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("Failed to write API response: %v", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, err error) {
+	apiErr := toAPIError(err)
+	writeJSON(w, apiErr.Status, APIErrorResponse{apiErr})
+}
+
+// APIResult is the outcome of an operation in one system.
+type APIResult struct {
+	System  string `json:"system"`
+	Message string `json:"message,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type APIResults struct {
+	Results []APIResult `json:"results"`
+}
+
+// apiResults returns the results, or an error with the results as details
+// if the operation failed in any system.
+func apiResults(results []SystemResult) (*APIResults, error) {
+	out := &APIResults{Results: []APIResult{}}
+	failed := false
+	for _, r := range results {
+		result := APIResult{System: r.System, Message: r.Message}
+		if r.Err != nil {
+			result.Error = r.Err.Error()
+			failed = true
+		}
+		out.Results = append(out.Results, result)
+	}
+	if failed {
+		return nil, &APIError{
+			Status:  http.StatusBadGateway,
+			Code:    "partial_failure",
+			Message: "the operation failed in at least one system",
+			Details: out.Results,
+		}
+	}
+	return out, nil
+}
+
+// apiRequest is a request to an API route.
+type apiRequest struct {
+	*http.Request
+	User   string
+	Params map[string]string // from the braces in the route path
+}
+
+// decode reads the JSON body into v, rejecting unknown fields so that typos
+// do not go unnoticed.
+func (r *apiRequest) decode(v any) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return apiErrorf(http.StatusBadRequest, "invalid_request", "invalid request body: %v", err)
+	}
+	return nil
+}
+
+// apiRoute is one operation of the API.
+type apiRoute struct {
+	Method  string
+	Path    string // e.g. /api/v1/users/{username}
+	Summary string
+	Roles   []string // any of them is required; empty means any user
+	Public  bool     // no token required
+	Query   []string // documented query parameters
+	Status  int      // of successful responses; 200 if 0
+
+	// Zero values of the request and response body types, for decoding and
+	// for the OpenAPI description. Request is nil for operations without a
+	// body.
+	Request  any
+	Response any
+
+	Handle func(r *apiRequest) (any, error)
+}
+
+// match returns the path parameters if the route matches the path.
+func (route *apiRoute) match(path string) (map[string]string, bool) {
+	want := strings.Split(strings.Trim(route.Path, "/"), "/")
+	have := strings.Split(strings.Trim(path, "/"), "/")
+	if len(want) != len(have) {
+		return nil, false
+	}
+	params := map[string]string{}
+	for i, w := range want {
+		if strings.HasPrefix(w, "{") && strings.HasSuffix(w, "}") {
+			if have[i] == "" {
+				return nil, false
+			}
+			params[w[1:len(w)-1]] = have[i]
+		} else if w != have[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// authenticateAPIRequest resolves the bearer token to its user and sets the
+// X-Remote-User and X-Remote-Roles headers like authenticate does for
+// browser requests, so that HasRole works the same.
+func authenticateAPIRequest(r *http.Request) error {
+	r.Header.Del("X-Remote-User")
+	r.Header.Del("X-Remote-Roles")
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" || token == r.Header.Get("Authorization") {
+		return apiErrorf(http.StatusUnauthorized, "unauthenticated", "an API token is required")
+	}
+	t, err := LookupAPIToken(token)
+	if err != nil {
+		return apiErrorf(http.StatusUnauthorized, "unauthenticated", "%v", err)
+	}
+	user, err := GetKeycloakUser(t.Username)
+	if err != nil {
+		return apiErrorf(http.StatusUnauthorized, "unauthenticated", "user %s: %v", t.Username, err)
+	}
+	if !user.Enabled {
+		return apiErrorf(http.StatusUnauthorized, "unauthenticated", "user %s is disabled", t.Username)
+	}
+	roles, err := GetKeycloakUserRoles(t.Username)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("X-Remote-User", t.Username)
+	r.Header.Set("X-Remote-Roles", strings.Join(roles, ","))
+	return nil
+}
+
+// handleAPI dispatches requests under /api/ to the routes.
+func handleAPI(routes []*apiRoute) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pathMatched := false
+		for _, route := range routes {
+			params, ok := route.match(r.URL.Path)
+			if !ok {
+				continue
+			}
+			pathMatched = true
+			if route.Method != r.Method {
+				continue
+			}
+			if !route.Public {
+				if err := authenticateAPIRequest(r); err != nil {
+					writeAPIError(w, err)
+					return
+				}
+				if len(route.Roles) > 0 && !HasRole(r, route.Roles...) {
+					writeAPIError(w, apiErrorf(http.StatusForbidden, "forbidden",
+						"requires one of the roles %s", strings.Join(route.Roles, ", ")))
+					return
+				}
+			}
+			resp, err := route.Handle(&apiRequest{r, r.Header.Get("X-Remote-User"), params})
+			if err != nil {
+				writeAPIError(w, err)
+				return
+			}
+			status := route.Status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			writeJSON(w, status, resp)
+			return
+		}
+		if pathMatched {
+			writeAPIError(w, apiErrorf(http.StatusMethodNotAllowed, "method_not_allowed", "%s is not allowed on %s", r.Method, r.URL.Path))
+			return
+		}
+		writeAPIError(w, apiErrorf(http.StatusNotFound, "not_found", "no such API endpoint: %s", r.URL.Path))
+	}
+}
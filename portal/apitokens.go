@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+API tokens let scripts and other non-browser clients use the JSON API as a
+user. A token is only shown once, when it is created; the portal keeps the
+SHA-256 hash of it in ${workdir}/portal/api_tokens.json. Tokens are random
+and long, so a fast hash is enough to make the file useless to a reader.
+*/
+
+const apiTokenPrefix = "nsbox_"
+
+type APIToken struct {
+	ID       string    `json:"id"`
+	Username string    `json:"username"`
+	Name     string    `json:"name"`
+	Hash     string    `json:"hash"`
+	Created  time.Time `json:"created"`
+}
+
+type apiTokensFile struct {
+	Tokens []*APIToken `json:"tokens"`
+}
+
+var apiTokensMutex sync.Mutex
+
+func apiTokensPath() string {
+	return filepath.Join(*workdir, "portal", "api_tokens.json")
+}
+
+func loadAPITokens() ([]*APIToken, error) {
+	bytes, err := os.ReadFile(apiTokensPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile(%s): %v", apiTokensPath(), err)
+	}
+	var f apiTokensFile
+	if err := json.Unmarshal(bytes, &f); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal(%s): %v", apiTokensPath(), err)
+	}
+	return f.Tokens, nil
+}
+
+func saveAPITokens(tokens []*APIToken) error {
+	bytes, err := json.MarshalIndent(apiTokensFile{Tokens: tokens}, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(apiTokensPath())
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("os.MkdirAll(%s): %v", dir, err)
+	}
+	tmp := apiTokensPath() + ".tmp"
+	if err := os.WriteFile(tmp, bytes, 0600); err != nil {
+		return fmt.Errorf("os.WriteFile(%s): %v", tmp, err)
+	}
+	return os.Rename(tmp, apiTokensPath())
+}
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIToken creates a token for the user and returns it. It cannot be
+// retrieved again.
+func CreateAPIToken(username, name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", errors.New("the token needs a name")
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	token := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	apiTokensMutex.Lock()
+	defer apiTokensMutex.Unlock()
+	tokens, err := loadAPITokens()
+	if err != nil {
+		return "", err
+	}
+	tokens = append(tokens, &APIToken{
+		ID:       hex.EncodeToString(id),
+		Username: username,
+		Name:     name,
+		Hash:     hashAPIToken(token),
+		Created:  time.Now().UTC(),
+	})
+	if err := saveAPITokens(tokens); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// ListAPITokens returns the tokens of the user, oldest first.
+func ListAPITokens(username string) ([]*APIToken, error) {
+	apiTokensMutex.Lock()
+	defer apiTokensMutex.Unlock()
+	tokens, err := loadAPITokens()
+	if err != nil {
+		return nil, err
+	}
+	var mine []*APIToken
+	for _, t := range tokens {
+		if t.Username == username {
+			mine = append(mine, t)
+		}
+	}
+	sort.Slice(mine, func(i, j int) bool {
+		return mine[i].Created.Before(mine[j].Created)
+	})
+	return mine, nil
+}
+
+// RevokeAPIToken deletes a token of the user.
+func RevokeAPIToken(username, id string) error {
+	apiTokensMutex.Lock()
+	defer apiTokensMutex.Unlock()
+	tokens, err := loadAPITokens()
+	if err != nil {
+		return err
+	}
+	for i, t := range tokens {
+		if t.Username == username && t.ID == id {
+			return saveAPITokens(append(tokens[:i], tokens[i+1:]...))
+		}
+	}
+	return fmt.Errorf("no such token: %s", id)
+}
+
+// RevokeUserAPITokens deletes all tokens of the user.
+func RevokeUserAPITokens(username string) error {
+	apiTokensMutex.Lock()
+	defer apiTokensMutex.Unlock()
+	tokens, err := loadAPITokens()
+	if err != nil {
+		return err
+	}
+	var kept []*APIToken
+	for _, t := range tokens {
+		if t.Username != username {
+			kept = append(kept, t)
+		}
+	}
+	if len(kept) == len(tokens) {
+		return nil
+	}
+	return saveAPITokens(kept)
+}
+
+// LookupAPIToken returns the stored token that token hashes to.
+func LookupAPIToken(token string) (*APIToken, error) {
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return nil, errors.New("not an nsbox API token")
+	}
+	hash := []byte(hashAPIToken(token))
+	apiTokensMutex.Lock()
+	defer apiTokensMutex.Unlock()
+	tokens, err := loadAPITokens()
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Hash), hash) == 1 {
+			return t, nil
+		}
+	}
+	return nil, errors.New("unknown API token")
+}
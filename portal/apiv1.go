@@ -0,0 +1,506 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Groups in the API are the teams of the portal, which are mirrored in
+// Keycloak, Gerrit and Redmine.
+
+type APIUser struct {
+	Username  string       `json:"username"`
+	FirstName string       `json:"first_name"`
+	LastName  string       `json:"last_name"`
+	Email     string       `json:"email"`
+	Enabled   bool         `json:"enabled"`
+	Accounts  []APIAccount `json:"accounts,omitempty"` // only for a single user
+}
+
+// APIAccount is the account of a user in one system.
+type APIAccount struct {
+	System string `json:"system"`
+	Name   string `json:"name,omitempty"`
+	Email  string `json:"email,omitempty"`
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type APIUsers struct {
+	Users []*APIUser `json:"users"`
+}
+
+type APICreateUser struct {
+	Username  string   `json:"username"`
+	FirstName string   `json:"first_name"`
+	LastName  string   `json:"last_name"`
+	Email     string   `json:"email,omitempty"`  // DefaultEmail if empty
+	Groups    []string `json:"groups,omitempty"` // teams or Gerrit groups
+	// show (return the password), email_password or email_link
+	Delivery string `json:"delivery,omitempty"`
+}
+
+type APICreatedUser struct {
+	Username     string `json:"username"`
+	Provisioning string `json:"provisioning"`
+	Password     string `json:"password,omitempty"` // unless sent by email
+	SentTo       string `json:"sent_to,omitempty"`
+	EmailError   string `json:"email_error,omitempty"`
+}
+
+// APIUpdateUser changes the fields that are set.
+type APIUpdateUser struct {
+	FirstName *string `json:"first_name,omitempty"`
+	LastName  *string `json:"last_name,omitempty"`
+	Email     *string `json:"email,omitempty"`
+}
+
+type APIGroup struct {
+	Name        string           `json:"name"`
+	Description string           `json:"description,omitempty"`
+	Members     []string         `json:"members"`
+	Drift       []*APIGroupDrift `json:"drift,omitempty"` // only for a single group
+}
+
+// APIGroupDrift is the difference between a group and its copy in one
+// system.
+type APIGroupDrift struct {
+	System       string   `json:"system"`
+	InSync       bool     `json:"in_sync"`
+	MissingGroup bool     `json:"missing_group,omitempty"`
+	Missing      []string `json:"missing,omitempty"`
+	Extra        []string `json:"extra,omitempty"`
+	Error        string   `json:"error,omitempty"`
+}
+
+type APIGroups struct {
+	Groups []*APIGroup `json:"groups"`
+}
+
+type APICreateGroup struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+type APIProject struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+type APIProjects struct {
+	Projects []*APIProject `json:"projects"`
+}
+
+type APIServices struct {
+	Services []*ServiceStatus `json:"services"`
+}
+
+type APIBuilds struct {
+	Builds []*Build `json:"builds"`
+}
+
+func toAPIUser(u *KeycloakUser) *APIUser {
+	return &APIUser{
+		Username:  u.Username,
+		FirstName: u.FirstName,
+		LastName:  u.LastName,
+		Email:     u.Email,
+		Enabled:   u.Enabled,
+	}
+}
+
+func toAPIGroup(t *Team) *APIGroup {
+	members := t.Members
+	if members == nil {
+		members = []string{}
+	}
+	return &APIGroup{Name: t.Name, Description: t.Description, Members: members}
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func requireString(field, value string) error {
+	if strings.TrimSpace(value) == "" {
+		return apiErrorf(http.StatusBadRequest, "invalid_request", "%s is required", field)
+	}
+	return nil
+}
+
+// checkChangeableUser rejects changes to the built-in users, like the user
+// pages do.
+func checkChangeableUser(username string) error {
+	if isBuiltinUser(username) {
+		return apiErrorf(http.StatusBadRequest, "builtin_user", "built-in user %s cannot be changed", username)
+	}
+	return nil
+}
+
+func apiListUsers(r *apiRequest) (any, error) {
+	users, err := ListKeycloakUsers()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+	out := &APIUsers{Users: []*APIUser{}}
+	for _, u := range users {
+		out.Users = append(out.Users, toAPIUser(u))
+	}
+	return out, nil
+}
+
+func apiGetUser(r *apiRequest) (any, error) {
+	ua := GetUserAccounts(r.Params["username"])
+	if ua.Keycloak == nil {
+		return nil, ua.KeycloakErr
+	}
+	user := toAPIUser(ua.Keycloak)
+	for _, a := range ua.Rows() {
+		user.Accounts = append(user.Accounts, APIAccount{
+			System: a.System, Name: a.Name, Email: a.Email, Status: a.Status, Error: errorString(a.Err),
+		})
+	}
+	return user, nil
+}
+
+func apiCreateUser(r *apiRequest) (any, error) {
+	var req APICreateUser
+	if err := r.decode(&req); err != nil {
+		return nil, err
+	}
+	if req.Username == "" || req.FirstName == "" || req.LastName == "" {
+		return nil, apiErrorf(http.StatusBadRequest, "invalid_request", "username, first_name and last_name are required")
+	}
+	req.Email = strings.TrimSpace(req.Email)
+	if req.Email != "" {
+		if err := CheckEmail(req.Email); err != nil {
+			return nil, apiErrorf(http.StatusBadRequest, "invalid_request", "%v", err)
+		}
+	}
+	switch req.Delivery {
+	case "", DeliveryShow, DeliveryEmailPassword, DeliveryEmailLink:
+	default:
+		return nil, apiErrorf(http.StatusBadRequest, "invalid_request", "unknown delivery: %s", req.Delivery)
+	}
+	for _, group := range req.Groups {
+		if err := CheckCanManageGroup(r.Request, group); err != nil {
+			return nil, err
+		}
+	}
+	p, err := NewProvisioning(r.User, req.Username, req.FirstName, req.LastName, req.Email, req.Groups)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.Run(); errors.Is(err, ErrUserExists) {
+		return nil, apiErrorf(http.StatusConflict, "conflict", "%v", err)
+	} else if err != nil {
+		return nil, &APIError{
+			Status:  http.StatusBadGateway,
+			Code:    "provisioning_failed",
+			Message: fmt.Sprintf("failed to create user: %v", err),
+			Details: map[string]string{"provisioning": p.ID},
+		}
+	}
+
+	created := &APICreatedUser{Username: req.Username, Provisioning: p.ID, Password: p.Password()}
+	if req.Delivery != "" && req.Delivery != DeliveryShow {
+		to, err := SendOnboardingEmail(req.Username, p.Password(), req.Delivery)
+		if err != nil {
+			// The password is returned instead so that the account is
+			// still usable.
+			log.Printf("Failed to send onboarding email to %s: %v", req.Username, err)
+			created.EmailError = err.Error()
+		} else {
+			created.SentTo = to
+			created.Password = ""
+		}
+	}
+	return created, nil
+}
+
+func apiUpdateUser(r *apiRequest) (any, error) {
+	username := r.Params["username"]
+	var req APIUpdateUser
+	if err := r.decode(&req); err != nil {
+		return nil, err
+	}
+	user, err := GetKeycloakUser(username)
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckCanManageUser(r.Request, username); err != nil {
+		return nil, err
+	}
+	firstName, lastName, email := user.FirstName, user.LastName, user.Email
+	if req.FirstName != nil {
+		firstName = *req.FirstName
+	}
+	if req.LastName != nil {
+		lastName = *req.LastName
+	}
+	if req.Email != nil {
+		email = strings.TrimSpace(*req.Email)
+	}
+	if firstName == "" || lastName == "" || email == "" {
+		return nil, apiErrorf(http.StatusBadRequest, "invalid_request", "first_name, last_name and email cannot be empty")
+	}
+	if err := CheckEmail(email); err != nil {
+		return nil, apiErrorf(http.StatusBadRequest, "invalid_request", "%v", err)
+	}
+	results := UpdateUser(username, firstName, lastName, email)
+	AuditResults(r.User, "user.update", username, results)
+	return apiResults(results)
+}
+
+// apiUserAction is like handleUserAction for the API.
+func apiUserAction(auditAction string, op func(username string) []SystemResult) func(r *apiRequest) (any, error) {
+	return func(r *apiRequest) (any, error) {
+		username := r.Params["username"]
+		if err := checkChangeableUser(username); err != nil {
+			return nil, err
+		}
+		if _, err := GetKeycloakUser(username); err != nil {
+			return nil, err
+		}
+		if err := CheckCanManageUser(r.Request, username); err != nil {
+			return nil, err
+		}
+		results := op(username)
+		AuditResults(r.User, auditAction, username, results)
+		return apiResults(results)
+	}
+}
+
+func apiListGroups(r *apiRequest) (any, error) {
+	teams, err := ListTeams()
+	if err != nil {
+		return nil, err
+	}
+	out := &APIGroups{Groups: []*APIGroup{}}
+	for _, t := range teams {
+		out.Groups = append(out.Groups, toAPIGroup(t))
+	}
+	return out, nil
+}
+
+func apiGetGroup(r *apiRequest) (any, error) {
+	team, err := GetTeam(r.Params["name"])
+	if err != nil {
+		return nil, err
+	}
+	group := toAPIGroup(team)
+	for _, d := range TeamDrifts(team) {
+		group.Drift = append(group.Drift, &APIGroupDrift{
+			System:       d.System,
+			InSync:       d.InSync(),
+			MissingGroup: d.MissingGroup,
+			Missing:      d.Missing,
+			Extra:        d.Extra,
+			Error:        errorString(d.Err),
+		})
+	}
+	return group, nil
+}
+
+// apiGroupAction is like handleTeamAction for the API.
+func apiGroupAction(action string, op func(r *apiRequest) ([]SystemResult, error)) func(r *apiRequest) (any, error) {
+	return func(r *apiRequest) (any, error) {
+		var results []SystemResult
+		err := CheckCanManageGroup(r.Request, r.Params["name"])
+		if err == nil {
+			results, err = op(r)
+		}
+		target := r.Params["name"]
+		if username := r.Params["username"]; username != "" {
+			target += "/" + username
+		}
+		if err != nil {
+			Audit(r.User, action, target, err, "")
+			return nil, err
+		}
+		AuditResults(r.User, action, target, results)
+		return apiResults(results)
+	}
+}
+
+func apiCreateGroup(r *apiRequest) (any, error) {
+	var req APICreateGroup
+	if err := r.decode(&req); err != nil {
+		return nil, err
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if !validTeamName.MatchString(req.Name) {
+		return nil, apiErrorf(http.StatusBadRequest, "invalid_request", "invalid group name: %q", req.Name)
+	}
+	if isReservedTeamName(req.Name) {
+		return nil, apiErrorf(http.StatusBadRequest, "invalid_request", "group name %s is reserved", req.Name)
+	}
+	if IsTeam(req.Name) {
+		return nil, apiErrorf(http.StatusConflict, "conflict", "group %s already exists", req.Name)
+	}
+	r.Params["name"] = req.Name
+	return apiGroupAction("team.create", func(r *apiRequest) ([]SystemResult, error) {
+		return CreateTeam(req.Name, req.Description)
+	})(r)
+}
+
+var (
+	apiDeleteGroup = apiGroupAction("team.delete", func(r *apiRequest) ([]SystemResult, error) {
+		return DeleteTeam(r.Params["name"])
+	})
+	apiSyncGroup = apiGroupAction("team.sync", func(r *apiRequest) ([]SystemResult, error) {
+		return SyncTeam(r.Params["name"])
+	})
+	apiAddGroupMember = apiGroupAction("team.add_member", func(r *apiRequest) ([]SystemResult, error) {
+		if _, err := GetKeycloakUser(r.Params["username"]); err != nil {
+			return nil, err
+		}
+		return AddTeamMember(r.Params["name"], r.Params["username"])
+	})
+	apiRemoveGroupMember = apiGroupAction("team.remove_member", func(r *apiRequest) ([]SystemResult, error) {
+		return RemoveTeamMember(r.Params["name"], r.Params["username"])
+	})
+)
+
+func apiListProjects(r *apiRequest) (any, error) {
+	client, err := NewGerritAdminClient()
+	if err != nil {
+		return nil, err
+	}
+	projects, err := client.ListProjects()
+	if err != nil {
+		return nil, err
+	}
+	sortProjects(projects)
+	out := &APIProjects{Projects: []*APIProject{}}
+	for _, p := range projects {
+		out.Projects = append(out.Projects, &APIProject{Name: p.Name, Description: p.Description})
+	}
+	return out, nil
+}
+
+func apiCreateProject(r *apiRequest) (any, error) {
+	var req APIProject
+	if err := r.decode(&req); err != nil {
+		return nil, err
+	}
+	req.Name = strings.Trim(strings.TrimSpace(req.Name), "/")
+	if err := requireString("name", req.Name); err != nil {
+		return nil, err
+	}
+	client, err := NewGerritAdminClient()
+	if err != nil {
+		return nil, err
+	}
+	project, err := client.CreateProject(req.Name, req.Description)
+	Audit(r.User, "project.create", req.Name, err, "")
+	if err != nil {
+		return nil, err
+	}
+	return &APIProject{Name: project.Name, Description: project.Description}, nil
+}
+
+func apiServiceStatus(r *apiRequest) (any, error) {
+	return &APIServices{Services: ServiceStatuses()}, nil
+}
+
+func apiListBuilds(r *apiRequest) (any, error) {
+	limit := 50
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > 1000 {
+			return nil, apiErrorf(http.StatusBadRequest, "invalid_request", "limit must be between 1 and 1000")
+		}
+		limit = n
+	}
+	builds, err := ListBuilds(r.User, limit)
+	if err != nil {
+		return nil, err
+	}
+	if builds == nil {
+		builds = []*Build{}
+	}
+	return &APIBuilds{Builds: builds}, nil
+}
+
+func apiGetBuild(r *apiRequest) (any, error) {
+	id, err := strconv.Atoi(r.Params["id"])
+	if err != nil {
+		return nil, apiErrorf(http.StatusBadRequest, "invalid_request", "invalid build id: %s", r.Params["id"])
+	}
+	return GetBuild(r.User, id)
+}
+
+// apiV1Routes is the table of the /api/v1 operations. The OpenAPI
+// description is generated from it.
+var apiV1Routes []*apiRoute
+
+func init() {
+	users := []string{RoleUserManager}
+	teams := []string{RoleUserManager, RoleProjectManager}
+	projects := []string{RoleProjectManager}
+	apiV1Routes = []*apiRoute{
+		{Method: "GET", Path: "/api/v1/users", Summary: "List users", Roles: users,
+			Response: APIUsers{}, Handle: apiListUsers},
+		{Method: "POST", Path: "/api/v1/users", Summary: "Create a user in every system", Roles: users,
+			Status: http.StatusCreated, Request: APICreateUser{}, Response: APICreatedUser{}, Handle: apiCreateUser},
+		{Method: "GET", Path: "/api/v1/users/{username}", Summary: "Get a user and their accounts", Roles: users,
+			Response: APIUser{}, Handle: apiGetUser},
+		{Method: "PATCH", Path: "/api/v1/users/{username}", Summary: "Update the name or the email of a user", Roles: users,
+			Request: APIUpdateUser{}, Response: APIResults{}, Handle: apiUpdateUser},
+		{Method: "DELETE", Path: "/api/v1/users/{username}", Summary: "Delete a user", Roles: users,
+			Response: APIResults{}, Handle: apiUserAction("user.delete", DeleteUser)},
+		{Method: "POST", Path: "/api/v1/users/{username}/disable", Summary: "Disable a user", Roles: users,
+			Response: APIResults{}, Handle: apiUserAction("user.disable", func(username string) []SystemResult {
+				return SetUserEnabled(username, false)
+			})},
+		{Method: "POST", Path: "/api/v1/users/{username}/enable", Summary: "Enable a user", Roles: users,
+			Response: APIResults{}, Handle: apiUserAction("user.enable", func(username string) []SystemResult {
+				return SetUserEnabled(username, true)
+			})},
+		{Method: "POST", Path: "/api/v1/users/{username}/reset-password", Summary: "Email a user a link to set a new password", Roles: users,
+			Response: APIResults{}, Handle: apiUserAction("user.reset_password", SendPasswordResetEmail)},
+
+		{Method: "GET", Path: "/api/v1/groups", Summary: "List groups", Roles: teams,
+			Response: APIGroups{}, Handle: apiListGroups},
+		{Method: "POST", Path: "/api/v1/groups", Summary: "Create a group in every system", Roles: projects,
+			Status: http.StatusCreated, Request: APICreateGroup{}, Response: APIResults{}, Handle: apiCreateGroup},
+		{Method: "GET", Path: "/api/v1/groups/{name}", Summary: "Get a group and its drift in every system", Roles: teams,
+			Response: APIGroup{}, Handle: apiGetGroup},
+		{Method: "DELETE", Path: "/api/v1/groups/{name}", Summary: "Delete a group", Roles: projects,
+			Response: APIResults{}, Handle: apiDeleteGroup},
+		{Method: "PUT", Path: "/api/v1/groups/{name}/members/{username}", Summary: "Add a member to a group", Roles: teams,
+			Response: APIResults{}, Handle: apiAddGroupMember},
+		{Method: "DELETE", Path: "/api/v1/groups/{name}/members/{username}", Summary: "Remove a member from a group", Roles: teams,
+			Response: APIResults{}, Handle: apiRemoveGroupMember},
+		{Method: "POST", Path: "/api/v1/groups/{name}/sync", Summary: "Fix the drift of a group", Roles: teams,
+			Response: APIResults{}, Handle: apiSyncGroup},
+
+		{Method: "GET", Path: "/api/v1/projects", Summary: "List Gerrit projects",
+			Response: APIProjects{}, Handle: apiListProjects},
+		{Method: "POST", Path: "/api/v1/projects", Summary: "Create a Gerrit project", Roles: projects,
+			Status: http.StatusCreated, Request: APIProject{}, Response: APIProject{}, Handle: apiCreateProject},
+
+		{Method: "GET", Path: "/api/v1/status", Summary: "Check the services",
+			Response: APIServices{}, Handle: apiServiceStatus},
+
+		{Method: "GET", Path: "/api/v1/builds", Summary: "List the latest builds", Query: []string{"limit"},
+			Response: APIBuilds{}, Handle: apiListBuilds},
+		{Method: "GET", Path: "/api/v1/builds/{id}", Summary: "Get a build",
+			Response: Build{}, Handle: apiGetBuild},
+
+		{Method: "GET", Path: "/api/v1/openapi.json", Summary: "Get this description of the API", Public: true,
+			Handle: func(r *apiRequest) (any, error) { return OpenAPI(apiV1Routes), nil }},
+	}
+}
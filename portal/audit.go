@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+The audit log records every administrative action taken through the portal
+and every automated change the portal makes to the other systems. It is a
+JSON Lines file in ${workdir}/portal/audit.jsonl that is only ever appended
+to; nothing in the portal rewrites or truncates it.
+*/
+
+// The actor of changes made by the portal on its own.
+const AuditSystemActor = "system"
+
+const (
+	AuditOK    = "ok"
+	AuditError = "error"
+)
+
+type AuditEntry struct {
+	Time    time.Time `json:"time"`
+	Actor   string    `json:"actor"`
+	Action  string    `json:"action"`
+	Target  string    `json:"target"`
+	Outcome string    `json:"outcome"`
+	Detail  string    `json:"detail,omitempty"`
+}
+
+var auditMutex sync.Mutex
+
+func auditLogPath() string {
+	return filepath.Join(*workdir, "portal", "audit.jsonl")
+}
+
+// Audit appends an entry to the audit log. The outcome is an error if err is
+// not nil, in which case err is the detail. Failures to write the log are
+// logged but do not fail the action, which has already happened.
+func Audit(actor, action, target string, err error, detail string) {
+	entry := AuditEntry{
+		Time:    time.Now().UTC(),
+		Actor:   actor,
+		Action:  action,
+		Target:  target,
+		Outcome: AuditOK,
+		Detail:  detail,
+	}
+	if err != nil {
+		entry.Outcome = AuditError
+		entry.Detail = err.Error()
+	}
+	if err := appendAuditEntry(&entry); err != nil {
+		log.Printf("Failed to write audit log: %v", err)
+	}
+}
+
+// AuditResults records an action on several systems, which failed if it
+// failed on any of them.
+func AuditResults(actor, action, target string, results []SystemResult) {
+	var details []string
+	failed := false
+	for _, r := range results {
+		if r.Err != nil {
+			details = append(details, r.System+": "+r.Err.Error())
+			failed = true
+		} else {
+			details = append(details, r.System+": "+r.Message)
+		}
+	}
+	detail := strings.Join(details, "; ")
+	if failed {
+		Audit(actor, action, target, errors.New(detail), "")
+	} else {
+		Audit(actor, action, target, nil, detail)
+	}
+}
+
+// auditActor is the signed-in user that sent the request.
+func auditActor(r *http.Request) string {
+	return r.Header.Get("X-Remote-User")
+}
+
+func appendAuditEntry(entry *AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	if err := os.MkdirAll(filepath.Dir(auditLogPath()), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(auditLogPath(), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	// Start a new line after an entry torn by a crash, so that this entry
+	// is not lost with it.
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			line = append([]byte{'\n'}, line...)
+		}
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// AuditFilter selects entries whose fields contain the given strings.
+type AuditFilter struct {
+	Actor  string
+	Action string
+	Target string
+}
+
+func (f *AuditFilter) match(e *AuditEntry) bool {
+	return strings.Contains(e.Actor, f.Actor) &&
+		strings.Contains(e.Action, f.Action) &&
+		strings.Contains(e.Target, f.Target)
+}
+
+func auditFilterFromQuery(q url.Values) *AuditFilter {
+	return &AuditFilter{
+		Actor:  q.Get("actor"),
+		Action: q.Get("action"),
+		Target: q.Get("target"),
+	}
+}
+
+// ReadAuditLog returns the matching entries, newest first, and the number
+// of lines that are not entries, such as one torn by a crash while it was
+// appended. Such lines are logged and skipped.
+func ReadAuditLog(filter *AuditFilter) ([]*AuditEntry, int, error) {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	f, err := os.Open(auditLogPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	var entries []*AuditEntry
+	skipped := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			log.Printf("Skipping %s:%d: %v", auditLogPath(), n, err)
+			skipped++
+			continue
+		}
+		if filter.match(&e) {
+			entries = append(entries, &e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, skipped, nil
+}
+
+// The browse page shows at most this many entries; exports have them all.
+const auditPageSize = 500
+
+func handleAuditLog(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	filter := auditFilterFromQuery(r.URL.Query())
+	entries, skipped, err := ReadAuditLog(filter)
+	if err != nil {
+		http.Error(w, "Failed to read audit log: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Filter          *AuditFilter
+		CSVURL, JSONURL template.URL
+		Entries         []*AuditEntry
+		Total           int // only set if not all entries are shown
+		Skipped         int
+	}{Filter: filter, Entries: entries, Skipped: skipped}
+	query := r.URL.Query()
+	query.Set("format", "csv")
+	data.CSVURL = template.URL("/audit/export?" + query.Encode())
+	query.Set("format", "json")
+	data.JSONURL = template.URL("/audit/export?" + query.Encode())
+	if len(entries) > auditPageSize {
+		data.Total = len(entries)
+		data.Entries = entries[:auditPageSize]
+	}
+	render(w, r, "audit", "Audit log", data)
+}
+
+func handleExportAuditLog(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	entries, skipped, err := ReadAuditLog(auditFilterFromQuery(r.URL.Query()))
+	if err != nil {
+		http.Error(w, "Failed to read audit log: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if skipped > 0 {
+		w.Header().Set("X-Audit-Skipped-Lines", fmt.Sprint(skipped))
+	}
+	switch r.URL.Query().Get("format") {
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit.json"`)
+		if entries == nil {
+			entries = []*AuditEntry{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(entries)
+	case "csv", "":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit.csv"`)
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"time", "actor", "action", "target", "outcome", "detail"})
+		for _, e := range entries {
+			cw.Write([]string{e.Time.Format(time.RFC3339), csvCell(e.Actor), csvCell(e.Action),
+				csvCell(e.Target), csvCell(e.Outcome), csvCell(e.Detail)})
+		}
+		cw.Flush()
+	default:
+		http.Error(w, "format must be csv or json", http.StatusBadRequest)
+	}
+}
+
+// csvCell keeps spreadsheets from evaluating a user-controlled value, such
+// as a team name, as a formula.
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
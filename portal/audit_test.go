@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/csv"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestReadAuditLogSkipsTornLines(t *testing.T) {
+	useTestWorkdir(t)
+	Audit("alice", "team.create", "ops", nil, "")
+	f, err := os.OpenFile(auditLogPath(), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An entry that a crash cut short.
+	if _, err := f.WriteString(`{"time":"2024-01-01T00:00:00Z","actor":"bo`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	Audit("bob", "team.delete", "ops", nil, "")
+
+	entries, skipped, err := ReadAuditLog(&AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped != 1 {
+		t.Errorf("skipped = %d, want 1", skipped)
+	}
+	if len(entries) != 2 || entries[0].Actor != "bob" || entries[1].Actor != "alice" {
+		t.Errorf("entries = %+v, want those of bob and alice", entries)
+	}
+}
+
+func TestExportAuditLogEscapesFormulas(t *testing.T) {
+	useTestWorkdir(t)
+	Audit("alice", "team.create", "=HYPERLINK(\"https://evil.example.com\")", nil, "@SUM(A1)")
+
+	w := httptest.NewRecorder()
+	handleExportAuditLog(w, httptest.NewRequest("GET", "/audit/export?format=csv", nil))
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("records = %v, want a header and one entry", records)
+	}
+	if target, detail := records[1][3], records[1][5]; target != "'=HYPERLINK(\"https://evil.example.com\")" || detail != "'@SUM(A1)" {
+		t.Errorf("target = %q, detail = %q, want them prefixed with '", target, detail)
+	}
+	if actor := records[1][1]; actor != "alice" {
+		t.Errorf("actor = %q, want alice", actor)
+	}
+}
@@ -0,0 +1,603 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+Admins set the product name, a logo and colours at /branding. They are kept
+in ${workdir}/portal/branding.json and ${workdir}/portal/branding/, and
+applied to:
+
+  - the portal layout, through /branding/style.css and /branding/logo
+  - the Keycloak login theme "nsbox" in ${workdir}/keycloak/themes, which
+    LoadRealmConfig selects for the realm along with the product name as
+    its display name
+  - discover.html and index.html of httpd, through the files in
+    ${workdir}/httpd/branding, which is mounted into the document root
+  - c['title'] of Buildbot
+  - the header of Gerrit, through ${workdir}/gerrit/static/gerrit-theme.js
+
+Until an admin saves the branding, everything keeps its own defaults.
+*/
+
+type Branding struct {
+	ProductName string `json:"productName"`
+	// Colours as #rrggbb: links and buttons, and the background of headers
+	// and of the login page.
+	PrimaryColor    string `json:"primaryColor"`
+	BackgroundColor string `json:"backgroundColor"`
+	// File name of the logo in ${workdir}/portal/branding, if any.
+	Logo string `json:"logo,omitempty"`
+}
+
+const (
+	defaultProductName     = "nsbox"
+	defaultPrimaryColor    = "#2563eb"
+	defaultBackgroundColor = "#f3f4f6"
+	maxLogoSize            = 1 << 20
+)
+
+// Logos are served by several origins, so only raster images are accepted:
+// an SVG file may carry scripts.
+var logoExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+}
+
+var colorPattern = regexp.MustCompile(`^#[0-9a-f]{6}$`)
+
+func brandingPath() string {
+	return filepath.Join(*workdir, "portal", "branding.json")
+}
+
+func brandingDir() string {
+	return filepath.Join(*workdir, "portal", "branding")
+}
+
+// LoadBranding returns nil if no branding has been saved.
+func LoadBranding() (*Branding, error) {
+	data, err := os.ReadFile(brandingPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("os.ReadFile(%s): %v", brandingPath(), err)
+	}
+	var b Branding
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal(%s): %v", brandingPath(), err)
+	}
+	return &b, nil
+}
+
+func saveBranding(b *Branding) error {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := brandingPath() + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("os.WriteFile(%s): %v", tmp, err)
+	}
+	return os.Rename(tmp, brandingPath())
+}
+
+// currentBranding is the saved branding or the defaults, for pages that
+// show it either way.
+func currentBranding() *Branding {
+	b, err := LoadBranding()
+	if err != nil {
+		log.Printf("Failed to load the branding: %v", err)
+	}
+	if b == nil {
+		b = &Branding{
+			ProductName:     defaultProductName,
+			PrimaryColor:    defaultPrimaryColor,
+			BackgroundColor: defaultBackgroundColor,
+		}
+	}
+	return b
+}
+
+func (b *Branding) Validate() error {
+	if b.ProductName == "" {
+		return errors.New("the product name is required")
+	}
+	if len(b.ProductName) > 64 || strings.ContainsAny(b.ProductName, "\r\n") {
+		return errors.New("the product name must be a single line of at most 64 characters")
+	}
+	for _, c := range []struct{ name, value string }{
+		{"primary colour", b.PrimaryColor},
+		{"background colour", b.BackgroundColor},
+	} {
+		if !colorPattern.MatchString(c.value) {
+			return fmt.Errorf("the %s must be like #1a2b3c", c.name)
+		}
+	}
+	return nil
+}
+
+func (b *Branding) String() string {
+	s := fmt.Sprintf("name %q, primary %s, background %s", b.ProductName, b.PrimaryColor, b.BackgroundColor)
+	if b.Logo != "" {
+		s += ", logo " + b.Logo
+	}
+	return s
+}
+
+func (b *Branding) logoPath() string {
+	return filepath.Join(brandingDir(), b.Logo)
+}
+
+// textColor is black or white, whichever reads better on the colour.
+func textColor(color string) string {
+	n, err := strconv.ParseUint(strings.TrimPrefix(color, "#"), 16, 32)
+	if err != nil {
+		return "#000000"
+	}
+	r, g, b := float64(n>>16&0xff), float64(n>>8&0xff), float64(n&0xff)
+	if 0.299*r+0.587*g+0.114*b > 150 {
+		return "#000000"
+	}
+	return "#ffffff"
+}
+
+// cssString quotes s as a CSS string.
+func cssString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20 || r == 0x7f || r == '<' || r == '>':
+			fmt.Fprintf(&b, "\\%x ", r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// jsString quotes s as a JavaScript string that is also safe in HTML.
+func jsString(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
+
+// WriteBrandingFiles writes the branding into the files of the services
+// that read it from disk. httpd always gets its files, so that the pages
+// that include them find them.
+func WriteBrandingFiles() error {
+	b, err := LoadBranding()
+	if err != nil {
+		return err
+	}
+	if err := writeHttpdBranding(b); err != nil {
+		return err
+	}
+	if b == nil {
+		return nil
+	}
+	if err := writeKeycloakTheme(b); err != nil {
+		return err
+	}
+	return writeGerritTheme(b)
+}
+
+func copyLogo(b *Branding, path string) error {
+	data, err := os.ReadFile(b.logoPath())
+	if err != nil {
+		return fmt.Errorf("os.ReadFile(%s): %v", b.logoPath(), err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("os.WriteFile(%s): %v", path, err)
+	}
+	return nil
+}
+
+// emptyDir removes what is in the directory, so that no logo of another
+// type is left behind, but keeps the directory itself, which httpd has
+// mounted.
+func emptyDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("os.MkdirAll(%s): %v", dir, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeHttpdBranding writes branding.css and branding.js, which the pages
+// of httpd include. They are empty without a branding.
+func writeHttpdBranding(b *Branding) error {
+	dir := filepath.Join(*workdir, "httpd", "branding")
+	if err := emptyDir(dir); err != nil {
+		return err
+	}
+	var css, js strings.Builder
+	css.WriteString("/* Written by the portal from the branding set at /branding. */\n")
+	js.WriteString("// Written by the portal from the branding set at /branding.\n")
+	if b != nil {
+		fmt.Fprintf(&css, `
+#background {
+  background-image: none;
+  background-color: %s;
+}
+
+#link, a {
+  color: %s;
+}
+
+#logo-image {
+  max-width: 100%%;
+  max-height: 48px;
+}
+`, b.BackgroundColor, b.PrimaryColor)
+		logo := ""
+		if b.Logo != "" {
+			logo = "/branding/logo" + filepath.Ext(b.Logo)
+			if err := copyLogo(b, filepath.Join(dir, "logo"+filepath.Ext(b.Logo))); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(&js, `
+(function () {
+  const name = %s;
+  const logo = %s;
+  document.title = document.title.replace("NaiveSystems Box", name);
+  for (const el of document.querySelectorAll(".product-name")) {
+    el.textContent = name;
+  }
+  const defaultLogo = document.getElementById("logo");
+  if (logo && defaultLogo) {
+    const img = document.createElement("img");
+    img.id = "logo-image";
+    img.src = logo;
+    img.alt = name;
+    defaultLogo.replaceWith(img);
+  }
+})();
+`, jsString(b.ProductName), jsString(logo))
+	}
+	if err := os.WriteFile(filepath.Join(dir, "branding.css"), []byte(css.String()), 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "branding.js"), []byte(js.String()), 0644)
+}
+
+func keycloakThemeDir() string {
+	return filepath.Join(*workdir, "keycloak", "themes", "nsbox")
+}
+
+// writeKeycloakTheme writes the login theme "nsbox", which extends the
+// default theme with a stylesheet. Keycloak shows the display name of the
+// realm in the header, below the logo.
+func writeKeycloakTheme(b *Branding) error {
+	dir := filepath.Join(keycloakThemeDir(), "login")
+	if err := emptyDir(dir); err != nil {
+		return err
+	}
+	properties := "parent=keycloak\nimport=common/keycloak\nstyles=css/login.css css/nsbox.css\n"
+	if err := os.WriteFile(filepath.Join(dir, "theme.properties"), []byte(properties), 0644); err != nil {
+		return err
+	}
+	cssDir := filepath.Join(dir, "resources", "css")
+	if err := os.MkdirAll(cssDir, 0755); err != nil {
+		return err
+	}
+	var css strings.Builder
+	fmt.Fprintf(&css, `/* Written by the portal from the branding set at /branding. */
+:root {
+  --pf-global--primary-color--100: %s;
+  --pf-global--primary-color--200: %s;
+  --pf-global--link--Color: %s;
+  --pf-global--link--Color--hover: %s;
+}
+
+.login-pf body {
+  background: %s none;
+}
+
+#kc-header-wrapper {
+  color: %s;
+}
+`, b.PrimaryColor, b.PrimaryColor, b.PrimaryColor, b.PrimaryColor, b.BackgroundColor, textColor(b.BackgroundColor))
+	if b.Logo != "" {
+		imgDir := filepath.Join(dir, "resources", "img")
+		if err := os.MkdirAll(imgDir, 0755); err != nil {
+			return err
+		}
+		logo := "logo" + filepath.Ext(b.Logo)
+		if err := copyLogo(b, filepath.Join(imgDir, logo)); err != nil {
+			return err
+		}
+		fmt.Fprintf(&css, `
+#kc-header-wrapper {
+  background: url("../img/%s") no-repeat center top;
+  background-size: auto 64px;
+  padding-top: 80px;
+}
+`, logo)
+	}
+	return os.WriteFile(filepath.Join(cssDir, "nsbox.css"), []byte(css.String()), 0644)
+}
+
+// brandingRealmSettings are the settings that LoadRealmConfig adds for the
+// branding.
+func brandingRealmSettings(b *Branding) map[string]any {
+	return map[string]any{
+		"loginTheme":      "nsbox",
+		"displayName":     b.ProductName,
+		"displayNameHtml": html.EscapeString(b.ProductName),
+	}
+}
+
+// writeGerritTheme writes gerrit-theme.js, which Gerrit loads from its
+// static directory on every page.
+func writeGerritTheme(b *Branding) error {
+	dir := filepath.Join(*workdir, "gerrit", "static")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("os.MkdirAll(%s): %v", dir, err)
+	}
+	old, _ := filepath.Glob(filepath.Join(dir, "nsbox-logo.*"))
+	for _, path := range old {
+		os.Remove(path)
+	}
+	properties := map[string]string{
+		"--header-title-content":            cssString(b.ProductName),
+		"--header-background-color":         b.BackgroundColor,
+		"--header-text-color":               textColor(b.BackgroundColor),
+		"--primary-button-background-color": b.PrimaryColor,
+		"--link-color":                      b.PrimaryColor,
+	}
+	if b.Logo != "" {
+		logo := "nsbox-logo" + filepath.Ext(b.Logo)
+		if err := copyLogo(b, filepath.Join(dir, logo)); err != nil {
+			return err
+		}
+		properties["--header-icon"] = `url("/static/` + logo + `")`
+		properties["--header-icon-size"] = "1.5em"
+	}
+	data, err := json.MarshalIndent(properties, "  ", "  ")
+	if err != nil {
+		return err
+	}
+	js := fmt.Sprintf(`// Written by the portal from the branding set at /branding.
+Gerrit.install(() => {
+  const properties = %s;
+  for (const [name, value] of Object.entries(properties)) {
+    document.documentElement.style.setProperty(name, value);
+  }
+});
+`, data)
+	return os.WriteFile(filepath.Join(dir, "gerrit-theme.js"), []byte(js), 0644)
+}
+
+// ApplyBranding writes the branding into the files of the services and
+// applies it where it is configured through an API. Gerrit and httpd read
+// their files on every request, while Buildbot is restarted for the title.
+func ApplyBranding(actor string, b *Branding) []SystemResult {
+	results := []SystemResult{
+		{System: "httpd", Message: "pages updated", Err: writeHttpdBranding(b)},
+		{System: "Gerrit", Message: "theme updated", Err: writeGerritTheme(b)},
+	}
+
+	if err := writeKeycloakTheme(b); err != nil {
+		results = append(results, SystemResult{System: "Keycloak", Err: err})
+	} else {
+		results = append(results, applyBrandingToRealm(actor)...)
+	}
+
+	result := SystemResult{System: "Buildbot", Message: "title updated"}
+	if bb == nil {
+		result.Message = "not running, the title is set on the next start"
+	} else if client, err := NewGerritAdminClient(); err != nil {
+		result.Err = err
+	} else if gps, err := client.ListProjects(); err != nil {
+		result.Err = err
+	} else {
+		sortProjects(gps)
+		bb.Title = b.ProductName
+		result.Err = bb.RewriteConfig(gps)
+		if result.Err == nil {
+			result.Err = bb.Restart()
+		}
+		Audit(AuditSystemActor, "buildbot.restart", "buildbot", result.Err, "branding")
+	}
+	return append(results, result)
+}
+
+// applyBrandingToRealm applies only the settings of the branding, leaving
+// other changes to realm.json for the realm page.
+func applyBrandingToRealm(actor string) []SystemResult {
+	cfg, err := LoadRealmConfig()
+	var changes []*RealmChange
+	if err == nil {
+		changes, err = PlanRealm(cfg)
+	}
+	if err != nil {
+		return []SystemResult{{System: "Keycloak", Err: err}}
+	}
+	var selected []*RealmChange
+	for _, c := range changes {
+		for key := range brandingRealmSettings(&Branding{}) {
+			if c.Resource == "setting "+key {
+				selected = append(selected, c)
+			}
+		}
+	}
+	if len(selected) == 0 {
+		return []SystemResult{{System: "Keycloak", Message: "theme updated"}}
+	}
+	return ApplyRealmChanges(actor, selected)
+}
+
+type brandingPage struct {
+	*Branding
+	Saved bool
+}
+
+func handleBranding(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	b, err := LoadBranding()
+	if err != nil {
+		http.Error(w, "Failed to load the branding: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page := &brandingPage{Branding: b, Saved: b != nil}
+	if b == nil {
+		page.Branding = currentBranding()
+	}
+	render(w, r, "branding", "Branding", page)
+}
+
+func handleSaveBranding(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodPost) {
+		return
+	}
+	if err := r.ParseMultipartForm(2 * maxLogoSize); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	old, err := LoadBranding()
+	if err != nil {
+		redirectWithFlash(w, r, "/branding", FlashError, "Failed to load the branding: "+err.Error())
+		return
+	}
+	b := &Branding{
+		ProductName:     strings.TrimSpace(r.FormValue("product_name")),
+		PrimaryColor:    strings.ToLower(strings.TrimSpace(r.FormValue("primary_color"))),
+		BackgroundColor: strings.ToLower(strings.TrimSpace(r.FormValue("background_color"))),
+	}
+	if old != nil && r.FormValue("remove_logo") != "1" {
+		b.Logo = old.Logo
+	}
+	if err := b.Validate(); err != nil {
+		redirectWithFlash(w, r, "/branding", FlashError, err.Error())
+		return
+	}
+
+	var logo []byte
+	file, _, err := r.FormFile("logo")
+	if err == nil {
+		defer file.Close()
+		logo, err = io.ReadAll(io.LimitReader(file, maxLogoSize+1))
+	} else if errors.Is(err, http.ErrMissingFile) {
+		err = nil
+	}
+	if err != nil {
+		redirectWithFlash(w, r, "/branding", FlashError, "Failed to read the logo: "+err.Error())
+		return
+	}
+	if len(logo) > maxLogoSize {
+		redirectWithFlash(w, r, "/branding", FlashError, "The logo must be at most 1 MB")
+		return
+	}
+	if len(logo) > 0 {
+		ext, ok := logoExtensions[http.DetectContentType(logo)]
+		if !ok {
+			redirectWithFlash(w, r, "/branding", FlashError, "The logo must be a PNG, JPEG or GIF image")
+			return
+		}
+		b.Logo = "logo" + ext
+	}
+
+	err = os.MkdirAll(brandingDir(), 0755)
+	if err == nil && len(logo) > 0 {
+		err = os.WriteFile(b.logoPath(), logo, 0644)
+	}
+	if err == nil {
+		err = saveBranding(b)
+	}
+	if err == nil {
+		removeOldLogos(b.Logo)
+	}
+	Audit(auditActor(r), "branding.update", "branding", err, b.String())
+	if err != nil {
+		redirectWithFlash(w, r, "/branding", FlashError, "Failed to save the branding: "+err.Error())
+		return
+	}
+	results := []SystemResult{{System: "Portal", Message: "saved"}}
+	redirectWithResults(w, r, "/branding", append(results, ApplyBranding(auditActor(r), b)...))
+}
+
+// removeOldLogos removes the logos other than keep, e.g. a PNG after a
+// JPEG has been uploaded.
+func removeOldLogos(keep string) {
+	for _, ext := range logoExtensions {
+		if name := "logo" + ext; name != keep {
+			os.Remove(filepath.Join(brandingDir(), name))
+		}
+	}
+}
+
+// handleBrandingLogo serves the logo for the portal layout.
+func handleBrandingLogo(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	b, err := LoadBranding()
+	if err != nil || b == nil || b.Logo == "" {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, b.logoPath())
+}
+
+// handleBrandingStyle serves the colours of the branding as a stylesheet
+// that the layout includes after portal.css. It is empty without a
+// branding.
+func handleBrandingStyle(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/css; charset=utf-8")
+	b, err := LoadBranding()
+	if err != nil || b == nil {
+		return
+	}
+	fmt.Fprintf(w, `.breadcrumbs {
+	background-color: %s;
+	color: %s;
+	padding: 8px;
+}
+
+.breadcrumbs a {
+	color: inherit;
+}
+
+a {
+	color: %s;
+}
+
+button {
+	background-color: %s;
+	border: 1px solid %s;
+	color: %s;
+}
+`, b.BackgroundColor, textColor(b.BackgroundColor), b.PrimaryColor, b.PrimaryColor, b.PrimaryColor, textColor(b.PrimaryColor))
+}
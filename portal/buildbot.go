@@ -21,6 +21,7 @@ import (
 	"naive.systems/box/buildbot"
 	"naive.systems/box/buildbot/pip"
 	"naive.systems/box/portal/gerrit"
+	"naive.systems/box/portal/secrets"
 )
 
 var bb *buildbot.Buildbot
@@ -71,15 +72,10 @@ func StartBuildbot() error {
 		}
 	}
 
-	bb = buildbot.New()
-	bb.WorkDir = buildbotDir
-	bb.IdentityFile = filepath.Join(buildbotDir, "ssh", "id_ed25519")
-	bb.WorkersList = "worker,password"
-	bb.WWWProtocol = "https"
-	bb.WWWHost = *hostname
-	bb.PublicPort = 9443
-	bb.Gerrit.Server = *bindIP
-	bb.Gerrit.Port = 29418
+	bb, err = newBuildbot()
+	if err != nil {
+		return err
+	}
 
 	gps, err := PrepareBuildbotAccountInGerrit()
 	if err != nil {
@@ -94,6 +90,90 @@ func StartBuildbot() error {
 	return nil
 }
 
+func newBuildbot() (*buildbot.Buildbot, error) {
+	buildbotDir := filepath.Join(*workdir, "buildbot")
+	password, err := buildbotWorkerPassword()
+	if err != nil {
+		return nil, err
+	}
+	b := buildbot.New()
+	b.WorkDir = buildbotDir
+	b.BinPath = filepath.Join(buildbotDir, "sandbox", "bin", "buildbot")
+	b.WorkerBin = filepath.Join(buildbotDir, "sandbox", "bin", "buildbot-worker")
+	if b.IdentityFile, err = buildbotIdentityFile(); err != nil {
+		return nil, err
+	}
+	b.WorkersList = "worker," + password
+	dir, err := secretRuntimeDir()
+	if err != nil {
+		return nil, err
+	}
+	b.WorkerPasswordsFile = filepath.Join(dir, "buildbot_workers.json")
+	if branding, err := LoadBranding(); err != nil {
+		return nil, err
+	} else if branding != nil {
+		b.Title = branding.ProductName
+	}
+	b.WWWProtocol = "https"
+	b.WWWHost = *hostname
+	b.PublicPort = 9443
+	b.Gerrit.Server = *bindIP
+	b.Gerrit.Port = 29418
+	return b, nil
+}
+
+// buildbotWorkerPassword returns the password of the worker, generating it
+// first if there is none. The workers are recreated on every start, so a
+// new password takes effect with the next start.
+func buildbotWorkerPassword() (string, error) {
+	password, err := ReadSecretString(secretBuildbotWorker)
+	if errors.Is(err, secrets.ErrNotFound) {
+		if err := writeBuildbotWorkerPassword(); err != nil {
+			return "", err
+		}
+		password, err = ReadSecretString(secretBuildbotWorker)
+	}
+	return password, err
+}
+
+func writeBuildbotWorkerPassword() error {
+	password, err := GenerateOIDCCryptoPassphrase(32)
+	if err != nil {
+		return err
+	}
+	return WriteSecret(secretBuildbotWorker, []byte(password+"\n"))
+}
+
+func buildbotPublicKeyPath() string {
+	return filepath.Join(*workdir, "buildbot", "ssh", "id_ed25519.pub")
+}
+
+// buildbotIdentityFile writes the SSH key of Buildbot from the secret store
+// into the runtime directory, for ssh and the Buildbot master, and returns
+// its path. The public key stays in the workdir.
+func buildbotIdentityFile() (string, error) {
+	key, err := ReadSecret(secretBuildbotSSHKey)
+	if err != nil {
+		return "", err
+	}
+	publicKey, err := os.ReadFile(buildbotPublicKeyPath())
+	if err != nil {
+		return "", fmt.Errorf("os.ReadFile(%s): %v", buildbotPublicKeyPath(), err)
+	}
+	dir, err := secretRuntimeDir()
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "buildbot_id_ed25519")
+	if err := writeSecretFile(path, string(key)); err != nil {
+		return "", err
+	}
+	if err := writeSecretFile(path+".pub", string(publicKey)); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
 func InitBuildbot() error {
 	buildbotDir := filepath.Join(*workdir, "buildbot")
 
@@ -124,6 +204,9 @@ func InitBuildbot() error {
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("%s: %v", cmd.String(), err)
 	}
+	if err := migrateSecret(secretBuildbotSSHKey); err != nil {
+		return err
+	}
 
 	// write version file
 	buildbot := filepath.Join(*workdir, "buildbot", "sandbox", "bin", "buildbot")
@@ -165,9 +248,10 @@ func UpgradeBuildbot() error {
 }
 
 func testGerritConnection(username, host string, portNumber int) error {
-	buildbotDir := filepath.Join(*workdir, "buildbot")
-	sshDir := filepath.Join(buildbotDir, "ssh")
-	privateKeyPath := filepath.Join(sshDir, "id_ed25519")
+	privateKeyPath, err := buildbotIdentityFile()
+	if err != nil {
+		return err
+	}
 
 	port := strconv.Itoa(portNumber)
 	cmd := exec.Command("ssh", "-T",
@@ -190,9 +274,10 @@ func testGerritConnection(username, host string, portNumber int) error {
 }
 
 func testGerritProjectAccess(project, username, host string, portNumber int) error {
-	buildbotDir := filepath.Join(*workdir, "buildbot")
-	sshDir := filepath.Join(buildbotDir, "ssh")
-	privateKeyPath := filepath.Join(sshDir, "id_ed25519")
+	privateKeyPath, err := buildbotIdentityFile()
+	if err != nil {
+		return err
+	}
 
 	port := strconv.Itoa(portNumber)
 	cmd := exec.Command("ssh", "-T",
@@ -224,9 +309,10 @@ func testGerritProjectAccess(project, username, host string, portNumber int) err
 }
 
 func testCloneProject(project, username, host string, portNumber int) error {
-	buildbotDir := filepath.Join(*workdir, "buildbot")
-	sshDir := filepath.Join(buildbotDir, "ssh")
-	privateKeyPath := filepath.Join(sshDir, "id_ed25519")
+	privateKeyPath, err := buildbotIdentityFile()
+	if err != nil {
+		return err
+	}
 
 	// Construct the SSH URL
 	sshURL := fmt.Sprintf("ssh://%s@%s:%d/%s.git", username, host, portNumber, project)
@@ -344,13 +430,13 @@ func PrepareBuildbotAccountInGerrit() ([]*gerrit.Project, error) {
 	}
 
 	// Ensure the user exists
-	if err := AddGerritUser(username, "Buildbot", "buildbot@nsbox.local"); err != nil {
+	if err := AddGerritUser(username, "Buildbot", DefaultEmail(username)); err != nil {
 		return nil, fmt.Errorf("error ensuring user exists: %w", err)
 	}
 
-	client := gerrit.NewClient("http://"+*bindIP+":8081", "admin", "Administrator", "admin@nsbox.local")
-	if err := client.Login(); err != nil {
-		return nil, fmt.Errorf("error logging into gerrit: %w", err)
+	client, err := NewGerritAdminClient()
+	if err != nil {
+		return nil, err
 	}
 
 	// Create the Verified label
@@ -359,7 +445,9 @@ func PrepareBuildbotAccountInGerrit() ([]*gerrit.Project, error) {
 	}
 
 	// Grant permissions to Service Users
-	if err := grantGerritPermissions(client, "All-Projects", *bindIP, 29418); err != nil {
+	err = grantGerritPermissions(client, "All-Projects", *bindIP, 29418)
+	Audit(AuditSystemActor, "gerrit.grant_permissions", "All-Projects", err, "Service Users")
+	if err != nil {
 		return nil, fmt.Errorf("error granting Gerrit permissions: %w", err)
 	}
 
@@ -398,9 +486,9 @@ func StopBuildbot() {
 
 func WatchGerritProjects() {
 	for {
-		client := gerrit.NewClient("http://"+*bindIP+":8081", "admin", "Administrator", "admin@nsbox.local")
-		if err := client.Login(); err != nil {
-			log.Printf("WatchGerritProjects: error logging into gerrit: %v", err)
+		client, err := NewGerritAdminClient()
+		if err != nil {
+			log.Printf("WatchGerritProjects: %v", err)
 			time.Sleep(30 * time.Second)
 			continue
 		}
@@ -428,12 +516,24 @@ func WatchGerritProjects() {
 				continue
 			}
 
-			if err := bb.RewriteConfig(newProjects); err != nil {
+			// 'portal rotate-secrets' may have changed the worker password.
+			password, err := buildbotWorkerPassword()
+			if err == nil {
+				err = bb.SetWorkersList("worker," + password)
+			}
+			if err == nil {
+				err = bb.RewriteConfig(newProjects)
+			}
+			Audit(AuditSystemActor, "buildbot.rewrite_config", "buildbot", err,
+				fmt.Sprintf("%d projects", len(newProjects)))
+			if err != nil {
 				log.Printf("WatchGerritProjects: error rewriting buildbot config: %v", err)
 				return
 			}
 
-			if err := bb.Restart(); err != nil {
+			err = bb.Restart()
+			Audit(AuditSystemActor, "buildbot.restart", "buildbot", err, "")
+			if err != nil {
 				log.Printf("WatchGerritProjects: error restarting buildbot: %v", err)
 				return
 			}
@@ -468,13 +568,15 @@ func sameProject(a, b *gerrit.Project) bool {
 }
 
 func WatchGerritChanges() {
-	buildbotDir := filepath.Join(*workdir, "buildbot")
-	sshDir := filepath.Join(buildbotDir, "ssh")
-	privateKeyPath := filepath.Join(sshDir, "id_ed25519")
-
 	for {
 		time.Sleep(5 * time.Second)
 
+		privateKeyPath, err := buildbotIdentityFile()
+		if err != nil {
+			log.Printf("WatchGerritChanges: %v", err)
+			continue
+		}
+
 		cmd := exec.Command("ssh", "-T",
 			"-i", privateKeyPath,
 			"-l", "buildbot",
@@ -538,8 +640,7 @@ func processGerritEvent(line string) {
 func sendUpdateToRedmine(bugID string, event GerritEvent) {
 	log.Printf("WatchGerritChanges: Bug-Id: %s", bugID)
 
-	adminKeyFile := filepath.Join(*workdir, "redmine", "data", "admin_api_key.txt")
-	redmineKey, err := os.ReadFile(adminKeyFile)
+	redmineKey, err := RedmineAdminKey()
 	if err != nil {
 		log.Printf("Error reading redmine key: %v\n", err)
 		return
@@ -561,7 +662,7 @@ func sendUpdateToRedmine(bugID string, event GerritEvent) {
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-Redmine-API-Key", strings.TrimSpace(string(redmineKey)))
+	req.Header.Set("X-Redmine-API-Key", redmineKey)
 	resp, err := client.Do(req)
 	if err != nil {
 		log.Printf("Error sending request: %v\n", err)
@@ -579,3 +680,126 @@ func indentCommitMessage(commitMsg string) string {
 	}
 	return strings.Join(lines, "\n")
 }
+
+// Build is a build in Buildbot, as reported by its data API.
+type Build struct {
+	ID        int        `json:"id"`
+	Builder   string     `json:"builder"`
+	Number    int        `json:"number"`
+	State     string     `json:"state"`
+	Result    string     `json:"result,omitempty"` // empty while running
+	Started   time.Time  `json:"started"`
+	Completed *time.Time `json:"completed,omitempty"`
+	URL       string     `json:"url"`
+}
+
+// Buildbot result codes, in the order of buildbot.process.results.
+var buildbotResults = []string{"success", "warnings", "failure", "skipped", "exception", "retry", "cancelled"}
+
+type buildbotBuild struct {
+	BuildID     int    `json:"buildid"`
+	BuilderID   int    `json:"builderid"`
+	Number      int    `json:"number"`
+	StartedAt   int64  `json:"started_at"`
+	Complete    bool   `json:"complete"`
+	CompleteAt  *int64 `json:"complete_at"`
+	Results     *int   `json:"results"`
+	StateString string `json:"state_string"`
+}
+
+// buildbotRequest queries the data API of Buildbot on behalf of username,
+// whom the master trusts through the X-Remote-User header like httpd.
+func buildbotRequest(username, path string, out any) error {
+	req, err := http.NewRequest(http.MethodGet, "http://127.0.0.1:8010/api/v2/"+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Remote-User", username)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w in Buildbot: %s", ErrNotFound, path)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status from Buildbot: %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("error decoding Buildbot response: %v", err)
+	}
+	return nil
+}
+
+func buildbotBuilderNames(username string) (map[int]string, error) {
+	var page struct {
+		Builders []struct {
+			BuilderID int    `json:"builderid"`
+			Name      string `json:"name"`
+		} `json:"builders"`
+	}
+	if err := buildbotRequest(username, "builders", &page); err != nil {
+		return nil, err
+	}
+	names := map[int]string{}
+	for _, b := range page.Builders {
+		names[b.BuilderID] = b.Name
+	}
+	return names, nil
+}
+
+func convertBuilds(builds []*buildbotBuild, builders map[int]string) []*Build {
+	var converted []*Build
+	for _, b := range builds {
+		build := &Build{
+			ID:      b.BuildID,
+			Builder: builders[b.BuilderID],
+			Number:  b.Number,
+			State:   b.StateString,
+			Started: time.Unix(b.StartedAt, 0).UTC(),
+			URL:     fmt.Sprintf("https://%s:9443/#/builders/%d/builds/%d", *hostname, b.BuilderID, b.Number),
+		}
+		if b.Results != nil && *b.Results >= 0 && *b.Results < len(buildbotResults) {
+			build.Result = buildbotResults[*b.Results]
+		}
+		if b.CompleteAt != nil {
+			completed := time.Unix(*b.CompleteAt, 0).UTC()
+			build.Completed = &completed
+		}
+		converted = append(converted, build)
+	}
+	return converted
+}
+
+// ListBuilds returns the latest builds, newest first.
+func ListBuilds(username string, limit int) ([]*Build, error) {
+	builders, err := buildbotBuilderNames(username)
+	if err != nil {
+		return nil, err
+	}
+	var page struct {
+		Builds []*buildbotBuild `json:"builds"`
+	}
+	if err := buildbotRequest(username, fmt.Sprintf("builds?order=-buildid&limit=%d", limit), &page); err != nil {
+		return nil, err
+	}
+	return convertBuilds(page.Builds, builders), nil
+}
+
+func GetBuild(username string, id int) (*Build, error) {
+	builders, err := buildbotBuilderNames(username)
+	if err != nil {
+		return nil, err
+	}
+	var page struct {
+		Builds []*buildbotBuild `json:"builds"`
+	}
+	if err := buildbotRequest(username, fmt.Sprintf("builds/%d", id), &page); err != nil {
+		return nil, err
+	}
+	if len(page.Builds) == 0 {
+		return nil, fmt.Errorf("%w in Buildbot: build %d", ErrNotFound, id)
+	}
+	return convertBuilds(page.Builds, builders)[0], nil
+}
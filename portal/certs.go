@@ -25,6 +25,7 @@ func PrepareSelfSignedKeyPair(certsDir string) {
 	cmd.Stderr = os.Stderr
 	log.Printf("Execute command: %s", cmd.String())
 	err := cmd.Run()
+	Audit(AuditSystemActor, "cert.generate", *hostname, err, crtFile)
 	if err != nil {
 		log.Fatalf("Error: %v", err)
 	}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/mail"
+	"strings"
+)
+
+var emailTemplate = flag.String("email_template", "{username}@{hostname}", "Email address of users created without one, and of the admin and buildbot accounts")
+var emailDomains = flag.String("email_domains", "", "Comma-separated domains allowed in user email addresses (default: any)")
+
+// DefaultEmail returns the address given to a user created without one.
+func DefaultEmail(username string) string {
+	return strings.NewReplacer("{username}", username, "{hostname}", *hostname).Replace(*emailTemplate)
+}
+
+// gerritEmailFormat is -email_template in the syntax of Gerrit's
+// auth.emailFormat.
+func gerritEmailFormat() string {
+	return strings.NewReplacer("{username}", "{0}", "{hostname}", *hostname).Replace(*emailTemplate)
+}
+
+func allowedEmailDomains() []string {
+	var domains []string
+	for _, d := range strings.Split(*emailDomains, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			domains = append(domains, strings.ToLower(d))
+		}
+	}
+	return domains
+}
+
+// CheckEmail returns an error unless email is a plain address in one of the
+// allowed domains.
+func CheckEmail(email string) error {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || addr.Name != "" {
+		return fmt.Errorf("invalid email address: %s", email)
+	}
+	domains := allowedEmailDomains()
+	if len(domains) == 0 {
+		return nil
+	}
+	domain := strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+	for _, d := range domains {
+		if domain == d {
+			return nil
+		}
+	}
+	return fmt.Errorf("email domain %s is not one of %s", domain, strings.Join(domains, ", "))
+}
+
+func checkEmailTemplate() error {
+	if !strings.Contains(*emailTemplate, "{username}") {
+		return fmt.Errorf("-email_template %s does not contain {username}", *emailTemplate)
+	}
+	return CheckEmail(DefaultEmail("user"))
+}
+
+// smtpRelayHostPort splits SMTPRelay for Gerrit and Redmine, which share
+// the network of the host. They send without authentication, so a relay
+// that requires it has to accept mail from this host.
+func smtpRelayHostPort() (string, string) {
+	host, port, err := net.SplitHostPort(SMTPRelay())
+	if err != nil {
+		log.Fatalf("Invalid SMTP relay %s: %v", SMTPRelay(), err)
+	}
+	return host, port
+}
+
+// ApplyServiceAccountEmails gives the admin and buildbot accounts the
+// addresses from -email_template.
+func ApplyServiceAccountEmails() {
+	if user, err := GetKeycloakUser("admin"); err != nil {
+		log.Printf("Keycloak admin: %v", err)
+	} else if user.Email != DefaultEmail("admin") {
+		if err := UpdateKeycloakUserEmail(user.ID, DefaultEmail("admin")); err != nil {
+			log.Printf("Keycloak admin: %v", err)
+		}
+	}
+
+	if user, err := FindRedmineUser("admin"); err != nil {
+		log.Printf("Redmine admin: %v", err)
+	} else if user.Mail != DefaultEmail("admin") {
+		if err := UpdateRedmineUser(user.ID, map[string]any{"mail": DefaultEmail("admin")}); err != nil {
+			log.Printf("Redmine admin: %v", err)
+		}
+	}
+
+	client, err := NewGerritAdminClient()
+	if err != nil {
+		log.Printf("Gerrit: %v", err)
+		return
+	}
+	for _, username := range []string{"admin", "buildbot"} {
+		account, err := client.GetAccount(username)
+		if err != nil {
+			log.Printf("Gerrit %s: %v", username, err)
+			continue
+		}
+		if account.Email == DefaultEmail(username) {
+			continue
+		}
+		if err := client.SetAccountEmail(username, DefaultEmail(username)); err != nil {
+			log.Printf("Gerrit %s: %v", username, err)
+		}
+	}
+}
@@ -12,6 +12,8 @@ import (
 	"strings"
 	"syscall"
 	"time"
+
+	"naive.systems/box/portal/gerrit"
 )
 
 var defaultGerritImage = "naive.systems/box/gerrit:dev"
@@ -72,7 +74,7 @@ func StartGerrit() error {
 		return err
 	}
 	WaitGerritUp()
-	if err := AddGerritUser("admin", "Administrator", "admin@nsbox.local"); err != nil {
+	if err := AddGerritUser("admin", "Administrator", DefaultEmail("admin")); err != nil {
 		return err
 	}
 	return nil
@@ -94,11 +96,24 @@ func UpgradeGerrit() error {
 	return nil
 }
 
+// gerritAllowedDomains is -email_domains for sendemail.allowedDomain.
+func gerritAllowedDomains() string {
+	if domains := allowedEmailDomains(); len(domains) > 0 {
+		return strings.Join(domains, ",")
+	}
+	return "*"
+}
+
 func RunGerrit() error {
+	smtpHost, smtpPort := smtpRelayHostPort()
 	cmd, err := PodmanRunGerrit(false, "/home/gerrit/run",
 		"--hostname", *hostname,
 		"--http-bind", *bindIP,
-		"--ssh-listen", *gerritSSHAddr)
+		"--ssh-listen", *gerritSSHAddr,
+		"--email-format", gerritEmailFormat(),
+		"--allowed-domains", gerritAllowedDomains(),
+		"--smtp-server", smtpHost,
+		"--smtp-port", smtpPort)
 	if err != nil {
 		return fmt.Errorf("failed to start Gerrit: %v", err)
 	}
@@ -228,3 +243,13 @@ func AddGerritUser(username, displayName, email string) error {
 	log.Printf("AddGerritUser('%s') succeeded", username)
 	return nil
 }
+
+// NewGerritAdminClient logs into Gerrit as the admin, whose address follows
+// -email_template and -hostname like that of every other account.
+func NewGerritAdminClient() (*gerrit.Client, error) {
+	client := gerrit.NewClient("http://"+*bindIP+":8081", "admin", "Administrator", DefaultEmail("admin"))
+	if err := client.Login(); err != nil {
+		return nil, fmt.Errorf("error logging into gerrit: %w", err)
+	}
+	return client, nil
+}
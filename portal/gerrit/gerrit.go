@@ -14,6 +14,40 @@ import (
 	"time"
 )
 
+// ErrNotFound is returned when Gerrit responds with 404 Not Found.
+var ErrNotFound = errors.New("not found in Gerrit")
+
+// ErrConflict is returned when Gerrit responds with 409 Conflict, e.g. for a
+// group that already exists or an account that is already inactive.
+var ErrConflict = errors.New("conflict in Gerrit")
+
+// Error is an unsuccessful response of Gerrit. It matches ErrNotFound and
+// ErrConflict with errors.Is according to its status.
+type Error struct {
+	Method   string
+	Endpoint string
+	Status   int
+	Message  string // the start of the response body
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%s %s: %d %s", e.Method, e.Endpoint, e.Status, http.StatusText(e.Status))
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.Status == http.StatusNotFound
+	case ErrConflict:
+		return e.Status == http.StatusConflict
+	}
+	return false
+}
+
 type Client struct {
 	RemoteURL    string // URL of the Gerrit instance.
 	RemoteUser   string // Remote user to be set as the REMOTE_USER header.
@@ -160,11 +194,15 @@ func (c *Client) makeRequest(method, endpoint string, data io.Reader, contentTyp
 	}
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		errorSnippet := string(responseData)
+		errorSnippet := strings.TrimSpace(string(responseData))
 		if len(errorSnippet) > 1000 {
 			errorSnippet = errorSnippet[:1000] + "..."
 		}
-		return nil, fmt.Errorf("server returned unexpected status %s: %s", resp.Status, errorSnippet)
+		return nil, &Error{Method: method, Endpoint: endpoint, Status: resp.StatusCode, Message: errorSnippet}
+	}
+
+	if len(responseData) == 0 {
+		return nil, nil
 	}
 
 	const jsonPrefix = ")]}'\n"
@@ -202,6 +240,12 @@ func (c *Client) AddMemberToGroup(groupID, accountID string) error {
 	return err
 }
 
+func (c *Client) RemoveMemberFromGroup(groupID, accountID string) error {
+	endpoint := fmt.Sprintf("groups/%s/members/%s", url.QueryEscape(groupID), url.QueryEscape(accountID))
+	_, err := c.MakePlainTextRequest(http.MethodDelete, endpoint, "")
+	return err
+}
+
 func (c *Client) ListProjects() ([]*Project, error) {
 	responseData, err := c.MakePlainTextRequest(http.MethodGet, "projects/", "")
 	if err != nil {
@@ -238,3 +282,258 @@ func (c *Client) GetGroup(groupID string) (*Group, error) {
 	}
 	return &group, nil
 }
+
+type Account struct {
+	ID       int    `json:"_account_id"`
+	Name     string `json:"name,omitempty"`
+	Email    string `json:"email,omitempty"`
+	Username string `json:"username,omitempty"`
+	Inactive bool   `json:"inactive,omitempty"`
+}
+
+type Email struct {
+	Email     string `json:"email"`
+	Preferred bool   `json:"preferred,omitempty"`
+}
+
+// QueryAccounts returns all accounts matching the query, including inactive
+// ones unless the query says otherwise.
+func (c *Client) QueryAccounts(query string) ([]*Account, error) {
+	var accounts []*Account
+	for {
+		endpoint := fmt.Sprintf("accounts/?q=%s&o=DETAILS&S=%d", url.QueryEscape(query), len(accounts))
+		responseData, err := c.MakePlainTextRequest(http.MethodGet, endpoint, "")
+		if err != nil {
+			return nil, err
+		}
+		var page []*struct {
+			Account
+			MoreAccounts bool `json:"_more_accounts,omitempty"`
+		}
+		if err := json.Unmarshal(responseData, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+		}
+		more := false
+		for _, a := range page {
+			account := a.Account
+			accounts = append(accounts, &account)
+			more = a.MoreAccounts
+		}
+		if !more {
+			return accounts, nil
+		}
+	}
+}
+
+func (c *Client) ListAccountEmails(accountID string) ([]*Email, error) {
+	endpoint := fmt.Sprintf("accounts/%s/emails", url.QueryEscape(accountID))
+	responseData, err := c.MakePlainTextRequest(http.MethodGet, endpoint, "")
+	if err != nil {
+		return nil, err
+	}
+	var emails []*Email
+	if err := json.Unmarshal(responseData, &emails); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return emails, nil
+}
+
+// AddAccountEmail registers a new email address for the account without
+// sending a confirmation email. Requires the Modify Account capability.
+func (c *Client) AddAccountEmail(accountID, email string, preferred bool) error {
+	endpoint := fmt.Sprintf("accounts/%s/emails/%s", url.QueryEscape(accountID), url.PathEscape(email))
+	payload := map[string]any{
+		"email":           email,
+		"preferred":       preferred,
+		"no_confirmation": true,
+	}
+	_, err := c.MakeJSONRequest(http.MethodPut, endpoint, payload)
+	return err
+}
+
+func (c *Client) DeleteAccountEmail(accountID, email string) error {
+	endpoint := fmt.Sprintf("accounts/%s/emails/%s", url.QueryEscape(accountID), url.PathEscape(email))
+	_, err := c.makeRequest(http.MethodDelete, endpoint, nil, "application/json")
+	return err
+}
+
+func (c *Client) GetAccount(accountID string) (*Account, error) {
+	endpoint := fmt.Sprintf("accounts/%s/detail", url.QueryEscape(accountID))
+	responseData, err := c.MakePlainTextRequest(http.MethodGet, endpoint, "")
+	if err != nil {
+		return nil, err
+	}
+	var account Account
+	if err := json.Unmarshal(responseData, &account); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return &account, nil
+}
+
+func (c *Client) IsAccountActive(accountID string) (bool, error) {
+	endpoint := fmt.Sprintf("accounts/%s/active", url.QueryEscape(accountID))
+	responseData, err := c.MakePlainTextRequest(http.MethodGet, endpoint, "")
+	if err != nil {
+		return false, err
+	}
+	// "ok" for active accounts, 204 No Content for inactive ones.
+	return len(responseData) > 0, nil
+}
+
+func (c *Client) SetAccountActive(accountID string, active bool) error {
+	endpoint := fmt.Sprintf("accounts/%s/active", url.QueryEscape(accountID))
+	method := http.MethodPut
+	if !active {
+		method = http.MethodDelete
+	}
+	_, err := c.MakePlainTextRequest(method, endpoint, "")
+	if !active && errors.Is(err, ErrConflict) {
+		// Already inactive
+		return nil
+	}
+	return err
+}
+
+func (c *Client) SetAccountName(accountID, name string) error {
+	endpoint := fmt.Sprintf("accounts/%s/name", url.QueryEscape(accountID))
+	_, err := c.MakeJSONRequest(http.MethodPut, endpoint, map[string]string{"name": name})
+	return err
+}
+
+// SetAccountEmail makes email the preferred address of the account and
+// removes every other address.
+func (c *Client) SetAccountEmail(accountID, email string) error {
+	emails, err := c.ListAccountEmails(accountID)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, e := range emails {
+		if e.Email == email {
+			found = true
+		}
+	}
+	if !found {
+		if err := c.AddAccountEmail(accountID, email, true); err != nil {
+			return err
+		}
+	} else {
+		endpoint := fmt.Sprintf("accounts/%s/emails/%s/preferred", url.QueryEscape(accountID), url.PathEscape(email))
+		if _, err := c.MakePlainTextRequest(http.MethodPut, endpoint, ""); err != nil {
+			return err
+		}
+	}
+	for _, e := range emails {
+		if e.Email == email {
+			continue
+		}
+		if err := c.DeleteAccountEmail(accountID, e.Email); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateGroup creates an internal group visible to all users. It succeeds if
+// the group already exists.
+func (c *Client) CreateGroup(name, description string) (*Group, error) {
+	endpoint := fmt.Sprintf("groups/%s", url.PathEscape(name))
+	payload := map[string]any{
+		"description":    description,
+		"visible_to_all": true,
+	}
+	responseData, err := c.MakeJSONRequest(http.MethodPut, endpoint, payload)
+	if err != nil {
+		if errors.Is(err, ErrConflict) {
+			return c.GetGroup(name)
+		}
+		return nil, err
+	}
+	var group Group
+	if err := json.Unmarshal(responseData, &group); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return &group, nil
+}
+
+func (c *Client) ListGroupMembers(groupID string) ([]*Account, error) {
+	endpoint := fmt.Sprintf("groups/%s/members/", url.QueryEscape(groupID))
+	responseData, err := c.MakePlainTextRequest(http.MethodGet, endpoint, "")
+	if err != nil {
+		return nil, err
+	}
+	var accounts []*Account
+	if err := json.Unmarshal(responseData, &accounts); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return accounts, nil
+}
+
+type SSHKey struct {
+	Seq          int    `json:"seq"`
+	SSHPublicKey string `json:"ssh_public_key"`
+	Algorithm    string `json:"algorithm"`
+	Comment      string `json:"comment,omitempty"`
+	Valid        bool   `json:"valid"`
+}
+
+func (c *Client) ListSSHKeys(accountID string) ([]*SSHKey, error) {
+	endpoint := fmt.Sprintf("accounts/%s/sshkeys", url.QueryEscape(accountID))
+	responseData, err := c.MakePlainTextRequest(http.MethodGet, endpoint, "")
+	if err != nil {
+		return nil, err
+	}
+	var keys []*SSHKey
+	if err := json.Unmarshal(responseData, &keys); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return keys, nil
+}
+
+func (c *Client) DeleteSSHKey(accountID string, seq int) error {
+	endpoint := fmt.Sprintf("accounts/%s/sshkeys/%d", url.QueryEscape(accountID), seq)
+	_, err := c.MakePlainTextRequest(http.MethodDelete, endpoint, "")
+	return err
+}
+
+// GenerateHTTPPassword replaces the HTTP password of the account, used for
+// git over HTTPS and the REST API, with a new random one and returns it.
+func (c *Client) GenerateHTTPPassword(accountID string) (string, error) {
+	endpoint := fmt.Sprintf("accounts/%s/password.http", url.QueryEscape(accountID))
+	responseData, err := c.MakeJSONRequest(http.MethodPut, endpoint, map[string]bool{"generate": true})
+	if err != nil {
+		return "", err
+	}
+	var password string
+	if err := json.Unmarshal(responseData, &password); err != nil {
+		return "", fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return password, nil
+}
+
+// DeleteHTTPPassword removes the HTTP password of the account, so that it
+// can no longer use git over HTTPS or the REST API.
+func (c *Client) DeleteHTTPPassword(accountID string) error {
+	endpoint := fmt.Sprintf("accounts/%s/password.http", url.QueryEscape(accountID))
+	_, err := c.MakePlainTextRequest(http.MethodDelete, endpoint, "")
+	return err
+}
+
+// CreateProject creates a project with an empty initial commit, so that it
+// can be cloned right away.
+func (c *Client) CreateProject(name, description string) (*Project, error) {
+	endpoint := fmt.Sprintf("projects/%s", url.PathEscape(name))
+	payload := map[string]any{
+		"description":         description,
+		"create_empty_commit": true,
+	}
+	responseData, err := c.MakeJSONRequest(http.MethodPut, endpoint, payload)
+	if err != nil {
+		return nil, err
+	}
+	var project Project
+	if err := json.Unmarshal(responseData, &project); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return &project, nil
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The hostname of the last successful start is recorded in the workdir so
+// that a later change of -hostname can be detected and migrated.
+func hostnameFile() string {
+	return filepath.Join(*workdir, "hostname.txt")
+}
+
+func WriteHostnameFile() error {
+	return os.WriteFile(hostnameFile(), []byte(*hostname+"\n"), 0600)
+}
+
+// errNoPreviousHostname is returned by DetectPreviousHostname for a workdir
+// that has never been started.
+var errNoPreviousHostname = errors.New("unable to detect the previous hostname")
+
+// CheckHostname refuses to start with a -hostname different from the one
+// recorded in the workdir, or found in the certificate and OIDC metadata of
+// workdirs from before hostname.txt, because certificates, Keycloak clients
+// and user emails would no longer match.
+func CheckHostname() {
+	previous, err := DetectPreviousHostname()
+	if errors.Is(err, errNoPreviousHostname) {
+		return
+	} else if err != nil {
+		log.Fatalf("Failed to detect the previous hostname: %v", err)
+	}
+	if previous != *hostname {
+		log.Fatalf("-hostname %s differs from the previous hostname %s. Run 'portal rename-host %s' to migrate.",
+			*hostname, previous, *hostname)
+	}
+}
+
+// DetectPreviousHostname looks at hostname.txt first, then falls back to the
+// subject of the certificate and the httpd OIDC metadata files for workdirs
+// created before hostname.txt existed.
+func DetectPreviousHostname() (string, error) {
+	if exists(hostnameFile()) {
+		bytes, err := os.ReadFile(hostnameFile())
+		if err != nil {
+			return "", fmt.Errorf("os.ReadFile(%s): %v", hostnameFile(), err)
+		}
+		return strings.TrimSpace(string(bytes)), nil
+	}
+
+	crtFile := filepath.Join(*workdir, "certs", *nsboxCrtFile)
+	if exists(crtFile) {
+		cert, err := loadCertificate(crtFile)
+		if err != nil {
+			return "", err
+		}
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0], nil
+		}
+		if cert.Subject.CommonName != "" {
+			return cert.Subject.CommonName, nil
+		}
+	}
+
+	const suffix = "%3A9992%2Frealms%2Fnsbox.provider"
+	matches, err := filepath.Glob(filepath.Join(*workdir, "httpd", "metadata", "*"+suffix))
+	if err != nil {
+		return "", err
+	}
+	if len(matches) == 1 {
+		return strings.TrimSuffix(filepath.Base(matches[0]), suffix), nil
+	} else if len(matches) > 1 {
+		return "", fmt.Errorf("found OIDC metadata of several hostnames: %s", strings.Join(matches, ", "))
+	}
+
+	return "", errNoPreviousHostname
+}
+
+func loadCertificate(path string) (*x509.Certificate, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile(%s): %v", path, err)
+	}
+	block, _ := pem.Decode(bytes)
+	if block == nil {
+		return nil, fmt.Errorf("%s does not contain a PEM block", path)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("x509.ParseCertificate(%s): %v", path, err)
+	}
+	return cert, nil
+}
+
+// RenameHost migrates every component from the previous hostname to
+// newHostname, then starts all services, verifies that login works and
+// stops them again.
+func RenameHost(newHostname string) {
+	oldHostname, err := DetectPreviousHostname()
+	if err != nil {
+		log.Fatalf("Failed to detect the previous hostname: %v", err)
+	}
+	if oldHostname == newHostname {
+		log.Printf("The hostname is already %s. Nothing to do.", newHostname)
+		return
+	}
+	log.Printf("Renaming host from %s to %s", oldHostname, newHostname)
+
+	if err := flag.Set("hostname", newHostname); err != nil {
+		log.Fatalf("failed to set hostname: %v", err)
+	}
+
+	if err := ReissueCerts(oldHostname); err != nil {
+		log.Fatalf("Failed to reissue certificates: %v", err)
+	}
+
+	// Keycloak redirect URIs, Gerrit's canonical URL, Buildbot's buildbotURL
+	// and the httpd configuration are all derived from -hostname on start.
+	StartServices()
+
+	err = MigrateHostname(oldHostname, newHostname)
+	if err == nil {
+		err = VerifyLogin()
+	}
+	if err == nil {
+		err = WriteHostnameFile()
+	}
+	if err == nil {
+		RemoveStaleOIDCMetadata(oldHostname)
+	}
+	StopServices()
+	Audit(AuditSystemActor, "host.rename", newHostname, err, "from "+oldHostname)
+	if err != nil {
+		log.Fatalf("Failed to rename host from %s to %s: %v", oldHostname, newHostname, err)
+	}
+	log.Printf("Successfully renamed host from %s to %s", oldHostname, newHostname)
+}
+
+// ReissueCerts moves the key pair aside into the backup directory and
+// generates a new one, unless the existing certificate is already valid for
+// the new hostname (e.g. a wildcard certificate).
+func ReissueCerts(oldHostname string) error {
+	certsDir := filepath.Join(*workdir, "certs")
+	keyFile := filepath.Join(certsDir, *nsboxKeyFile)
+	crtFile := filepath.Join(certsDir, *nsboxCrtFile)
+	if !exists(crtFile) {
+		return nil
+	}
+	cert, err := loadCertificate(crtFile)
+	if err != nil {
+		return err
+	}
+	if cert.VerifyHostname(*hostname) == nil {
+		log.Printf("%s is valid for %s. Skip certificate reissue.", crtFile, *hostname)
+		return nil
+	}
+
+	backupDir := filepath.Join(*workdir, "backup", "certs", oldHostname)
+	if err := os.MkdirAll(backupDir, 0700); err != nil {
+		return fmt.Errorf("os.MkdirAll(%s): %v", backupDir, err)
+	}
+	for _, path := range []string{keyFile, crtFile} {
+		if !exists(path) {
+			continue
+		}
+		dest := filepath.Join(backupDir, filepath.Base(path))
+		if err := os.Rename(path, dest); err != nil {
+			return fmt.Errorf("os.Rename(%s, %s): %v", path, dest, err)
+		}
+		log.Printf("Moved %s to %s", path, dest)
+	}
+	Audit(AuditSystemActor, "cert.reissue", *hostname, nil, "previous certificate moved to "+backupDir)
+	PrepareCerts()
+	return nil
+}
+
+func replaceEmailDomain(email, oldHostname, newHostname string) (string, bool) {
+	if !strings.HasSuffix(email, "@"+oldHostname) {
+		return email, false
+	}
+	return strings.TrimSuffix(email, oldHostname) + newHostname, true
+}
+
+// MigrateHostname rewrites the data that is not regenerated on start: user
+// emails in Keycloak, Redmine and Gerrit, and Redmine settings saved in its
+// database. It keeps going after an error so that a single run fixes as much
+// as possible.
+func MigrateHostname(oldHostname, newHostname string) error {
+	var errs []string
+
+	if err := migrateKeycloakEmails(oldHostname, newHostname); err != nil {
+		errs = append(errs, fmt.Sprintf("Keycloak: %v", err))
+	}
+	if err := RenameRedmineHost(oldHostname, newHostname); err != nil {
+		errs = append(errs, fmt.Sprintf("Redmine settings: %v", err))
+	}
+	if err := migrateRedmineEmails(oldHostname, newHostname); err != nil {
+		errs = append(errs, fmt.Sprintf("Redmine: %v", err))
+	}
+	if err := migrateGerritEmails(oldHostname, newHostname); err != nil {
+		errs = append(errs, fmt.Sprintf("Gerrit: %v", err))
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func migrateKeycloakEmails(oldHostname, newHostname string) error {
+	users, err := ListKeycloakUsers()
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		email, ok := replaceEmailDomain(user.Email, oldHostname, newHostname)
+		if !ok {
+			continue
+		}
+		if err := UpdateKeycloakUserEmail(user.ID, email); err != nil {
+			return err
+		}
+		log.Printf("Keycloak: %s: %s => %s", user.Username, user.Email, email)
+	}
+	return nil
+}
+
+func migrateRedmineEmails(oldHostname, newHostname string) error {
+	users, err := ListRedmineUsers()
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		email, ok := replaceEmailDomain(user.Mail, oldHostname, newHostname)
+		if !ok {
+			continue
+		}
+		if err := UpdateRedmineUser(user.ID, map[string]any{"mail": email}); err != nil {
+			return fmt.Errorf("%s: %v", user.Login, err)
+		}
+		log.Printf("Redmine: %s: %s => %s", user.Login, user.Mail, email)
+	}
+	return nil
+}
+
+func migrateGerritEmails(oldHostname, newHostname string) error {
+	client, err := NewGerritAdminClient()
+	if err != nil {
+		return err
+	}
+	accounts, err := client.QueryAccounts("is:active OR is:inactive")
+	if err != nil {
+		return err
+	}
+	for _, account := range accounts {
+		accountID := strconv.Itoa(account.ID)
+		emails, err := client.ListAccountEmails(accountID)
+		if err != nil {
+			return err
+		}
+		for _, e := range emails {
+			email, ok := replaceEmailDomain(e.Email, oldHostname, newHostname)
+			if !ok {
+				continue
+			}
+			if err := client.AddAccountEmail(accountID, email, e.Preferred); err != nil {
+				return fmt.Errorf("%s: %v", account.Username, err)
+			}
+			if err := client.DeleteAccountEmail(accountID, e.Email); err != nil {
+				return fmt.Errorf("%s: %v", account.Username, err)
+			}
+			log.Printf("Gerrit: %s: %s => %s", account.Username, e.Email, email)
+		}
+	}
+	return nil
+}
+
+func RemoveStaleOIDCMetadata(oldHostname string) {
+	paths := []string{
+		filepath.Join(*workdir, "httpd", "metadata", oldHostname+"%3A9992%2Frealms%2Fnsbox.provider"),
+		filepath.Join(*workdir, "httpd", "metadata", oidcClientFile(oldHostname)),
+	}
+	if dir, err := httpdSecretDir(); err == nil {
+		paths = append(paths, filepath.Join(dir, oidcClientFile(oldHostname)))
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("os.Remove(%s): %v", path, err)
+		}
+	}
+}
+
+// newLoopbackClient returns an HTTP client that connects to 127.0.0.1 for
+// every host but still verifies the TLS certificate against the real
+// hostname, so that it works before DNS is updated.
+func newLoopbackClient() (*http.Client, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	crtFile := filepath.Join(*workdir, "certs", *nsboxCrtFile)
+	crt, err := os.ReadFile(crtFile)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile(%s): %v", crtFile, err)
+	}
+	pool.AppendCertsFromPEM(crt)
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			_, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			return dialer.DialContext(ctx, network, net.JoinHostPort("127.0.0.1", port))
+		},
+	}
+	return &http.Client{
+		Transport: tr,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		Timeout: 30 * time.Second,
+	}, nil
+}
+
+// VerifyLogin walks through the first steps of the OIDC login flow of the
+// portal: the certificate must be valid for the hostname, the portal must
+// redirect to Keycloak under the hostname, and Keycloak must accept the
+// redirect URI of the httpd client.
+func VerifyLogin() error {
+	client, err := newLoopbackClient()
+	if err != nil {
+		return err
+	}
+
+	issuer := "https://" + *hostname + ":9992/realms/nsbox"
+	resp, err := client.Get(issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return fmt.Errorf("failed to fetch openid-configuration: %v", err)
+	}
+	var config struct {
+		Issuer string `json:"issuer"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&config)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to decode openid-configuration: %v", err)
+	}
+	if config.Issuer != issuer {
+		return fmt.Errorf("Keycloak issuer is %s instead of %s", config.Issuer, issuer)
+	}
+
+	var location *url.URL
+	for i := 0; i < 10; i++ {
+		location, err = portalLoginRedirect(client)
+		if err == nil {
+			break
+		}
+		log.Printf("VerifyLogin: %v", err)
+		time.Sleep(3 * time.Second)
+	}
+	if err != nil {
+		return err
+	}
+	if location.Host != *hostname+":9992" || !strings.HasPrefix(location.Path, "/realms/nsbox/") {
+		return fmt.Errorf("portal redirects to %s instead of %s", location, issuer)
+	}
+
+	resp, err = client.Get(location.String())
+	if err != nil {
+		return fmt.Errorf("failed to open the login page: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("login page returned %s: %s", resp.Status, body)
+	}
+
+	log.Printf("Verified login via https://%s:9440/", *hostname)
+	return nil
+}
+
+func portalLoginRedirect(client *http.Client) (*url.URL, error) {
+	resp, err := client.Get("https://" + *hostname + ":9440/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the portal: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		return nil, fmt.Errorf("portal returned %s instead of a redirect to Keycloak", resp.Status)
+	}
+	return resp.Location()
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -50,14 +51,8 @@ func StartHttpd() error {
 }
 
 func InitHttpd() error {
-	confDir := filepath.Join(*workdir, "httpd", "conf.d")
-	err := os.MkdirAll(confDir, 0700)
-	if err != nil {
-		return fmt.Errorf("os.MkdirAll(%s): %v", confDir, err)
-	}
-
 	logsDir := filepath.Join(*workdir, "httpd", "logs")
-	err = os.MkdirAll(logsDir, 0700)
+	err := os.MkdirAll(logsDir, 0700)
 	if err != nil {
 		return fmt.Errorf("os.MkdirAll(%s): %v", logsDir, err)
 	}
@@ -74,13 +69,55 @@ func InitHttpd() error {
 
 func RunHttpd() error {
 	httpdDir := filepath.Join(*workdir, "httpd")
-	confDir := filepath.Join(httpdDir, "conf.d")
 	logsDir := filepath.Join(httpdDir, "logs")
 	metadataDir := filepath.Join(httpdDir, "metadata")
+	brandingDir := filepath.Join(httpdDir, "branding")
 
-	os.MkdirAll(confDir, 0700)
 	os.MkdirAll(logsDir, 0700)
 	os.MkdirAll(metadataDir, 0700)
+	os.MkdirAll(brandingDir, 0755)
+
+	if err := writeOIDCConfig(); err != nil {
+		return err
+	}
+
+	// Generate provider metadata
+	providerPath := filepath.Join(metadataDir, *hostname+"%3A9992%2Frealms%2Fnsbox.provider")
+	err := WriteOpenIDConfiguration(providerPath)
+	if err != nil {
+		return err
+	}
+
+	return PodmanRunHttpd()
+}
+
+// httpdSecretDir is the directory in the runtime directory that is mounted
+// into httpd as /mnt/conf.d.
+func httpdSecretDir() (string, error) {
+	dir, err := secretRuntimeDir()
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, "httpd")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("os.MkdirAll(%s): %v", dir, err)
+	}
+	return dir, nil
+}
+
+// oidcClientFile is the name of the client metadata of mod_auth_openidc.
+func oidcClientFile(hostname string) string {
+	return hostname + "%3A9992%2Frealms%2Fnsbox.client"
+}
+
+// writeOIDCConfig writes the configuration of mod_auth_openidc with the
+// secret of the httpd client, x0auth_openidc.conf and the client metadata,
+// into the runtime directory. httpd reads them when it starts.
+func writeOIDCConfig() error {
+	secretDir, err := httpdSecretDir()
+	if err != nil {
+		return err
+	}
 
 	// Generate x0auth_openidc.conf
 	passphrase, err := GenerateOIDCCryptoPassphrase(80)
@@ -111,17 +148,13 @@ OIDCCacheFileCleanInterval 72000
 OIDCDiscoverURL "https://%s:8443/discover.html"
 OIDCDefaultURL "https://%s:8443/index.html"
 OIDCRemoteUserClaim "preferred_username"
-`, passphrase, clientSecret, *hostname, *hostname, *hostname)
-
-	oidcConf := filepath.Join(confDir, "x0auth_openidc.conf")
-	err = os.WriteFile(oidcConf, []byte(confStr), 0600)
-	if err != nil {
-		return err
-	}
+OIDCRefreshAccessTokenBeforeExpiry 60 authenticate_on_error
+Define PORTAL_UPSTREAM "%s"
+Define PORTAL_URL "%s"
+`, passphrase, clientSecret, *hostname, *hostname, *hostname, portalUpstream(), portalURL())
 
-	// Generate metadata
-	providerPath := filepath.Join(metadataDir, *hostname+"%3A9992%2Frealms%2Fnsbox.provider")
-	err = WriteOpenIDConfiguration(providerPath)
+	oidcConf := filepath.Join(secretDir, "x0auth_openidc.conf")
+	err = writeSecretFile(oidcConf, confStr)
 	if err != nil {
 		return err
 	}
@@ -133,13 +166,37 @@ OIDCRemoteUserClaim "preferred_username"
 }
 `, clientSecret)
 
-	clientPath := filepath.Join(metadataDir, *hostname+"%3A9992%2Frealms%2Fnsbox.client")
-	err = os.WriteFile(clientPath, []byte(clientStr), 0600)
+	clientPath := filepath.Join(secretDir, oidcClientFile(*hostname))
+	err = writeSecretFile(clientPath, clientStr)
 	if err != nil {
 		return err
 	}
 
-	return PodmanRunHttpd()
+	// Older versions wrote both files into the workdir.
+	for _, path := range []string{
+		filepath.Join(*workdir, "httpd", "conf.d", "x0auth_openidc.conf"),
+		filepath.Join(*workdir, "httpd", "metadata", oidcClientFile(*hostname)),
+	} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func portalURL() string {
+	if *listenUnix {
+		return "http://localhost/"
+	}
+	return "http://localhost:7777/"
+}
+
+// portalUpstream is where httpd forwards requests for the portal.
+func portalUpstream() string {
+	if *listenUnix {
+		return "unix:/run/portal/portal.sock|" + portalURL()
+	}
+	return portalURL()
 }
 
 func PodmanRunHttpd() error {
@@ -152,17 +209,27 @@ func PodmanRunHttpd() error {
 
 	certsDir := filepath.Join(*workdir, "certs")
 	httpdDir := filepath.Join(*workdir, "httpd")
-	confDir := filepath.Join(httpdDir, "conf.d")
+	secretDir, err := httpdSecretDir()
+	if err != nil {
+		return err
+	}
 	logsDir := filepath.Join(httpdDir, "logs")
 	metadataDir := filepath.Join(httpdDir, "metadata")
+	brandingDir := filepath.Join(httpdDir, "branding")
+	socketDir := portalSocketDir()
+	if err := makePortalSocketDir(); err != nil {
+		return err
+	}
 
 	// Start the container
 	httpdCmd = exec.Command("podman", "run", "--rm",
 		"--name", "httpd", "--replace",
 		"-v", certsDir+":/certs",
 		"-v", logsDir+":/etc/httpd/logs",
-		"-v", confDir+":/mnt/conf.d",
+		"-v", secretDir+":/mnt/conf.d:ro",
 		"-v", metadataDir+":/var/cache/httpd/mod_auth_openidc/metadata:O",
+		"-v", socketDir+":/run/portal",
+		"-v", brandingDir+":/var/www/html/branding:ro",
 		"--network=host",
 		*httpdImage,
 		"/usr/local/bin/run_httpd", "--hostname", *hostname)
@@ -212,8 +279,7 @@ func GenerateOIDCCryptoPassphrase(length int) (string, error) {
 }
 
 func LoadHttpdClientSecret() (string, error) {
-	path := filepath.Join(*workdir, "keycloak", "client_secret.json")
-	data, err := os.ReadFile(path)
+	data, err := ReadSecret(secretHttpdClient)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+httpd passes the OIDC access token of the signed-in user to the portal in
+the X-Access-Token header. The portal verifies its signature against the
+JWKS of the nsbox realm and takes the username and the roles from the
+verified claims, overwriting X-Remote-User and X-Remote-Roles, so that no
+other process that can reach the portal can impersonate a user. httpd
+refreshes the access token before it expires, so unlike the ID token it
+stays valid for the whole session.
+*/
+
+var verifyToken = flag.Bool("verify_token", true, "Verify the access token passed by httpd instead of trusting X-Remote-User")
+var listenUnix = flag.Bool("listen_unix", false, "Listen on a unix socket shared with httpd instead of -bind:7777")
+
+// The audience that access tokens must have, added by a protocol mapper of
+// the httpd client.
+const tokenAudience = "httpd"
+
+// Tolerated clock difference between Keycloak and the portal.
+const tokenLeeway = 30 * time.Second
+
+func portalSocketDir() string {
+	return filepath.Join(*workdir, "portal", "socket")
+}
+
+// makePortalSocketDir creates the directory of the socket. The portal trusts
+// X-Remote-User and X-Remote-Roles from whoever connects, so only the group
+// of the portal may. apache inside the container runs as a different user,
+// but in the group that the group of the portal is mapped to (see
+// httpd/Containerfile).
+func makePortalSocketDir() error {
+	dir := portalSocketDir()
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return fmt.Errorf("os.MkdirAll(%s): %v", dir, err)
+	}
+	if err := os.Chmod(dir, 0750); err != nil {
+		return fmt.Errorf("os.Chmod(%s): %v", dir, err)
+	}
+	return nil
+}
+
+func portalSocket() string {
+	return filepath.Join(portalSocketDir(), "portal.sock")
+}
+
+func tokenIssuer() string {
+	return fmt.Sprintf("https://%s:9992/realms/nsbox", *hostname)
+}
+
+type jwksCache struct {
+	mutex   sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+var realmKeys jwksCache
+
+// key returns the public key with the given ID. Keycloak may rotate its
+// keys, so an unknown ID causes the JWKS to be fetched again, but at most
+// every 30 seconds.
+func (c *jwksCache) key(kid string) (*rsa.PublicKey, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if key, ok := c.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(c.fetched) < 30*time.Second {
+		return nil, fmt.Errorf("unknown key ID: %s", kid)
+	}
+	c.fetched = time.Now()
+	keys, err := fetchRealmKeys()
+	if err != nil {
+		return nil, err
+	}
+	c.keys = keys
+	if key, ok := c.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key ID: %s", kid)
+}
+
+func getJSON(client *http.Client, url string, v any) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func fetchRealmKeys() (map[string]*rsa.PublicKey, error) {
+	client, err := newLoopbackClient()
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := getJSON(client, tokenIssuer()+"/.well-known/openid-configuration", &config); err != nil {
+		return nil, err
+	}
+	if config.Issuer != tokenIssuer() {
+		return nil, fmt.Errorf("unexpected issuer %s (not %s)", config.Issuer, tokenIssuer())
+	}
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := getJSON(client, config.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || k.Use != "sig" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %v", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %v", k.Kid, err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	log.Printf("Fetched %d signing keys of the nsbox realm", len(keys))
+	return keys, nil
+}
+
+// audience is the aud claim, which is either a string or an array.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var ss []string
+	if err := json.Unmarshal(data, &ss); err != nil {
+		return err
+	}
+	*a = ss
+	return nil
+}
+
+type TokenClaims struct {
+	Issuer            string   `json:"iss"`
+	Type              string   `json:"typ"`
+	Audience          audience `json:"aud"`
+	Expiry            int64    `json:"exp"`
+	NotBefore         int64    `json:"nbf"`
+	PreferredUsername string   `json:"preferred_username"`
+	Roles             []string `json:"roles"`
+	SessionID         string   `json:"sid"`
+}
+
+// VerifyToken checks the signature, issuer, type, audience and validity
+// period of an access token signed with RS256 by the nsbox realm and
+// returns its claims.
+func VerifyToken(token string) (*TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token header: %v", err)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %v", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported algorithm: %s", header.Alg)
+	}
+	key, err := realmKeys.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %v", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, fmt.Errorf("invalid token signature: %v", err)
+	}
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token claims: %v", err)
+	}
+	var claims TokenClaims
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %v", err)
+	}
+	if claims.Issuer != tokenIssuer() {
+		return nil, fmt.Errorf("unexpected issuer: %s", claims.Issuer)
+	}
+	// Keycloak signs its ID tokens with the same keys, and these may have
+	// the httpd client as audience too.
+	if claims.Type != "Bearer" {
+		return nil, fmt.Errorf("not an access token: typ %q", claims.Type)
+	}
+	found := false
+	for _, aud := range claims.Audience {
+		if aud == tokenAudience {
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("unexpected audience: %v", claims.Audience)
+	}
+	now := time.Now()
+	if claims.Expiry == 0 || now.After(time.Unix(claims.Expiry, 0).Add(tokenLeeway)) {
+		return nil, errors.New("token expired")
+	}
+	if claims.NotBefore != 0 && now.Add(tokenLeeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return nil, errors.New("token not valid yet")
+	}
+	if claims.PreferredUsername == "" {
+		return nil, errors.New("token has no preferred_username")
+	}
+	return &claims, nil
+}
+
+// authenticate replaces the identity headers set by httpd with the claims
+// of the verified access token, and rejects requests without a valid one.
+// The API authenticates its own requests with API tokens.
+func authenticate(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, apiPrefix) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		token := r.Header.Get("X-Access-Token")
+		r.Header.Del("X-Access-Token")
+		r.Header.Del("X-Remote-User")
+		r.Header.Del("X-Remote-Roles")
+		r.Header.Del("X-Remote-Session")
+		if token == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		claims, err := VerifyToken(token)
+		if err != nil {
+			log.Printf("Rejected %s %s: %v", r.Method, r.URL.Path, err)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		r.Header.Set("X-Remote-User", claims.PreferredUsername)
+		r.Header.Set("X-Remote-Roles", strings.Join(claims.Roles, ","))
+		r.Header.Set("X-Remote-Session", claims.SessionID)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// ServePortal serves the registered handlers on -bind:7777 or, with
+// -listen_unix, on a unix socket in a directory that is only mounted into
+// the httpd container.
+func ServePortal() error {
+	handler := protect(http.DefaultServeMux)
+	if *verifyToken {
+		handler = authenticate(handler)
+	} else {
+		log.Printf("WARNING: trusting X-Remote-User without verification")
+	}
+
+	if !*listenUnix {
+		return http.ListenAndServe(*bindIP+":7777", handler)
+	}
+	if err := makePortalSocketDir(); err != nil {
+		return err
+	}
+	_ = os.Remove(portalSocket())
+	listener, err := net.Listen("unix", portalSocket())
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(portalSocket(), 0660); err != nil {
+		return fmt.Errorf("os.Chmod(%s): %v", portalSocket(), err)
+	}
+	log.Printf("Listening on %s", portalSocket())
+	return http.Serve(listener, handler)
+}
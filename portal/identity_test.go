@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func signToken(t *testing.T, key *rsa.PrivateKey, header, claims map[string]any) string {
+	encode := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(header) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerifyToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	realmKeys.mutex.Lock()
+	realmKeys.keys = map[string]*rsa.PublicKey{"k1": &key.PublicKey}
+	// Unknown key IDs must not make the test fetch the JWKS.
+	realmKeys.fetched = time.Now().Add(time.Hour)
+	realmKeys.mutex.Unlock()
+	t.Cleanup(func() {
+		realmKeys.mutex.Lock()
+		realmKeys.keys = nil
+		realmKeys.fetched = time.Time{}
+		realmKeys.mutex.Unlock()
+	})
+
+	now := time.Now()
+	header := func(alg, kid string) map[string]any {
+		return map[string]any{"alg": alg, "kid": kid, "typ": "JWT"}
+	}
+	claims := func(change func(c map[string]any)) map[string]any {
+		c := map[string]any{
+			"iss":                tokenIssuer(),
+			"typ":                "Bearer",
+			"aud":                []string{"account", tokenAudience},
+			"exp":                now.Add(5 * time.Minute).Unix(),
+			"nbf":                now.Add(-time.Minute).Unix(),
+			"preferred_username": "alice",
+			"roles":              []string{RoleUserManager},
+		}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+	valid := signToken(t, key, header("RS256", "k1"), claims(nil))
+	parts := strings.Split(valid, ".")
+
+	tests := []struct {
+		name  string
+		token string
+		err   string // empty if the token is valid
+	}{
+		{"valid", valid, ""},
+		{"string audience", signToken(t, key, header("RS256", "k1"), claims(func(c map[string]any) {
+			c["aud"] = tokenAudience
+		})), ""},
+		{"malformed", "abc.def", "malformed token"},
+		{"alg none", base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"k1"}`)) + "." + parts[1] + ".",
+			"unsupported algorithm: none"},
+		{"alg HS256", base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","kid":"k1"}`)) + "." + parts[1] + "." + parts[2],
+			"unsupported algorithm: HS256"},
+		{"unknown kid", signToken(t, key, header("RS256", "k2"), claims(nil)), "unknown key ID: k2"},
+		{"signed with another key", signToken(t, otherKey, header("RS256", "k1"), claims(nil)), "invalid token signature"},
+		{"changed claims", parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"preferred_username":"admin"}`)) + "." + parts[2],
+			"invalid token signature"},
+		{"wrong issuer", signToken(t, key, header("RS256", "k1"), claims(func(c map[string]any) {
+			c["iss"] = "https://evil.example.com:9992/realms/nsbox"
+		})), "unexpected issuer"},
+		{"ID token", signToken(t, key, header("RS256", "k1"), claims(func(c map[string]any) {
+			c["typ"] = "ID"
+			c["aud"] = tokenAudience
+		})), "not an access token"},
+		{"no type", signToken(t, key, header("RS256", "k1"), claims(func(c map[string]any) {
+			delete(c, "typ")
+		})), "not an access token"},
+		{"wrong audience", signToken(t, key, header("RS256", "k1"), claims(func(c map[string]any) {
+			c["aud"] = []string{"account"}
+		})), "unexpected audience"},
+		{"no expiry", signToken(t, key, header("RS256", "k1"), claims(func(c map[string]any) {
+			delete(c, "exp")
+		})), "token expired"},
+		{"expired within leeway", signToken(t, key, header("RS256", "k1"), claims(func(c map[string]any) {
+			c["exp"] = now.Add(-tokenLeeway + 5*time.Second).Unix()
+		})), ""},
+		{"expired", signToken(t, key, header("RS256", "k1"), claims(func(c map[string]any) {
+			c["exp"] = now.Add(-tokenLeeway - 5*time.Second).Unix()
+		})), "token expired"},
+		{"not yet valid within leeway", signToken(t, key, header("RS256", "k1"), claims(func(c map[string]any) {
+			c["nbf"] = now.Add(tokenLeeway - 5*time.Second).Unix()
+		})), ""},
+		{"not yet valid", signToken(t, key, header("RS256", "k1"), claims(func(c map[string]any) {
+			c["nbf"] = now.Add(tokenLeeway + 5*time.Second).Unix()
+		})), "token not valid yet"},
+		{"no username", signToken(t, key, header("RS256", "k1"), claims(func(c map[string]any) {
+			delete(c, "preferred_username")
+		})), "token has no preferred_username"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := VerifyToken(tt.token)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("VerifyToken() error = %v", err)
+				}
+				if got.PreferredUsername != "alice" || len(got.Roles) != 1 || got.Roles[0] != RoleUserManager {
+					t.Errorf("VerifyToken() = %+v", got)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("VerifyToken() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+/*
+Bulk import of users from CSV or LDIF.
+
+CSV columns are username, first name, last name, email and groups, where
+groups are separated by semicolons. A header row starting with "username" is
+skipped, as are lines starting with '#'. An empty email means the address
+from -email_template.
+
+LDIF entries use uid, givenName, sn, mail and memberOf (the first RDN value of
+each memberOf DN is the group name).
+*/
+
+type ImportRecord struct {
+	Line      int
+	Username  string
+	FirstName string
+	LastName  string
+	Email     string
+	Groups    []string
+}
+
+// Planned actions of an import
+const (
+	ImportCreate = "create"
+	ImportSkip   = "skip"
+)
+
+type ImportItem struct {
+	Record *ImportRecord
+	Action string
+	Reason string
+
+	// Filled in by RunImport
+	ProvisioningID string
+	Password       string
+	Err            error
+}
+
+var validUsername = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// ParseImport parses CSV or LDIF. An empty format is detected from the
+// content.
+func ParseImport(data []byte, format string) ([]*ImportRecord, error) {
+	// Spreadsheets often save CSV with a byte order mark.
+	data = bytes.TrimPrefix(data, []byte("\ufeff"))
+	if format == "" {
+		format = detectImportFormat(data)
+	}
+	switch format {
+	case "csv":
+		return parseImportCSV(data)
+	case "ldif":
+		return parseImportLDIF(data)
+	default:
+		return nil, fmt.Errorf("unknown import format: %s", format)
+	}
+}
+
+func detectImportFormat(data []byte) string {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lower := strings.ToLower(line)
+		if strings.HasPrefix(lower, "dn:") || strings.HasPrefix(lower, "version:") {
+			return "ldif"
+		}
+		return "csv"
+	}
+	return "csv"
+}
+
+func parseImportCSV(data []byte) ([]*ImportRecord, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+
+	var records []*ImportRecord
+	for {
+		fields, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := r.FieldPos(0)
+		if len(records) == 0 && strings.EqualFold(strings.TrimSpace(fields[0]), "username") {
+			continue
+		}
+		for len(fields) < 5 {
+			fields = append(fields, "")
+		}
+		if len(fields) > 5 {
+			return nil, fmt.Errorf("line %d: expected at most 5 fields, got %d", line, len(fields))
+		}
+		records = append(records, &ImportRecord{
+			Line:      line,
+			Username:  strings.TrimSpace(fields[0]),
+			FirstName: strings.TrimSpace(fields[1]),
+			LastName:  strings.TrimSpace(fields[2]),
+			Email:     strings.TrimSpace(fields[3]),
+			Groups:    splitGroups(fields[4]),
+		})
+	}
+	return records, nil
+}
+
+func splitGroups(s string) []string {
+	var groups []string
+	for _, g := range strings.Split(s, ";") {
+		if g = strings.TrimSpace(g); g != "" {
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
+
+func parseImportLDIF(data []byte) ([]*ImportRecord, error) {
+	var records []*ImportRecord
+	var entry *ImportRecord
+	var hasDN bool
+
+	flush := func() {
+		// Entries without uid are groups or organizational units.
+		if entry != nil && hasDN && entry.Username != "" {
+			records = append(records, entry)
+		}
+		entry = nil
+		hasDN = false
+	}
+
+	// Unfold continuation lines (starting with a single space) first.
+	var lines []string
+	var lineNumbers []int
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.HasPrefix(line, " ") && len(lines) > 0 && lines[len(lines)-1] != "" {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+		lineNumbers = append(lineNumbers, n)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, line := range lines {
+		if line == "" {
+			flush()
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			return nil, fmt.Errorf("line %d: missing ':'", lineNumbers[i])
+		}
+		attr := strings.ToLower(line[:colon])
+		value := line[colon+1:]
+		if strings.HasPrefix(value, ":") {
+			decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value[1:]))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNumbers[i], err)
+			}
+			value = string(decoded)
+		} else {
+			value = strings.TrimSpace(value)
+		}
+
+		if attr == "version" && entry == nil {
+			continue
+		}
+		if entry == nil {
+			entry = &ImportRecord{Line: lineNumbers[i]}
+		}
+		switch attr {
+		case "dn":
+			hasDN = true
+		case "uid":
+			entry.Username = value
+		case "givenname":
+			entry.FirstName = value
+		case "sn":
+			entry.LastName = value
+		case "mail":
+			if entry.Email == "" {
+				entry.Email = value
+			}
+		case "memberof":
+			rdn := strings.SplitN(value, ",", 2)[0]
+			if eq := strings.Index(rdn, "="); eq >= 0 {
+				entry.Groups = append(entry.Groups, strings.TrimSpace(rdn[eq+1:]))
+			}
+		}
+	}
+	flush()
+	return records, nil
+}
+
+// PlanImport decides which records will be created. Invalid records,
+// duplicates and users that already exist are skipped.
+func PlanImport(records []*ImportRecord) []*ImportItem {
+	seen := map[string]bool{}
+	var items []*ImportItem
+	for _, rec := range records {
+		item := &ImportItem{Record: rec, Action: ImportSkip}
+		items = append(items, item)
+		switch {
+		case !validUsername.MatchString(rec.Username):
+			item.Reason = "invalid username"
+		case rec.FirstName == "" || rec.LastName == "":
+			item.Reason = "first and last names are required"
+		case rec.Email != "" && CheckEmail(rec.Email) != nil:
+			item.Reason = CheckEmail(rec.Email).Error()
+		case seen[rec.Username]:
+			item.Reason = "duplicate username"
+		default:
+			if err := CheckUsernameAvailable(rec.Username); err != nil {
+				item.Reason = err.Error()
+			} else {
+				item.Action = ImportCreate
+			}
+		}
+		seen[rec.Username] = true
+	}
+	return items
+}
+
+// skipGroupsNotManageable skips the records that would add users to groups
+// that grant roles the importing user lacks, see CheckCanManageGroup.
+func skipGroupsNotManageable(r *http.Request, items []*ImportItem) {
+	for _, item := range items {
+		if item.Action != ImportCreate {
+			continue
+		}
+		for _, group := range item.Record.Groups {
+			if err := CheckCanManageGroup(r, group); err != nil {
+				item.Action = ImportSkip
+				item.Reason = err.Error()
+				break
+			}
+		}
+	}
+}
+
+// RunImport provisions every item planned for creation, one at a time.
+func RunImport(actor string, items []*ImportItem) {
+	for _, item := range items {
+		if item.Action != ImportCreate {
+			continue
+		}
+		rec := item.Record
+		p, err := NewProvisioning(actor, rec.Username, rec.FirstName, rec.LastName, rec.Email, rec.Groups)
+		if err != nil {
+			item.Err = err
+			continue
+		}
+		item.ProvisioningID = p.ID
+		item.Err = p.Run()
+		if item.Err == nil {
+			item.Password = p.Password()
+		}
+	}
+}
+
+// WriteImportReport writes one CSV row per record.
+func WriteImportReport(w io.Writer, items []*ImportItem) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"line", "username", "first_name", "last_name", "email", "groups",
+		"result", "password", "provisioning_id", "details"})
+	for _, item := range items {
+		rec := item.Record
+		result, details := importResult(item)
+		cw.Write([]string{fmt.Sprint(rec.Line), rec.Username, rec.FirstName, rec.LastName,
+			rec.Email, strings.Join(rec.Groups, ";"), result, item.Password,
+			item.ProvisioningID, details})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func importResult(item *ImportItem) (string, string) {
+	switch {
+	case item.Action == ImportSkip:
+		return "skipped", item.Reason
+	case item.Err != nil:
+		return "failed", item.Err.Error()
+	case item.ProvisioningID == "":
+		return "will be created", ""
+	default:
+		return "created", ""
+	}
+}
+
+// importResults is the data of the import preview and report pages.
+type importResults struct {
+	Preview   bool
+	Rows      []importRow
+	Format    string
+	Raw       string
+	ReportURL template.URL
+}
+
+type importRow struct {
+	Line                                                     int
+	Username, Name, Email, Groups, Result, Password, Details string
+}
+
+func importRows(items []*ImportItem) []importRow {
+	var rows []importRow
+	for _, item := range items {
+		rec := item.Record
+		result, details := importResult(item)
+		rows = append(rows, importRow{
+			rec.Line, rec.Username, rec.FirstName + " " + rec.LastName, rec.Email,
+			strings.Join(rec.Groups, ", "), result, item.Password, details,
+		})
+	}
+	return rows
+}
+
+func handleImportUsers(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	render(w, r, "import", "Import users", nil)
+}
+
+// readImportForm returns the uploaded file, or the pasted content if no file
+// was uploaded.
+func readImportForm(r *http.Request) ([]byte, string, error) {
+	if err := r.ParseMultipartForm(10 << 20); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		return nil, "", err
+	}
+	format := r.FormValue("format")
+	file, _, err := r.FormFile("file")
+	if err == nil {
+		defer file.Close()
+		data, err := io.ReadAll(file)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(bytes.TrimSpace(data)) > 0 {
+			return data, format, nil
+		}
+	} else if !errors.Is(err, http.ErrMissingFile) && !errors.Is(err, http.ErrNotMultipart) {
+		return nil, "", err
+	}
+	return []byte(r.FormValue("data")), format, nil
+}
+
+func handlePreviewImport(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodPost) {
+		return
+	}
+	data, format, err := readImportForm(r)
+	if err != nil {
+		http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	records, err := ParseImport(data, format)
+	if err != nil {
+		http.Error(w, "Failed to parse: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	items := PlanImport(records)
+	skipGroupsNotManageable(r, items)
+	render(w, r, "import_result", "Import preview", &importResults{
+		Preview: true,
+		Rows:    importRows(items),
+		Format:  format,
+		Raw:     string(data),
+	})
+}
+
+func handleRunImport(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodPost) {
+		return
+	}
+	data, format, err := readImportForm(r)
+	if err != nil {
+		http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	records, err := ParseImport(data, format)
+	if err != nil {
+		http.Error(w, "Failed to parse: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	items := PlanImport(records)
+	skipGroupsNotManageable(r, items)
+	RunImport(r.Header.Get("X-Remote-User"), items)
+
+	var report bytes.Buffer
+	if err := WriteImportReport(&report, items); err != nil {
+		http.Error(w, "Failed to write report: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The report contains initial passwords, so it is only offered as a
+	// download from this page and never stored on the server.
+	render(w, r, "import_result", "Import report", &importResults{
+		Rows:      importRows(items),
+		ReportURL: template.URL("data:text/csv;base64," + base64.StdEncoding.EncodeToString(report.Bytes())),
+	})
+}
+
+// ImportUsersCommand implements 'portal import-users', which talks to the
+// services started by a running portal.
+func ImportUsersCommand(args []string) {
+	fs := flag.NewFlagSet("import-users", flag.ExitOnError)
+	format := fs.String("format", "", "csv or ldif (default: detect)")
+	dryRun := fs.Bool("dry_run", false, "Only print what would be created or skipped")
+	reportFile := fs.String("report", "", "Write the CSV report to this file instead of stdout")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: portal [flags] import-users [-format csv|ldif] [-dry_run] [-report FILE] FILE")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("os.ReadFile(%s): %v", fs.Arg(0), err)
+	}
+	if *format == "" {
+		switch {
+		case strings.HasSuffix(fs.Arg(0), ".ldif"):
+			*format = "ldif"
+		case strings.HasSuffix(fs.Arg(0), ".csv"):
+			*format = "csv"
+		}
+	}
+	records, err := ParseImport(data, *format)
+	if err != nil {
+		log.Fatalf("Failed to parse %s: %v", fs.Arg(0), err)
+	}
+	items := PlanImport(records)
+	if !*dryRun {
+		RunImport("admin", items)
+	}
+
+	out := os.Stdout
+	if *reportFile != "" {
+		out, err = os.OpenFile(*reportFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			log.Fatalf("Failed to create %s: %v", *reportFile, err)
+		}
+		defer out.Close()
+	}
+	if err := WriteImportReport(out, items); err != nil {
+		log.Fatalf("Failed to write report: %v", err)
+	}
+}
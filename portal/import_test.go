@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseImportCSV(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []*ImportRecord
+	}{
+		{
+			name: "header and comments",
+			data: "username,first name,last name,email,groups\n" +
+				"# a comment\n" +
+				"alice,Alice,Liddell,alice@example.com,dev;qa\n",
+			want: []*ImportRecord{
+				{Line: 3, Username: "alice", FirstName: "Alice", LastName: "Liddell",
+					Email: "alice@example.com", Groups: []string{"dev", "qa"}},
+			},
+		},
+		{
+			name: "quoting",
+			data: `bob, "Bob, Jr.","O""Brien",,"dev; ops"` + "\n",
+			want: []*ImportRecord{
+				{Line: 1, Username: "bob", FirstName: "Bob, Jr.", LastName: `O"Brien`,
+					Groups: []string{"dev", "ops"}},
+			},
+		},
+		{
+			name: "byte order mark",
+			data: "\ufeffusername,first,last\ncarol,Carol,Danvers\n",
+			want: []*ImportRecord{
+				{Line: 2, Username: "carol", FirstName: "Carol", LastName: "Danvers"},
+			},
+		},
+		{
+			name: "missing columns",
+			data: "dave,Dave\r\neve\r\n",
+			want: []*ImportRecord{
+				{Line: 1, Username: "dave", FirstName: "Dave"},
+				{Line: 2, Username: "eve"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseImport([]byte(tt.data), "csv")
+			if err != nil {
+				t.Fatalf("ParseImport() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseImport() = %s, want %s", formatRecords(got), formatRecords(tt.want))
+			}
+		})
+	}
+}
+
+func TestParseImportCSVErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"too many columns", "frank,Frank,Castle,frank@example.com,dev,extra\n"},
+		{"unterminated quote", "grace,\"Grace,Hopper\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := ParseImport([]byte(tt.data), "csv"); err == nil {
+				t.Errorf("ParseImport() = %s, want an error", formatRecords(got))
+			}
+		})
+	}
+}
+
+func TestParseImportLDIF(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []*ImportRecord
+	}{
+		{
+			name: "entries",
+			data: "version: 1\n" +
+				"\n" +
+				"dn: ou=people,dc=example,dc=com\n" +
+				"ou: people\n" +
+				"\n" +
+				"# alice\n" +
+				"dn: uid=alice,ou=people,dc=example,dc=com\n" +
+				"uid: alice\n" +
+				"givenName: Alice\n" +
+				"sn: Liddell\n" +
+				"mail: alice@example.com\n" +
+				"mail: alice@old.example.com\n" +
+				"memberOf: cn=dev,ou=groups,dc=example,dc=com\n" +
+				"memberOf: cn=qa,ou=groups,dc=example,dc=com\n",
+			want: []*ImportRecord{
+				{Line: 7, Username: "alice", FirstName: "Alice", LastName: "Liddell",
+					Email: "alice@example.com", Groups: []string{"dev", "qa"}},
+			},
+		},
+		{
+			name: "base64 values",
+			// "Zoë" and "Ångström"
+			data: "dn: uid=zoe,dc=example,dc=com\n" +
+				"uid: zoe\n" +
+				"givenName:: Wm/Dqw==\n" +
+				"sn:: w4VuZ3N0csO2bQ==\n",
+			want: []*ImportRecord{
+				{Line: 1, Username: "zoe", FirstName: "Zoë", LastName: "Ångström"},
+			},
+		},
+		{
+			name: "folded lines",
+			data: "dn: uid=bob,ou=people,\n" +
+				" dc=example,dc=com\n" +
+				"uid: bob\n" +
+				"givenName: Bob\n" +
+				"sn: Build\n" +
+				" er\n" +
+				"mail:: Ym9iQGV4YW1w\n" +
+				" bGUuY29t\n" +
+				"memberOf: cn=o\r\n" +
+				" ps,dc=example,dc=com\r\n",
+			want: []*ImportRecord{
+				{Line: 1, Username: "bob", FirstName: "Bob", LastName: "Builder",
+					Email: "bob@example.com", Groups: []string{"ops"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseImport([]byte(tt.data), "")
+			if err != nil {
+				t.Fatalf("ParseImport() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseImport() = %s, want %s", formatRecords(got), formatRecords(tt.want))
+			}
+		})
+	}
+}
+
+func TestParseImportLDIFErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"missing colon", "dn: uid=alice,dc=example,dc=com\nuid alice\n"},
+		{"bad base64", "dn: uid=alice,dc=example,dc=com\nuid:: not base64!\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := ParseImport([]byte(tt.data), "ldif"); err == nil {
+				t.Errorf("ParseImport() = %s, want an error", formatRecords(got))
+			}
+		})
+	}
+}
+
+func formatRecords(records []*ImportRecord) string {
+	var s []string
+	for _, r := range records {
+		s = append(s, fmt.Sprintf("%+v", *r))
+	}
+	return "[" + strings.Join(s, " ") + "]"
+}
@@ -1,20 +1,24 @@
 package main
 
 import (
-	"bytes"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
+
+	"naive.systems/box/portal/keycloak"
 )
 
 var defaultKeycloakImage = "naive.systems/box/keycloak:dev"
@@ -22,6 +26,7 @@ var keycloakImage = flag.String("keycloak_image", defaultKeycloakImage, "")
 
 var keycloakHTTPSAddr = flag.String("keycloak_https_addr", "0.0.0.0:9992", "")
 var keycloakManagementAddr = flag.String("keycloak_management_addr", "0.0.0.0:9000", "")
+var keycloakSMTPRelay = flag.String("keycloak_smtp_relay", "", "host:port of the SMTP relay as seen from the keycloak container (default: -smtp_relay, with 0.0.0.0 replaced by host.containers.internal)")
 
 var keycloakCmd *exec.Cmd
 
@@ -72,10 +77,15 @@ func StartKeycloak() {
 		}
 		RunKeycloak()
 		WaitKeycloakUp()
-		UpdateKeycloakRedirectURIs()
 	} else {
 		InstallAndRunKeycloak()
 	}
+	if err := ApplyRealmConfig(); err != nil {
+		log.Fatalf("Failed to apply %s: %v", realmConfigPath(), err)
+	}
+	if err := GrantKeycloakAdminRole(); err != nil {
+		log.Fatalf("Failed to grant the admin user the %s role: %v", RoleAdmin, err)
+	}
 }
 
 func InstallAndRunKeycloak() {
@@ -153,15 +163,26 @@ func ExtractKeycloak() {
 	}
 }
 
+// InitKeycloak creates the nsbox realm and the admin user with the temporary
+// password "admin". The rest of the realm is set up from realm.json.
 func InitKeycloak() {
-	cmd := exec.Command("podman", "exec", "keycloak",
-		"/home/keycloak/init", "--hostname", *hostname)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
+	kc, err := KeycloakAdminClient()
 	if err != nil {
 		log.Fatalf("Failed to initialize Keycloak: %v", err)
 	}
+	if err := kc.CreateRealm(); err != nil && !errors.Is(err, keycloak.ErrConflict) {
+		log.Fatalf("Failed to create the nsbox realm: %v", err)
+	}
+	_, err = kc.CreateUser(&keycloak.User{
+		Username:      "admin",
+		Enabled:       true,
+		FirstName:     "Administrator",
+		Email:         DefaultEmail("admin"),
+		EmailVerified: true,
+	}, &keycloak.Credential{Type: "password", Value: "admin", Temporary: true})
+	if err != nil && !errors.Is(err, keycloak.ErrConflict) {
+		log.Fatalf("Failed to create the admin user: %v", err)
+	}
 }
 
 func UpgradeKeycloak() {
@@ -204,17 +225,6 @@ func RunKeycloak() {
 	}
 }
 
-func UpdateKeycloakRedirectURIs() {
-	cmd := exec.Command("podman", "exec", "keycloak",
-		"/home/keycloak/update_redirect_uris", "--hostname", *hostname)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
-	if err != nil {
-		log.Fatalf("Failed to update Keycloak redirectUris: %v", err)
-	}
-}
-
 func StopKeycloak() {
 	err := keycloakCmd.Process.Signal(syscall.SIGTERM)
 	if err != nil {
@@ -223,34 +233,246 @@ func StopKeycloak() {
 	PodmanKill("keycloak")
 }
 
-func AddKeycloakUser(username, firstname, lastname string) (string, error) {
+var keycloakAdminClient struct {
+	sync.Mutex
+	client *keycloak.Client
+}
+
+// KeycloakAdminClient returns a client of the admin API of the nsbox realm,
+// logged in as the admin of the master realm. The password is read every
+// time, so that a client with the new one replaces the cached client after
+// 'portal rotate-secrets'.
+func KeycloakAdminClient() (*keycloak.Client, error) {
+	keycloakAdminClient.Lock()
+	defer keycloakAdminClient.Unlock()
+	password, err := ReadSecretString(secretKeycloakAdminPassword)
+	if err != nil {
+		return nil, err
+	}
+	if c := keycloakAdminClient.client; c != nil && c.Password == password {
+		return c, nil
+	}
+	httpClient, err := newLoopbackClient()
+	if err != nil {
+		return nil, err
+	}
+	keycloakAdminClient.client = keycloak.NewClient(fmt.Sprintf("https://%s:9992", *hostname), "nsbox",
+		"admin", password, httpClient)
+	return keycloakAdminClient.client, nil
+}
+
+// AddKeycloakUser creates the user with a temporary password and returns
+// the password. The email defaults to DefaultEmail if empty. Whether the
+// user has to set up OTP is up to the OTP policy.
+func AddKeycloakUser(username, firstname, lastname, email string) (string, error) {
 	log.Printf("AddKeycloakUser('%s')", username)
+	kc, err := KeycloakAdminClient()
+	if err != nil {
+		return "", err
+	}
+	password, err := GenerateInitialPassword()
+	if err != nil {
+		return "", err
+	}
+	if email == "" {
+		email = DefaultEmail(username)
+	}
+	_, err = kc.CreateUser(&keycloak.User{
+		Username:      username,
+		Enabled:       true,
+		FirstName:     firstname,
+		LastName:      lastname,
+		Email:         email,
+		EmailVerified: true,
+	}, &keycloak.Credential{Type: "password", Value: password, Temporary: true})
+	if err != nil {
+		return "", err
+	}
+	return password, nil
+}
+
+type KeycloakUser = keycloak.User
+
+func ListKeycloakUsers() ([]*KeycloakUser, error) {
+	kc, err := KeycloakAdminClient()
+	if err != nil {
+		return nil, err
+	}
+	return kc.ListUsers()
+}
+
+func UpdateKeycloakUserEmail(userID, email string) error {
+	return updateKeycloakUser(userID, map[string]any{"email": email})
+}
+
+func GetKeycloakUser(username string) (*KeycloakUser, error) {
+	kc, err := KeycloakAdminClient()
+	if err != nil {
+		return nil, err
+	}
+	user, err := kc.FindUser(username)
+	if errors.Is(err, keycloak.ErrNotFound) {
+		return nil, fmt.Errorf("%w in Keycloak: %s", ErrUserNotFound, username)
+	}
+	return user, err
+}
+
+func updateKeycloakUser(userID string, fields map[string]any) error {
+	kc, err := KeycloakAdminClient()
+	if err != nil {
+		return err
+	}
+	return kc.UpdateUser(userID, fields)
+}
 
+func UpdateKeycloakUser(userID, firstname, lastname, email string) error {
+	return updateKeycloakUser(userID, map[string]any{
+		"firstName": firstname,
+		"lastName":  lastname,
+		"email":     email,
+	})
+}
+
+func SetKeycloakUserName(userID, firstname, lastname string) error {
+	return updateKeycloakUser(userID, map[string]any{
+		"firstName": firstname,
+		"lastName":  lastname,
+	})
+}
+
+func SetKeycloakUserEnabled(userID string, enabled bool) error {
+	return updateKeycloakUser(userID, map[string]any{"enabled": enabled})
+}
+
+func DeleteKeycloakUser(userID string) error {
+	kc, err := KeycloakAdminClient()
+	if err != nil {
+		return err
+	}
+	return kc.DeleteUser(userID)
+}
+
+// SetKeycloakUserPassword sets a temporary password that the user has to
+// change at the next login.
+func SetKeycloakUserPassword(username, password string) error {
+	user, err := GetKeycloakUser(username)
+	if err != nil {
+		return err
+	}
+	kc, err := KeycloakAdminClient()
+	if err != nil {
+		return err
+	}
+	return kc.SetPassword(user.ID, password, true)
+}
+
+// SendKeycloakActionsEmail makes Keycloak email the user a link to perform
+// the given required actions, valid for lifespan or, if it is zero, for the
+// default of the realm. It needs the SMTP settings of the realm, see
+// keycloakSMTPServer.
+func SendKeycloakActionsEmail(userID string, actions []string, lifespan time.Duration) error {
+	// Keycloak only reports that it failed to send the email.
+	if err := CheckKeycloakSMTPRelay(); err != nil {
+		return err
+	}
+	kc, err := KeycloakAdminClient()
+	if err != nil {
+		return err
+	}
+	return kc.ExecuteActionsEmail(userID, actions, lifespan)
+}
+
+// keycloakSMTPRelayAddr returns SMTPRelay as seen from the keycloak
+// container, which does not share the network of the host.
+func keycloakSMTPRelayAddr() (string, error) {
+	if *keycloakSMTPRelay != "" {
+		return *keycloakSMTPRelay, nil
+	}
+	relay := SMTPRelay()
+	host, port, err := net.SplitHostPort(relay)
+	if err != nil {
+		return "", fmt.Errorf("invalid SMTP relay %s: %v", relay, err)
+	}
+	ip := net.ParseIP(host)
+	if host == "localhost" || ip != nil && ip.IsLoopback() {
+		return "", fmt.Errorf("the SMTP relay %s is on a loopback address, which the keycloak container cannot reach. "+
+			"Set -mailpit_smtp_bind, -smtp_relay or -keycloak_smtp_relay", relay)
+	}
+	if ip != nil && ip.IsUnspecified() {
+		// The relay listens on every address of the host, which the
+		// container reaches through this name.
+		return net.JoinHostPort("host.containers.internal", port), nil
+	}
+	return relay, nil
+}
+
+// CheckKeycloakSMTPRelay connects to the SMTP relay from inside the keycloak
+// container, so that a relay Keycloak cannot reach is reported instead of
+// emails getting lost.
+func CheckKeycloakSMTPRelay() error {
+	addr, err := keycloakSMTPRelayAddr()
+	if err != nil {
+		return err
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid SMTP relay %s: %v", addr, err)
+	}
 	cmd := exec.Command("podman", "exec", "keycloak",
-		"/home/keycloak/createuser",
-		"--hostname", *hostname,
-		"--username", username,
-		"--first-name", firstname,
-		"--last-name", lastname)
+		"timeout", "5", "bash", "-c", `exec 3<>"/dev/tcp/$0/$1"`, host, port)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("Keycloak cannot reach the SMTP relay %s: %v: %s", addr, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
 
-	cmd.Stderr = os.Stderr
+type KeycloakGroup = keycloak.Group
 
-	var out bytes.Buffer
-	cmd.Stdout = &out
+// GetKeycloakGroup looks up a top-level group by its exact name.
+func GetKeycloakGroup(name string) (*KeycloakGroup, error) {
+	kc, err := KeycloakAdminClient()
+	if err != nil {
+		return nil, err
+	}
+	return kc.FindGroup(name)
+}
 
-	err := cmd.Run()
+func CreateKeycloakGroup(name string) (*KeycloakGroup, error) {
+	kc, err := KeycloakAdminClient()
+	if err != nil {
+		return nil, err
+	}
+	return kc.CreateGroup(name)
+}
+
+func DeleteKeycloakGroup(groupID string) error {
+	kc, err := KeycloakAdminClient()
 	if err != nil {
-		return "", fmt.Errorf("error running createuser script: %v", err)
+		return err
 	}
+	return kc.DeleteGroup(groupID)
+}
 
-	lines := strings.Split(out.String(), "\n")
-	for _, line := range lines {
-		if strings.HasPrefix(line, "[PASSWORD_OUTPUT]:") {
-			// Extracting the password from the line
-			password := strings.Split(line, ": ")[2]
-			return password, nil
-		}
+func ListKeycloakGroupMembers(groupID string) ([]*KeycloakUser, error) {
+	kc, err := KeycloakAdminClient()
+	if err != nil {
+		return nil, err
 	}
+	return kc.ListGroupMembers(groupID)
+}
 
-	return "", fmt.Errorf("unable to find password: %s", out.String())
+func AddKeycloakGroupMember(groupID, userID string) error {
+	kc, err := KeycloakAdminClient()
+	if err != nil {
+		return err
+	}
+	return kc.AddGroupMember(groupID, userID)
+}
+
+func RemoveKeycloakGroupMember(groupID, userID string) error {
+	kc, err := KeycloakAdminClient()
+	if err != nil {
+		return err
+	}
+	return kc.RemoveGroupMember(groupID, userID)
 }
@@ -0,0 +1,91 @@
+package keycloak
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// OIDCClient is a client of the realm, named so to avoid confusion with
+// Client.
+type OIDCClient struct {
+	ID           string   `json:"id,omitempty"`
+	ClientID     string   `json:"clientId"`
+	Enabled      bool     `json:"enabled"`
+	RedirectURIs []string `json:"redirectUris,omitempty"`
+	WebOrigins   []string `json:"webOrigins,omitempty"`
+	PublicClient bool     `json:"publicClient"`
+	// e.g. "backchannel.logout.url"
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+type ProtocolMapper struct {
+	ID             string            `json:"id,omitempty"`
+	Name           string            `json:"name"`
+	Protocol       string            `json:"protocol"`
+	ProtocolMapper string            `json:"protocolMapper"`
+	Config         map[string]string `json:"config,omitempty"`
+}
+
+// FindClient looks up a client by its client ID, e.g. "httpd", as opposed
+// to its internal ID.
+func (c *Client) FindClient(clientID string) (*OIDCClient, error) {
+	var clients []*OIDCClient
+	query := url.Values{"clientId": {clientID}}
+	if _, err := c.do(http.MethodGet, c.realmPath("/clients"), query, nil, &clients); err != nil {
+		return nil, err
+	}
+	for _, cl := range clients {
+		if cl.ClientID == clientID {
+			return cl, nil
+		}
+	}
+	return nil, fmt.Errorf("client %s: %w", clientID, ErrNotFound)
+}
+
+// CreateClient creates the client and returns its internal ID.
+func (c *Client) CreateClient(client *OIDCClient) (string, error) {
+	return c.create(c.realmPath("/clients"), client)
+}
+
+// UpdateClient sets the given fields of the representation of the client.
+func (c *Client) UpdateClient(id string, fields map[string]any) error {
+	_, err := c.do(http.MethodPut, c.realmPath("/clients/%s", id), nil, fields, nil)
+	return err
+}
+
+// GetClientSecret returns the secret of a confidential client.
+func (c *Client) GetClientSecret(id string) (string, error) {
+	var secret struct {
+		Value string `json:"value"`
+	}
+	_, err := c.do(http.MethodGet, c.realmPath("/clients/%s/client-secret", id), nil, nil, &secret)
+	return secret.Value, err
+}
+
+// RegenerateClientSecret replaces the secret of a confidential client and
+// returns the new one.
+func (c *Client) RegenerateClientSecret(id string) (string, error) {
+	var secret struct {
+		Value string `json:"value"`
+	}
+	_, err := c.do(http.MethodPost, c.realmPath("/clients/%s/client-secret", id), nil, nil, &secret)
+	return secret.Value, err
+}
+
+func (c *Client) ListProtocolMappers(id string) ([]*ProtocolMapper, error) {
+	var mappers []*ProtocolMapper
+	_, err := c.do(http.MethodGet, c.realmPath("/clients/%s/protocol-mappers/models", id), nil, nil, &mappers)
+	return mappers, err
+}
+
+func (c *Client) CreateProtocolMapper(id string, mapper *ProtocolMapper) error {
+	_, err := c.do(http.MethodPost, c.realmPath("/clients/%s/protocol-mappers/models", id), nil, mapper, nil)
+	return err
+}
+
+// UpdateProtocolMapper replaces the mapper with the given ID.
+func (c *Client) UpdateProtocolMapper(id string, mapper *ProtocolMapper) error {
+	_, err := c.do(http.MethodPut, c.realmPath("/clients/%s/protocol-mappers/models/%s", id, mapper.ID), nil, mapper, nil)
+	return err
+}
@@ -0,0 +1,111 @@
+package keycloak
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// Provider types of components.
+const (
+	UserStorageProvider = "org.keycloak.storage.UserStorageProvider"
+	LDAPStorageMapper   = "org.keycloak.storage.ldap.mappers.LDAPStorageMapper"
+)
+
+// Component is a configurable provider of the realm, such as an LDAP user
+// storage provider or one of its mappers. Keycloak masks secrets in the
+// config it returns, and keeps the old value if a masked value is sent
+// back.
+type Component struct {
+	ID           string              `json:"id,omitempty"`
+	Name         string              `json:"name"`
+	ProviderID   string              `json:"providerId"`
+	ProviderType string              `json:"providerType"`
+	ParentID     string              `json:"parentId,omitempty"`
+	Config       map[string][]string `json:"config,omitempty"`
+}
+
+// SyncResult is the outcome of a synchronization of a user storage
+// provider.
+type SyncResult struct {
+	Ignored bool   `json:"ignored"`
+	Added   int    `json:"added"`
+	Updated int    `json:"updated"`
+	Removed int    `json:"removed"`
+	Failed  int    `json:"failed"`
+	Status  string `json:"status"`
+}
+
+// ListComponents returns the components of the type whose parent has the
+// given ID. The parent of user storage providers is the realm, whose ID
+// is in its representation.
+func (c *Client) ListComponents(providerType, parentID string) ([]*Component, error) {
+	var components []*Component
+	query := url.Values{"type": {providerType}}
+	if parentID != "" {
+		query.Set("parent", parentID)
+	}
+	_, err := c.do(http.MethodGet, c.realmPath("/components"), query, nil, &components)
+	return components, err
+}
+
+// CreateComponent creates the component and returns its ID.
+func (c *Client) CreateComponent(component *Component) (string, error) {
+	return c.create(c.realmPath("/components"), component)
+}
+
+func (c *Client) UpdateComponent(component *Component) error {
+	_, err := c.do(http.MethodPut, c.realmPath("/components/%s", component.ID), nil, component, nil)
+	return err
+}
+
+func (c *Client) DeleteComponent(id string) error {
+	_, err := c.do(http.MethodDelete, c.realmPath("/components/%s", id), nil, nil, nil)
+	return err
+}
+
+// SyncUserStorage imports the users of a user storage provider, all of
+// them if full is set and otherwise those changed since the last sync.
+func (c *Client) SyncUserStorage(id string, full bool) (*SyncResult, error) {
+	action := "triggerChangedUsersSync"
+	if full {
+		action = "triggerFullSync"
+	}
+	var result SyncResult
+	query := url.Values{"action": {action}}
+	if _, err := c.do(http.MethodPost, c.realmPath("/user-storage/%s/sync", id), query, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// SyncLDAPMapper copies the data of an LDAP mapper, such as groups, from
+// LDAP into Keycloak.
+func (c *Client) SyncLDAPMapper(storageID, mapperID string) (*SyncResult, error) {
+	var result SyncResult
+	query := url.Values{"direction": {"fedToKeycloak"}}
+	path := c.realmPath("/user-storage/%s/mappers/%s/sync", storageID, mapperID)
+	if _, err := c.do(http.MethodPost, path, query, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// LDAPConnectionTest is a test of the connection to an LDAP server. If
+// ComponentID is set, a masked BindCredential stands for the credential
+// of that component.
+type LDAPConnectionTest struct {
+	Action           string `json:"action"` // testConnection or testAuthentication
+	ConnectionURL    string `json:"connectionUrl"`
+	BindDN           string `json:"bindDn,omitempty"`
+	BindCredential   string `json:"bindCredential,omitempty"`
+	UseTruststoreSPI string `json:"useTruststoreSpi,omitempty"`
+	StartTLS         string `json:"startTls,omitempty"`
+	ComponentID      string `json:"componentId,omitempty"`
+}
+
+// TestLDAPConnection connects, and authenticates if asked to, to an LDAP
+// server from Keycloak. It returns an error if that fails.
+func (c *Client) TestLDAPConnection(test *LDAPConnectionTest) error {
+	_, err := c.do(http.MethodPost, c.realmPath("/testLDAPConnection"), nil, test, nil)
+	return err
+}
@@ -0,0 +1,74 @@
+package keycloak
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+type Group struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name"`
+	Path string `json:"path,omitempty"`
+}
+
+// FindGroup looks up a top-level group by its exact name.
+func (c *Client) FindGroup(name string) (*Group, error) {
+	var groups []*Group
+	query := url.Values{"search": {name}, "exact": {"true"}}
+	if _, err := c.do(http.MethodGet, c.realmPath("/groups"), query, nil, &groups); err != nil {
+		return nil, err
+	}
+	for _, g := range groups {
+		if g.Name == name {
+			return g, nil
+		}
+	}
+	return nil, fmt.Errorf("group %s: %w", name, ErrNotFound)
+}
+
+// ListGroups returns the top-level groups.
+func (c *Client) ListGroups() ([]*Group, error) {
+	var groups []*Group
+	query := url.Values{"briefRepresentation": {"true"}, "max": {"-1"}}
+	_, err := c.do(http.MethodGet, c.realmPath("/groups"), query, nil, &groups)
+	return groups, err
+}
+
+// CreateGroup creates a top-level group and returns it.
+func (c *Client) CreateGroup(name string) (*Group, error) {
+	id, err := c.create(c.realmPath("/groups"), &Group{Name: name})
+	if err != nil {
+		return nil, err
+	}
+	return &Group{ID: id, Name: name, Path: "/" + name}, nil
+}
+
+func (c *Client) DeleteGroup(groupID string) error {
+	_, err := c.do(http.MethodDelete, c.realmPath("/groups/%s", groupID), nil, nil, nil)
+	return err
+}
+
+func (c *Client) ListGroupMembers(groupID string) ([]*User, error) {
+	var users []*User
+	query := url.Values{"briefRepresentation": {"true"}, "max": {"-1"}}
+	_, err := c.do(http.MethodGet, c.realmPath("/groups/%s/members", groupID), query, nil, &users)
+	return users, err
+}
+
+// ListUserGroups returns the groups that the user is a direct member of.
+func (c *Client) ListUserGroups(userID string) ([]*Group, error) {
+	var groups []*Group
+	_, err := c.do(http.MethodGet, c.realmPath("/users/%s/groups", userID), nil, nil, &groups)
+	return groups, err
+}
+
+func (c *Client) AddGroupMember(groupID, userID string) error {
+	_, err := c.do(http.MethodPut, c.realmPath("/users/%s/groups/%s", userID, groupID), nil, nil, nil)
+	return err
+}
+
+func (c *Client) RemoveGroupMember(groupID, userID string) error {
+	_, err := c.do(http.MethodDelete, c.realmPath("/users/%s/groups/%s", userID, groupID), nil, nil, nil)
+	return err
+}
@@ -0,0 +1,228 @@
+// Package keycloak is a client of the Keycloak Admin REST API, authenticated
+// as an admin of the master realm.
+package keycloak
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned when Keycloak responds with 404 Not Found.
+var ErrNotFound = errors.New("not found in Keycloak")
+
+// ErrConflict is returned when Keycloak responds with 409 Conflict, e.g. for
+// a user or group that already exists.
+var ErrConflict = errors.New("already exists in Keycloak")
+
+// ErrUnauthorized is returned when the admin credentials are rejected.
+var ErrUnauthorized = errors.New("unauthorized by Keycloak")
+
+// Error is an unsuccessful response of Keycloak. It matches ErrNotFound,
+// ErrConflict and ErrUnauthorized with errors.Is according to its status.
+type Error struct {
+	Method  string
+	Path    string
+	Status  int
+	Message string // errorMessage or error_description of the response
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%s %s: %d %s", e.Method, e.Path, e.Status, http.StatusText(e.Status))
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.Status == http.StatusNotFound
+	case ErrConflict:
+		return e.Status == http.StatusConflict
+	case ErrUnauthorized:
+		return e.Status == http.StatusUnauthorized
+	}
+	return false
+}
+
+type Client struct {
+	URL      string // e.g. https://nsbox.local:9992
+	Realm    string // the realm managed through this client
+	Username string // an admin of the master realm
+	Password string
+
+	HTTPClient *http.Client
+
+	mutex  sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func NewClient(baseURL, realm, username, password string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{
+		URL:        strings.TrimSuffix(baseURL, "/"),
+		Realm:      realm,
+		Username:   username,
+		Password:   password,
+		HTTPClient: httpClient,
+	}
+}
+
+// accessToken returns a cached admin token, or logs in through the admin-cli
+// client like kcadm.sh does.
+func (c *Client) accessToken() (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.token != "" && time.Now().Before(c.expiry) {
+		return c.token, nil
+	}
+	form := url.Values{
+		"grant_type": {"password"},
+		"client_id":  {"admin-cli"},
+		"username":   {c.Username},
+		"password":   {c.Password},
+	}
+	path := "/realms/master/protocol/openid-connect/token"
+	resp, err := c.HTTPClient.PostForm(c.URL+path, form)
+	if err != nil {
+		return "", fmt.Errorf("failed to log in to Keycloak: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", responseError(http.MethodPost, path, resp.StatusCode, body)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", fmt.Errorf("failed to unmarshal token: %w", err)
+	}
+	c.token = token.AccessToken
+	// Renew a little early so that a token does not expire in flight.
+	c.expiry = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - 10*time.Second)
+	return c.token, nil
+}
+
+func (c *Client) resetToken() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.token = ""
+}
+
+func responseError(method, path string, status int, body []byte) *Error {
+	e := &Error{Method: method, Path: path, Status: status}
+	var msg struct {
+		ErrorMessage     string `json:"errorMessage"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if json.Unmarshal(body, &msg) == nil {
+		switch {
+		case msg.ErrorMessage != "":
+			e.Message = msg.ErrorMessage
+		case msg.ErrorDescription != "":
+			e.Message = msg.ErrorDescription
+		default:
+			e.Message = msg.Error
+		}
+	}
+	return e
+}
+
+// do sends a request to the admin API below /admin/realms, with in encoded
+// as JSON unless it is nil, and decodes the response into out unless it is
+// nil. It returns the response headers.
+func (c *Client) do(method, path string, query url.Values, in, out any) (http.Header, error) {
+	var data []byte
+	if in != nil {
+		var err error
+		data, err = json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+	}
+	endpoint := c.URL + "/admin/realms" + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+
+	for attempt := 0; ; attempt++ {
+		token, err := c.accessToken()
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest(method, endpoint, bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Accept", "application/json")
+		if in != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := c.HTTPClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("error sending request: %w", err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		// The token may have been revoked, e.g. by a restart of Keycloak.
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			c.resetToken()
+			continue
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return nil, responseError(method, path, resp.StatusCode, body)
+		}
+		if out != nil && len(body) > 0 {
+			if err := json.Unmarshal(body, out); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal response of %s %s: %w", method, path, err)
+			}
+		}
+		return resp.Header, nil
+	}
+}
+
+// realmPath returns the path of a resource of the realm of the client.
+func (c *Client) realmPath(format string, args ...any) string {
+	for i, arg := range args {
+		if s, ok := arg.(string); ok {
+			args[i] = url.PathEscape(s)
+		}
+	}
+	return "/" + url.PathEscape(c.Realm) + fmt.Sprintf(format, args...)
+}
+
+// create sends a POST request and returns the ID of the created resource,
+// which Keycloak only reports in the Location header.
+func (c *Client) create(path string, in any) (string, error) {
+	header, err := c.do(http.MethodPost, path, nil, in, nil)
+	if err != nil {
+		return "", err
+	}
+	location := header.Get("Location")
+	if location == "" {
+		return "", fmt.Errorf("POST %s: no Location in the response", path)
+	}
+	return location[strings.LastIndex(location, "/")+1:], nil
+}
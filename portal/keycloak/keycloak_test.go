@@ -0,0 +1,253 @@
+package keycloak
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeKeycloak serves the token endpoint and records the admin requests,
+// which are answered by handler.
+type fakeKeycloak struct {
+	t       *testing.T
+	server  *httptest.Server
+	handler func(w http.ResponseWriter, r *http.Request, body []byte)
+
+	mutex    sync.Mutex
+	logins   int
+	tokens   map[string]bool // valid access tokens
+	requests []string        // "METHOD path?query"
+}
+
+func newFakeKeycloak(t *testing.T, handler func(w http.ResponseWriter, r *http.Request, body []byte)) (*fakeKeycloak, *Client) {
+	f := &fakeKeycloak{t: t, handler: handler, tokens: map[string]bool{}}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.server.Close)
+	return f, NewClient(f.server.URL, "nsbox", "admin", "secret", f.server.Client())
+}
+
+func (f *fakeKeycloak) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if r.URL.Path == "/realms/master/protocol/openid-connect/token" {
+		if r.FormValue("grant_type") != "password" || r.FormValue("client_id") != "admin-cli" ||
+			r.FormValue("username") != "admin" || r.FormValue("password") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":"invalid_grant","error_description":"Invalid user credentials"}`)
+			return
+		}
+		f.logins++
+		token := fmt.Sprintf("token-%d", f.logins)
+		f.tokens[token] = true
+		fmt.Fprintf(w, `{"access_token":%q,"expires_in":60}`, token)
+		return
+	}
+	if !f.tokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")] {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	request := r.Method + " " + r.URL.EscapedPath()
+	if r.URL.RawQuery != "" {
+		request += "?" + r.URL.RawQuery
+	}
+	f.requests = append(f.requests, request)
+	f.handler(w, r, body)
+}
+
+// revokeTokens makes the fake forget the tokens, like a restart of Keycloak.
+func (f *fakeKeycloak) revokeTokens() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.tokens = map[string]bool{}
+}
+
+func TestFindUser(t *testing.T) {
+	f, c := newFakeKeycloak(t, func(w http.ResponseWriter, r *http.Request, body []byte) {
+		// Keycloak matches prefixes unless exact=true, so the client must
+		// not trust the first result either.
+		if r.URL.Query().Get("username") == "alice" {
+			fmt.Fprint(w, `[{"id":"1","username":"alice2"},{"id":"2","username":"alice","enabled":true}]`)
+		} else {
+			fmt.Fprint(w, `[]`)
+		}
+	})
+
+	user, err := c.FindUser("alice")
+	if err != nil {
+		t.Fatalf("FindUser(alice): %v", err)
+	}
+	if user.ID != "2" || !user.Enabled {
+		t.Errorf("FindUser(alice) = %+v, want ID 2, enabled", user)
+	}
+
+	_, err = c.FindUser("bob")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("FindUser(bob) = %v, want ErrNotFound", err)
+	}
+
+	want := []string{
+		"GET /admin/realms/nsbox/users?exact=true&username=alice",
+		"GET /admin/realms/nsbox/users?exact=true&username=bob",
+	}
+	if fmt.Sprint(f.requests) != fmt.Sprint(want) {
+		t.Errorf("requests = %q, want %q", f.requests, want)
+	}
+	if f.logins != 1 {
+		t.Errorf("logged in %d times, want the token to be reused", f.logins)
+	}
+}
+
+func TestCreateUser(t *testing.T) {
+	var got map[string]any
+	_, c := newFakeKeycloak(t, func(w http.ResponseWriter, r *http.Request, body []byte) {
+		if r.Method != http.MethodPost || r.URL.Path != "/admin/realms/nsbox/users" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Content-Type = %q", r.Header.Get("Content-Type"))
+		}
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Fatal(err)
+		}
+		w.Header().Set("Location", "http://keycloak/admin/realms/nsbox/users/b3c9")
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	id, err := c.CreateUser(&User{Username: "alice", Enabled: true, RequiredActions: []string{"CONFIGURE_TOTP"}},
+		&Credential{Type: "password", Value: "pw", Temporary: true})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	if id != "b3c9" {
+		t.Errorf("CreateUser returned ID %q, want b3c9 from the Location header", id)
+	}
+	want := `map[credentials:[map[temporary:true type:password value:pw]] enabled:true requiredActions:[CONFIGURE_TOTP] username:alice]`
+	if fmt.Sprint(got) != want {
+		t.Errorf("request body = %v, want %v", got, want)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	_, c := newFakeKeycloak(t, func(w http.ResponseWriter, r *http.Request, body []byte) {
+		switch r.URL.Path {
+		case "/admin/realms/nsbox/groups":
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, `{"errorMessage":"Top level group named 'dev' already exists."}`)
+		case "/admin/realms/nsbox/roles/missing":
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":"Could not find role"}`)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+
+	_, err := c.CreateGroup("dev")
+	if !errors.Is(err, ErrConflict) || errors.Is(err, ErrNotFound) {
+		t.Errorf("CreateGroup(dev) = %v, want ErrConflict", err)
+	}
+	var kcErr *Error
+	if !errors.As(err, &kcErr) || kcErr.Message != "Top level group named 'dev' already exists." {
+		t.Errorf("CreateGroup(dev) = %#v, want the message of Keycloak", err)
+	}
+
+	_, err = c.GetRealmRole("missing")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetRealmRole(missing) = %v, want ErrNotFound", err)
+	}
+	if want := "GET /nsbox/roles/missing: 404 Not Found: Could not find role"; err.Error() != want {
+		t.Errorf("error = %q, want %q", err, want)
+	}
+
+	err = c.DeleteUser("x")
+	if !errors.As(err, &kcErr) || kcErr.Status != http.StatusInternalServerError {
+		t.Errorf("DeleteUser = %v, want status 500", err)
+	}
+}
+
+func TestBadCredentials(t *testing.T) {
+	f, _ := newFakeKeycloak(t, func(w http.ResponseWriter, r *http.Request, body []byte) {})
+	c := NewClient(f.server.URL, "nsbox", "admin", "wrong", f.server.Client())
+	_, err := c.ListUsers()
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("ListUsers = %v, want ErrUnauthorized", err)
+	}
+	if len(f.requests) != 0 {
+		t.Errorf("sent %q without a token", f.requests)
+	}
+}
+
+func TestTokenRenewal(t *testing.T) {
+	f, c := newFakeKeycloak(t, func(w http.ResponseWriter, r *http.Request, body []byte) {
+		fmt.Fprint(w, `[]`)
+	})
+	if _, err := c.ListGroups(); err != nil {
+		t.Fatal(err)
+	}
+	f.revokeTokens()
+	if _, err := c.ListGroups(); err != nil {
+		t.Fatalf("ListGroups after revoking the token: %v", err)
+	}
+	if f.logins != 2 {
+		t.Errorf("logged in %d times, want 2", f.logins)
+	}
+
+	// An expired token is renewed before it is sent.
+	c.expiry = time.Now().Add(-time.Second)
+	if _, err := c.ListGroups(); err != nil {
+		t.Fatal(err)
+	}
+	if f.logins != 3 {
+		t.Errorf("logged in %d times, want 3", f.logins)
+	}
+}
+
+func TestPaths(t *testing.T) {
+	var bodies []string
+	f, c := newFakeKeycloak(t, func(w http.ResponseWriter, r *http.Request, body []byte) {
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	if err := c.ExecuteActionsEmail("u/1", []string{"UPDATE_PASSWORD"}, 72*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetPassword("u1", "pw", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddGroupMember("g1", "u1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.UpdateRealm(map[string]any{"resetPasswordAllowed": true}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"PUT /admin/realms/nsbox/users/u%2F1/execute-actions-email?lifespan=259200",
+		"PUT /admin/realms/nsbox/users/u1/reset-password",
+		"PUT /admin/realms/nsbox/users/u1/groups/g1",
+		"PUT /admin/realms/nsbox",
+	}
+	if fmt.Sprint(f.requests) != fmt.Sprint(want) {
+		t.Errorf("requests = %q, want %q", f.requests, want)
+	}
+	wantBodies := []string{
+		`["UPDATE_PASSWORD"]`,
+		`{"type":"password","value":"pw","temporary":false}`,
+		``,
+		`{"resetPasswordAllowed":true}`,
+	}
+	if fmt.Sprint(bodies) != fmt.Sprint(wantBodies) {
+		t.Errorf("bodies = %q, want %q", bodies, wantBodies)
+	}
+}
@@ -0,0 +1,44 @@
+package keycloak
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+)
+
+// Realm settings are passed as generic maps: the representation has many
+// fields and updates only need the ones that change.
+
+// GetRealm returns the representation of the realm of the client.
+func (c *Client) GetRealm() (map[string]any, error) {
+	var realm map[string]any
+	if _, err := c.do(http.MethodGet, c.realmPath(""), nil, nil, &realm); err != nil {
+		return nil, err
+	}
+	return realm, nil
+}
+
+// CreateRealm creates the realm of the client, enabled.
+func (c *Client) CreateRealm() error {
+	rep := map[string]any{"realm": c.Realm, "enabled": true}
+	_, err := c.do(http.MethodPost, "", nil, rep, nil)
+	return err
+}
+
+// UpdateRealm sets the given fields of the representation of the realm, e.g.
+// {"resetPasswordAllowed": true}.
+func (c *Client) UpdateRealm(fields map[string]any) error {
+	_, err := c.do(http.MethodPut, c.realmPath(""), nil, fields, nil)
+	return err
+}
+
+// ExportRealm returns the representation of the realm with its clients,
+// groups and roles. Keycloak masks the secrets in it.
+func (c *Client) ExportRealm() (json.RawMessage, error) {
+	var export json.RawMessage
+	query := url.Values{"exportClients": {"true"}, "exportGroupsAndRoles": {"true"}}
+	if _, err := c.do(http.MethodPost, c.realmPath("/partial-export"), query, nil, &export); err != nil {
+		return nil, err
+	}
+	return export, nil
+}
@@ -0,0 +1,92 @@
+package keycloak
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// Role is a realm role.
+type Role struct {
+	ID          string `json:"id,omitempty"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Composite   bool   `json:"composite,omitempty"`
+}
+
+func (c *Client) GetRealmRole(name string) (*Role, error) {
+	var role Role
+	if _, err := c.do(http.MethodGet, c.realmPath("/roles/%s", name), nil, nil, &role); err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+func (c *Client) ListRealmRoles() ([]*Role, error) {
+	var roles []*Role
+	_, err := c.do(http.MethodGet, c.realmPath("/roles"), nil, nil, &roles)
+	return roles, err
+}
+
+func (c *Client) CreateRealmRole(role *Role) error {
+	_, err := c.do(http.MethodPost, c.realmPath("/roles"), nil, role, nil)
+	return err
+}
+
+func (c *Client) UpdateRealmRole(name string, role *Role) error {
+	_, err := c.do(http.MethodPut, c.realmPath("/roles/%s", name), nil, role, nil)
+	return err
+}
+
+// ListRoleUsers returns the users that have the role directly.
+func (c *Client) ListRoleUsers(name string) ([]*User, error) {
+	var users []*User
+	_, err := c.do(http.MethodGet, c.realmPath("/roles/%s/users", name), nil, nil, &users)
+	return users, err
+}
+
+// ListRoleGroups returns the groups that have the role directly.
+func (c *Client) ListRoleGroups(name string) ([]*Group, error) {
+	var groups []*Group
+	query := url.Values{"briefRepresentation": {"true"}}
+	_, err := c.do(http.MethodGet, c.realmPath("/roles/%s/groups", name), query, nil, &groups)
+	return groups, err
+}
+
+// ListUserRealmRoles returns the realm roles of the user, including those
+// granted through groups and composite roles if effective is set.
+func (c *Client) ListUserRealmRoles(userID string, effective bool) ([]*Role, error) {
+	path := c.realmPath("/users/%s/role-mappings/realm", userID)
+	if effective {
+		path += "/composite"
+	}
+	var roles []*Role
+	_, err := c.do(http.MethodGet, path, nil, nil, &roles)
+	return roles, err
+}
+
+func (c *Client) AddUserRealmRoles(userID string, roles ...*Role) error {
+	_, err := c.do(http.MethodPost, c.realmPath("/users/%s/role-mappings/realm", userID), nil, roles, nil)
+	return err
+}
+
+func (c *Client) RemoveUserRealmRoles(userID string, roles ...*Role) error {
+	_, err := c.do(http.MethodDelete, c.realmPath("/users/%s/role-mappings/realm", userID), nil, roles, nil)
+	return err
+}
+
+// ListGroupRealmRoles returns the realm roles granted to the group directly
+// or, if effective, also through composite roles and parent groups.
+func (c *Client) ListGroupRealmRoles(groupID string, effective bool) ([]*Role, error) {
+	path := c.realmPath("/groups/%s/role-mappings/realm", groupID)
+	if effective {
+		path += "/composite"
+	}
+	var roles []*Role
+	_, err := c.do(http.MethodGet, path, nil, nil, &roles)
+	return roles, err
+}
+
+func (c *Client) AddGroupRealmRoles(groupID string, roles ...*Role) error {
+	_, err := c.do(http.MethodPost, c.realmPath("/groups/%s/role-mappings/realm", groupID), nil, roles, nil)
+	return err
+}
@@ -0,0 +1,139 @@
+package keycloak
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type User struct {
+	ID              string              `json:"id,omitempty"`
+	Username        string              `json:"username,omitempty"`
+	FirstName       string              `json:"firstName,omitempty"`
+	LastName        string              `json:"lastName,omitempty"`
+	Email           string              `json:"email,omitempty"`
+	EmailVerified   bool                `json:"emailVerified,omitempty"`
+	Enabled         bool                `json:"enabled"`
+	RequiredActions []string            `json:"requiredActions,omitempty"`
+	Attributes      map[string][]string `json:"attributes,omitempty"`
+	FederationLink  string              `json:"federationLink,omitempty"`
+	CreatedAt       int64               `json:"createdTimestamp,omitempty"` // milliseconds
+}
+
+// Credential is a password or OTP credential of a user.
+type Credential struct {
+	ID        string `json:"id,omitempty"`
+	Type      string `json:"type"`
+	Value     string `json:"value,omitempty"`
+	Temporary bool   `json:"temporary"`
+	UserLabel string `json:"userLabel,omitempty"`
+	CreatedAt int64  `json:"createdDate,omitempty"` // milliseconds
+}
+
+// ListUsers returns all users of the realm.
+func (c *Client) ListUsers() ([]*User, error) {
+	var users []*User
+	query := url.Values{"briefRepresentation": {"true"}, "max": {"-1"}}
+	_, err := c.do(http.MethodGet, c.realmPath("/users"), query, nil, &users)
+	return users, err
+}
+
+// FindUser looks up a user by the exact username.
+func (c *Client) FindUser(username string) (*User, error) {
+	var users []*User
+	query := url.Values{"username": {username}, "exact": {"true"}}
+	if _, err := c.do(http.MethodGet, c.realmPath("/users"), query, nil, &users); err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		if u.Username == username {
+			return u, nil
+		}
+	}
+	return nil, fmt.Errorf("user %s: %w", username, ErrNotFound)
+}
+
+func (c *Client) GetUser(userID string) (*User, error) {
+	var user User
+	if _, err := c.do(http.MethodGet, c.realmPath("/users/%s", userID), nil, nil, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// CreateUser creates the user, optionally with credentials, and returns
+// its ID.
+func (c *Client) CreateUser(user *User, credentials ...*Credential) (string, error) {
+	rep := struct {
+		*User
+		Credentials []*Credential `json:"credentials,omitempty"`
+	}{user, credentials}
+	return c.create(c.realmPath("/users"), rep)
+}
+
+// UpdateUser sets the given fields of the representation of the user, e.g.
+// {"firstName": "Alice"}, and leaves the others alone.
+func (c *Client) UpdateUser(userID string, fields map[string]any) error {
+	_, err := c.do(http.MethodPut, c.realmPath("/users/%s", userID), nil, fields, nil)
+	return err
+}
+
+func (c *Client) DeleteUser(userID string) error {
+	_, err := c.do(http.MethodDelete, c.realmPath("/users/%s", userID), nil, nil, nil)
+	return err
+}
+
+// SetPassword sets the password of the user. A temporary password has to be
+// changed at the next login.
+func (c *Client) SetPassword(userID, password string, temporary bool) error {
+	cred := &Credential{Type: "password", Value: password, Temporary: temporary}
+	_, err := c.do(http.MethodPut, c.realmPath("/users/%s/reset-password", userID), nil, cred, nil)
+	return err
+}
+
+// ListCredentials returns the credentials of the user, without secrets.
+func (c *Client) ListCredentials(userID string) ([]*Credential, error) {
+	var creds []*Credential
+	_, err := c.do(http.MethodGet, c.realmPath("/users/%s/credentials", userID), nil, nil, &creds)
+	return creds, err
+}
+
+func (c *Client) DeleteCredential(userID, credentialID string) error {
+	_, err := c.do(http.MethodDelete, c.realmPath("/users/%s/credentials/%s", userID, credentialID), nil, nil, nil)
+	return err
+}
+
+// ExecuteActionsEmail emails the user a link to perform the required actions,
+// valid for lifespan or, if it is zero, for the default of the realm.
+func (c *Client) ExecuteActionsEmail(userID string, actions []string, lifespan time.Duration) error {
+	query := url.Values{}
+	if lifespan > 0 {
+		query.Set("lifespan", strconv.Itoa(int(lifespan.Seconds())))
+	}
+	_, err := c.do(http.MethodPut, c.realmPath("/users/%s/execute-actions-email", userID), query, actions, nil)
+	return err
+}
+
+// UserSession is a login session of a user.
+type UserSession struct {
+	ID         string            `json:"id"`
+	IPAddress  string            `json:"ipAddress"`
+	Start      int64             `json:"start"`      // milliseconds
+	LastAccess int64             `json:"lastAccess"` // milliseconds
+	Clients    map[string]string `json:"clients"`    // client IDs by internal ID
+}
+
+func (c *Client) ListUserSessions(userID string) ([]*UserSession, error) {
+	var sessions []*UserSession
+	_, err := c.do(http.MethodGet, c.realmPath("/users/%s/sessions", userID), nil, nil, &sessions)
+	return sessions, err
+}
+
+// LogoutUser ends all sessions of the user. Keycloak notifies the clients
+// that have a back-channel logout URL.
+func (c *Client) LogoutUser(userID string) error {
+	_, err := c.do(http.MethodPost, c.realmPath("/users/%s/logout", userID), nil, nil, nil)
+	return err
+}
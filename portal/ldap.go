@@ -0,0 +1,624 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"naive.systems/box/portal/keycloak"
+)
+
+/*
+Users of a corporate LDAP directory or Active Directory can log in through
+an LDAP user storage provider of the nsbox realm, described by the "ldap"
+section of realm.json and edited at /realm/ldap. Keycloak imports the users
+in read-only mode, on a sync or at their first login, and the portal then
+creates their Gerrit and Redmine accounts: after every sync triggered in
+the portal and every -ldap_provision_interval. The bind password is kept
+in the secret store as keycloak/ldap_bind_password.txt rather than in
+realm.json.
+*/
+
+var ldapProvisionInterval = flag.Duration("ldap_provision_interval", time.Minute, "Create Gerrit and Redmine accounts for new LDAP users at this interval (0 disables)")
+
+// The names of the components of the LDAP provider in Keycloak.
+const (
+	ldapComponentName      = "ldap"
+	ldapGroupMapperName    = "groups"
+	ldapVendorOther        = "other"
+	ldapVendorAD           = "ad"
+	ldapSearchScopeSubtree = "2"
+)
+
+type LDAPConfig struct {
+	Enabled       bool   `json:"enabled"`
+	Vendor        string `json:"vendor"` // "other" or "ad" for Active Directory
+	ConnectionURL string `json:"connectionUrl"`
+	StartTLS      bool   `json:"startTls"`
+	BindDN        string `json:"bindDn"` // anonymous bind if empty
+	UsersDN       string `json:"usersDn"`
+	// The attributes and object classes of users, which default to those
+	// of inetOrgPerson, or of Active Directory.
+	UsernameAttribute string `json:"usernameAttribute"`
+	RDNAttribute      string `json:"rdnAttribute"`
+	UUIDAttribute     string `json:"uuidAttribute"`
+	UserObjectClasses string `json:"userObjectClasses"`
+	UserFilter        string `json:"userFilter"` // e.g. "(memberOf=cn=dev,ou=groups,dc=example,dc=com)"
+	// Groups are only imported if GroupsDN is set.
+	GroupsDN                 string `json:"groupsDn"`
+	GroupObjectClass         string `json:"groupObjectClass"`
+	GroupMembershipAttribute string `json:"groupMembershipAttribute"`
+	// How often Keycloak imports changed users on its own; 0 disables.
+	SyncPeriodSeconds int `json:"syncPeriodSeconds"`
+}
+
+// fillDefaults sets the attributes left empty to the defaults of the
+// vendor.
+func (c *LDAPConfig) fillDefaults() {
+	if c.Vendor == "" {
+		c.Vendor = ldapVendorOther
+	}
+	defaults := map[*string]string{
+		&c.UsernameAttribute:        "uid",
+		&c.RDNAttribute:             "uid",
+		&c.UUIDAttribute:            "entryUUID",
+		&c.UserObjectClasses:        "inetOrgPerson, organizationalPerson",
+		&c.GroupObjectClass:         "groupOfNames",
+		&c.GroupMembershipAttribute: "member",
+	}
+	if c.Vendor == ldapVendorAD {
+		defaults[&c.UsernameAttribute] = "sAMAccountName"
+		defaults[&c.RDNAttribute] = "cn"
+		defaults[&c.UUIDAttribute] = "objectGUID"
+		defaults[&c.UserObjectClasses] = "person, organizationalPerson, user"
+		defaults[&c.GroupObjectClass] = "group"
+	}
+	for field, value := range defaults {
+		if *field == "" {
+			*field = value
+		}
+	}
+}
+
+func (c *LDAPConfig) Validate() error {
+	if c.Vendor != ldapVendorOther && c.Vendor != ldapVendorAD {
+		return fmt.Errorf("unknown LDAP vendor %q", c.Vendor)
+	}
+	if !strings.HasPrefix(c.ConnectionURL, "ldap://") && !strings.HasPrefix(c.ConnectionURL, "ldaps://") {
+		return errors.New("the connection URL must start with ldap:// or ldaps://")
+	}
+	if c.UsersDN == "" {
+		return errors.New("the users DN is required")
+	}
+	if c.SyncPeriodSeconds < 0 {
+		return errors.New("the sync period cannot be negative")
+	}
+	return nil
+}
+
+func (c *LDAPConfig) String() string {
+	return fmt.Sprintf("%s %s, users in %s, groups in %s, enabled %t",
+		c.Vendor, c.ConnectionURL, c.UsersDN, c.GroupsDN, c.Enabled)
+}
+
+// componentConfig returns the config of the user storage provider, without
+// the bind credential.
+func (c *LDAPConfig) componentConfig() map[string][]string {
+	authType := "simple"
+	if c.BindDN == "" {
+		authType = "none"
+	}
+	changedSyncPeriod := "-1"
+	if c.SyncPeriodSeconds > 0 {
+		changedSyncPeriod = strconv.Itoa(c.SyncPeriodSeconds)
+	}
+	return map[string][]string{
+		"enabled":                {strconv.FormatBool(c.Enabled)},
+		"vendor":                 {c.Vendor},
+		"connectionUrl":          {c.ConnectionURL},
+		"startTls":               {strconv.FormatBool(c.StartTLS)},
+		"authType":               {authType},
+		"bindDn":                 {c.BindDN},
+		"usersDn":                {c.UsersDN},
+		"usernameLDAPAttribute":  {c.UsernameAttribute},
+		"rdnLDAPAttribute":       {c.RDNAttribute},
+		"uuidLDAPAttribute":      {c.UUIDAttribute},
+		"userObjectClasses":      {c.UserObjectClasses},
+		"customUserSearchFilter": {c.UserFilter},
+		"searchScope":            {ldapSearchScopeSubtree},
+		"editMode":               {"READ_ONLY"},
+		"importEnabled":          {"true"},
+		"syncRegistrations":      {"false"},
+		"trustEmail":             {"true"},
+		"pagination":             {"true"},
+		"useTruststoreSpi":       {"always"},
+		"fullSyncPeriod":         {"-1"},
+		"changedSyncPeriod":      {changedSyncPeriod},
+		"batchSizeForSync":       {"1000"},
+	}
+}
+
+func (c *LDAPConfig) groupMapperConfig() map[string][]string {
+	return map[string][]string{
+		"groups.dn":                            {c.GroupsDN},
+		"group.name.ldap.attribute":            {"cn"},
+		"group.object.classes":                 {c.GroupObjectClass},
+		"membership.ldap.attribute":            {c.GroupMembershipAttribute},
+		"membership.attribute.type":            {"DN"},
+		"membership.user.ldap.attribute":       {c.UsernameAttribute},
+		"mode":                                 {"READ_ONLY"},
+		"user.roles.retrieve.strategy":         {"LOAD_GROUPS_BY_MEMBER_ATTRIBUTE"},
+		"preserve.group.inheritance":           {"false"},
+		"drop.non.existing.groups.during.sync": {"false"},
+	}
+}
+
+func readLDAPBindPassword() (string, error) {
+	return ReadSecretString(secretLDAPBindPassword)
+}
+
+// configDiffers reports whether the live config lacks any of want, where
+// a missing value equals an empty one.
+func configDiffers(have, want map[string][]string) bool {
+	for k, v := range want {
+		if strings.Join(have[k], "\n") != strings.Join(v, "\n") {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeConfig returns the live config updated with want. Keycloak drops
+// the keys that an update leaves out and keeps masked secrets as they are.
+func mergeConfig(have, want map[string][]string) map[string][]string {
+	merged := map[string][]string{}
+	for k, v := range have {
+		merged[k] = v
+	}
+	for k, v := range want {
+		merged[k] = v
+	}
+	return merged
+}
+
+// findComponent returns the component with the name, or nil.
+func findComponent(kc *keycloak.Client, providerType, parentID, name string) (*keycloak.Component, error) {
+	components, err := kc.ListComponents(providerType, parentID)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range components {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	return nil, nil
+}
+
+// planLDAP returns the changes that make the LDAP provider of the realm
+// with the given ID match cfg.
+func planLDAP(kc *keycloak.Client, realmID string, cfg *LDAPConfig) ([]*RealmChange, error) {
+	provider, err := findComponent(kc, keycloak.UserStorageProvider, realmID, ldapComponentName)
+	if err != nil {
+		return nil, err
+	}
+	if provider == nil {
+		if !cfg.Enabled {
+			return nil, nil
+		}
+		return []*RealmChange{{
+			Kind:     RealmCreate,
+			Resource: "LDAP provider",
+			Detail:   cfg.String(),
+			apply:    func() error { return createLDAPProvider(kc, realmID, cfg) },
+		}}, nil
+	}
+
+	var changes []*RealmChange
+	if want := cfg.componentConfig(); configDiffers(provider.Config, want) {
+		changes = append(changes, &RealmChange{
+			Kind:     RealmUpdate,
+			Resource: "LDAP provider",
+			Detail:   cfg.String(),
+			apply: func() error {
+				updated := *provider
+				updated.Config = mergeConfig(provider.Config, want)
+				return kc.UpdateComponent(&updated)
+			},
+		})
+	}
+	if cfg.GroupsDN == "" {
+		return changes, nil
+	}
+	mapper, err := findComponent(kc, keycloak.LDAPStorageMapper, provider.ID, ldapGroupMapperName)
+	if err != nil {
+		return nil, err
+	}
+	want := cfg.groupMapperConfig()
+	if mapper == nil {
+		changes = append(changes, &RealmChange{
+			Kind:     RealmCreate,
+			Resource: "LDAP group mapper",
+			Detail:   "groups in " + cfg.GroupsDN,
+			apply:    func() error { return createLDAPGroupMapper(kc, provider.ID, want) },
+		})
+	} else if configDiffers(mapper.Config, want) {
+		changes = append(changes, &RealmChange{
+			Kind:     RealmUpdate,
+			Resource: "LDAP group mapper",
+			Detail:   "groups in " + cfg.GroupsDN,
+			apply: func() error {
+				updated := *mapper
+				updated.Config = mergeConfig(mapper.Config, want)
+				return kc.UpdateComponent(&updated)
+			},
+		})
+	}
+	return changes, nil
+}
+
+// createLDAPProvider creates the user storage provider, for which Keycloak
+// adds the mappers of the username, names and email, and the group mapper.
+func createLDAPProvider(kc *keycloak.Client, realmID string, cfg *LDAPConfig) error {
+	config := cfg.componentConfig()
+	if cfg.BindDN != "" {
+		password, err := readLDAPBindPassword()
+		if err != nil {
+			return err
+		}
+		config["bindCredential"] = []string{password}
+	}
+	id, err := kc.CreateComponent(&keycloak.Component{
+		Name:         ldapComponentName,
+		ProviderID:   "ldap",
+		ProviderType: keycloak.UserStorageProvider,
+		ParentID:     realmID,
+		Config:       config,
+	})
+	if err != nil {
+		return err
+	}
+	if cfg.GroupsDN == "" {
+		return nil
+	}
+	return createLDAPGroupMapper(kc, id, cfg.groupMapperConfig())
+}
+
+func createLDAPGroupMapper(kc *keycloak.Client, providerID string, config map[string][]string) error {
+	_, err := kc.CreateComponent(&keycloak.Component{
+		Name:         ldapGroupMapperName,
+		ProviderID:   "group-ldap-mapper",
+		ProviderType: keycloak.LDAPStorageMapper,
+		ParentID:     providerID,
+		Config:       config,
+	})
+	return err
+}
+
+// ldapProvider returns the LDAP provider of the realm, or an error if
+// there is none.
+func ldapProvider(kc *keycloak.Client) (*keycloak.Component, error) {
+	realm, err := kc.GetRealm()
+	if err != nil {
+		return nil, err
+	}
+	realmID, _ := realm["id"].(string)
+	provider, err := findComponent(kc, keycloak.UserStorageProvider, realmID, ldapComponentName)
+	if err != nil {
+		return nil, err
+	}
+	if provider == nil {
+		return nil, fmt.Errorf("LDAP provider: %w", keycloak.ErrNotFound)
+	}
+	return provider, nil
+}
+
+// setLDAPBindPassword gives the LDAP provider the password in
+// ldap_bind_password.txt.
+func setLDAPBindPassword(kc *keycloak.Client) error {
+	provider, err := ldapProvider(kc)
+	if err != nil {
+		return err
+	}
+	password, err := readLDAPBindPassword()
+	if err != nil {
+		return err
+	}
+	provider.Config = mergeConfig(provider.Config, map[string][]string{"bindCredential": {password}})
+	return kc.UpdateComponent(provider)
+}
+
+// ProvisionFederatedUsers creates the missing Gerrit and Redmine accounts
+// of users imported from LDAP, and applies the other automatic fixes to
+// them, such as names changed in the directory.
+func ProvisionFederatedUsers(actor string) []SystemResult {
+	users, err := ListKeycloakUsers()
+	if err != nil {
+		return []SystemResult{{System: "Keycloak", Err: err}}
+	}
+	federated := map[string]bool{}
+	for _, u := range users {
+		if u.FederationLink != "" {
+			federated[u.Username] = true
+		}
+	}
+	if len(federated) == 0 {
+		return nil
+	}
+	drifts, err := Reconcile()
+	if err != nil {
+		return []SystemResult{{System: "Reconcile", Err: err}}
+	}
+	var selected []*UserDrift
+	for _, d := range drifts {
+		if federated[d.Username] && d.Automatic() {
+			selected = append(selected, d)
+		}
+	}
+	return FixDrifts(actor, selected)
+}
+
+// StartFederationProvisioner runs ProvisionFederatedUsers every
+// -ldap_provision_interval while LDAP is enabled, which catches users that
+// Keycloak imported on its own or at their first login.
+func StartFederationProvisioner() {
+	if *ldapProvisionInterval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			time.Sleep(*ldapProvisionInterval)
+			cfg, err := readRealmConfig(false)
+			if err != nil {
+				log.Printf("LDAP provisioning: %v", err)
+				continue
+			}
+			if cfg.LDAP == nil || !cfg.LDAP.Enabled {
+				continue
+			}
+			for _, r := range ProvisionFederatedUsers(AuditSystemActor) {
+				if r.Err != nil {
+					log.Printf("LDAP provisioning: %s: %v", r.System, r.Err)
+				}
+			}
+		}
+	}()
+}
+
+// ldapSync is the outcome of the last sync triggered in the portal.
+type ldapSync struct {
+	Time        time.Time
+	Actor       string
+	Full        bool
+	Users       *keycloak.SyncResult
+	Groups      *keycloak.SyncResult
+	Provisioned []SystemResult
+	Err         error
+}
+
+var lastLDAPSync struct {
+	sync.Mutex
+	sync *ldapSync
+}
+
+// SyncLDAP imports the users, and groups if configured, from LDAP and
+// provisions the new users in Gerrit and Redmine.
+func SyncLDAP(actor string, full bool) *ldapSync {
+	s := &ldapSync{Time: time.Now(), Actor: actor, Full: full}
+	s.Err = func() error {
+		kc, err := KeycloakAdminClient()
+		if err != nil {
+			return err
+		}
+		provider, err := ldapProvider(kc)
+		if err != nil {
+			return err
+		}
+		if s.Users, err = kc.SyncUserStorage(provider.ID, full); err != nil {
+			return err
+		}
+		mapper, err := findComponent(kc, keycloak.LDAPStorageMapper, provider.ID, ldapGroupMapperName)
+		if err != nil {
+			return err
+		}
+		if mapper != nil {
+			if s.Groups, err = kc.SyncLDAPMapper(provider.ID, mapper.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	detail := ""
+	if s.Users != nil {
+		detail = s.Users.Status
+	}
+	Audit(actor, "ldap.sync", ldapComponentName, s.Err, detail)
+	if s.Err == nil {
+		s.Provisioned = ProvisionFederatedUsers(actor)
+	}
+	lastLDAPSync.Lock()
+	lastLDAPSync.sync = s
+	lastLDAPSync.Unlock()
+	return s
+}
+
+type ldapPage struct {
+	LDAP        *LDAPConfig
+	HasPassword bool
+	LastSync    *ldapSync
+}
+
+func handleRealmLDAP(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	cfg, err := readRealmConfig(false)
+	if err != nil {
+		http.Error(w, "Failed to load the realm configuration: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page := &ldapPage{LDAP: cfg.LDAP, HasPassword: hasSecret(secretLDAPBindPassword)}
+	if page.LDAP == nil {
+		page.LDAP = &LDAPConfig{}
+		page.LDAP.fillDefaults()
+	}
+	lastLDAPSync.Lock()
+	page.LastSync = lastLDAPSync.sync
+	lastLDAPSync.Unlock()
+	render(w, r, "realm_ldap", "LDAP federation", page)
+}
+
+func handleSaveRealmLDAP(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodPost) {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	syncPeriod, err := strconv.Atoi(strings.TrimSpace(r.FormValue("sync_period_seconds")))
+	if err != nil {
+		redirectWithFlash(w, r, "/realm/ldap", FlashError, "sync_period_seconds must be a number")
+		return
+	}
+	ldap := &LDAPConfig{
+		Enabled:                  r.FormValue("enabled") == "1",
+		Vendor:                   r.FormValue("vendor"),
+		ConnectionURL:            strings.TrimSpace(r.FormValue("connection_url")),
+		StartTLS:                 r.FormValue("start_tls") == "1",
+		BindDN:                   strings.TrimSpace(r.FormValue("bind_dn")),
+		UsersDN:                  strings.TrimSpace(r.FormValue("users_dn")),
+		UsernameAttribute:        strings.TrimSpace(r.FormValue("username_attribute")),
+		RDNAttribute:             strings.TrimSpace(r.FormValue("rdn_attribute")),
+		UUIDAttribute:            strings.TrimSpace(r.FormValue("uuid_attribute")),
+		UserObjectClasses:        strings.TrimSpace(r.FormValue("user_object_classes")),
+		UserFilter:               strings.TrimSpace(r.FormValue("user_filter")),
+		GroupsDN:                 strings.TrimSpace(r.FormValue("groups_dn")),
+		GroupObjectClass:         strings.TrimSpace(r.FormValue("group_object_class")),
+		GroupMembershipAttribute: strings.TrimSpace(r.FormValue("group_membership_attribute")),
+		SyncPeriodSeconds:        syncPeriod,
+	}
+	ldap.fillDefaults()
+	if err := ldap.Validate(); err != nil {
+		redirectWithFlash(w, r, "/realm/ldap", FlashError, err.Error())
+		return
+	}
+	password := r.FormValue("bind_password")
+	if ldap.BindDN != "" && password == "" && !hasSecret(secretLDAPBindPassword) {
+		redirectWithFlash(w, r, "/realm/ldap", FlashError, "The bind password is required")
+		return
+	}
+
+	realmMutex.Lock()
+	cfg, err := readRealmConfig(false)
+	if err == nil && password != "" {
+		err = WriteSecret(secretLDAPBindPassword, []byte(password))
+	}
+	if err == nil {
+		cfg.LDAP = ldap
+		err = saveRealmConfig(cfg)
+	}
+	realmMutex.Unlock()
+	detail := ldap.String()
+	if password != "" {
+		detail += ", new bind password"
+	}
+	Audit(auditActor(r), "realm.ldap", ldapComponentName, err, detail)
+	if err != nil {
+		redirectWithFlash(w, r, "/realm/ldap", FlashError, "Failed to save the LDAP configuration: "+err.Error())
+		return
+	}
+
+	// Only apply the LDAP changes; others are left for the realm page.
+	results := []SystemResult{{System: "realm.json", Message: "saved"}}
+	full, err := LoadRealmConfig()
+	var changes []*RealmChange
+	if err == nil {
+		changes, err = PlanRealm(full)
+	}
+	if err != nil {
+		results = append(results, SystemResult{System: "Keycloak", Err: err})
+		redirectWithResults(w, r, "/realm/ldap", results)
+		return
+	}
+	var selected []*RealmChange
+	created := false
+	for _, c := range changes {
+		if strings.HasPrefix(c.Resource, "LDAP ") {
+			selected = append(selected, c)
+			created = created || (c.Resource == "LDAP provider" && c.Kind == RealmCreate)
+		}
+	}
+	results = append(results, ApplyRealmChanges(auditActor(r), selected)...)
+	// A new provider already has the password.
+	if password != "" && !created {
+		kc, err := KeycloakAdminClient()
+		if err == nil {
+			err = setLDAPBindPassword(kc)
+		}
+		if !errors.Is(err, keycloak.ErrNotFound) {
+			results = append(results, SystemResult{System: "Keycloak (LDAP bind password)", Message: "updated", Err: err})
+		}
+	}
+	redirectWithResults(w, r, "/realm/ldap", results)
+}
+
+func handleTestRealmLDAP(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodPost) {
+		return
+	}
+	err := func() error {
+		kc, err := KeycloakAdminClient()
+		if err != nil {
+			return err
+		}
+		provider, err := ldapProvider(kc)
+		if err != nil {
+			return err
+		}
+		test := &keycloak.LDAPConnectionTest{
+			Action:           "testAuthentication",
+			ConnectionURL:    strings.Join(provider.Config["connectionUrl"], ""),
+			BindDN:           strings.Join(provider.Config["bindDn"], ""),
+			BindCredential:   strings.Join(provider.Config["bindCredential"], ""),
+			UseTruststoreSPI: strings.Join(provider.Config["useTruststoreSpi"], ""),
+			StartTLS:         strings.Join(provider.Config["startTls"], ""),
+			ComponentID:      provider.ID,
+		}
+		if test.BindDN == "" {
+			test.Action = "testConnection"
+		}
+		return kc.TestLDAPConnection(test)
+	}()
+	if err != nil {
+		redirectWithFlash(w, r, "/realm/ldap", FlashError, "LDAP connection failed: "+err.Error())
+		return
+	}
+	redirectWithFlash(w, r, "/realm/ldap", FlashOK, "Connected to the LDAP server")
+}
+
+func handleSyncRealmLDAP(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodPost) {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	s := SyncLDAP(auditActor(r), r.FormValue("full") == "1")
+	if s.Err != nil {
+		redirectWithFlash(w, r, "/realm/ldap", FlashError, "LDAP sync failed: "+s.Err.Error())
+		return
+	}
+	results := []SystemResult{{System: "Keycloak (users)", Message: s.Users.Status}}
+	if s.Groups != nil {
+		results = append(results, SystemResult{System: "Keycloak (groups)", Message: s.Groups.Status})
+	}
+	redirectWithResults(w, r, "/realm/ldap", append(results, s.Provisioned...))
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
@@ -14,6 +15,8 @@ import (
 
 var mailpitBin = flag.String("mailpit_bin", "", "Absolute path to the mailpit binary")
 var mailpitTag = flag.String("mailpit_tag", "1.8.2+nsbox.2023110501", "Release tag for the mailpit binary")
+var mailpitSMTPBind = flag.String("mailpit_smtp_bind", "", "IP address of the SMTP port of Mailpit (default: -bind). "+
+	"Keycloak runs in a container and cannot reach Mailpit on a loopback address")
 
 var mailpitCmd *exec.Cmd
 
@@ -80,7 +83,7 @@ func StartMailpit() error {
 		"--db-file", filepath.Join(mailpitDir, "mails.db"),
 		"--max", "100000",
 		"--listen", *bindIP+":8025",
-		"--smtp", *bindIP+":9025")
+		"--smtp", mailpitSMTPAddr())
 
 	if err := RedirectPipes(mailpitCmd, "M", "\033[0;34m"); err != nil {
 		return fmt.Errorf("failed to redirect pipes: %v", err)
@@ -90,6 +93,14 @@ func StartMailpit() error {
 	return mailpitCmd.Start()
 }
 
+func mailpitSMTPAddr() string {
+	ip := *mailpitSMTPBind
+	if ip == "" {
+		ip = *bindIP
+	}
+	return net.JoinHostPort(ip, "9025")
+}
+
 func StopMailpit() {
 	if err := mailpitCmd.Process.Signal(syscall.SIGTERM); err != nil {
 		log.Printf("Failed to stop Mailpit: %v", err)
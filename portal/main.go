@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -11,6 +12,7 @@ import (
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -35,6 +37,122 @@ func main() {
 	if *hostname == "" {
 		log.Fatalln("-hostname must be specified")
 	}
+	if err := checkEmailTemplate(); err != nil {
+		log.Fatalln(err)
+	}
+	OpenSecretStore()
+	switch flag.Arg(0) {
+	case "":
+	case "rename-host":
+		if flag.NArg() != 2 {
+			log.Fatalln("Usage: portal [flags] rename-host <new hostname>")
+		}
+		RenameHost(flag.Arg(1))
+		return
+	case "rotate-secrets":
+		RotateSecretsCommand(flag.Args()[1:])
+		return
+	case "import-users":
+		ImportUsersCommand(flag.Args()[1:])
+		return
+	default:
+		log.Fatalf("Unknown command: %s", flag.Arg(0))
+	}
+
+	CheckHostname()
+	StartServices()
+	MigrateSecrets()
+	if err := WriteBrandingFiles(); err != nil {
+		log.Printf("Failed to write the branding: %v", err)
+	}
+	if err := WriteHostnameFile(); err != nil {
+		log.Printf("Failed to record hostname: %v", err)
+	}
+	ApplyServiceAccountEmails()
+	StartOTPPolicy()
+	MarkInterruptedProvisionings()
+	StartReconciler()
+	StartFederationProvisioner()
+
+	sigs := make(chan os.Signal, 1)
+	// Ctrl-C triggers SIGINT. systemd is supposed to trigger SIGTERM.
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		fmt.Println()
+		os.Stdout.Sync()
+		os.Stderr.Sync()
+		log.Printf("Received signal: %v", sig)
+		StopServices()
+		os.Exit(0)
+	}()
+
+	// TODO
+	http.HandleFunc("/", handleHome)
+	http.Handle("/static/", staticHandler())
+	http.HandleFunc("/users/new", requireRole(handleNewUser, RoleUserManager))
+	http.HandleFunc("/users/create", requireRole(handleCreateUser, RoleUserManager))
+	http.HandleFunc("/users", requireRole(handleListUsers, RoleUserManager))
+	http.HandleFunc("/users/view", requireRole(handleViewUser, RoleUserManager))
+	http.HandleFunc("/users/edit", requireRole(handleEditUser, RoleUserManager))
+	http.HandleFunc("/users/update", requireRole(handleUpdateUser, RoleUserManager))
+	http.HandleFunc("/users/disable", requireRole(handleUserAction("Disable", "user.disable", func(username string) []SystemResult {
+		return SetUserEnabled(username, false)
+	}), RoleUserManager))
+	http.HandleFunc("/users/enable", requireRole(handleUserAction("Enable", "user.enable", func(username string) []SystemResult {
+		return SetUserEnabled(username, true)
+	}), RoleUserManager))
+	http.HandleFunc("/users/delete", requireRole(handleUserAction("Delete", "user.delete", DeleteUser), RoleUserManager))
+	http.HandleFunc("/users/reset-password", requireRole(handleUserAction("Reset password of", "user.reset_password", SendPasswordResetEmail), RoleUserManager))
+	http.HandleFunc("/users/reset-otp", requireRole(handleUserAction("Reset OTP of", "user.reset_otp", ResetUserOTP), RoleUserManager))
+	http.HandleFunc("/users/sessions", requireRole(handleUserSessions, RoleUserManager))
+	http.HandleFunc("/users/revoke-sessions", requireRole(handleUserAction("Revoke sessions of", "user.revoke_sessions", RevokeUserSessions), RoleUserManager))
+	http.HandleFunc("/users/import", requireRole(handleImportUsers, RoleUserManager))
+	http.HandleFunc("/users/import/preview", requireRole(handlePreviewImport, RoleUserManager))
+	http.HandleFunc("/users/import/run", requireRole(handleRunImport, RoleUserManager))
+	http.HandleFunc("/provisioning", requireRole(handleListProvisionings, RoleUserManager))
+	http.HandleFunc("/provisioning/view", requireRole(handleViewProvisioning, RoleUserManager))
+	http.HandleFunc("/provisioning/retry", requireRole(handleRetryProvisioning, RoleUserManager))
+	http.HandleFunc("/provisioning/rollback", requireRole(handleRollBackProvisioning, RoleUserManager))
+	http.HandleFunc("/reconcile", requireRole(handleReconcile, RoleUserManager))
+	http.HandleFunc("/reconcile/fix", requireRole(handleReconcileFix, RoleUserManager))
+	http.HandleFunc("/profile", handleProfile)
+	http.HandleFunc("/profile/name", handleProfileName)
+	http.HandleFunc("/profile/sshkeys/add", handleAddSSHKey)
+	http.HandleFunc("/profile/sshkeys/delete", handleDeleteSSHKey)
+	http.HandleFunc("/profile/http-password", handleGenerateHTTPPassword)
+	http.HandleFunc("/teams", requireRole(handleListTeams, RoleUserManager, RoleProjectManager))
+	http.HandleFunc("/teams/view", requireRole(handleViewTeam, RoleUserManager, RoleProjectManager))
+	http.HandleFunc("/teams/drift", requireRole(handleTeamsDrift, RoleUserManager, RoleProjectManager))
+	http.HandleFunc("/teams/create", requireRole(handleCreateTeam, RoleProjectManager))
+	http.HandleFunc("/teams/delete", requireRole(handleDeleteTeam, RoleProjectManager))
+	http.HandleFunc("/teams/sync", requireRole(handleSyncTeam, RoleUserManager, RoleProjectManager))
+	http.HandleFunc("/teams/members/add", requireRole(handleAddTeamMember, RoleUserManager, RoleProjectManager))
+	http.HandleFunc("/teams/members/remove", requireRole(handleRemoveTeamMember, RoleUserManager, RoleProjectManager))
+	http.HandleFunc("/audit", requireRole(handleAuditLog, RoleAdmin))
+	http.HandleFunc("/audit/export", requireRole(handleExportAuditLog, RoleAdmin))
+	http.HandleFunc("/otp", requireRole(handleOTP, RoleUserManager))
+	http.HandleFunc("/otp/policy", requireRole(handleOTPPolicy, RoleAdmin))
+	http.HandleFunc("/realm", requireRole(handleRealm, RoleAdmin))
+	http.HandleFunc("/realm/apply", requireRole(handleApplyRealm, RoleAdmin))
+	http.HandleFunc("/realm/passwords", requireRole(handleRealmPasswords, RoleAdmin))
+	http.HandleFunc("/realm/passwords/save", requireRole(handleSaveRealmPasswords, RoleAdmin))
+	http.HandleFunc("/realm/ldap", requireRole(handleRealmLDAP, RoleAdmin))
+	http.HandleFunc("/realm/ldap/save", requireRole(handleSaveRealmLDAP, RoleAdmin))
+	http.HandleFunc("/realm/ldap/test", requireRole(handleTestRealmLDAP, RoleAdmin))
+	http.HandleFunc("/realm/ldap/sync", requireRole(handleSyncRealmLDAP, RoleAdmin))
+	http.HandleFunc("/realm/export", requireRole(handleExportRealm, RoleAdmin))
+	http.HandleFunc("/branding", requireRole(handleBranding, RoleAdmin))
+	http.HandleFunc("/branding/save", requireRole(handleSaveBranding, RoleAdmin))
+	http.HandleFunc("/branding/logo", handleBrandingLogo)
+	http.HandleFunc("/branding/style.css", handleBrandingStyle)
+	http.HandleFunc("/profile/api-tokens/create", handleCreateAPIToken)
+	http.HandleFunc("/profile/api-tokens/revoke", handleRevokeAPIToken)
+	http.HandleFunc(apiPrefix, handleAPI(apiV1Routes))
+	log.Fatal(ServePortal())
+}
+
+func StartServices() {
 	PrepareCerts()
 	StartKeycloak()
 
@@ -83,29 +201,18 @@ func main() {
 		os.Exit(1)
 	}
 
-	sigs := make(chan os.Signal, 1)
-	// Ctrl-C triggers SIGINT. systemd is supposed to trigger SIGTERM.
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		sig := <-sigs
-		fmt.Println()
-		os.Stdout.Sync()
-		os.Stderr.Sync()
-		log.Printf("Received signal: %v", sig)
-		StopHttpd()
-		StopBuildbot()
-		StopGerrit()
-		StopRedmine()
-		StopMailpit()
-		StopKeycloak()
-		os.Exit(0)
-	}()
+	if err := CheckKeycloakSMTPRelay(); err != nil {
+		log.Printf("WARNING: Keycloak cannot send password reset and onboarding emails: %v", err)
+	}
+}
 
-	// TODO
-	http.HandleFunc("/", handleHome)
-	http.HandleFunc("/users/new", handleNewUser)
-	http.HandleFunc("/users/create", handleCreateUser)
-	log.Fatal(http.ListenAndServe(*bindIP+":7777", nil))
+func StopServices() {
+	StopHttpd()
+	StopBuildbot()
+	StopGerrit()
+	StopRedmine()
+	StopMailpit()
+	StopKeycloak()
 }
 
 func handleHome(w http.ResponseWriter, r *http.Request) {
@@ -114,23 +221,17 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	u := r.Header.Get("X-Remote-User")
-	if u != "admin" {
+	if u == "" {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
-	w.Header().Add("Content-Type", "text/html")
-	w.Write([]byte(fmt.Sprintf(`<!DOCTYPE html>
-<html>
-	<head>
-		<meta charset="utf-8"/>
-		<title>nsbox</title>
-	</head>
-	<body>
-		<p>Hello %s</p>
-		<a href="/users/new">Create a new user</a>
-	</body>
-</html>
-`, u)))
+	if !HasRole(r, RoleUserManager, RoleProjectManager) {
+		http.Redirect(w, r, "/profile", http.StatusFound)
+		return
+	}
+	render(w, r, "home", "nsbox", struct{ UserManager, Admin bool }{
+		HasRole(r, RoleUserManager), HasRole(r, RoleAdmin),
+	})
 }
 
 func handleNewUser(w http.ResponseWriter, r *http.Request) {
@@ -138,40 +239,7 @@ func handleNewUser(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	u := r.Header.Get("X-Remote-User")
-	if u != "admin" {
-		http.Error(w, "Forbidden", http.StatusForbidden)
-		return
-	}
-	w.Header().Add("Content-Type", "text/html")
-	w.Write([]byte(fmt.Sprintf(`<!DOCTYPE html>
-<html>
-	<head>
-		<meta charset="utf-8"/>
-		<title>nsbox</title>
-	</head>
-	<body>
-		<p>Hello %s</p>
-		<form method="POST" action="/users/create">
-			<p>
-				<label for="username">Username</label>
-				<input type="text" id="username" name="username" required/>
-			</p>
-			<p>
-				<label for="first_name">First Name</label>
-				<input type="text" id="first_name" name="first_name" required/>
-			</p>
-			<p>
-				<label for="last_name">Last Name</label>
-				<input type="text" id="last_name" name="last_name" required/>
-			</p>
-			<p>
-				<button type="submit">Create</button>
-			</p>
-		</form>
-	</body>
-</html>
-`, u)))
+	render(w, r, "user_new", "Create a new user", struct{ DefaultEmail string }{DefaultEmail("username")})
 }
 
 func handleCreateUser(w http.ResponseWriter, r *http.Request) {
@@ -180,10 +248,6 @@ func handleCreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	u := r.Header.Get("X-Remote-User")
-	if u != "admin" {
-		http.Error(w, "Forbidden", http.StatusForbidden)
-		return
-	}
 	err := r.ParseForm()
 	if err != nil {
 		http.Error(w, "Bad Request", http.StatusBadRequest)
@@ -193,74 +257,47 @@ func handleCreateUser(w http.ResponseWriter, r *http.Request) {
 	username := r.FormValue("username")
 	firstName := r.FormValue("first_name")
 	lastName := r.FormValue("last_name")
+	email := strings.TrimSpace(r.FormValue("email"))
 
 	if username == "" || firstName == "" || lastName == "" {
-		http.Error(w, "All fields are required", http.StatusBadRequest)
+		redirectWithFlash(w, r, "/users/new", FlashError, "Username, first name and last name are required")
 		return
 	}
-
-	// Add user to Gerrit (idempotent operation)
-	err = AddGerritUser(username, firstName+" "+lastName, username+"@nsbox.local")
-	if err != nil {
-		http.Error(w, "Failed to add user to Gerrit: "+err.Error(), http.StatusInternalServerError)
-		return
+	if email != "" {
+		if err := CheckEmail(email); err != nil {
+			redirectWithFlash(w, r, "/users/new", FlashError, err.Error())
+			return
+		}
 	}
 
-	// Add user to Redmine and obtain the user's ID
-	redmineUserID, err := AddRedmineUser(username, firstName, lastName)
+	p, err := NewProvisioning(u, username, firstName, lastName, email, nil)
 	if err != nil {
-		http.Error(w, "Failed to add user to Redmine: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Failed to start provisioning: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	// Add user to Keycloak
-	password, err := AddKeycloakUser(username, firstName, lastName)
-	if err != nil {
-		// Rollback Redmine user creation using the user ID
-		if deleteErr := DeleteRedmineUser(redmineUserID); deleteErr != nil {
-			log.Printf("Error deleting Redmine user (ID: %d) during rollback: %v", redmineUserID, deleteErr)
-		}
-		http.Error(w, "Failed to add user to Keycloak: "+err.Error(), http.StatusInternalServerError)
+	if err := p.Run(); errors.Is(err, ErrUserExists) {
+		redirectWithFlash(w, r, "/users/new", FlashError, err.Error())
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create user (see /provisioning/view?id=%s): %v", p.ID, err),
+			http.StatusInternalServerError)
 		return
 	}
+	deliverInitialPassword(w, r, username, p.Password(), r.FormValue("delivery"))
+}
 
-	// Send a response back in HTML format
-	w.Header().Set("Content-Type", "text/html")
-	w.WriteHeader(http.StatusOK)
+// createdUser is how the initial password of a new user was handed over.
+type createdUser struct {
+	Username string
+	Password string // shown on the page unless SentTo is set
+	SentTo   string // the email address of the onboarding email
+	EmailErr error
+}
 
-	htmlResponse := `
-<!doctype html>
-<html lang="en">
-<head>
-	<meta charset="utf-8">
-	<meta name="viewport" content="width=device-width, initial-scale=1, shrink-to-fit=no">
-	<title>User Creation Success</title>
-	<style>
-		body {
-			font-family: Arial, sans-serif;
-			margin: 40px;
-			background-color: #f5f5f5;
-		}
-		.container {
-			background-color: white;
-			padding: 20px;
-			border-radius: 5px;
-			box-shadow: 0px 0px 15px rgba(0, 0, 0, 0.1);
-		}
-		.highlight {
-			font-weight: bold;
-		}
-	</style>
-</head>
-<body>
-	<div class="container">
-		<h2>Success</h2>
-		<p>User added successfully. Please note down the provided initial password: <span class="highlight">%s</span></p>
-	</div>
-</body>
-</html>
-`
-	w.Write([]byte(fmt.Sprintf(htmlResponse, password)))
+// writePasswordPage shows the initial password of a newly created user. It
+// is never put in a flash message, which would store it in a cookie.
+func writePasswordPage(w http.ResponseWriter, r *http.Request, username, password string, emailErr error) {
+	render(w, r, "user_created", "User created", &createdUser{Username: username, Password: password, EmailErr: emailErr})
 }
 
 func exists(path string) bool {
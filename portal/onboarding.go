@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+var smtpRelay = flag.String("smtp_relay", "", "host:port of the SMTP relay for outgoing mail (default: Mailpit on -mailpit_smtp_bind:9025)")
+var smtpFrom = flag.String("smtp_from", "", "Sender address of outgoing mail (default: nsbox@<hostname>)")
+var smtpUsername = flag.String("smtp_username", "", "Username for the SMTP relay, if it requires authentication")
+var smtpPasswordFile = flag.String("smtp_password_file", "", "File containing the password for the SMTP relay")
+var onboardingLinkLifespan = flag.Duration("onboarding_link_lifespan", 72*time.Hour, "How long the set password link of an onboarding email is valid")
+
+// How the initial password of a new user is handed over.
+const (
+	// The admin sees the temporary password and passes it on by hand.
+	DeliveryShow = "show"
+	// The user receives the temporary password by email.
+	DeliveryEmailPassword = "email_password"
+	// The user receives a time-limited link from Keycloak to set a password.
+	// The temporary password is never shown to anyone.
+	DeliveryEmailLink = "email_link"
+)
+
+func SMTPRelay() string {
+	if *smtpRelay != "" {
+		return *smtpRelay
+	}
+	return mailpitSMTPAddr()
+}
+
+func SMTPFrom() string {
+	if *smtpFrom != "" {
+		return *smtpFrom
+	}
+	return "nsbox@" + *hostname
+}
+
+// SendMail sends a plain text email through the configured relay. The
+// credentials, if any, are only sent over TLS unless the relay is local.
+func SendMail(to, subject, body string) error {
+	var auth smtp.Auth
+	if *smtpUsername != "" {
+		password, err := os.ReadFile(*smtpPasswordFile)
+		if err != nil {
+			return fmt.Errorf("os.ReadFile(%s): %v", *smtpPasswordFile, err)
+		}
+		host, _, err := net.SplitHostPort(SMTPRelay())
+		if err != nil {
+			return fmt.Errorf("invalid -smtp_relay %s: %v", SMTPRelay(), err)
+		}
+		auth = smtp.PlainAuth("", *smtpUsername, strings.TrimSpace(string(password)), host)
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", SMTPFrom())
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), *hostname)
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	log.Printf("SendMail(%s, '%s') via %s", to, subject, SMTPRelay())
+	if err := smtp.SendMail(SMTPRelay(), auth, SMTPFrom(), []string{to}, msg.Bytes()); err != nil {
+		return fmt.Errorf("smtp.SendMail(%s): %v", SMTPRelay(), err)
+	}
+	return nil
+}
+
+func serviceLinks() string {
+	return fmt.Sprintf(`  Portal:   https://%[1]s:9440/
+  Redmine:  https://%[1]s:9441/
+  Gerrit:   https://%[1]s:9442/
+  Buildbot: https://%[1]s:9443/
+`, *hostname)
+}
+
+// SendOnboardingEmail sends the welcome message to a newly created user. With
+// DeliveryEmailPassword the message contains the temporary password, which
+// Keycloak asks the user to change at the first login. With
+// DeliveryEmailLink, Keycloak sends a separate email with a link to set the
+// password, valid for -onboarding_link_lifespan.
+func SendOnboardingEmail(username, password, delivery string) (string, error) {
+	user, err := GetKeycloakUser(username)
+	if err != nil {
+		return "", err
+	}
+	if user.Email == "" {
+		return "", fmt.Errorf("user %s has no email address", username)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Hello %s,\n\n", strings.TrimSpace(user.FirstName+" "+user.LastName))
+	fmt.Fprintf(&b, "An nsbox account has been created for you. Your username is:\n\n  %s\n\n", username)
+
+	switch delivery {
+	case DeliveryEmailPassword:
+		fmt.Fprintf(&b, "Your temporary password is:\n\n  %s\n\n", password)
+		b.WriteString("You will be asked to choose a new password when you first sign in.\n\n")
+	case DeliveryEmailLink:
+		if err := SendKeycloakActionsEmail(user.ID, []string{"UPDATE_PASSWORD"}, *onboardingLinkLifespan); err != nil {
+			return "", fmt.Errorf("failed to send the set password link: %v", err)
+		}
+		fmt.Fprintf(&b, "You will receive a separate email with a link to set your password.\n"+
+			"The link expires in %s.\n\n", *onboardingLinkLifespan)
+	default:
+		return "", fmt.Errorf("unknown delivery: %s", delivery)
+	}
+
+	b.WriteString("Once signed in, you can use the following services:\n\n")
+	b.WriteString(serviceLinks())
+
+	if err := SendMail(user.Email, "Welcome to nsbox", b.String()); err != nil {
+		return "", err
+	}
+	return user.Email, nil
+}
+
+// deliverInitialPassword hands over the password of a newly created user as
+// chosen by the admin. If the email cannot be sent, the password is shown
+// instead so that the account is still usable.
+func deliverInitialPassword(w http.ResponseWriter, r *http.Request, username, password, delivery string) {
+	if delivery == "" || delivery == DeliveryShow {
+		writePasswordPage(w, r, username, password, nil)
+		return
+	}
+	to, err := SendOnboardingEmail(username, password, delivery)
+	if err != nil {
+		log.Printf("Failed to send onboarding email to %s: %v", username, err)
+		writePasswordPage(w, r, username, password, err)
+		return
+	}
+	render(w, r, "user_created", "User created", &createdUser{Username: username, SentTo: to})
+}
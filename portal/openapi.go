@@ -0,0 +1,200 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+The OpenAPI description is generated from the API route table, with the
+schemas of the request and response bodies derived from their Go types, so
+that it cannot drift from the handlers.
+*/
+
+type openAPISchema map[string]any
+
+// openAPIGenerator collects the named schemas of struct types while the
+// operations are described.
+type openAPIGenerator struct {
+	schemas map[string]openAPISchema
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (g *openAPIGenerator) schema(t reflect.Type) openAPISchema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return openAPISchema{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return openAPISchema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return openAPISchema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return openAPISchema{"type": "number"}
+	case reflect.String:
+		return openAPISchema{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return openAPISchema{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return openAPISchema{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		return g.structSchema(t)
+	default:
+		// Interfaces, like the details of errors, can be anything.
+		return openAPISchema{}
+	}
+}
+
+func (g *openAPIGenerator) structSchema(t reflect.Type) openAPISchema {
+	name := t.Name()
+	ref := openAPISchema{"$ref": "#/components/schemas/" + name}
+	if name == "" {
+		return g.objectSchema(t)
+	}
+	if _, ok := g.schemas[name]; !ok {
+		g.schemas[name] = nil // for recursive types
+		g.schemas[name] = g.objectSchema(t)
+	}
+	return ref
+}
+
+func (g *openAPIGenerator) objectSchema(t reflect.Type) openAPISchema {
+	properties := openAPISchema{}
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = g.schema(f.Type)
+		if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Pointer {
+			required = append(required, name)
+		}
+	}
+	s := openAPISchema{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+func (g *openAPIGenerator) operation(route *apiRoute) openAPISchema {
+	op := openAPISchema{
+		"summary":     route.Summary,
+		"operationId": operationID(route),
+	}
+	var params []openAPISchema
+	for _, segment := range strings.Split(route.Path, "/") {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			params = append(params, openAPISchema{
+				"name": segment[1 : len(segment)-1], "in": "path", "required": true,
+				"schema": openAPISchema{"type": "string"},
+			})
+		}
+	}
+	for _, q := range route.Query {
+		params = append(params, openAPISchema{
+			"name": q, "in": "query", "schema": openAPISchema{"type": "string"},
+		})
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+	if route.Request != nil {
+		op["requestBody"] = openAPISchema{
+			"required": true,
+			"content": openAPISchema{"application/json": openAPISchema{
+				"schema": g.schema(reflect.TypeOf(route.Request)),
+			}},
+		}
+	}
+	if route.Public {
+		op["security"] = []openAPISchema{}
+	} else if len(route.Roles) > 0 {
+		op["description"] = "Requires one of the roles: " + strings.Join(route.Roles, ", ") + "."
+	}
+
+	status := route.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := openAPISchema{"description": http.StatusText(status)}
+	if route.Response != nil {
+		success["content"] = openAPISchema{"application/json": openAPISchema{
+			"schema": g.schema(reflect.TypeOf(route.Response)),
+		}}
+	}
+	op["responses"] = openAPISchema{
+		strconv.Itoa(status): success,
+		"default":            openAPISchema{"$ref": "#/components/responses/Error"},
+	}
+	return op
+}
+
+// operationID is derived from the method and the path, e.g. GET
+// /api/v1/users/{username} is getUsersUsername.
+func operationID(route *apiRoute) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(route.Method))
+	for _, segment := range strings.Split(strings.TrimPrefix(route.Path, "/api/v1/"), "/") {
+		segment = strings.Trim(segment, "{}")
+		for _, word := range strings.FieldsFunc(segment, func(r rune) bool { return r == '-' || r == '_' || r == '.' }) {
+			b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+	return b.String()
+}
+
+// OpenAPI returns the OpenAPI 3.0 description of the routes.
+func OpenAPI(routes []*apiRoute) map[string]any {
+	g := &openAPIGenerator{schemas: map[string]openAPISchema{}}
+	paths := map[string]openAPISchema{}
+	for _, route := range routes {
+		if paths[route.Path] == nil {
+			paths[route.Path] = openAPISchema{}
+		}
+		paths[route.Path][strings.ToLower(route.Method)] = g.operation(route)
+	}
+	errorSchema := g.schema(reflect.TypeOf(APIErrorResponse{}))
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": openAPISchema{
+			"title":   "nsbox portal API",
+			"version": "v1",
+		},
+		"servers": []openAPISchema{{"url": "https://" + *hostname + ":9440"}},
+		"paths":   paths,
+		"components": openAPISchema{
+			"schemas": g.schemas,
+			"responses": openAPISchema{
+				"Error": openAPISchema{
+					"description": "Error",
+					"content":     openAPISchema{"application/json": openAPISchema{"schema": errorSchema}},
+				},
+			},
+			"securitySchemes": openAPISchema{
+				"token": openAPISchema{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "An API token created on the profile page of the portal.",
+				},
+			},
+		},
+		"security": []openAPISchema{{"token": []string{}}},
+	}
+}
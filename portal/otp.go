@@ -0,0 +1,430 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"naive.systems/box/portal/keycloak"
+)
+
+/*
+Two-factor authentication uses the OTP support of Keycloak: users who have
+an OTP credential are asked for a code at every login, and users with the
+CONFIGURE_TOTP required action have to set one up at their next login. The
+OTP policy in ${workdir}/portal/otp_policy.json lists the Keycloak groups
+and realm roles whose users must use OTP; the portal adds the required
+action for them and removes it from everyone else who has not set up OTP,
+for whom it is optional. The policy is enforced on startup, when it
+changes and when team membership changes. Roles granted through groups
+count, composite roles do not.
+*/
+
+const requiredActionOTP = "CONFIGURE_TOTP"
+
+type OTPPolicy struct {
+	Groups []string `json:"groups"`
+	Roles  []string `json:"roles"`
+}
+
+var otpMutex sync.Mutex
+
+func otpPolicyPath() string {
+	return filepath.Join(*workdir, "portal", "otp_policy.json")
+}
+
+// LoadOTPPolicy reads the OTP policy, which requires OTP for admins unless
+// it has been changed.
+func LoadOTPPolicy() (*OTPPolicy, error) {
+	bytes, err := os.ReadFile(otpPolicyPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return &OTPPolicy{Roles: []string{RoleAdmin}}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile(%s): %v", otpPolicyPath(), err)
+	}
+	var policy OTPPolicy
+	if err := json.Unmarshal(bytes, &policy); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal(%s): %v", otpPolicyPath(), err)
+	}
+	return &policy, nil
+}
+
+func SaveOTPPolicy(policy *OTPPolicy) error {
+	sort.Strings(policy.Groups)
+	sort.Strings(policy.Roles)
+	bytes, err := json.MarshalIndent(policy, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := otpPolicyPath() + ".tmp"
+	if err := os.WriteFile(tmp, bytes, 0600); err != nil {
+		return fmt.Errorf("os.WriteFile(%s): %v", tmp, err)
+	}
+	return os.Rename(tmp, otpPolicyPath())
+}
+
+func (p *OTPPolicy) String() string {
+	return fmt.Sprintf("groups: %s; roles: %s", strings.Join(p.Groups, ", "), strings.Join(p.Roles, ", "))
+}
+
+// requiredUsers returns the users the policy applies to, each with the
+// group or role that makes it apply.
+func (p *OTPPolicy) requiredUsers(kc *keycloak.Client) (map[string]string, error) {
+	required := map[string]string{}
+	addMembers := func(groupID, reason string) error {
+		members, err := kc.ListGroupMembers(groupID)
+		if err != nil {
+			return err
+		}
+		for _, m := range members {
+			if required[m.Username] == "" {
+				required[m.Username] = reason
+			}
+		}
+		return nil
+	}
+	for _, name := range p.Roles {
+		users, err := kc.ListRoleUsers(name)
+		if errors.Is(err, keycloak.ErrNotFound) {
+			log.Printf("OTP policy: no role %s", name)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, u := range users {
+			if required[u.Username] == "" {
+				required[u.Username] = "role " + name
+			}
+		}
+		groups, err := kc.ListRoleGroups(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range groups {
+			if err := addMembers(g.ID, "role "+name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, name := range p.Groups {
+		g, err := kc.FindGroup(name)
+		if errors.Is(err, keycloak.ErrNotFound) {
+			log.Printf("OTP policy: no group %s", name)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if err := addMembers(g.ID, "group "+name); err != nil {
+			return nil, err
+		}
+	}
+	return required, nil
+}
+
+// OTPStatus is whether a user has enrolled OTP and has to.
+type OTPStatus struct {
+	Username    string
+	RequiredBy  string // the group or role of the policy, empty if optional
+	Credentials []*keycloak.Credential
+	Pending     bool // has to set up OTP at the next login
+
+	userID          string
+	requiredActions []string
+}
+
+func (s *OTPStatus) Enrolled() bool {
+	return len(s.Credentials) > 0
+}
+
+// Resettable is whether the OTP of the user can be reset in the portal.
+func (s *OTPStatus) Resettable() bool {
+	return s.Enrolled() && !isBuiltinUser(s.Username)
+}
+
+// EnrolledAt is when the user set up their first OTP device.
+func (s *OTPStatus) EnrolledAt() string {
+	if len(s.Credentials) == 0 {
+		return ""
+	}
+	first := s.Credentials[0].CreatedAt
+	for _, c := range s.Credentials {
+		if c.CreatedAt < first {
+			first = c.CreatedAt
+		}
+	}
+	return time.UnixMilli(first).UTC().Format("2006-01-02 15:04")
+}
+
+// ListOTPStatuses returns the OTP status of the given users, or of all
+// users if none are given, sorted by username. Service accounts cannot log
+// in and are left out.
+func ListOTPStatuses(policy *OTPPolicy, usernames ...string) ([]*OTPStatus, error) {
+	kc, err := KeycloakAdminClient()
+	if err != nil {
+		return nil, err
+	}
+	required, err := policy.requiredUsers(kc)
+	if err != nil {
+		return nil, err
+	}
+	var users []*KeycloakUser
+	if len(usernames) == 0 {
+		if users, err = kc.ListUsers(); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, username := range usernames {
+			user, err := kc.FindUser(username)
+			if err != nil {
+				return nil, err
+			}
+			users = append(users, user)
+		}
+	}
+	var statuses []*OTPStatus
+	for _, u := range users {
+		if strings.HasPrefix(u.Username, "service-account-") {
+			continue
+		}
+		// The brief representations in the user list lack the required
+		// actions.
+		user, err := kc.GetUser(u.ID)
+		if err != nil {
+			return nil, err
+		}
+		credentials, err := kc.ListCredentials(u.ID)
+		if err != nil {
+			return nil, err
+		}
+		s := &OTPStatus{
+			Username:        user.Username,
+			RequiredBy:      required[user.Username],
+			userID:          user.ID,
+			requiredActions: user.RequiredActions,
+		}
+		for _, c := range credentials {
+			if c.Type == "otp" {
+				s.Credentials = append(s.Credentials, c)
+			}
+		}
+		for _, a := range user.RequiredActions {
+			if a == requiredActionOTP {
+				s.Pending = true
+			}
+		}
+		statuses = append(statuses, s)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Username < statuses[j].Username
+	})
+	return statuses, nil
+}
+
+// setOTPRequired adds or removes the required action to set up OTP.
+func (s *OTPStatus) setOTPRequired(required bool) error {
+	actions := []string{}
+	for _, a := range s.requiredActions {
+		if a != requiredActionOTP {
+			actions = append(actions, a)
+		}
+	}
+	if required {
+		actions = append(actions, requiredActionOTP)
+	}
+	if err := updateKeycloakUser(s.userID, map[string]any{"requiredActions": actions}); err != nil {
+		return err
+	}
+	s.requiredActions = actions
+	s.Pending = required
+	return nil
+}
+
+// EnforceOTPPolicy makes the given users, or all users if none are given,
+// set up OTP if the policy applies to them and no longer asks the others
+// to, unless they have set it up already. It returns one result per user
+// that changed.
+func EnforceOTPPolicy(actor string, usernames ...string) []SystemResult {
+	otpMutex.Lock()
+	defer otpMutex.Unlock()
+	policy, err := LoadOTPPolicy()
+	if err != nil {
+		return []SystemResult{{System: "Keycloak (OTP policy)", Err: err}}
+	}
+	statuses, err := ListOTPStatuses(policy, usernames...)
+	if err != nil {
+		return []SystemResult{{System: "Keycloak (OTP policy)", Err: err}}
+	}
+	var results []SystemResult
+	for _, s := range statuses {
+		if s.Enrolled() {
+			continue
+		}
+		if s.RequiredBy != "" && !s.Pending {
+			err := s.setOTPRequired(true)
+			Audit(actor, "otp.require", s.Username, err, "required by "+s.RequiredBy)
+			results = append(results, SystemResult{System: "Keycloak (" + s.Username + ")", Message: "OTP setup required", Err: err})
+		} else if s.RequiredBy == "" && s.Pending {
+			err := s.setOTPRequired(false)
+			Audit(actor, "otp.unrequire", s.Username, err, "")
+			results = append(results, SystemResult{System: "Keycloak (" + s.Username + ")", Message: "OTP setup no longer required", Err: err})
+		}
+	}
+	return finishResults(results, "")
+}
+
+// ResetUserOTP removes the OTP credentials of the user, e.g. after they
+// lost their device. They have to set up OTP again at the next login if
+// the policy applies to them.
+func ResetUserOTP(username string) []SystemResult {
+	otpMutex.Lock()
+	defer otpMutex.Unlock()
+	results := []SystemResult{{System: "Keycloak"}}
+	results[0].Message, results[0].Err = resetUserOTP(username)
+	return finishResults(results, "")
+}
+
+func resetUserOTP(username string) (string, error) {
+	policy, err := LoadOTPPolicy()
+	if err != nil {
+		return "", err
+	}
+	statuses, err := ListOTPStatuses(policy, username)
+	if err != nil {
+		return "", err
+	}
+	if len(statuses) == 0 {
+		return "", fmt.Errorf("%s is a service account", username)
+	}
+	s := statuses[0]
+	kc, err := KeycloakAdminClient()
+	if err != nil {
+		return "", err
+	}
+	for _, c := range s.Credentials {
+		if err := kc.DeleteCredential(s.userID, c.ID); err != nil {
+			return "", err
+		}
+	}
+	message := fmt.Sprintf("removed %d OTP credentials", len(s.Credentials))
+	if s.RequiredBy != "" {
+		if err := s.setOTPRequired(true); err != nil {
+			return "", err
+		}
+		message += ", OTP setup required at the next login"
+	}
+	return message, nil
+}
+
+// StartOTPPolicy enforces the OTP policy once Keycloak is up.
+func StartOTPPolicy() {
+	for _, r := range EnforceOTPPolicy(AuditSystemActor) {
+		if r.Err != nil {
+			log.Printf("OTP policy: %s: %v", r.System, r.Err)
+		}
+	}
+}
+
+type otpPage struct {
+	Policy   *OTPPolicy
+	Groups   []string
+	Roles    []string
+	Statuses []*OTPStatus
+	Admin    bool
+}
+
+func (p *otpPage) HasGroup(name string) bool {
+	for _, g := range p.Policy.Groups {
+		if g == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *otpPage) HasRole(name string) bool {
+	for _, r := range p.Policy.Roles {
+		if r == name {
+			return true
+		}
+	}
+	return false
+}
+
+func handleOTP(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	policy, err := LoadOTPPolicy()
+	if err != nil {
+		http.Error(w, "Failed to load the OTP policy: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	statuses, err := ListOTPStatuses(policy)
+	if err != nil {
+		http.Error(w, "Failed to list OTP enrollment: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page := &otpPage{Policy: policy, Statuses: statuses, Admin: HasRole(r, RoleAdmin)}
+	if page.Admin {
+		kc, err := KeycloakAdminClient()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		groups, err := kc.ListGroups()
+		if err != nil {
+			http.Error(w, "Failed to list groups: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, g := range groups {
+			page.Groups = append(page.Groups, g.Name)
+		}
+		roles, err := kc.ListRealmRoles()
+		if err != nil {
+			http.Error(w, "Failed to list roles: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, role := range roles {
+			page.Roles = append(page.Roles, role.Name)
+		}
+		sort.Strings(page.Groups)
+		sort.Strings(page.Roles)
+	}
+	render(w, r, "otp", "Two-factor authentication", page)
+}
+
+func handleOTPPolicy(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodPost) {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	policy := &OTPPolicy{Groups: r.Form["group"], Roles: r.Form["role"]}
+	if policy.Groups == nil {
+		policy.Groups = []string{}
+	}
+	if policy.Roles == nil {
+		policy.Roles = []string{}
+	}
+	otpMutex.Lock()
+	err := SaveOTPPolicy(policy)
+	otpMutex.Unlock()
+	Audit(auditActor(r), "otp.policy", "nsbox", err, policy.String())
+	if err != nil {
+		redirectWithFlash(w, r, "/otp", FlashError, "Failed to save the OTP policy: "+err.Error())
+		return
+	}
+	results := append([]SystemResult{{System: "OTP policy", Message: "saved"}}, EnforceOTPPolicy(auditActor(r))...)
+	redirectWithResults(w, r, "/otp", results)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"embed"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"naive.systems/box/portal/secrets"
+)
+
+/*
+Every portal page is an html/template in templates/ rendered inside the
+shared layout in templates/layout.html, with the pieces shared by several
+pages in templates/partials.html, so that all values are escaped for the
+context they appear in. Pages never contain inline scripts or styles; the
+security headers forbid them. Forms that change anything carry a CSRF
+token, and the handlers behind them report their results as flash messages
+on the page they redirect to.
+*/
+
+//go:embed templates/*.html
+var templateFS embed.FS
+
+//go:embed static/*
+var staticFS embed.FS
+
+var pageTemplates = parsePageTemplates()
+
+func parsePageTemplates() map[string]*template.Template {
+	layout := template.Must(template.ParseFS(templateFS, "templates/layout.html", "templates/partials.html"))
+	names, err := fs.Glob(templateFS, "templates/*.html")
+	if err != nil {
+		log.Fatalf("fs.Glob: %v", err)
+	}
+	pages := map[string]*template.Template{}
+	for _, name := range names {
+		if name == "templates/layout.html" || name == "templates/partials.html" {
+			continue
+		}
+		t := template.Must(template.Must(layout.Clone()).ParseFS(templateFS, name))
+		pages[strings.TrimSuffix(filepath.Base(name), ".html")] = t
+	}
+	return pages
+}
+
+// Page is the data of the layout. Templates find their own data in Data.
+type Page struct {
+	Title     string
+	Product   string
+	Logo      bool
+	User      string
+	Section   *Link
+	CSRFToken string
+	Flashes   []Flash
+	Data      any
+}
+
+type Link struct {
+	Name string
+	URL  string
+}
+
+// pageSection is the breadcrumb between the home page and the current page.
+func pageSection(path string) *Link {
+	switch {
+	case path == "/":
+		return nil
+	case strings.HasPrefix(path, "/profile"):
+		return &Link{"Profile", "/profile"}
+	case strings.HasPrefix(path, "/teams"):
+		return &Link{"Teams", "/teams"}
+	case strings.HasPrefix(path, "/audit"):
+		return &Link{"Audit log", "/audit"}
+	case strings.HasPrefix(path, "/otp"):
+		return &Link{"Two-factor authentication", "/otp"}
+	case strings.HasPrefix(path, "/realm"):
+		return &Link{"Realm", "/realm"}
+	case strings.HasPrefix(path, "/branding"):
+		return &Link{"Branding", "/branding"}
+	default:
+		return &Link{"Users", "/users"}
+	}
+}
+
+// render writes the named page. It is rendered into a buffer first so that
+// a template error does not leave a half-written page behind.
+func render(w http.ResponseWriter, r *http.Request, name, title string, data any) {
+	t, ok := pageTemplates[name]
+	if !ok {
+		log.Printf("No template %s", name)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	branding := currentBranding()
+	page := &Page{
+		Title:     title,
+		Product:   branding.ProductName,
+		Logo:      branding.Logo != "",
+		User:      r.Header.Get("X-Remote-User"),
+		Section:   pageSection(r.URL.Path),
+		CSRFToken: csrfToken(r),
+		Flashes:   takeFlashes(w, r),
+		Data:      data,
+	}
+	var b bytes.Buffer
+	if err := t.ExecuteTemplate(&b, "layout", page); err != nil {
+		log.Printf("Rendering %s: %v", name, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(b.Bytes())
+}
+
+const (
+	FlashOK    = "ok"
+	FlashError = "error"
+)
+
+type Flash struct {
+	Kind string `json:"kind"`
+	Text string `json:"text"`
+}
+
+const flashCookie = "nsbox_flash"
+
+// setFlashes shows the messages on the next page the browser renders. They
+// travel in a cookie, so they must not contain secrets.
+func setFlashes(w http.ResponseWriter, flashes ...Flash) {
+	data, err := json.Marshal(flashes)
+	if err != nil {
+		log.Printf("Failed to encode flash messages: %v", err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     flashCookie,
+		Value:    base64.RawURLEncoding.EncodeToString(data),
+		Path:     "/",
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func takeFlashes(w http.ResponseWriter, r *http.Request) []Flash {
+	c, err := r.Cookie(flashCookie)
+	if err != nil {
+		return nil
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     flashCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	data, err := base64.RawURLEncoding.DecodeString(c.Value)
+	if err != nil {
+		return nil
+	}
+	var flashes []Flash
+	if err := json.Unmarshal(data, &flashes); err != nil {
+		return nil
+	}
+	return flashes
+}
+
+// redirectWithResults shows one flash message per system on the page at
+// url.
+func redirectWithResults(w http.ResponseWriter, r *http.Request, url string, results []SystemResult) {
+	var flashes []Flash
+	for _, result := range results {
+		if result.Err != nil {
+			flashes = append(flashes, Flash{FlashError, result.System + ": " + result.Err.Error()})
+		} else {
+			flashes = append(flashes, Flash{FlashOK, result.System + ": " + result.Message})
+		}
+	}
+	setFlashes(w, flashes...)
+	http.Redirect(w, r, url, http.StatusSeeOther)
+}
+
+// redirectWithFlash shows a single flash message on the page at url.
+func redirectWithFlash(w http.ResponseWriter, r *http.Request, url, kind, text string) {
+	setFlashes(w, Flash{kind, text})
+	http.Redirect(w, r, url, http.StatusSeeOther)
+}
+
+var (
+	csrfKeyOnce sync.Once
+	csrfKey     []byte
+)
+
+// loadCSRFKey reads the key that CSRF tokens are derived from, generating
+// it on first use. Keeping it in the secret store keeps forms that are
+// already open valid across restarts.
+func loadCSRFKey() []byte {
+	csrfKeyOnce.Do(func() {
+		key, err := ReadSecret(secretCSRFKey)
+		if err == nil && len(key) >= 32 {
+			csrfKey = key
+			return
+		}
+		if err != nil && !errors.Is(err, secrets.ErrNotFound) {
+			log.Fatalf("Failed to read the CSRF key: %v", err)
+		}
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			log.Fatalf("Failed to generate CSRF key: %v", err)
+		}
+		if err := WriteSecret(secretCSRFKey, key); err != nil {
+			log.Fatalf("Failed to save the CSRF key: %v", err)
+		}
+		csrfKey = key
+	})
+	return csrfKey
+}
+
+// CSRF tokens expire, so that a token that got out, e.g. in a saved page,
+// does not stay valid for good. They are also bound to the Keycloak session
+// if the access token names one, so that signing out invalidates them.
+const csrfTokenLifetime = 12 * time.Hour
+
+func csrfMAC(r *http.Request, issued string) string {
+	mac := hmac.New(sha256.New, loadCSRFKey())
+	mac.Write([]byte("csrf:" + r.Header.Get("X-Remote-User") + ":" + r.Header.Get("X-Remote-Session") + ":" + issued))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// csrfToken is the token that forms of the signed-in user must send back.
+// Another site can make the browser send the request, but cannot read the
+// token from a portal page.
+func csrfToken(r *http.Request) string {
+	issued := strconv.FormatInt(time.Now().Unix(), 10)
+	return issued + "." + csrfMAC(r, issued)
+}
+
+func checkCSRFToken(r *http.Request) bool {
+	token := r.Header.Get("X-CSRF-Token")
+	if token == "" {
+		token = r.FormValue("csrf_token")
+	}
+	issued, mac, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+	unix, err := strconv.ParseInt(issued, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := time.Since(time.Unix(unix, 0)); age < -time.Minute || age > csrfTokenLifetime {
+		return false
+	}
+	return hmac.Equal([]byte(mac), []byte(csrfMAC(r, issued)))
+}
+
+// protect adds the security headers to every response and rejects requests
+// that may change something unless they carry the CSRF token. API requests
+// carry a bearer token instead of cookies and need no CSRF token.
+func protect(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		header.Set("Content-Security-Policy", "default-src 'none'; script-src 'self'; style-src 'self'; "+
+			"img-src 'self'; form-action 'self'; frame-ancestors 'none'; base-uri 'none'")
+		header.Set("X-Content-Type-Options", "nosniff")
+		header.Set("X-Frame-Options", "DENY")
+		header.Set("Referrer-Policy", "same-origin")
+		// Pages show passwords and API keys.
+		header.Set("Cache-Control", "no-store")
+
+		switch {
+		case strings.HasPrefix(r.URL.Path, apiPrefix):
+		case r.Method == http.MethodGet, r.Method == http.MethodHead, r.Method == http.MethodOptions:
+		default:
+			if !checkCSRFToken(r) {
+				log.Printf("Rejected %s %s from %s: invalid CSRF token", r.Method, r.URL.Path, r.Header.Get("X-Remote-User"))
+				http.Error(w, "Invalid CSRF token. Reload the page and try again.", http.StatusForbidden)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func staticHandler() http.Handler {
+	sub, err := fs.Sub(staticFS, "static")
+	if err != nil {
+		log.Fatalf("fs.Sub: %v", err)
+	}
+	return http.StripPrefix("/static/", http.FileServer(http.FS(sub)))
+}
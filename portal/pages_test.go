@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCSRFToken(t *testing.T) {
+	useTestWorkdir(t)
+
+	request := func(user, session, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/users/update", nil)
+		r.Header.Set("X-Remote-User", user)
+		r.Header.Set("X-Remote-Session", session)
+		r.Header.Set("X-CSRF-Token", token)
+		w := httptest.NewRecorder()
+		protect(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})).ServeHTTP(w, r)
+		return w
+	}
+	page := httptest.NewRequest(http.MethodGet, "/", nil)
+	page.Header.Set("X-Remote-User", "alice")
+	page.Header.Set("X-Remote-Session", "session-1")
+	token := csrfToken(page)
+
+	// An expired token, signed like a fresh one.
+	issued := strconv.FormatInt(time.Now().Add(-csrfTokenLifetime-time.Minute).Unix(), 10)
+	expired := issued + "." + csrfMAC(page, issued)
+	_, mac, _ := strings.Cut(token, ".")
+
+	tests := []struct {
+		name          string
+		user, session string
+		token         string
+		ok            bool
+	}{
+		{"valid", "alice", "session-1", token, true},
+		{"missing", "alice", "session-1", "", false},
+		{"other user", "mallory", "session-1", token, false},
+		{"other session", "alice", "session-2", token, false},
+		{"expired", "alice", "session-1", expired, false},
+		{"changed time", "alice", "session-1", strconv.FormatInt(time.Now().Unix()+1, 10) + "." + mac, false},
+	}
+	for _, tt := range tests {
+		w := request(tt.user, tt.session, tt.token)
+		if ok := w.Code == http.StatusOK; ok != tt.ok {
+			t.Errorf("%s: status %d", tt.name, w.Code)
+		}
+	}
+}
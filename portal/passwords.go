@@ -0,0 +1,345 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// PasswordPolicy is the password policy of the nsbox realm. Zero values
+// disable the rules.
+type PasswordPolicy struct {
+	Length       int  `json:"length"` // minimum
+	Digits       int  `json:"digits"`
+	LowerCase    int  `json:"lowerCase"`
+	UpperCase    int  `json:"upperCase"`
+	SpecialChars int  `json:"specialChars"`
+	NotUsername  bool `json:"notUsername"`
+	NotEmail     bool `json:"notEmail"`
+	History      int  `json:"history"`    // number of recent passwords that cannot be reused
+	ExpireDays   int  `json:"expireDays"` // days until a password has to be changed
+}
+
+// BruteForcePolicy locks out users for a while after failed logins, for
+// waitIncrementSeconds after maxLoginFailures failures and longer after
+// each further failure, up to maxFailureWaitSeconds. The failures are
+// forgotten after maxDeltaTimeSeconds.
+type BruteForcePolicy struct {
+	Enabled               bool `json:"enabled"`
+	MaxLoginFailures      int  `json:"maxLoginFailures"`
+	WaitIncrementSeconds  int  `json:"waitIncrementSeconds"`
+	MaxFailureWaitSeconds int  `json:"maxFailureWaitSeconds"`
+	MaxDeltaTimeSeconds   int  `json:"maxDeltaTimeSeconds"`
+	// Disable the user instead, until an admin enables them again.
+	PermanentLockout bool `json:"permanentLockout"`
+}
+
+func defaultPasswordPolicy() *PasswordPolicy {
+	return &PasswordPolicy{
+		Length:      12,
+		Digits:      1,
+		LowerCase:   1,
+		UpperCase:   1,
+		NotUsername: true,
+		NotEmail:    true,
+		History:     3,
+	}
+}
+
+func defaultBruteForcePolicy() *BruteForcePolicy {
+	return &BruteForcePolicy{
+		Enabled:               true,
+		MaxLoginFailures:      10,
+		WaitIncrementSeconds:  60,
+		MaxFailureWaitSeconds: 900,
+		MaxDeltaTimeSeconds:   12 * 60 * 60,
+	}
+}
+
+// String returns the policy in the syntax of Keycloak, e.g.
+// "length(12) and digits(1)".
+func (p *PasswordPolicy) String() string {
+	var rules []string
+	add := func(name string, n int) {
+		if n > 0 {
+			rules = append(rules, fmt.Sprintf("%s(%d)", name, n))
+		}
+	}
+	add("length", p.Length)
+	add("digits", p.Digits)
+	add("lowerCase", p.LowerCase)
+	add("upperCase", p.UpperCase)
+	add("specialChars", p.SpecialChars)
+	if p.NotUsername {
+		rules = append(rules, "notUsername(undefined)")
+	}
+	if p.NotEmail {
+		rules = append(rules, "notEmail(undefined)")
+	}
+	add("passwordHistory", p.History)
+	add("forceExpiredPasswordChange", p.ExpireDays)
+	return strings.Join(rules, " and ")
+}
+
+func (p *PasswordPolicy) Validate() error {
+	for _, n := range []int{p.Length, p.Digits, p.LowerCase, p.UpperCase, p.SpecialChars, p.History, p.ExpireDays} {
+		if n < 0 {
+			return errors.New("the password policy cannot have negative values")
+		}
+	}
+	if p.Length > 64 {
+		return errors.New("the minimum password length cannot be more than 64")
+	}
+	if classes := p.Digits + p.LowerCase + p.UpperCase + p.SpecialChars; classes > 64 {
+		return errors.New("passwords cannot need more than 64 characters of the required kinds")
+	}
+	return nil
+}
+
+// settings returns the policy as settings of the realm.
+func (p *BruteForcePolicy) settings() map[string]any {
+	return map[string]any{
+		"bruteForceProtected":   p.Enabled,
+		"failureFactor":         p.MaxLoginFailures,
+		"waitIncrementSeconds":  p.WaitIncrementSeconds,
+		"maxFailureWaitSeconds": p.MaxFailureWaitSeconds,
+		"maxDeltaTimeSeconds":   p.MaxDeltaTimeSeconds,
+		"permanentLockout":      p.PermanentLockout,
+	}
+}
+
+func (p *BruteForcePolicy) String() string {
+	if !p.Enabled {
+		return "disabled"
+	}
+	lockout := fmt.Sprintf("locked out for %ds, up to %ds", p.WaitIncrementSeconds, p.MaxFailureWaitSeconds)
+	if p.PermanentLockout {
+		lockout = "disabled"
+	}
+	return fmt.Sprintf("after %d failures within %ds, %s", p.MaxLoginFailures, p.MaxDeltaTimeSeconds, lockout)
+}
+
+func (p *BruteForcePolicy) Validate() error {
+	for _, n := range []int{p.MaxLoginFailures, p.WaitIncrementSeconds, p.MaxFailureWaitSeconds, p.MaxDeltaTimeSeconds} {
+		if n < 0 {
+			return errors.New("the brute-force policy cannot have negative values")
+		}
+	}
+	if p.Enabled && p.MaxLoginFailures == 0 {
+		return errors.New("the number of login failures before a lockout must be at least 1")
+	}
+	if p.WaitIncrementSeconds > p.MaxFailureWaitSeconds {
+		return errors.New("the lockout cannot be longer than the maximum lockout")
+	}
+	return nil
+}
+
+// LoadPasswordPolicy returns the password policy of realm.json, which is
+// empty if it leaves the policy to Keycloak.
+func LoadPasswordPolicy() (*PasswordPolicy, error) {
+	cfg, err := readRealmConfig(false)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.PasswordPolicy == nil {
+		return &PasswordPolicy{}, nil
+	}
+	return cfg.PasswordPolicy, nil
+}
+
+// Characters of generated passwords, without those easily confused with
+// each other such as l, 1, O and 0.
+const (
+	passwordLowerCase = "abcdefghijkmnpqrstuvwxyz"
+	passwordUpperCase = "ABCDEFGHJKLMNPQRSTUVWXYZ"
+	passwordDigits    = "23456789"
+	passwordSpecial   = "!#%+-=?@_"
+)
+
+// Generated passwords are at least this long, however short the policy
+// allows passwords to be.
+const minGeneratedPasswordLength = 16
+
+// GenerateInitialPassword returns a random password that satisfies the
+// password policy of the realm.
+func GenerateInitialPassword() (string, error) {
+	policy, err := LoadPasswordPolicy()
+	if err != nil {
+		return "", err
+	}
+	return generatePassword(policy)
+}
+
+func generatePassword(policy *PasswordPolicy) (string, error) {
+	length := policy.Length
+	if length < minGeneratedPasswordLength {
+		length = minGeneratedPasswordLength
+	}
+	// Special characters are only used if required, since some users type
+	// initial passwords on keyboards that make them hard to find.
+	alphabet := passwordLowerCase + passwordUpperCase + passwordDigits
+	if policy.SpecialChars > 0 {
+		alphabet += passwordSpecial
+	}
+	var password []byte
+	for _, class := range []struct {
+		chars string
+		n     int
+	}{
+		{passwordDigits, policy.Digits},
+		{passwordLowerCase, policy.LowerCase},
+		{passwordUpperCase, policy.UpperCase},
+		{passwordSpecial, policy.SpecialChars},
+	} {
+		for i := 0; i < class.n; i++ {
+			c, err := randomChar(class.chars)
+			if err != nil {
+				return "", err
+			}
+			password = append(password, c)
+		}
+	}
+	for len(password) < length {
+		c, err := randomChar(alphabet)
+		if err != nil {
+			return "", err
+		}
+		password = append(password, c)
+	}
+	// Shuffle, so that the required characters are not always in front.
+	for i := len(password) - 1; i > 0; i-- {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return "", err
+		}
+		password[i], password[j.Int64()] = password[j.Int64()], password[i]
+	}
+	return string(password), nil
+}
+
+func randomChar(chars string) (byte, error) {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
+	if err != nil {
+		return 0, err
+	}
+	return chars[i.Int64()], nil
+}
+
+type passwordsPage struct {
+	Password   *PasswordPolicy
+	BruteForce *BruteForcePolicy
+	// Whether realm.json leaves the policies to Keycloak.
+	KeycloakPassword, KeycloakBruteForce bool
+}
+
+func handleRealmPasswords(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	cfg, err := readRealmConfig(false)
+	if err != nil {
+		http.Error(w, "Failed to load the realm configuration: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page := &passwordsPage{Password: cfg.PasswordPolicy, BruteForce: cfg.BruteForce}
+	if page.Password == nil {
+		page.Password = &PasswordPolicy{}
+		page.KeycloakPassword = true
+	}
+	if page.BruteForce == nil {
+		page.BruteForce = &BruteForcePolicy{}
+		page.KeycloakBruteForce = true
+	}
+	render(w, r, "realm_passwords", "Password policy", page)
+}
+
+func handleSaveRealmPasswords(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodPost) {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	var formErr error
+	formInt := func(name string) int {
+		n, err := strconv.Atoi(strings.TrimSpace(r.FormValue(name)))
+		if err != nil && formErr == nil {
+			formErr = fmt.Errorf("%s must be a number", name)
+		}
+		return n
+	}
+	password := &PasswordPolicy{
+		Length:       formInt("length"),
+		Digits:       formInt("digits"),
+		LowerCase:    formInt("lower_case"),
+		UpperCase:    formInt("upper_case"),
+		SpecialChars: formInt("special_chars"),
+		NotUsername:  r.FormValue("not_username") == "1",
+		NotEmail:     r.FormValue("not_email") == "1",
+		History:      formInt("history"),
+		ExpireDays:   formInt("expire_days"),
+	}
+	bruteForce := &BruteForcePolicy{
+		Enabled:               r.FormValue("brute_force") == "1",
+		MaxLoginFailures:      formInt("max_login_failures"),
+		WaitIncrementSeconds:  formInt("wait_increment_seconds"),
+		MaxFailureWaitSeconds: formInt("max_failure_wait_seconds"),
+		MaxDeltaTimeSeconds:   formInt("max_delta_time_seconds"),
+		PermanentLockout:      r.FormValue("permanent_lockout") == "1",
+	}
+	if formErr == nil {
+		formErr = password.Validate()
+	}
+	if formErr == nil {
+		formErr = bruteForce.Validate()
+	}
+	if formErr != nil {
+		redirectWithFlash(w, r, "/realm/passwords", FlashError, formErr.Error())
+		return
+	}
+
+	realmMutex.Lock()
+	cfg, err := readRealmConfig(false)
+	if err == nil {
+		cfg.PasswordPolicy = password
+		cfg.BruteForce = bruteForce
+		err = saveRealmConfig(cfg)
+	}
+	realmMutex.Unlock()
+	Audit(auditActor(r), "realm.password_policy", "nsbox", err,
+		fmt.Sprintf("password: %s; brute force: %s", password, bruteForce))
+	if err != nil {
+		redirectWithFlash(w, r, "/realm/passwords", FlashError, "Failed to save the policy: "+err.Error())
+		return
+	}
+
+	// Only apply the policies; other changes to realm.json are left for
+	// the realm page.
+	policySettings := map[string]bool{"setting passwordPolicy": true}
+	for k := range bruteForce.settings() {
+		policySettings["setting "+k] = true
+	}
+	results := []SystemResult{{System: "realm.json", Message: "saved"}}
+	full, err := LoadRealmConfig()
+	var changes []*RealmChange
+	if err == nil {
+		changes, err = PlanRealm(full)
+	}
+	if err != nil {
+		results = append(results, SystemResult{System: "Keycloak", Err: err})
+		redirectWithResults(w, r, "/realm/passwords", results)
+		return
+	}
+	var selected []*RealmChange
+	for _, c := range changes {
+		if policySettings[c.Resource] {
+			selected = append(selected, c)
+		}
+	}
+	redirectWithResults(w, r, "/realm/passwords", append(results, ApplyRealmChanges(auditActor(r), selected)...))
+}
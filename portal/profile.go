@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"naive.systems/box/portal/gerrit"
+)
+
+/*
+The profile pages are open to every user who signed in through httpd and
+only ever act on the signed-in user's own accounts. They use the admin
+credentials of each system, so the username must always come from the
+X-Remote-User header and never from the request itself.
+*/
+
+// checkUser writes an error response and returns false unless the request
+// uses the given method and comes from a signed-in user.
+func checkUser(w http.ResponseWriter, r *http.Request, method string) (string, bool) {
+	if r.Method != method {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return "", false
+	}
+	username := r.Header.Get("X-Remote-User")
+	if username == "" {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return "", false
+	}
+	if method == http.MethodPost {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return "", false
+		}
+	}
+	return username, true
+}
+
+// SetUserDisplayName sets the first and last name of the user in every
+// backend, leaving the email addresses alone.
+func SetUserDisplayName(username, firstName, lastName string) []SystemResult {
+	results := []SystemResult{{System: "Keycloak"}, {System: "Gerrit"}, {System: "Redmine"}}
+
+	if user, err := GetKeycloakUser(username); err != nil {
+		results[0].Err = err
+	} else {
+		results[0].Err = SetKeycloakUserName(user.ID, firstName, lastName)
+	}
+
+	if client, err := NewGerritAdminClient(); err != nil {
+		results[1].Err = err
+	} else {
+		results[1].Err = client.SetAccountName(username, firstName+" "+lastName)
+	}
+
+	if user, err := FindRedmineUser(username); err != nil {
+		results[2].Err = err
+	} else {
+		results[2].Err = UpdateRedmineUser(user.ID, map[string]any{
+			"firstname": firstName,
+			"lastname":  lastName,
+		})
+	}
+
+	return finishResults(results, "updated")
+}
+
+// profile is the data of the profile page.
+type profile struct {
+	Username      string
+	Accounts      []accountRow
+	FirstName     string
+	LastName      string
+	HasGerrit     bool
+	SSHKeys       []*gerrit.SSHKey
+	SSHKeysErr    error
+	HasRedmine    bool
+	RedmineKey    string
+	RedmineKeyErr error
+	APITokens     []*APIToken
+	APITokensErr  error
+}
+
+func handleProfile(w http.ResponseWriter, r *http.Request) {
+	username, ok := checkUser(w, r, http.MethodGet)
+	if !ok {
+		return
+	}
+	ua := GetUserAccounts(username)
+	p := &profile{Username: username}
+
+	if ua.Keycloak != nil {
+		p.FirstName, p.LastName = ua.Keycloak.FirstName, ua.Keycloak.LastName
+		p.Accounts = append(p.Accounts, accountRow{System: "Keycloak", Name: p.FirstName + " " + p.LastName, Email: ua.Keycloak.Email})
+	} else {
+		p.Accounts = append(p.Accounts, accountRow{System: "Keycloak", Err: ua.KeycloakErr})
+	}
+	if ua.Gerrit != nil {
+		p.Accounts = append(p.Accounts, accountRow{System: "Gerrit", Name: ua.Gerrit.Name, Email: ua.Gerrit.Email})
+		p.HasGerrit = true
+		client, err := NewGerritAdminClient()
+		if err == nil {
+			p.SSHKeys, err = client.ListSSHKeys(username)
+		}
+		p.SSHKeysErr = err
+	} else {
+		p.Accounts = append(p.Accounts, accountRow{System: "Gerrit", Err: ua.GerritErr})
+	}
+	if ua.Redmine != nil {
+		p.Accounts = append(p.Accounts, accountRow{System: "Redmine", Name: ua.Redmine.FirstName + " " + ua.Redmine.LastName, Email: ua.Redmine.Mail})
+		p.HasRedmine = true
+		p.RedmineKey, p.RedmineKeyErr = GetRedmineAPIKey(ua.Redmine.ID)
+	} else {
+		p.Accounts = append(p.Accounts, accountRow{System: "Redmine", Err: ua.RedmineErr})
+	}
+
+	p.APITokens, p.APITokensErr = ListAPITokens(username)
+
+	render(w, r, "profile", "Profile", p)
+}
+
+func handleProfileName(w http.ResponseWriter, r *http.Request) {
+	username, ok := checkUser(w, r, http.MethodPost)
+	if !ok {
+		return
+	}
+	firstName := strings.TrimSpace(r.FormValue("first_name"))
+	lastName := strings.TrimSpace(r.FormValue("last_name"))
+	if firstName == "" || lastName == "" {
+		redirectWithFlash(w, r, "/profile", FlashError, "First and last name are required")
+		return
+	}
+	log.Printf("User '%s' changes their name", username)
+	results := SetUserDisplayName(username, firstName, lastName)
+	AuditResults(username, "profile.name", username, results)
+	redirectWithResults(w, r, "/profile", results)
+}
+
+func handleAddSSHKey(w http.ResponseWriter, r *http.Request) {
+	username, ok := checkUser(w, r, http.MethodPost)
+	if !ok {
+		return
+	}
+	key := strings.TrimSpace(r.FormValue("key"))
+	if key == "" || strings.ContainsAny(key, "\r\n") {
+		redirectWithFlash(w, r, "/profile", FlashError, "The key must be a single line in OpenSSH format")
+		return
+	}
+	client, err := NewGerritAdminClient()
+	if err == nil {
+		err = client.AddSSHKeyToAccount(username, key)
+	}
+	Audit(username, "profile.add_ssh_key", username, err, "")
+	if err != nil {
+		redirectWithFlash(w, r, "/profile", FlashError, "Failed to add SSH key: "+err.Error())
+		return
+	}
+	log.Printf("User '%s' added an SSH key", username)
+	redirectWithFlash(w, r, "/profile", FlashOK, "SSH key added")
+}
+
+func handleDeleteSSHKey(w http.ResponseWriter, r *http.Request) {
+	username, ok := checkUser(w, r, http.MethodPost)
+	if !ok {
+		return
+	}
+	seq, err := strconv.Atoi(r.FormValue("seq"))
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	client, err := NewGerritAdminClient()
+	if err == nil {
+		err = client.DeleteSSHKey(username, seq)
+	}
+	Audit(username, "profile.delete_ssh_key", username, err, fmt.Sprintf("key %d", seq))
+	if err != nil {
+		redirectWithFlash(w, r, "/profile", FlashError, "Failed to remove SSH key: "+err.Error())
+		return
+	}
+	log.Printf("User '%s' removed SSH key %d", username, seq)
+	redirectWithFlash(w, r, "/profile", FlashOK, "SSH key removed")
+}
+
+func handleGenerateHTTPPassword(w http.ResponseWriter, r *http.Request) {
+	username, ok := checkUser(w, r, http.MethodPost)
+	if !ok {
+		return
+	}
+	client, err := NewGerritAdminClient()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	password, err := client.GenerateHTTPPassword(username)
+	Audit(username, "profile.http_password", username, err, "")
+	if err != nil {
+		http.Error(w, "Failed to generate HTTP password: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User '%s' generated a new Gerrit HTTP password", username)
+	render(w, r, "profile_http_password", "Gerrit HTTP password", struct {
+		Username, Password, Hostname string
+	}{username, password, *hostname})
+}
+
+func handleCreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	username, ok := checkUser(w, r, http.MethodPost)
+	if !ok {
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	token, err := CreateAPIToken(username, name)
+	Audit(username, "profile.create_api_token", username, err, name)
+	if err != nil {
+		redirectWithFlash(w, r, "/profile", FlashError, "Failed to create API token: "+err.Error())
+		return
+	}
+	log.Printf("User '%s' created API token '%s'", username, name)
+	render(w, r, "profile_api_token", "API token", struct {
+		Name, Token, Hostname string
+	}{name, token, *hostname})
+}
+
+func handleRevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	username, ok := checkUser(w, r, http.MethodPost)
+	if !ok {
+		return
+	}
+	id := r.FormValue("id")
+	err := RevokeAPIToken(username, id)
+	Audit(username, "profile.revoke_api_token", username, err, id)
+	if err != nil {
+		redirectWithFlash(w, r, "/profile", FlashError, "Failed to revoke API token: "+err.Error())
+		return
+	}
+	log.Printf("User '%s' revoked API token %s", username, id)
+	redirectWithFlash(w, r, "/profile", FlashOK, "API token revoked")
+}
@@ -0,0 +1,668 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+User provisioning is a saga over Gerrit, Redmine, Keycloak and group
+memberships. Every step has a compensating action, and the state of each
+operation is persisted in ${workdir}/portal/provisioning/<id>.json after every
+transition, so that an operation interrupted by a crash can be retried or
+rolled back by the admin.
+*/
+
+// States of a provisioning operation
+const (
+	ProvisionRunning     = "running"
+	ProvisionCompleted   = "completed"
+	ProvisionRolledBack  = "rolled_back"
+	ProvisionFailed      = "failed"      // compensation failed, needs attention
+	ProvisionInterrupted = "interrupted" // the portal stopped while running
+)
+
+// States of a single step
+const (
+	StepPending     = "pending"
+	StepRunning     = "running"
+	StepDone        = "done"
+	StepFailed      = "failed"
+	StepCompensated = "compensated"
+)
+
+type ProvisionStep struct {
+	Name   string            `json:"name"`
+	Status string            `json:"status"`
+	Error  string            `json:"error,omitempty"`
+	Data   map[string]string `json:"data,omitempty"`
+}
+
+type ProvisionLogEntry struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+type Provisioning struct {
+	ID        string               `json:"id"`
+	Username  string               `json:"username"`
+	FirstName string               `json:"first_name"`
+	LastName  string               `json:"last_name"`
+	Email     string               `json:"email,omitempty"`
+	Groups    []string             `json:"groups,omitempty"`
+	Actor     string               `json:"actor"`
+	State     string               `json:"state"`
+	Created   time.Time            `json:"created"`
+	Updated   time.Time            `json:"updated"`
+	Steps     []*ProvisionStep     `json:"steps"`
+	Log       []*ProvisionLogEntry `json:"log"`
+
+	// The initial Keycloak password is only kept in memory and never
+	// written to disk.
+	password string
+}
+
+type provisionAction struct {
+	name string
+	do   func(p *Provisioning, s *ProvisionStep) error
+	undo func(p *Provisioning, s *ProvisionStep) error
+}
+
+var provisionActions = []provisionAction{
+	{"Gerrit", provisionGerrit, compensateGerrit},
+	{"Redmine", provisionRedmine, compensateRedmine},
+	{"Keycloak", provisionKeycloak, compensateKeycloak},
+	{"Groups", provisionGroups, compensateGroups},
+}
+
+// Provisioning operations are serialized so that two admins cannot work on
+// the same operation (or the same username) at the same time.
+var provisionMutex sync.Mutex
+
+const provisionAttempts = 3
+
+func provisioningDir() string {
+	return filepath.Join(*workdir, "portal", "provisioning")
+}
+
+// NewProvisioning prepares the creation of a user. If email is empty, the
+// user gets DefaultEmail in every system. Groups are teams or, for names that are
+// not teams, Gerrit groups to add the user to.
+func NewProvisioning(actor, username, firstName, lastName, email string, groups []string) (*Provisioning, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	if email == "" {
+		email = DefaultEmail(username)
+	}
+	now := time.Now()
+	p := &Provisioning{
+		ID:        now.UTC().Format("20060102T150405") + "-" + hex.EncodeToString(b),
+		Username:  username,
+		FirstName: firstName,
+		LastName:  lastName,
+		Email:     email,
+		Groups:    groups,
+		Actor:     actor,
+		State:     ProvisionRunning,
+		Created:   now,
+	}
+	for _, a := range provisionActions {
+		p.Steps = append(p.Steps, &ProvisionStep{Name: a.name, Status: StepPending})
+	}
+	return p, nil
+}
+
+func LoadProvisioning(id string) (*Provisioning, error) {
+	if filepath.Base(id) != id || id == "" {
+		return nil, fmt.Errorf("invalid provisioning ID: %s", id)
+	}
+	path := filepath.Join(provisioningDir(), id+".json")
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile(%s): %v", path, err)
+	}
+	var p Provisioning
+	if err := json.Unmarshal(bytes, &p); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal(%s): %v", path, err)
+	}
+	return &p, nil
+}
+
+// ListProvisionings returns all persisted operations, newest first.
+func ListProvisionings() ([]*Provisioning, error) {
+	matches, err := filepath.Glob(filepath.Join(provisioningDir(), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var ps []*Provisioning
+	for _, m := range matches {
+		p, err := LoadProvisioning(filepath.Base(m[:len(m)-len(".json")]))
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, p)
+	}
+	sort.Slice(ps, func(i, j int) bool {
+		return ps[i].Created.After(ps[j].Created)
+	})
+	return ps, nil
+}
+
+func (p *Provisioning) save() error {
+	dir := provisioningDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("os.MkdirAll(%s): %v", dir, err)
+	}
+	p.Updated = time.Now()
+	bytes, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, p.ID+".json")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, bytes, 0600); err != nil {
+		return fmt.Errorf("os.WriteFile(%s): %v", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("os.Rename(%s, %s): %v", tmp, path, err)
+	}
+	return nil
+}
+
+func (p *Provisioning) logf(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	log.Printf("Provisioning %s (%s): %s", p.ID, p.Username, msg)
+	p.Log = append(p.Log, &ProvisionLogEntry{Time: time.Now(), Message: msg})
+}
+
+// Incomplete reports whether the operation needs the admin's attention.
+func (p *Provisioning) Incomplete() bool {
+	return p.State == ProvisionInterrupted || p.State == ProvisionFailed
+}
+
+// Password returns the initial Keycloak password if it was set by this
+// process.
+func (p *Provisioning) Password() string {
+	return p.password
+}
+
+// ErrProvisioningState is returned for an operation that is not in a state
+// that allows the action, e.g. because another admin acted on it first.
+var ErrProvisioningState = errors.New("the provisioning operation is not in the expected state")
+
+// Run executes the pending steps in order. If a step fails, the steps that
+// are done are compensated in reverse order.
+func (p *Provisioning) Run() error {
+	err := p.run(false)
+	Audit(p.Actor, "user.create", p.Username, err, "provisioning "+p.ID)
+	return err
+}
+
+// Retry runs the remaining steps of an interrupted operation.
+func (p *Provisioning) Retry() error {
+	err := p.run(true)
+	Audit(p.Actor, "user.create", p.Username, err, "provisioning "+p.ID)
+	return err
+}
+
+func (p *Provisioning) run(resume bool) error {
+	provisionMutex.Lock()
+	defer provisionMutex.Unlock()
+
+	// Checked under the lock, so that only one of two operations for the
+	// same username can start, and only one of two retries of the same
+	// operation. Resumed operations have created some of the accounts
+	// themselves.
+	if resume {
+		if err := p.reload(p.Interrupted); err != nil {
+			return err
+		}
+	} else if err := CheckUsernameAvailable(p.Username); err != nil {
+		return err
+	}
+
+	p.State = ProvisionRunning
+	p.logf("started by %s", p.Actor)
+	if err := p.save(); err != nil {
+		return err
+	}
+
+	for i, a := range provisionActions {
+		s := p.Steps[i]
+		if s.Status == StepDone {
+			continue
+		}
+		s.Status = StepRunning
+		if err := p.save(); err != nil {
+			return err
+		}
+		err := retry(func() error { return a.do(p, s) })
+		if err == nil {
+			s.Status = StepDone
+			s.Error = ""
+			p.logf("%s: done", s.Name)
+			if err := p.save(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		s.Status = StepFailed
+		s.Error = err.Error()
+		p.logf("%s: %v", s.Name, err)
+		if saveErr := p.save(); saveErr != nil {
+			log.Printf("Provisioning %s: %v", p.ID, saveErr)
+		}
+		if compErr := p.compensate(); compErr != nil {
+			return fmt.Errorf("%s: %v (rollback failed: %v)", s.Name, err, compErr)
+		}
+		return fmt.Errorf("%s: %v", s.Name, err)
+	}
+
+	p.State = ProvisionCompleted
+	p.logf("completed")
+	return p.save()
+}
+
+// RollBack compensates every step that is done or may have been partially
+// done.
+func (p *Provisioning) RollBack() error {
+	provisionMutex.Lock()
+	defer provisionMutex.Unlock()
+
+	if err := p.reload(p.Incomplete); err != nil {
+		return err
+	}
+	p.logf("rollback requested by %s", p.Actor)
+	err := p.compensate()
+	Audit(p.Actor, "user.rollback", p.Username, err, "provisioning "+p.ID)
+	return err
+}
+
+// reload replaces the operation with what is saved, keeping the actor, and
+// returns ErrProvisioningState unless ok then holds. It is called under
+// provisionMutex.
+func (p *Provisioning) reload(ok func() bool) error {
+	saved, err := LoadProvisioning(p.ID)
+	if err != nil {
+		return err
+	}
+	actor := p.Actor
+	*p = *saved
+	p.Actor = actor
+	if !ok() {
+		return fmt.Errorf("%w: %s is %s", ErrProvisioningState, p.ID, p.State)
+	}
+	return nil
+}
+
+func (p *Provisioning) compensate() error {
+	var errs []string
+	for i := len(provisionActions) - 1; i >= 0; i-- {
+		a := provisionActions[i]
+		s := p.Steps[i]
+		if s.Status == StepPending || s.Status == StepCompensated {
+			continue
+		}
+		err := retry(func() error { return a.undo(p, s) })
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", s.Name, err))
+			p.logf("%s: compensation failed: %v", s.Name, err)
+			continue
+		}
+		s.Status = StepCompensated
+		p.logf("%s: compensated", s.Name)
+	}
+	if len(errs) > 0 {
+		p.State = ProvisionFailed
+	} else {
+		p.State = ProvisionRolledBack
+	}
+	if err := p.save(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func retry(f func() error) error {
+	var err error
+	for i := 0; i < provisionAttempts; i++ {
+		if i > 0 {
+			time.Sleep(2 * time.Second)
+		}
+		if err = f(); err == nil {
+			return nil
+		}
+		log.Printf("Attempt %d/%d failed: %v", i+1, provisionAttempts, err)
+	}
+	return err
+}
+
+// MarkInterruptedProvisionings is called on start. Any operation still
+// running was interrupted by a crash or a restart of the portal.
+func MarkInterruptedProvisionings() {
+	ps, err := ListProvisionings()
+	if err != nil {
+		log.Printf("Failed to list provisioning operations: %v", err)
+		return
+	}
+	for _, p := range ps {
+		if p.State != ProvisionRunning {
+			continue
+		}
+		p.State = ProvisionInterrupted
+		p.logf("interrupted")
+		if err := p.save(); err != nil {
+			log.Printf("Provisioning %s: %v", p.ID, err)
+		}
+	}
+}
+
+// ErrUserExists is returned by CheckUsernameAvailable.
+var ErrUserExists = errors.New("user already exists")
+
+// CheckUsernameAvailable makes sure that accounts found while resuming an
+// operation can only have been created by that operation. A deactivated
+// Gerrit account of a former user counts as well, since it would give the
+// new user its SSH keys, groups and history.
+func CheckUsernameAvailable(username string) error {
+	client, err := NewGerritAdminClient()
+	if err != nil {
+		return err
+	}
+	if _, err := client.GetAccount(username); err == nil {
+		return fmt.Errorf("%w in Gerrit: %s", ErrUserExists, username)
+	} else if !isNotFound(err) {
+		return err
+	}
+	if _, err := GetKeycloakUser(username); err == nil {
+		return fmt.Errorf("%w in Keycloak: %s", ErrUserExists, username)
+	} else if !isNotFound(err) {
+		return err
+	}
+	if _, err := FindRedmineUser(username); err == nil {
+		return fmt.Errorf("%w in Redmine: %s", ErrUserExists, username)
+	} else if !isNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func provisionGerrit(p *Provisioning, s *ProvisionStep) error {
+	client, err := NewGerritAdminClient()
+	if err != nil {
+		return err
+	}
+	if s.Data == nil {
+		s.Data = map[string]string{}
+		// An existing account was not created by us and must not be
+		// deactivated on rollback.
+		_, err := client.GetAccount(p.Username)
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+		s.Data["preexisting"] = strconv.FormatBool(err == nil)
+		if err := p.save(); err != nil {
+			return err
+		}
+	}
+	// CheckUsernameAvailable has refused such accounts, but one may have
+	// been created since. It belongs to someone else and is never
+	// reactivated for this user.
+	if s.Data["preexisting"] != "false" {
+		return fmt.Errorf("%w in Gerrit: %s", ErrUserExists, p.Username)
+	}
+	email := p.Email
+	if email == "" {
+		email = DefaultEmail(p.Username)
+	}
+	if err := AddGerritUser(p.Username, p.FirstName+" "+p.LastName, email); err != nil {
+		return err
+	}
+	// Reactivate the account in case this step was compensated before the
+	// operation was interrupted.
+	return client.SetAccountActive(p.Username, true)
+}
+
+func compensateGerrit(p *Provisioning, s *ProvisionStep) error {
+	// Unknown means the step was interrupted before doing anything.
+	if s.Data["preexisting"] != "false" {
+		return nil
+	}
+	client, err := NewGerritAdminClient()
+	if err != nil {
+		return err
+	}
+	return client.SetAccountActive(p.Username, false)
+}
+
+func provisionRedmine(p *Provisioning, s *ProvisionStep) error {
+	// The user may have been created right before a crash or by a failed
+	// attempt, in which case AddRedmineUser returns it.
+	id, err := AddRedmineUser(p.Username, p.FirstName, p.LastName, p.Email)
+	if err != nil {
+		return err
+	}
+	s.Data = map[string]string{"user_id": strconv.Itoa(id)}
+	return nil
+}
+
+func compensateRedmine(p *Provisioning, s *ProvisionStep) error {
+	user, err := FindRedmineUser(p.Username)
+	if isNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// Without a recorded ID, the step was interrupted right after creating
+	// the user, which did not exist before (see CheckUsernameAvailable).
+	if s.Data["user_id"] != "" && strconv.Itoa(user.ID) != s.Data["user_id"] {
+		return fmt.Errorf("Redmine user %s has ID %d instead of %s", p.Username, user.ID, s.Data["user_id"])
+	}
+	return DeleteRedmineUser(user.ID)
+}
+
+func provisionKeycloak(p *Provisioning, s *ProvisionStep) error {
+	// The user may have been created right before a crash, in which case
+	// the password is lost and a new one is set.
+	if user, err := GetKeycloakUser(p.Username); err == nil {
+		password, err := GenerateInitialPassword()
+		if err != nil {
+			return err
+		}
+		if err := SetKeycloakUserPassword(p.Username, password); err != nil {
+			return err
+		}
+		s.Data = map[string]string{"user_id": user.ID}
+		p.password = password
+		return nil
+	} else if !isNotFound(err) {
+		return err
+	}
+	password, err := AddKeycloakUser(p.Username, p.FirstName, p.LastName, p.Email)
+	if err != nil {
+		return err
+	}
+	user, err := GetKeycloakUser(p.Username)
+	if err != nil {
+		return err
+	}
+	s.Data = map[string]string{"user_id": user.ID}
+	p.password = password
+	return nil
+}
+
+func compensateKeycloak(p *Provisioning, s *ProvisionStep) error {
+	user, err := GetKeycloakUser(p.Username)
+	if isNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if s.Data["user_id"] != "" && user.ID != s.Data["user_id"] {
+		return fmt.Errorf("Keycloak user %s has ID %s instead of %s", p.Username, user.ID, s.Data["user_id"])
+	}
+	return DeleteKeycloakUser(user.ID)
+}
+
+func provisionGroups(p *Provisioning, s *ProvisionStep) error {
+	if len(p.Groups) == 0 {
+		return nil
+	}
+	client, err := NewGerritAdminClient()
+	if err != nil {
+		return err
+	}
+	for _, group := range p.Groups {
+		if IsTeam(group) {
+			results, err := AddTeamMember(group, p.Username)
+			if err == nil {
+				err = resultsError(results)
+			}
+			if err != nil {
+				return fmt.Errorf("team %s: %v", group, err)
+			}
+			continue
+		}
+		if err := client.AddMemberToGroup(group, p.Username); err != nil {
+			return fmt.Errorf("%s: %v", group, err)
+		}
+	}
+	return nil
+}
+
+func compensateGroups(p *Provisioning, s *ProvisionStep) error {
+	if len(p.Groups) == 0 {
+		return nil
+	}
+	client, err := NewGerritAdminClient()
+	if err != nil {
+		return err
+	}
+	for _, group := range p.Groups {
+		if IsTeam(group) {
+			results, err := RemoveTeamMember(group, p.Username)
+			if err == nil {
+				err = resultsError(results)
+			}
+			if err != nil {
+				return fmt.Errorf("team %s: %v", group, err)
+			}
+			continue
+		}
+		err := client.RemoveMemberFromGroup(group, p.Username)
+		if err != nil && !isNotFound(err) {
+			return fmt.Errorf("%s: %v", group, err)
+		}
+	}
+	return nil
+}
+
+func handleListProvisionings(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	ps, err := ListProvisionings()
+	if err != nil {
+		http.Error(w, "Failed to list provisioning operations: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	all := r.URL.Query().Get("all") != ""
+	if !all {
+		var incomplete []*Provisioning
+		for _, p := range ps {
+			if p.Incomplete() {
+				incomplete = append(incomplete, p)
+			}
+		}
+		ps = incomplete
+	}
+	render(w, r, "provisionings", "Provisioning", struct {
+		All           bool
+		Provisionings []*Provisioning
+	}{all, ps})
+}
+
+func (p *Provisioning) Interrupted() bool {
+	return p.State == ProvisionInterrupted
+}
+
+func handleViewProvisioning(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	p, err := LoadProvisioning(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	render(w, r, "provisioning", "Provisioning "+p.ID, p)
+}
+
+func handleRetryProvisioning(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodPost) {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	p, err := LoadProvisioning(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	p.Actor = r.Header.Get("X-Remote-User")
+	if err := p.Retry(); errors.Is(err, ErrProvisioningState) {
+		http.Error(w, "Only interrupted operations can be retried", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create user (see /provisioning/view?id=%s): %v", p.ID, err),
+			http.StatusInternalServerError)
+		return
+	}
+	writePasswordPage(w, r, p.Username, p.Password(), nil)
+}
+
+func handleRollBackProvisioning(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodPost) {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	p, err := LoadProvisioning(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	p.Actor = r.Header.Get("X-Remote-User")
+	next := "/provisioning/view?id=" + url.QueryEscape(p.ID)
+	if err := p.RollBack(); errors.Is(err, ErrProvisioningState) {
+		http.Error(w, "Only incomplete operations can be rolled back", http.StatusConflict)
+		return
+	} else if err != nil {
+		redirectWithFlash(w, r, next, FlashError, "Failed to roll back: "+err.Error())
+		return
+	}
+	redirectWithFlash(w, r, next, FlashOK, "Rolled back")
+}
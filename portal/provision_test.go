@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRetryProvisioningChecksSavedState(t *testing.T) {
+	useTestWorkdir(t)
+	p, err := NewProvisioning("admin", "alice", "Alice", "Liddell", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.State = ProvisionInterrupted
+	if err := p.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two admins load the interrupted operation, and the first one's retry
+	// is running when the second one's starts.
+	first, err := LoadProvisioning(p.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := LoadProvisioning(p.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.State = ProvisionRunning
+	if err := first.save(); err != nil {
+		t.Fatal(err)
+	}
+	second.Actor = "bob"
+	if err := second.Retry(); !errors.Is(err, ErrProvisioningState) {
+		t.Errorf("Retry() = %v, want ErrProvisioningState", err)
+	}
+	if err := second.RollBack(); !errors.Is(err, ErrProvisioningState) {
+		t.Errorf("RollBack() = %v, want ErrProvisioningState", err)
+	}
+
+	saved, err := LoadProvisioning(p.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range saved.Steps {
+		if s.Status != StepPending {
+			t.Errorf("step %s is %s, want %s", s.Name, s.Status, StepPending)
+		}
+	}
+}
@@ -0,0 +1,810 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"naive.systems/box/portal/keycloak"
+)
+
+/*
+The desired state of the nsbox realm is described in
+${workdir}/keycloak/realm.json, which is written with the defaults on the
+first start and may be edited afterwards. On every start the portal compares
+it with the live realm, logs the planned changes and applies them; admins
+can review the plan, apply it and download an export of the realm at
+/realm. Changes only ever add or update: nothing that is missing from the
+file is removed from the realm, because teams create their own groups and
+admins may add clients by hand.
+
+In strings, {hostname} stands for -hostname, and the smtpServer setting
+"{smtp}" stands for the relay given by the -smtp_* flags. The password and
+brute-force policies have their own sections, which admins can also edit at
+/realm/passwords, and take precedence over the equivalent settings. So does
+the LDAP section, see ldap.go. The branding adds the login theme and the
+display name unless the settings name them, see branding.go.
+*/
+
+type RealmConfig struct {
+	// Fields of the realm representation, e.g. "resetPasswordAllowed".
+	// Objects are compared field by field and arrays as sets.
+	Settings map[string]any `json:"settings"`
+	// The defaults of Keycloak apply if these are left out.
+	PasswordPolicy *PasswordPolicy   `json:"passwordPolicy,omitempty"`
+	BruteForce     *BruteForcePolicy `json:"bruteForce,omitempty"`
+	LDAP           *LDAPConfig       `json:"ldap,omitempty"`
+	Clients        []*RealmClient    `json:"clients"`
+	Roles          []*RealmRole      `json:"roles"`
+	Groups         []*RealmGroup     `json:"groups"`
+}
+
+type RealmClient struct {
+	ClientID        string                     `json:"clientId"`
+	RedirectURIs    []string                   `json:"redirectUris"`
+	WebOrigins      []string                   `json:"webOrigins"`
+	Attributes      map[string]string          `json:"attributes,omitempty"`
+	ProtocolMappers []*keycloak.ProtocolMapper `json:"protocolMappers"`
+}
+
+type RealmRole struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type RealmGroup struct {
+	Name       string   `json:"name"`
+	RealmRoles []string `json:"realmRoles"`
+}
+
+const smtpPlaceholder = "{smtp}"
+
+// Keycloak returns secrets such as the SMTP password masked like this.
+const maskedSecret = "**********"
+
+func realmConfigPath() string {
+	return filepath.Join(*workdir, "keycloak", "realm.json")
+}
+
+func realmBackupDir() string {
+	return filepath.Join(*workdir, "backup", "realm")
+}
+
+func defaultRealmConfig() *RealmConfig {
+	var redirectURIs []string
+	for _, port := range []string{"8443", "9440", "9441", "9442", "9443", "9444"} {
+		redirectURIs = append(redirectURIs, "https://{hostname}:"+port+"/*")
+	}
+	cfg := &RealmConfig{
+		Settings: map[string]any{
+			"enabled":                true,
+			"registrationAllowed":    false,
+			"resetPasswordAllowed":   true,
+			"rememberMe":             false,
+			"loginWithEmailAllowed":  true,
+			"duplicateEmailsAllowed": false,
+			"smtpServer":             smtpPlaceholder,
+		},
+		PasswordPolicy: defaultPasswordPolicy(),
+		BruteForce:     defaultBruteForcePolicy(),
+		Clients: []*RealmClient{{
+			ClientID:     "httpd",
+			RedirectURIs: redirectURIs,
+			WebOrigins:   []string{"+"},
+			Attributes:   httpdLogoutAttributes(),
+			ProtocolMappers: []*keycloak.ProtocolMapper{{
+				Name:           "roles",
+				Protocol:       "openid-connect",
+				ProtocolMapper: "oidc-usermodel-realm-role-mapper",
+				Config: map[string]string{
+					"claim.name":           "roles",
+					"multivalued":          "true",
+					"jsonType.label":       "String",
+					"id.token.claim":       "true",
+					"access.token.claim":   "true",
+					"userinfo.token.claim": "true",
+				},
+			}, {
+				Name:           "audience",
+				Protocol:       "openid-connect",
+				ProtocolMapper: "oidc-audience-mapper",
+				Config: map[string]string{
+					"included.client.audience": tokenAudience,
+					"id.token.claim":           "false",
+					"access.token.claim":       "true",
+				},
+			}},
+		}},
+		Groups: []*RealmGroup{},
+	}
+	for _, role := range portalRoles {
+		cfg.Roles = append(cfg.Roles, &RealmRole{role.name, role.description})
+	}
+	return cfg
+}
+
+// readRealmConfig reads realm.json as written, with the placeholders,
+// writing the defaults first if it does not exist.
+func readRealmConfig(expand bool) (*RealmConfig, error) {
+	path := realmConfigPath()
+	if !exists(path) {
+		if err := saveRealmConfig(defaultRealmConfig()); err != nil {
+			return nil, err
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile(%s): %v", path, err)
+	}
+	if expand {
+		data = []byte(strings.ReplaceAll(string(data), "{hostname}", *hostname))
+	}
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.DisallowUnknownFields()
+	var cfg RealmConfig
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if cfg.Settings == nil {
+		cfg.Settings = map[string]any{}
+	}
+	return &cfg, nil
+}
+
+func saveRealmConfig(cfg *RealmConfig) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := realmConfigPath() + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("os.WriteFile(%s): %v", tmp, err)
+	}
+	return os.Rename(tmp, realmConfigPath())
+}
+
+// LoadRealmConfig reads realm.json and expands the placeholders, the
+// policies and the branding into settings. The portal roles and the back-channel logout of
+// httpd are added if the file leaves them out, since the portal cannot
+// work without the roles and cannot revoke sessions without the logout.
+func LoadRealmConfig() (*RealmConfig, error) {
+	cfg, err := readRealmConfig(true)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.PasswordPolicy != nil {
+		cfg.Settings["passwordPolicy"] = cfg.PasswordPolicy.String()
+	}
+	if cfg.BruteForce != nil {
+		for k, v := range cfg.BruteForce.settings() {
+			cfg.Settings[k] = v
+		}
+	}
+	branding, err := LoadBranding()
+	if err != nil {
+		return nil, err
+	}
+	if branding != nil {
+		for k, v := range brandingRealmSettings(branding) {
+			if _, ok := cfg.Settings[k]; !ok {
+				cfg.Settings[k] = v
+			}
+		}
+	}
+	if cfg.Settings["smtpServer"] == smtpPlaceholder {
+		smtpServer, err := keycloakSMTPServer()
+		if err != nil {
+			// Keycloak works without email, but must not offer password
+			// resets or verify emails with links that are never sent.
+			log.Printf("WARNING: not configuring email in Keycloak, so password resets "+
+				"and email verification are turned off: %v", err)
+			delete(cfg.Settings, "smtpServer")
+			cfg.Settings["resetPasswordAllowed"] = false
+			cfg.Settings["verifyEmail"] = false
+		} else {
+			cfg.Settings["smtpServer"] = smtpServer
+		}
+	}
+	for _, role := range portalRoles {
+		if cfg.role(role.name) == nil {
+			cfg.Roles = append(cfg.Roles, &RealmRole{role.name, role.description})
+		}
+	}
+	for _, client := range cfg.Clients {
+		if client.ClientID != "httpd" {
+			continue
+		}
+		if client.Attributes == nil {
+			client.Attributes = map[string]string{}
+		}
+		for k, v := range httpdLogoutAttributes() {
+			if _, ok := client.Attributes[k]; !ok {
+				client.Attributes[k] = v
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// httpdLogoutAttributes make Keycloak tell httpd when a session ends, so
+// that mod_auth_openidc drops it from its cache at once instead of keeping
+// it for up to OIDCSessionMaxDuration. Keycloak cannot reach the HTTPS
+// ports by the hostname, which resolves to itself in its container, so it
+// uses the plain HTTP port of the host; the logout tokens are signed.
+func httpdLogoutAttributes() map[string]string {
+	return map[string]string{
+		"backchannel.logout.url":              "http://host.containers.internal:8080/OIDCRedirectURI?logout=backchannel",
+		"backchannel.logout.session.required": "true",
+	}
+}
+
+func (cfg *RealmConfig) role(name string) *RealmRole {
+	for _, role := range cfg.Roles {
+		if role.Name == name {
+			return role
+		}
+	}
+	return nil
+}
+
+// keycloakSMTPServer returns the SMTP settings of the realm for the relay
+// used by the portal.
+func keycloakSMTPServer() (map[string]any, error) {
+	addr, err := keycloakSMTPRelayAddr()
+	if err != nil {
+		return nil, err
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP relay %s: %v", addr, err)
+	}
+	smtpServer := map[string]any{
+		"host":            host,
+		"port":            port,
+		"from":            SMTPFrom(),
+		"fromDisplayName": "nsbox",
+	}
+	if *smtpUsername != "" {
+		password, err := os.ReadFile(*smtpPasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("os.ReadFile(%s): %v", *smtpPasswordFile, err)
+		}
+		smtpServer["auth"] = "true"
+		smtpServer["starttls"] = "true"
+		smtpServer["user"] = *smtpUsername
+		smtpServer["password"] = strings.TrimSpace(string(password))
+	}
+	return smtpServer, nil
+}
+
+const (
+	RealmCreate = "create"
+	RealmUpdate = "update"
+)
+
+// RealmChange is a difference between realm.json and the live realm.
+type RealmChange struct {
+	Kind     string
+	Resource string // e.g. "client httpd"
+	Detail   string // free of secrets
+
+	apply func() error
+}
+
+func (c *RealmChange) String() string {
+	if c.Detail == "" {
+		return c.Kind + " " + c.Resource
+	}
+	return c.Kind + " " + c.Resource + ": " + c.Detail
+}
+
+// PlanRealm returns the changes that make the live realm match cfg, in the
+// order they must be applied.
+func PlanRealm(cfg *RealmConfig) ([]*RealmChange, error) {
+	kc, err := KeycloakAdminClient()
+	if err != nil {
+		return nil, err
+	}
+	var changes []*RealmChange
+
+	realm, err := kc.GetRealm()
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for key := range cfg.Settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		want := jsonValue(cfg.Settings[key])
+		if realmValueEqual(want, realm[key]) {
+			continue
+		}
+		key := key
+		changes = append(changes, &RealmChange{
+			Kind:     RealmUpdate,
+			Resource: "setting " + key,
+			Detail:   describeRealmValue(realm[key]) + " -> " + describeRealmValue(want),
+			apply:    func() error { return kc.UpdateRealm(map[string]any{key: want}) },
+		})
+	}
+
+	for _, client := range cfg.Clients {
+		clientChanges, err := planRealmClient(kc, client)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, clientChanges...)
+	}
+
+	for _, role := range cfg.Roles {
+		role := role
+		have, err := kc.GetRealmRole(role.Name)
+		if errors.Is(err, keycloak.ErrNotFound) {
+			changes = append(changes, &RealmChange{
+				Kind:     RealmCreate,
+				Resource: "role " + role.Name,
+				Detail:   role.Description,
+				apply: func() error {
+					return kc.CreateRealmRole(&keycloak.Role{Name: role.Name, Description: role.Description})
+				},
+			})
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if have.Description != role.Description {
+			changes = append(changes, &RealmChange{
+				Kind:     RealmUpdate,
+				Resource: "role " + role.Name,
+				Detail:   fmt.Sprintf("description %q -> %q", have.Description, role.Description),
+				apply: func() error {
+					return kc.UpdateRealmRole(role.Name, &keycloak.Role{Name: role.Name, Description: role.Description})
+				},
+			})
+		}
+	}
+
+	for _, group := range cfg.Groups {
+		groupChanges, err := planRealmGroup(kc, group)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, groupChanges...)
+	}
+
+	if cfg.LDAP != nil {
+		realmID, _ := realm["id"].(string)
+		ldapChanges, err := planLDAP(kc, realmID, cfg.LDAP)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, ldapChanges...)
+	}
+	return changes, nil
+}
+
+func planRealmClient(kc *keycloak.Client, client *RealmClient) ([]*RealmChange, error) {
+	have, err := kc.FindClient(client.ClientID)
+	if errors.Is(err, keycloak.ErrNotFound) {
+		return []*RealmChange{{
+			Kind:     RealmCreate,
+			Resource: "client " + client.ClientID,
+			Detail:   "redirect URIs " + strings.Join(client.RedirectURIs, " "),
+			apply:    func() error { return createRealmClient(kc, client) },
+		}}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var changes []*RealmChange
+	attributesMatch := true
+	for k, v := range client.Attributes {
+		if have.Attributes[k] != v {
+			attributesMatch = false
+		}
+	}
+	if !sameStrings(have.RedirectURIs, client.RedirectURIs) || !sameStrings(have.WebOrigins, client.WebOrigins) || !attributesMatch {
+		changes = append(changes, &RealmChange{
+			Kind:     RealmUpdate,
+			Resource: "client " + client.ClientID,
+			Detail: fmt.Sprintf("redirect URIs %s, web origins %s",
+				strings.Join(client.RedirectURIs, " "), strings.Join(client.WebOrigins, " ")),
+			apply: func() error {
+				// Keycloak merges the attributes into those it has.
+				return kc.UpdateClient(have.ID, map[string]any{
+					"redirectUris": client.RedirectURIs,
+					"webOrigins":   client.WebOrigins,
+					"attributes":   client.Attributes,
+				})
+			},
+		})
+	}
+
+	mappers, err := kc.ListProtocolMappers(have.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, want := range client.ProtocolMappers {
+		want := want
+		resource := fmt.Sprintf("protocol mapper %s of client %s", want.Name, client.ClientID)
+		var existing *keycloak.ProtocolMapper
+		for _, m := range mappers {
+			if m.Name == want.Name {
+				existing = m
+			}
+		}
+		if existing == nil {
+			changes = append(changes, &RealmChange{
+				Kind:     RealmCreate,
+				Resource: resource,
+				Detail:   want.ProtocolMapper,
+				apply:    func() error { return kc.CreateProtocolMapper(have.ID, want) },
+			})
+			continue
+		}
+		if mapperMatches(existing, want) {
+			continue
+		}
+		changes = append(changes, &RealmChange{
+			Kind:     RealmUpdate,
+			Resource: resource,
+			Detail:   want.ProtocolMapper,
+			apply: func() error {
+				mapper := *want
+				mapper.ID = existing.ID
+				return kc.UpdateProtocolMapper(have.ID, &mapper)
+			},
+		})
+	}
+	return changes, nil
+}
+
+// mapperMatches reports whether the mapper has the type and at least the
+// config of want.
+func mapperMatches(m, want *keycloak.ProtocolMapper) bool {
+	if m.ProtocolMapper != want.ProtocolMapper {
+		return false
+	}
+	for k, v := range want.Config {
+		if m.Config[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// createRealmClient creates a confidential client with its protocol
+// mappers. The ID and secret of the httpd client are kept in the secret
+// store, where the httpd configuration takes them from.
+func createRealmClient(kc *keycloak.Client, client *RealmClient) error {
+	id, err := kc.CreateClient(&keycloak.OIDCClient{
+		ClientID:     client.ClientID,
+		Enabled:      true,
+		RedirectURIs: client.RedirectURIs,
+		WebOrigins:   client.WebOrigins,
+		Attributes:   client.Attributes,
+	})
+	if err != nil {
+		return err
+	}
+	for _, mapper := range client.ProtocolMappers {
+		if err := kc.CreateProtocolMapper(id, mapper); err != nil {
+			return err
+		}
+	}
+	if client.ClientID != "httpd" {
+		return nil
+	}
+	secret, err := kc.GetClientSecret(id)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(map[string]string{"id": id, "secret": secret}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteSecret(secretHttpdClient, data)
+}
+
+func planRealmGroup(kc *keycloak.Client, group *RealmGroup) ([]*RealmChange, error) {
+	addRoles := func(groupID string, names []string) error {
+		var roles []*keycloak.Role
+		for _, name := range names {
+			role, err := kc.GetRealmRole(name)
+			if err != nil {
+				return err
+			}
+			roles = append(roles, role)
+		}
+		if len(roles) == 0 {
+			return nil
+		}
+		return kc.AddGroupRealmRoles(groupID, roles...)
+	}
+
+	have, err := kc.FindGroup(group.Name)
+	if errors.Is(err, keycloak.ErrNotFound) {
+		return []*RealmChange{{
+			Kind:     RealmCreate,
+			Resource: "group " + group.Name,
+			Detail:   "roles " + strings.Join(group.RealmRoles, " "),
+			apply: func() error {
+				g, err := kc.CreateGroup(group.Name)
+				if err != nil {
+					return err
+				}
+				return addRoles(g.ID, group.RealmRoles)
+			},
+		}}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	roles, err := kc.ListGroupRealmRoles(have.ID, false)
+	if err != nil {
+		return nil, err
+	}
+	granted := map[string]bool{}
+	for _, role := range roles {
+		granted[role.Name] = true
+	}
+	var missing []string
+	for _, name := range group.RealmRoles {
+		if !granted[name] {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) == 0 {
+		return nil, nil
+	}
+	return []*RealmChange{{
+		Kind:     RealmUpdate,
+		Resource: "group " + group.Name,
+		Detail:   "grant roles " + strings.Join(missing, " "),
+		apply:    func() error { return addRoles(have.ID, missing) },
+	}}, nil
+}
+
+// jsonValue converts v to what decoding its JSON yields, so that it can be
+// compared with the representations returned by Keycloak.
+func jsonValue(v any) any {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var out any
+	if err := json.Unmarshal(data, &out); err != nil {
+		return v
+	}
+	return out
+}
+
+// realmValueEqual reports whether the live value have satisfies want.
+// Objects only need to have the fields of want, arrays are compared as
+// sets and masked secrets are assumed to be equal.
+func realmValueEqual(want, have any) bool {
+	switch want := want.(type) {
+	case map[string]any:
+		have, ok := have.(map[string]any)
+		if !ok {
+			return false
+		}
+		for k, v := range want {
+			if !realmValueEqual(v, have[k]) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		have, ok := have.([]any)
+		if !ok || len(have) != len(want) {
+			return false
+		}
+		for _, w := range want {
+			found := false
+			for _, h := range have {
+				if realmValueEqual(w, h) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	case string:
+		return have == want || have == maskedSecret
+	default:
+		return have == want
+	}
+}
+
+// describeRealmValue formats a value for the plan, with passwords masked.
+func describeRealmValue(v any) string {
+	if v == nil {
+		return "(unset)"
+	}
+	if m, ok := v.(map[string]any); ok && m["password"] != nil {
+		masked := map[string]any{}
+		for k, v := range m {
+			masked[k] = v
+		}
+		masked["password"] = maskedSecret
+		v = masked
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+var realmMutex sync.Mutex
+
+// ApplyRealmChanges backs up the realm and applies the changes on behalf
+// of actor, returning one result per change.
+func ApplyRealmChanges(actor string, changes []*RealmChange) []SystemResult {
+	realmMutex.Lock()
+	defer realmMutex.Unlock()
+	if len(changes) == 0 {
+		return nil
+	}
+	path, err := BackUpRealm()
+	if err != nil {
+		return []SystemResult{{System: "Keycloak", Err: fmt.Errorf("not applying the plan, failed to back up the realm: %v", err)}}
+	}
+	log.Printf("Backed up the nsbox realm to %s", path)
+	var results []SystemResult
+	for _, c := range changes {
+		log.Printf("Realm: %s", c)
+		err := c.apply()
+		Audit(actor, "realm.apply", c.Resource, err, c.Kind+" "+c.Detail)
+		results = append(results, SystemResult{
+			System:  "Keycloak (" + c.Resource + ")",
+			Message: c.Kind + "d",
+			Err:     err,
+		})
+	}
+	return results
+}
+
+// ApplyRealmConfig makes the live realm match realm.json.
+func ApplyRealmConfig() error {
+	cfg, err := LoadRealmConfig()
+	if err != nil {
+		return err
+	}
+	changes, err := PlanRealm(cfg)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		log.Print("The nsbox realm matches realm.json")
+		return nil
+	}
+	var errs []string
+	for _, r := range ApplyRealmChanges(AuditSystemActor, changes) {
+		if r.Err != nil {
+			errs = append(errs, r.System+": "+r.Err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// BackUpRealm saves an export of the realm in ${workdir}/backup/realm and
+// returns its path.
+func BackUpRealm() (string, error) {
+	kc, err := KeycloakAdminClient()
+	if err != nil {
+		return "", err
+	}
+	export, err := kc.ExportRealm()
+	if err != nil {
+		return "", err
+	}
+	dir := realmBackupDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("os.MkdirAll(%s): %v", dir, err)
+	}
+	path := filepath.Join(dir, "realm-"+time.Now().UTC().Format("20060102T150405Z")+".json")
+	if err := os.WriteFile(path, export, 0600); err != nil {
+		return "", fmt.Errorf("os.WriteFile(%s): %v", path, err)
+	}
+	return path, nil
+}
+
+type realmPage struct {
+	Path    string
+	Changes []*RealmChange
+}
+
+func handleRealm(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	cfg, err := LoadRealmConfig()
+	if err != nil {
+		http.Error(w, "Failed to load the realm configuration: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	changes, err := PlanRealm(cfg)
+	if err != nil {
+		http.Error(w, "Failed to plan the realm configuration: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	render(w, r, "realm", "Realm configuration", &realmPage{realmConfigPath(), changes})
+}
+
+func handleApplyRealm(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodPost) {
+		return
+	}
+	cfg, err := LoadRealmConfig()
+	if err != nil {
+		redirectWithFlash(w, r, "/realm", FlashError, "Failed to load the realm configuration: "+err.Error())
+		return
+	}
+	changes, err := PlanRealm(cfg)
+	if err != nil {
+		redirectWithFlash(w, r, "/realm", FlashError, "Failed to plan the realm configuration: "+err.Error())
+		return
+	}
+	if len(changes) == 0 {
+		redirectWithFlash(w, r, "/realm", FlashOK, "Nothing to apply; the realm already matches")
+		return
+	}
+	redirectWithResults(w, r, "/realm", ApplyRealmChanges(auditActor(r), changes))
+}
+
+// handleExportRealm downloads the realm with its clients, groups and roles,
+// without users and with secrets masked by Keycloak.
+func handleExportRealm(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	kc, err := KeycloakAdminClient()
+	if err != nil {
+		http.Error(w, "Failed to export the realm: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	export, err := kc.ExportRealm()
+	if err != nil {
+		http.Error(w, "Failed to export the realm: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	Audit(auditActor(r), "realm.export", "nsbox", nil, "")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="nsbox-realm-%s.json"`, time.Now().UTC().Format("20060102")))
+	w.Write(export)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadRealmConfigWithoutEmail(t *testing.T) {
+	useTestWorkdir(t)
+	if err := os.MkdirAll(filepath.Dir(realmConfigPath()), 0700); err != nil {
+		t.Fatal(err)
+	}
+	// The defaults: Mailpit on the loopback address of -bind, which the
+	// keycloak container cannot reach.
+	if *smtpRelay != "" || *keycloakSMTPRelay != "" || *mailpitSMTPBind != "" || *bindIP != "127.0.0.1" {
+		t.Skip("SMTP flags are not the defaults")
+	}
+
+	cfg, err := LoadRealmConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cfg.Settings["smtpServer"]; ok {
+		t.Errorf("smtpServer = %v, want none", cfg.Settings["smtpServer"])
+	}
+	for _, key := range []string{"resetPasswordAllowed", "verifyEmail"} {
+		if cfg.Settings[key] != false {
+			t.Errorf("%s = %v, want false", key, cfg.Settings[key])
+		}
+	}
+
+	*keycloakSMTPRelay = "mail.example.com:25"
+	defer func() { *keycloakSMTPRelay = "" }()
+	cfg, err = LoadRealmConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Settings["smtpServer"] == nil || cfg.Settings["resetPasswordAllowed"] != true {
+		t.Errorf("settings = %v, want email and password resets", cfg.Settings)
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"naive.systems/box/portal/gerrit"
+)
+
+/*
+Reconciliation compares the users in Keycloak, Gerrit and Redmine. Keycloak
+is the source of truth: Gerrit and Redmine accounts are created, renamed,
+re-addressed, locked and unlocked to match it. Accounts that only exist in
+Gerrit or Redmine are reported as orphans and only deactivated on request,
+never automatically.
+*/
+
+var reconcileInterval = flag.Duration("reconcile_interval", 0, "Reconcile users and apply automatic fixes at this interval (0 disables)")
+
+const (
+	DriftMissing = "missing" // no account for a Keycloak user
+	DriftOrphan  = "orphan"  // account without a Keycloak user
+	DriftName    = "name"
+	DriftEmail   = "email"
+	DriftStatus  = "status"
+)
+
+// UserDrift is a difference between a Keycloak user and their account in
+// Gerrit or Redmine.
+type UserDrift struct {
+	Username string
+	System   string
+	Kind     string
+	Want     string // according to Keycloak
+	Have     string // according to System
+
+	fix func() error
+}
+
+// Automatic reports whether the fix is safe to apply without asking.
+func (d *UserDrift) Automatic() bool {
+	return d.Kind != DriftOrphan
+}
+
+func (d *UserDrift) Key() string {
+	return d.Username + "/" + d.System + "/" + d.Kind
+}
+
+func (d *UserDrift) Fix() error {
+	log.Printf("Fixing %s drift of %s in %s", d.Kind, d.Username, d.System)
+	return d.fix()
+}
+
+// reconciledUser is whether a user should be compared across the systems.
+// Built-in and service accounts are set up differently in each system.
+func reconciledUser(username string) bool {
+	return username != "" && !isBuiltinUser(username) &&
+		!strings.HasPrefix(username, "service-account-")
+}
+
+func statusString(active bool) string {
+	if active {
+		return "active"
+	}
+	return "disabled"
+}
+
+// Reconcile lists the users of all three systems and returns their drifts,
+// sorted by username.
+func Reconcile() ([]*UserDrift, error) {
+	kcUsers, err := ListKeycloakUsers()
+	if err != nil {
+		return nil, fmt.Errorf("Keycloak: %v", err)
+	}
+	client, err := NewGerritAdminClient()
+	if err != nil {
+		return nil, fmt.Errorf("Gerrit: %v", err)
+	}
+	gerritAccounts, err := client.QueryAccounts("is:active OR is:inactive")
+	if err != nil {
+		return nil, fmt.Errorf("Gerrit: %v", err)
+	}
+	redmineUsers, err := ListRedmineUsers()
+	if err != nil {
+		return nil, fmt.Errorf("Redmine: %v", err)
+	}
+
+	gerritByName := map[string]*gerrit.Account{}
+	for _, a := range gerritAccounts {
+		if reconciledUser(a.Username) {
+			gerritByName[a.Username] = a
+		}
+	}
+	redmineByName := map[string]*RedmineUser{}
+	for _, u := range redmineUsers {
+		if reconciledUser(u.Login) {
+			redmineByName[u.Login] = u
+		}
+	}
+
+	var drifts []*UserDrift
+	for _, kc := range kcUsers {
+		if !reconciledUser(kc.Username) {
+			continue
+		}
+		drifts = append(drifts, gerritDrifts(client, kc, gerritByName[kc.Username])...)
+		drifts = append(drifts, redmineDrifts(kc, redmineByName[kc.Username])...)
+		delete(gerritByName, kc.Username)
+		delete(redmineByName, kc.Username)
+	}
+
+	for username, a := range gerritByName {
+		if a.Inactive {
+			continue
+		}
+		username := username
+		drifts = append(drifts, &UserDrift{
+			Username: username, System: "Gerrit", Kind: DriftOrphan, Have: "active",
+			fix: func() error { return client.SetAccountActive(username, false) },
+		})
+	}
+	for username, u := range redmineByName {
+		if u.Status == RedmineStatusLocked {
+			continue
+		}
+		id := u.ID
+		drifts = append(drifts, &UserDrift{
+			Username: username, System: "Redmine", Kind: DriftOrphan, Have: "active",
+			fix: func() error { return SetRedmineUserLocked(id, true) },
+		})
+	}
+
+	sort.SliceStable(drifts, func(i, j int) bool {
+		return drifts[i].Username < drifts[j].Username
+	})
+	return drifts, nil
+}
+
+func gerritDrifts(client *gerrit.Client, kc *KeycloakUser, a *gerrit.Account) []*UserDrift {
+	username := kc.Username
+	name := kc.FirstName + " " + kc.LastName
+	if a == nil {
+		return []*UserDrift{{
+			Username: username, System: "Gerrit", Kind: DriftMissing, Want: username,
+			fix: func() error {
+				if err := AddGerritUser(username, name, kc.Email); err != nil {
+					return err
+				}
+				if !kc.Enabled {
+					return client.SetAccountActive(username, false)
+				}
+				return nil
+			},
+		}}
+	}
+	var drifts []*UserDrift
+	if a.Name != name {
+		drifts = append(drifts, &UserDrift{
+			Username: username, System: "Gerrit", Kind: DriftName, Want: name, Have: a.Name,
+			fix: func() error { return client.SetAccountName(username, name) },
+		})
+	}
+	if kc.Email != "" && !strings.EqualFold(a.Email, kc.Email) {
+		drifts = append(drifts, &UserDrift{
+			Username: username, System: "Gerrit", Kind: DriftEmail, Want: kc.Email, Have: a.Email,
+			fix: func() error { return client.SetAccountEmail(username, kc.Email) },
+		})
+	}
+	if a.Inactive == kc.Enabled {
+		drifts = append(drifts, &UserDrift{
+			Username: username, System: "Gerrit", Kind: DriftStatus,
+			Want: statusString(kc.Enabled), Have: statusString(!a.Inactive),
+			fix: func() error { return client.SetAccountActive(username, kc.Enabled) },
+		})
+	}
+	return drifts
+}
+
+func redmineDrifts(kc *KeycloakUser, u *RedmineUser) []*UserDrift {
+	username := kc.Username
+	if u == nil {
+		return []*UserDrift{{
+			Username: username, System: "Redmine", Kind: DriftMissing, Want: username,
+			fix: func() error {
+				id, err := AddRedmineUser(username, kc.FirstName, kc.LastName, kc.Email)
+				if err != nil {
+					return err
+				}
+				if !kc.Enabled {
+					return SetRedmineUserLocked(id, true)
+				}
+				return nil
+			},
+		}}
+	}
+	var drifts []*UserDrift
+	if u.FirstName != kc.FirstName || u.LastName != kc.LastName {
+		drifts = append(drifts, &UserDrift{
+			Username: username, System: "Redmine", Kind: DriftName,
+			Want: kc.FirstName + " " + kc.LastName, Have: u.FirstName + " " + u.LastName,
+			fix: func() error {
+				return UpdateRedmineUser(u.ID, map[string]any{
+					"firstname": kc.FirstName,
+					"lastname":  kc.LastName,
+				})
+			},
+		})
+	}
+	if kc.Email != "" && !strings.EqualFold(u.Mail, kc.Email) {
+		drifts = append(drifts, &UserDrift{
+			Username: username, System: "Redmine", Kind: DriftEmail, Want: kc.Email, Have: u.Mail,
+			fix: func() error { return UpdateRedmineUser(u.ID, map[string]any{"mail": kc.Email}) },
+		})
+	}
+	active := u.Status != RedmineStatusLocked
+	if active != kc.Enabled {
+		drifts = append(drifts, &UserDrift{
+			Username: username, System: "Redmine", Kind: DriftStatus,
+			Want: statusString(kc.Enabled), Have: statusString(active),
+			fix: func() error { return SetRedmineUserLocked(u.ID, !kc.Enabled) },
+		})
+	}
+	return drifts
+}
+
+// FixDrifts applies the fixes of the drifts on behalf of actor and returns
+// one result per drift.
+func FixDrifts(actor string, drifts []*UserDrift) []SystemResult {
+	provisionMutex.Lock()
+	defer provisionMutex.Unlock()
+	var results []SystemResult
+	for _, d := range drifts {
+		err := d.Fix()
+		Audit(actor, "reconcile.fix", d.Username, err,
+			fmt.Sprintf("%s %s: %q -> %q", d.System, d.Kind, d.Have, d.Want))
+		results = append(results, SystemResult{
+			System:  fmt.Sprintf("%s (%s, %s)", d.System, d.Username, d.Kind),
+			Message: "fixed",
+			Err:     err,
+		})
+	}
+	return results
+}
+
+// StartReconciler applies the automatic fixes every -reconcile_interval.
+func StartReconciler() {
+	if *reconcileInterval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			time.Sleep(*reconcileInterval)
+			drifts, err := Reconcile()
+			if err != nil {
+				log.Printf("Reconcile: %v", err)
+				continue
+			}
+			var automatic []*UserDrift
+			for _, d := range drifts {
+				if d.Automatic() {
+					automatic = append(automatic, d)
+				} else {
+					log.Printf("Reconcile: %s has an orphan account in %s", d.Username, d.System)
+				}
+			}
+			for _, r := range FixDrifts(AuditSystemActor, automatic) {
+				if r.Err != nil {
+					log.Printf("Reconcile: %s: %v", r.System, r.Err)
+				}
+			}
+		}
+	}()
+}
+
+func handleReconcile(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	drifts, err := Reconcile()
+	if err != nil {
+		http.Error(w, "Failed to reconcile users: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	render(w, r, "reconcile", "User reconciliation", drifts)
+}
+
+// FixLabel is the label of the button that fixes the drift.
+func (d *UserDrift) FixLabel() string {
+	switch d.Kind {
+	case DriftMissing:
+		return "Create"
+	case DriftOrphan:
+		return "Deactivate"
+	default:
+		return "Fix"
+	}
+}
+
+func handleReconcileFix(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodPost) {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	drifts, err := Reconcile()
+	if err != nil {
+		http.Error(w, "Failed to reconcile users: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	all := r.FormValue("all") == "1"
+	key := r.FormValue("key")
+	var selected []*UserDrift
+	for _, d := range drifts {
+		if (all && d.Automatic()) || d.Key() == key {
+			selected = append(selected, d)
+		}
+	}
+	if len(selected) == 0 {
+		redirectWithFlash(w, r, "/reconcile", FlashOK, "Nothing to fix; the drift may have been fixed already")
+		return
+	}
+	redirectWithResults(w, r, "/reconcile", FixDrifts(auditActor(r), selected))
+}
@@ -5,8 +5,10 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -75,7 +77,7 @@ func StartRedmine() error {
 	// sometimes, but I couldn't reproduce reliably.
 	// TODO: fix the race properly
 	time.Sleep(5 * time.Second)
-	// TODO: update all user emails in case that hostname changed
+	// Emails of other users are migrated by the rename-host command.
 	if err := UpdateRedmineAdminEmail(); err != nil {
 		StopRedmine()
 		return err
@@ -100,9 +102,13 @@ func UpgradeRedmine() error {
 }
 
 func RunRedmine() error {
+	smtpHost, smtpPort := smtpRelayHostPort()
 	cmd, err := PodmanRunRedmine(false, "/home/redmine/run",
 		"--bind", *bindIP,
-		"--hostname", *hostname)
+		"--hostname", *hostname,
+		"--email-domains", strings.Join(allowedEmailDomains(), ","),
+		"--smtp-address", smtpHost,
+		"--smtp-port", smtpPort)
 	if err != nil {
 		return fmt.Errorf("failed to start Redmine: %v", err)
 	}
@@ -169,11 +175,18 @@ func StopRedmine() {
 	PodmanKill("redmine")
 }
 
-func AddRedmineUser(username, firstname, lastname string) (int, error) {
-	adminKeyFile := filepath.Join(*workdir, "redmine", "data", "admin_api_key.txt")
-	redmineKey, err := os.ReadFile(adminKeyFile)
-	if err != nil {
-		return 0, fmt.Errorf("error reading redmine key: %v", err)
+// AddRedmineUser creates the user and returns its ID. The email defaults to
+// DefaultEmail if empty. Creating users is not idempotent in Redmine, so a
+// user that already exists, e.g. because an earlier attempt failed after
+// Redmine had created it, is returned instead.
+func AddRedmineUser(username, firstname, lastname, email string) (int, error) {
+	if email == "" {
+		email = DefaultEmail(username)
+	}
+	if user, err := FindRedmineUser(username); err == nil {
+		return user.ID, nil
+	} else if !isNotFound(err) {
+		return 0, err
 	}
 
 	body := map[string]any{
@@ -181,131 +194,284 @@ func AddRedmineUser(username, firstname, lastname string) (int, error) {
 			"login":             username,
 			"firstname":         firstname,
 			"lastname":          lastname,
-			"mail":              username + "@" + *hostname,
+			"mail":              email,
 			"generate_password": true, // Let Redmine generate the password
 		},
 	}
-
-	jsonBody, err := json.Marshal(body)
-	if err != nil {
-		return 0, fmt.Errorf("error marshalling JSON: %v", err)
+	var userResponse struct {
+		User struct {
+			ID int `json:"id"`
+		} `json:"user"`
 	}
+	if err := redmineRequest("POST", "/users.json", body, http.StatusCreated, &userResponse); err != nil {
+		return 0, err
+	}
+	return userResponse.User.ID, nil
+}
 
-	req, err := http.NewRequest("POST",
-		fmt.Sprintf("http://%s:3000/users.json", *bindIP),
-		bytes.NewBuffer(jsonBody))
+func DeleteRedmineUser(userID int) error {
+	return redmineRequest("DELETE", fmt.Sprintf("/users/%d.json", userID), nil, http.StatusNoContent, nil)
+}
 
-	if err != nil {
-		return 0, fmt.Errorf("error creating request: %v", err)
+func UpdateRedmineAdminEmail() error {
+	body := map[string]any{
+		"user": map[string]any{
+			"mail": "admin@" + *hostname,
+		},
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-Redmine-API-Key", strings.TrimSpace(string(redmineKey)))
+	const maxRetries = 5
+	const retryDelay = 2 * time.Second
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return 0, fmt.Errorf("error sending request: %v", err)
+	var err error
+	for i := 0; i < maxRetries; i++ {
+		if err = redmineRequest("PUT", "/my/account.json", body, http.StatusNoContent, nil); err == nil {
+			return nil
+		}
+		fmt.Printf("Error sending request: %v, retrying in %v seconds...\n", err, retryDelay.Seconds())
+		time.Sleep(retryDelay)
 	}
-	defer resp.Body.Close()
+	return fmt.Errorf("after %d retries, final error: %v", maxRetries, err)
+}
 
-	if resp.StatusCode != http.StatusCreated {
-		return 0, fmt.Errorf("unexpected status from Redmine: %s (not http.StatusCreated)", resp.Status)
+func RedmineAdminKey() (string, error) {
+	redmineKey, err := ReadSecretString(secretRedmineAdminKey)
+	if err != nil {
+		return "", fmt.Errorf("error reading redmine key: %v", err)
 	}
+	return redmineKey, nil
+}
 
-	var userResponse struct {
-		User struct {
-			ID int `json:"id"`
-		} `json:"user"`
-	}
-	decoder := json.NewDecoder(resp.Body)
-	err = decoder.Decode(&userResponse)
-	if err != nil {
-		return 0, fmt.Errorf("error decoding Redmine response: %v", err)
+type RedmineUser struct {
+	ID        int    `json:"id"`
+	Login     string `json:"login"`
+	FirstName string `json:"firstname"`
+	LastName  string `json:"lastname"`
+	Mail      string `json:"mail"`
+	Status    int    `json:"status"`
+}
+
+// ListRedmineUsers returns all users regardless of their status.
+func ListRedmineUsers() ([]*RedmineUser, error) {
+	return listRedmineUsers("")
+}
+
+// listRedmineUsers returns the users that match the name filter of
+// users.json, or all users, page by page.
+func listRedmineUsers(name string) ([]*RedmineUser, error) {
+	var users []*RedmineUser
+	for offset := 0; ; {
+		path := fmt.Sprintf("/users.json?status=&limit=100&offset=%d", offset)
+		if name != "" {
+			path += "&name=" + url.QueryEscape(name)
+		}
+		var page struct {
+			Users      []*RedmineUser `json:"users"`
+			TotalCount int            `json:"total_count"`
+		}
+		if err := redmineRequest("GET", path, nil, http.StatusOK, &page); err != nil {
+			return nil, err
+		}
+		users = append(users, page.Users...)
+		offset += len(page.Users)
+		if len(page.Users) == 0 || offset >= page.TotalCount {
+			return users, nil
+		}
 	}
+}
 
-	return userResponse.User.ID, nil
+func UpdateRedmineUser(userID int, fields map[string]any) error {
+	body := map[string]any{"user": fields}
+	return redmineRequest("PUT", fmt.Sprintf("/users/%d.json", userID), body, http.StatusNoContent, nil)
 }
 
-func DeleteRedmineUser(userID int) error {
-	adminKeyFile := filepath.Join(*workdir, "redmine", "data", "admin_api_key.txt")
-	redmineKey, err := os.ReadFile(adminKeyFile)
-	if err != nil {
-		return fmt.Errorf("error reading Redmine key: %v", err)
+func RenameRedmineHost(oldHostname, newHostname string) error {
+	cmd := exec.Command("podman", "exec", "redmine",
+		"/home/redmine/rename_host",
+		"--old-hostname", oldHostname,
+		"--new-hostname", newHostname)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %v", cmd.String(), err)
 	}
+	return nil
+}
+
+// RedmineToken is an API key, Atom key, session or other token of a user.
+type RedmineToken struct {
+	Action    string    `json:"action"` // e.g. "api"
+	CreatedOn time.Time `json:"created_on"`
+}
 
-	req, err := http.NewRequest("DELETE", fmt.Sprintf("http://%s:3000/users/%d.json", *bindIP, userID), nil)
+// RedmineUserTokens returns the tokens of the user, and deletes them too if
+// revoke is set. Redmine has no API for other users' tokens.
+func RedmineUserTokens(login string, revoke bool) ([]*RedmineToken, error) {
+	args := []string{"exec", "redmine", "/home/redmine/user_tokens", "--login", login}
+	if revoke {
+		args = append(args, "--revoke")
+	}
+	cmd := exec.Command("podman", args...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
 	if err != nil {
-		return fmt.Errorf("error creating DELETE request for Redmine user: %v", err)
+		return nil, fmt.Errorf("%s: %v", cmd.String(), err)
+	}
+	// Rails may print warnings before the result.
+	lines := bytes.Split(bytes.TrimSpace(out), []byte("\n"))
+	var tokens []*RedmineToken
+	if err := json.Unmarshal(lines[len(lines)-1], &tokens); err != nil {
+		return nil, fmt.Errorf("error decoding the tokens of %s: %v", login, err)
 	}
+	return tokens, nil
+}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-Redmine-API-Key", strings.TrimSpace(string(redmineKey)))
+// Values of the status field of Redmine users
+const (
+	RedmineStatusActive     = 1
+	RedmineStatusRegistered = 2
+	RedmineStatusLocked     = 3
+)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+func FindRedmineUser(login string) (*RedmineUser, error) {
+	// The name filter also matches first names, last names and emails, so
+	// the user may be on any page of the results.
+	users, err := listRedmineUsers(login)
 	if err != nil {
-		return fmt.Errorf("error sending DELETE request to Redmine: %v", err)
+		return nil, err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusNoContent {
-		return fmt.Errorf("error deleting user from Redmine, got status: %s", resp.Status)
+	for _, user := range users {
+		if user.Login == login {
+			return user, nil
+		}
 	}
-
-	return nil
+	return nil, fmt.Errorf("%w in Redmine: %s", ErrUserNotFound, login)
 }
 
-func UpdateRedmineAdminEmail() error {
-	adminKeyFile := filepath.Join(*workdir, "redmine", "data", "admin_api_key.txt")
-	redmineKey, err := os.ReadFile(adminKeyFile)
-	if err != nil {
-		return fmt.Errorf("error reading redmine key: %v", err)
+// GetRedmineAPIKey returns the API key of the user. Redmine creates the key
+// on first access if the user has none yet.
+func GetRedmineAPIKey(userID int) (string, error) {
+	var resp struct {
+		User struct {
+			APIKey string `json:"api_key"`
+		} `json:"user"`
+	}
+	if err := redmineRequest("GET", fmt.Sprintf("/users/%d.json", userID), nil, http.StatusOK, &resp); err != nil {
+		return "", err
+	}
+	if resp.User.APIKey == "" {
+		return "", fmt.Errorf("no API key in Redmine response for user %d", userID)
 	}
+	return resp.User.APIKey, nil
+}
 
-	body := map[string]any{
-		"user": map[string]any{
-			"mail": "admin@" + *hostname,
-		},
+func SetRedmineUserLocked(userID int, locked bool) error {
+	status := RedmineStatusActive
+	if locked {
+		status = RedmineStatusLocked
 	}
+	return UpdateRedmineUser(userID, map[string]any{"status": status})
+}
+
+type RedmineGroup struct {
+	ID    int            `json:"id"`
+	Name  string         `json:"name"`
+	Users []*RedmineUser `json:"users,omitempty"`
+}
 
-	jsonBody, err := json.Marshal(body)
+// redmineRequest sends a JSON request with the admin API key and decodes
+// the response into out if it is not nil.
+func redmineRequest(method, path string, body any, wantStatus int, out any) error {
+	redmineKey, err := RedmineAdminKey()
 	if err != nil {
-		return fmt.Errorf("error marshalling JSON: %v", err)
+		return err
 	}
 
-	req, err := http.NewRequest("PUT",
-		fmt.Sprintf("http://%s:3000/my/account.json", *bindIP),
-		bytes.NewBuffer(jsonBody))
+	var reader io.Reader
+	if body != nil {
+		jsonBody, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("error marshalling JSON: %v", err)
+		}
+		reader = bytes.NewReader(jsonBody)
+	}
 
+	req, err := http.NewRequest(method, fmt.Sprintf("http://%s:3000%s", *bindIP, path), reader)
 	if err != nil {
 		return fmt.Errorf("error creating request: %v", err)
 	}
-
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-Redmine-API-Key", strings.TrimSpace(string(redmineKey)))
+	req.Header.Set("X-Redmine-API-Key", redmineKey)
 
 	client := &http.Client{}
-	var resp *http.Response
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending request: %v", err)
+	}
+	defer resp.Body.Close()
 
-	const maxRetries = 5
-	const retryDelay = 2 * time.Second
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w in Redmine: %s", ErrNotFound, path)
+	}
+	if resp.StatusCode != wantStatus {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status from Redmine: %s (not %d): %s", resp.Status, wantStatus, msg)
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("error decoding Redmine response: %v", err)
+		}
+	}
+	return nil
+}
 
-	for i := 0; i < maxRetries; i++ {
-		if resp, err = client.Do(req); err == nil {
-			break
+func FindRedmineGroup(name string) (*RedmineGroup, error) {
+	var page struct {
+		Groups []*RedmineGroup `json:"groups"`
+	}
+	if err := redmineRequest("GET", "/groups.json", nil, http.StatusOK, &page); err != nil {
+		return nil, err
+	}
+	for _, g := range page.Groups {
+		if g.Name == name {
+			return GetRedmineGroup(g.ID)
 		}
-		fmt.Printf("Error sending request: %v, retrying in %v seconds...\n", err, retryDelay.Seconds())
-		time.Sleep(retryDelay)
 	}
-	if err != nil {
-		return fmt.Errorf("after %d retries, final error: %v", maxRetries, err)
+	return nil, fmt.Errorf("%w in Redmine: group %s", ErrNotFound, name)
+}
+
+// GetRedmineGroup returns the group including its users.
+func GetRedmineGroup(groupID int) (*RedmineGroup, error) {
+	var resp struct {
+		Group *RedmineGroup `json:"group"`
 	}
-	defer resp.Body.Close()
+	path := fmt.Sprintf("/groups/%d.json?include=users", groupID)
+	if err := redmineRequest("GET", path, nil, http.StatusOK, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Group, nil
+}
 
-	if resp.StatusCode != http.StatusNoContent {
-		return fmt.Errorf("unexpected status from Redmine: %s (not http.StatusNoContent)", resp.Status)
+func CreateRedmineGroup(name string) (*RedmineGroup, error) {
+	var resp struct {
+		Group *RedmineGroup `json:"group"`
 	}
+	body := map[string]any{"group": map[string]any{"name": name}}
+	if err := redmineRequest("POST", "/groups.json", body, http.StatusCreated, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Group, nil
+}
 
-	return nil
+func DeleteRedmineGroup(groupID int) error {
+	return redmineRequest("DELETE", fmt.Sprintf("/groups/%d.json", groupID), nil, http.StatusNoContent, nil)
+}
+
+func AddRedmineGroupMember(groupID, userID int) error {
+	body := map[string]any{"user_id": userID}
+	return redmineRequest("POST", fmt.Sprintf("/groups/%d/users.json", groupID), body, http.StatusNoContent, nil)
+}
+
+func RemoveRedmineGroupMember(groupID, userID int) error {
+	return redmineRequest("DELETE", fmt.Sprintf("/groups/%d/users/%d.json", groupID, userID), nil, http.StatusNoContent, nil)
 }
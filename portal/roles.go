@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"naive.systems/box/portal/keycloak"
+)
+
+/*
+Access to the portal is controlled by realm roles in Keycloak. The roles of
+the signed-in user are put into the "roles" claim of the access token by a
+protocol mapper of the httpd client, and httpd forwards the token in the
+X-Access-Token header. authenticate verifies the token and sets the
+X-Remote-User and X-Remote-Roles headers from its claims, replacing any that
+the request came with, so that handlers only ever see roles that Keycloak
+signed. With -verify_token=false, the headers that httpd sets from the
+claims are trusted as they are. Roles can be granted to users directly or to
+Keycloak groups, such as those of teams.
+*/
+
+const (
+	// Full access to the portal.
+	RoleAdmin = "nsbox-admin"
+	// Create, import, change and remove users, and manage team membership.
+	RoleUserManager = "user-manager"
+	// Manage teams and projects.
+	RoleProjectManager = "project-manager"
+)
+
+var portalRoles = []struct{ name, description string }{
+	{RoleAdmin, "Full access to the nsbox portal"},
+	{RoleUserManager, "Manage users and teams in the nsbox portal"},
+	{RoleProjectManager, "Manage teams and projects in the nsbox portal"},
+}
+
+// UserRoles returns the portal roles of the user that sent the request.
+func UserRoles(r *http.Request) map[string]bool {
+	roles := map[string]bool{}
+	for _, role := range strings.Split(r.Header.Get("X-Remote-Roles"), ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			roles[role] = true
+		}
+	}
+	return roles
+}
+
+// HasRole reports whether the user has any of the roles. Admins have every
+// role.
+func HasRole(r *http.Request, roles ...string) bool {
+	userRoles := UserRoles(r)
+	if userRoles[RoleAdmin] {
+		return true
+	}
+	for _, role := range roles {
+		if userRoles[role] {
+			return true
+		}
+	}
+	return false
+}
+
+// requireRole only passes requests from signed-in users with any of the
+// roles on to h.
+func requireRole(h http.HandlerFunc, roles ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Remote-User") == "" || !HasRole(r, roles...) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func httpdClientID() (string, error) {
+	data, err := ReadSecret(secretHttpdClient)
+	if err != nil {
+		return "", err
+	}
+	var secret struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(data, &secret); err != nil {
+		return "", fmt.Errorf("json.Unmarshal(%s): %v", secretHttpdClient, err)
+	}
+	return secret.ID, nil
+}
+
+// GetKeycloakUserRoles returns the effective realm roles of a user, for
+// requests that do not come with a token from Keycloak.
+func GetKeycloakUserRoles(username string) ([]string, error) {
+	user, err := GetKeycloakUser(username)
+	if err != nil {
+		return nil, err
+	}
+	kc, err := KeycloakAdminClient()
+	if err != nil {
+		return nil, err
+	}
+	roles, err := kc.ListUserRealmRoles(user.ID, true)
+	if err != nil {
+		return nil, err
+	}
+	return roleNames(roles), nil
+}
+
+// GetKeycloakGroupRoles returns the effective realm roles that a group
+// grants to its members.
+func GetKeycloakGroupRoles(name string) ([]string, error) {
+	group, err := GetKeycloakGroup(name)
+	if err != nil {
+		return nil, err
+	}
+	kc, err := KeycloakAdminClient()
+	if err != nil {
+		return nil, err
+	}
+	roles, err := kc.ListGroupRealmRoles(group.ID, true)
+	if err != nil {
+		return nil, err
+	}
+	return roleNames(roles), nil
+}
+
+func roleNames(roles []*keycloak.Role) []string {
+	var names []string
+	for _, role := range roles {
+		names = append(names, role.Name)
+	}
+	return names
+}
+
+// ErrMissingRoles is wrapped by the checks that keep users from gaining
+// roles through the accounts and groups they manage.
+var ErrMissingRoles = errors.New("permission denied")
+
+// rolesNotHeld returns the roles that the user who sent the request does
+// not have. Admins have every role.
+func rolesNotHeld(r *http.Request, roles []string) []string {
+	userRoles := UserRoles(r)
+	if userRoles[RoleAdmin] {
+		return nil
+	}
+	var missing []string
+	for _, role := range roles {
+		if !userRoles[role] {
+			missing = append(missing, role)
+		}
+	}
+	return missing
+}
+
+// CheckCanManageUser refuses changes to a user with a realm role that the
+// user who sent the request lacks. Otherwise a user manager could change the
+// email of an admin, send the password reset there and sign in as the admin.
+func CheckCanManageUser(r *http.Request, username string) error {
+	if UserRoles(r)[RoleAdmin] {
+		return nil
+	}
+	roles, err := GetKeycloakUserRoles(username)
+	if isNotFound(err) {
+		// Accounts that only exist in Gerrit or Redmine have no roles.
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if missing := rolesNotHeld(r, roles); len(missing) > 0 {
+		return fmt.Errorf("%w: %s has the roles %s, which you do not have",
+			ErrMissingRoles, username, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// checkCanManage writes the error of CheckCanManageUser or
+// CheckCanManageGroup and returns false if there is one.
+func checkCanManage(w http.ResponseWriter, err error) bool {
+	if errors.Is(err, ErrMissingRoles) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	} else if err != nil {
+		http.Error(w, "Failed to look up roles: "+err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// CheckCanManageGroup refuses changes to the members of a Keycloak group,
+// and creating or deleting a team with its name, if the group grants a realm
+// role that the user who sent the request lacks.
+func CheckCanManageGroup(r *http.Request, name string) error {
+	if UserRoles(r)[RoleAdmin] {
+		return nil
+	}
+	roles, err := GetKeycloakGroupRoles(name)
+	if isNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if missing := rolesNotHeld(r, roles); len(missing) > 0 {
+		return fmt.Errorf("%w: group %s grants the roles %s, which you do not have",
+			ErrMissingRoles, name, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// GrantKeycloakAdminRole grants the admin user the admin role, which
+// realm.json creates.
+func GrantKeycloakAdminRole() error {
+	kc, err := KeycloakAdminClient()
+	if err != nil {
+		return err
+	}
+	admin, err := GetKeycloakUser("admin")
+	if err != nil {
+		return err
+	}
+	role, err := kc.GetRealmRole(RoleAdmin)
+	if err != nil {
+		return err
+	}
+	return kc.AddUserRealmRoles(admin.ID, role)
+}
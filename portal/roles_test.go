@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"naive.systems/box/portal/keycloak"
+	"naive.systems/box/portal/secrets"
+)
+
+// useTestWorkdir points -workdir at a new directory with its own secret
+// store.
+func useTestWorkdir(t *testing.T) {
+	oldWorkdir := *workdir
+	*workdir = t.TempDir()
+	t.Cleanup(func() { *workdir = oldWorkdir })
+
+	key, err := secrets.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := secrets.Open(secretStorePath(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretStore.once.Do(func() {})
+	secretStore.store = store
+}
+
+// fakeRealm answers the lookups of users, groups and their roles in the
+// nsbox realm and fails the test on any other request.
+type fakeRealm struct {
+	t      *testing.T
+	users  map[string][]string // roles by username
+	groups map[string][]string // roles by group name
+
+	mutex    sync.Mutex
+	requests []string
+}
+
+func useFakeRealm(t *testing.T, users, groups map[string][]string) *fakeRealm {
+	f := &fakeRealm{t: t, users: users, groups: groups}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+
+	const password = "secret"
+	if err := WriteSecret(secretKeycloakAdminPassword, []byte(password)); err != nil {
+		t.Fatal(err)
+	}
+	keycloakAdminClient.Lock()
+	keycloakAdminClient.client = keycloak.NewClient(server.URL, "nsbox", "admin", password, server.Client())
+	keycloakAdminClient.Unlock()
+	t.Cleanup(func() {
+		keycloakAdminClient.Lock()
+		keycloakAdminClient.client = nil
+		keycloakAdminClient.Unlock()
+	})
+	return f
+}
+
+func (f *fakeRealm) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if r.URL.Path == "/realms/master/protocol/openid-connect/token" {
+		w.Write([]byte(`{"access_token":"token","expires_in":60}`))
+		return
+	}
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+
+	const prefix = "/admin/realms/nsbox"
+	path := strings.TrimPrefix(r.URL.Path, prefix)
+	var out any
+	switch {
+	case r.Method != http.MethodGet:
+		f.t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	case path == "/users":
+		users := []*keycloak.User{}
+		if _, ok := f.users[r.FormValue("username")]; ok {
+			users = append(users, &keycloak.User{ID: "user-" + r.FormValue("username"), Username: r.FormValue("username")})
+		}
+		out = users
+	case path == "/groups":
+		groups := []*keycloak.Group{}
+		if _, ok := f.groups[r.FormValue("search")]; ok {
+			groups = append(groups, &keycloak.Group{ID: "group-" + r.FormValue("search"), Name: r.FormValue("search")})
+		}
+		out = groups
+	case strings.HasPrefix(path, "/users/user-") && strings.HasSuffix(path, "/role-mappings/realm/composite"):
+		name := strings.TrimSuffix(strings.TrimPrefix(path, "/users/user-"), "/role-mappings/realm/composite")
+		out = toKeycloakRoles(f.users[name])
+	case strings.HasPrefix(path, "/groups/group-") && strings.HasSuffix(path, "/role-mappings/realm/composite"):
+		name := strings.TrimSuffix(strings.TrimPrefix(path, "/groups/group-"), "/role-mappings/realm/composite")
+		out = toKeycloakRoles(f.groups[name])
+	default:
+		f.t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(out)
+}
+
+func toKeycloakRoles(names []string) []*keycloak.Role {
+	roles := []*keycloak.Role{}
+	for _, name := range names {
+		roles = append(roles, &keycloak.Role{Name: name})
+	}
+	return roles
+}
+
+var defaultRoles = []string{"default-roles-nsbox", "offline_access", "uma_authorization"}
+
+func requestAs(username string, roles []string, form url.Values) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-Remote-User", username)
+	r.Header.Set("X-Remote-Roles", strings.Join(roles, ","))
+	return r
+}
+
+func TestCheckCanManageUser(t *testing.T) {
+	useTestWorkdir(t)
+	useFakeRealm(t, map[string][]string{
+		"boss":  append([]string{RoleAdmin}, defaultRoles...),
+		"alice": defaultRoles,
+	}, nil)
+
+	manager := append([]string{RoleUserManager}, defaultRoles...)
+	tests := []struct {
+		caller  []string
+		target  string
+		allowed bool
+	}{
+		{manager, "alice", true},
+		{manager, "boss", false},
+		{manager, "gerrit-only", true},
+		{[]string{RoleAdmin}, "boss", true},
+	}
+	for _, tt := range tests {
+		err := CheckCanManageUser(requestAs("mallory", tt.caller, nil), tt.target)
+		if tt.allowed && err != nil {
+			t.Errorf("CheckCanManageUser(%v, %s) = %v, want nil", tt.caller, tt.target, err)
+		} else if !tt.allowed && err == nil {
+			t.Errorf("CheckCanManageUser(%v, %s) = nil, want an error", tt.caller, tt.target)
+		}
+	}
+}
+
+func TestUserActionsRefuseEscalation(t *testing.T) {
+	useTestWorkdir(t)
+	useFakeRealm(t, map[string][]string{
+		"boss": append([]string{RoleAdmin}, defaultRoles...),
+	}, nil)
+
+	handlers := map[string]http.HandlerFunc{
+		"update": requireRole(handleUpdateUser, RoleUserManager),
+		"reset-password": requireRole(handleUserAction("Reset password of", "user.reset_password", func(string) []SystemResult {
+			t.Error("the password of boss was reset")
+			return nil
+		}), RoleUserManager),
+	}
+	form := url.Values{
+		"username":   {"boss"},
+		"first_name": {"Boss"},
+		"last_name":  {"Admin"},
+		"email":      {"mallory@example.com"},
+	}
+	for name, h := range handlers {
+		w := httptest.NewRecorder()
+		h(w, requestAs("mallory", append([]string{RoleUserManager}, defaultRoles...), form))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s: status %d, want %d", name, w.Code, http.StatusForbidden)
+		}
+	}
+}
+
+func TestTeamActionsRefuseEscalation(t *testing.T) {
+	useTestWorkdir(t)
+	useFakeRealm(t, map[string][]string{
+		"mallory": append([]string{RoleUserManager}, defaultRoles...),
+	}, map[string][]string{
+		"admins": {RoleAdmin},
+	})
+	if err := saveTeams([]*Team{{Name: "admins", Members: []string{"boss"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	handlers := map[string]http.HandlerFunc{
+		"add":    requireRole(handleAddTeamMember, RoleUserManager, RoleProjectManager),
+		"remove": requireRole(handleRemoveTeamMember, RoleUserManager, RoleProjectManager),
+		"delete": requireRole(handleDeleteTeam, RoleProjectManager),
+	}
+	for name, h := range handlers {
+		username := "mallory"
+		if name == "remove" {
+			username = "boss"
+		}
+		w := httptest.NewRecorder()
+		roles := append([]string{RoleUserManager, RoleProjectManager}, defaultRoles...)
+		h(w, requestAs("mallory", roles, url.Values{"name": {"admins"}, "username": {username}}))
+		if w.Code != http.StatusSeeOther {
+			t.Errorf("%s: status %d, want %d", name, w.Code, http.StatusSeeOther)
+		}
+	}
+
+	team, err := GetTeam("admins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(team.Members) != 1 || team.Members[0] != "boss" {
+		t.Errorf("members of admins = %v, want [boss]", team.Members)
+	}
+}
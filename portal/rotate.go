@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"naive.systems/box/portal/keycloak"
+)
+
+// secretRotation replaces one of the credentials that the portal generates
+// for itself, both in the system that checks it and in the files of its
+// consumers. Services that only read the credential on start are named in
+// restart.
+type secretRotation struct {
+	name        string
+	description string
+	rotate      func() error
+	restart     string // "httpd", "buildbot" or empty
+}
+
+var secretRotations = []*secretRotation{
+	{"keycloak-admin", "password of the Keycloak admin (keycloak/admin_password.txt)", rotateKeycloakAdminPassword, ""},
+	{"httpd-client", "secret of the httpd client in Keycloak (keycloak/client_secret.json)", rotateHttpdClientSecret, "httpd"},
+	{"redmine-admin", "API key of the Redmine admin (redmine/data/admin_api_key.txt)", rotateRedmineAdminKey, ""},
+	{"buildbot-ssh", "SSH key of Buildbot in Gerrit (buildbot/ssh/id_ed25519)", rotateBuildbotSSHKey, "buildbot"},
+	{"buildbot-worker", "password of the Buildbot worker (buildbot/worker_password.txt)", rotateBuildbotWorkerPassword, "buildbot"},
+}
+
+// RotateSecretsCommand implements 'portal rotate-secrets [secret...]'. It
+// works on the running services, which a portal started as usual has to
+// provide, and rotates all secrets if none are named.
+func RotateSecretsCommand(args []string) {
+	rotations := secretRotations
+	if len(args) > 0 {
+		rotations = nil
+		for _, name := range args {
+			r := findSecretRotation(name)
+			if r == nil {
+				log.Fatalf("Unknown secret %s. Known secrets:\n%s", name, secretRotationUsage())
+			}
+			rotations = append(rotations, r)
+		}
+	}
+	if status, err := GetKeycloakStatus(); status != "UP" {
+		log.Fatalf("Keycloak is not up (%s, %v). Secrets can only be rotated while the portal is running.", status, err)
+	}
+
+	restart := map[string]bool{}
+	failed := false
+	for _, r := range rotations {
+		log.Printf("Rotating the %s", r.description)
+		err := r.rotate()
+		Audit(AuditSystemActor, "secret.rotate", r.name, err, "")
+		if err != nil {
+			log.Printf("Failed to rotate %s: %v", r.name, err)
+			failed = true
+			continue
+		}
+		if r.restart != "" {
+			restart[r.restart] = true
+		}
+	}
+
+	if restart["buildbot"] {
+		b, err := newBuildbot()
+		if err == nil {
+			err = b.Restart()
+		}
+		Audit(AuditSystemActor, "buildbot.restart", "buildbot", err, "secret rotation")
+		if err != nil {
+			log.Printf("Failed to restart Buildbot: %v", err)
+			failed = true
+		}
+	}
+	if restart["httpd"] {
+		// The portal starts httpd again with the new configuration. This
+		// also ends all sessions, since the OIDC crypto passphrase changes.
+		PodmanKill("httpd")
+		Audit(AuditSystemActor, "httpd.restart", "httpd", nil, "secret rotation")
+	}
+
+	if failed {
+		log.Fatalln("Some secrets were not rotated")
+	}
+	log.Printf("Rotated %d secrets", len(rotations))
+}
+
+func findSecretRotation(name string) *secretRotation {
+	for _, r := range secretRotations {
+		if r.name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+func secretRotationUsage() string {
+	var b strings.Builder
+	for _, r := range secretRotations {
+		fmt.Fprintf(&b, "  %-16s %s\n", r.name, r.description)
+	}
+	return b.String()
+}
+
+// rotateKeycloakAdminPassword changes the password of the admin of the
+// master realm. Keycloak only takes KEYCLOAK_ADMIN_PASSWORD to create the
+// admin, so it does not need a restart.
+func rotateKeycloakAdminPassword() error {
+	kc, err := KeycloakAdminClient()
+	if err != nil {
+		return err
+	}
+	master := keycloak.NewClient(kc.URL, "master", kc.Username, kc.Password, kc.HTTPClient)
+	admin, err := master.FindUser(kc.Username)
+	if err != nil {
+		return err
+	}
+	password, err := GenerateOIDCCryptoPassphrase(32)
+	if err != nil {
+		return err
+	}
+	if err := master.SetPassword(admin.ID, password, false); err != nil {
+		return err
+	}
+	// The portal picks up the new password the next time it needs a client.
+	return WriteSecret(secretKeycloakAdminPassword, []byte(password))
+}
+
+func rotateHttpdClientSecret() error {
+	kc, err := KeycloakAdminClient()
+	if err != nil {
+		return err
+	}
+	id, err := httpdClientID()
+	if err != nil {
+		return err
+	}
+	secret, err := kc.RegenerateClientSecret(id)
+	if err != nil {
+		return err
+	}
+	data := fmt.Sprintf("{\n  \"id\": %q,\n  \"secret\": %q\n}", id, secret)
+	if err := WriteSecret(secretHttpdClient, []byte(data)); err != nil {
+		return err
+	}
+	return writeOIDCConfig()
+}
+
+// rotateRedmineAdminKey replaces the API key of the Redmine admin, which
+// the portal reads for every request. The script prints the new key, which
+// only goes into the secret store.
+func rotateRedmineAdminKey() error {
+	cmd := exec.Command("podman", "exec", "redmine", "/home/redmine/rotate_admin_api_key")
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("%s: %v", cmd.String(), err)
+	}
+	key := strings.TrimSpace(string(out))
+	if key == "" || strings.ContainsAny(key, " \n") {
+		return fmt.Errorf("%s did not print an API key", cmd.String())
+	}
+	if err := WriteSecret(secretRedmineAdminKey, []byte(key+"\n")); err != nil {
+		return err
+	}
+	// Older versions of the script wrote the key into the workdir.
+	path := filepath.Join(*workdir, "redmine", "data", "admin_api_key.txt.tmp")
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// rotateBuildbotSSHKey adds a new key to the buildbot account in Gerrit
+// before it replaces the old one, so that Buildbot can connect throughout,
+// and removes the old key from Gerrit once the new one works.
+func rotateBuildbotSSHKey() error {
+	client, err := NewGerritAdminClient()
+	if err != nil {
+		return err
+	}
+	dir, err := secretRuntimeDir()
+	if err != nil {
+		return err
+	}
+	newKeyPath := filepath.Join(dir, "buildbot_id_ed25519.new")
+	for _, path := range []string{newKeyPath, newKeyPath + ".pub"} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	cmd := exec.Command("ssh-keygen", "-t", "ed25519", "-f", newKeyPath, "-N", "", "-q")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %v", cmd.String(), err)
+	}
+	defer os.Remove(newKeyPath)
+	defer os.Remove(newKeyPath + ".pub")
+	privateKey, err := os.ReadFile(newKeyPath)
+	if err != nil {
+		return err
+	}
+	newKey, err := os.ReadFile(newKeyPath + ".pub")
+	if err != nil {
+		return err
+	}
+	if err := client.AddSSHKeyToAccount("buildbot", strings.TrimSpace(string(newKey))); err != nil {
+		return err
+	}
+	if err := WriteSecret(secretBuildbotSSHKey, privateKey); err != nil {
+		return err
+	}
+	if err := writeSecretFile(buildbotPublicKeyPath(), string(newKey)); err != nil {
+		return err
+	}
+	if err := testGerritConnection("buildbot", *bindIP, 29418); err != nil {
+		return err
+	}
+
+	keys, err := client.ListSSHKeys("buildbot")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if sameSSHKey(key.SSHPublicKey, string(newKey)) {
+			continue
+		}
+		if err := client.DeleteSSHKey("buildbot", key.Seq); err != nil {
+			return err
+		}
+		log.Printf("Removed SSH key %d of buildbot from Gerrit", key.Seq)
+	}
+	return nil
+}
+
+// sameSSHKey compares the type and the key data, leaving out the comment.
+func sameSSHKey(a, b string) bool {
+	fa, fb := strings.Fields(a), strings.Fields(b)
+	return len(fa) >= 2 && len(fb) >= 2 && fa[0] == fb[0] && fa[1] == fb[1]
+}
+
+// rotateBuildbotWorkerPassword gives the worker a new password, in its own
+// directory and in master.cfg.
+func rotateBuildbotWorkerPassword() error {
+	if err := writeBuildbotWorkerPassword(); err != nil {
+		return err
+	}
+	b, err := newBuildbot()
+	if err != nil {
+		return err
+	}
+	client, err := NewGerritAdminClient()
+	if err != nil {
+		return err
+	}
+	gps, err := client.ListProjects()
+	if err != nil {
+		return err
+	}
+	sortProjects(gps)
+	return b.ReplaceWorkers(gps)
+}
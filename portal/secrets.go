@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"naive.systems/box/portal/secrets"
+)
+
+var masterKeyFile = flag.String("master_key_file", "",
+	"File with the key of the secret store. Defaults to $NSBOX_MASTER_KEY, "+
+		"the systemd credential nsbox-master-key, or a key generated in the user config directory")
+
+// Secrets that the portal and the services generate, by their old paths in
+// the workdir. A file that is still at the path is moved into the store the
+// next time the secret is read.
+const (
+	secretKeycloakAdminPassword = "keycloak/admin_password.txt"
+	secretHttpdClient           = "keycloak/client_secret.json"
+	secretLDAPBindPassword      = "keycloak/ldap_bind_password.txt"
+	secretRedmineAdminKey       = "redmine/data/admin_api_key.txt"
+	secretBuildbotSSHKey        = "buildbot/ssh/id_ed25519"
+	secretBuildbotWorker        = "buildbot/worker_password.txt"
+	secretCSRFKey               = "portal/csrf.key"
+)
+
+var knownSecrets = []string{
+	secretKeycloakAdminPassword,
+	secretHttpdClient,
+	secretLDAPBindPassword,
+	secretRedmineAdminKey,
+	secretBuildbotSSHKey,
+	secretBuildbotWorker,
+	secretCSRFKey,
+}
+
+var secretStore struct {
+	once  sync.Once
+	store *secrets.Store
+}
+
+func secretStorePath() string {
+	return filepath.Join(*workdir, "portal", "secrets.json")
+}
+
+// OpenSecretStore opens the store with the master key, and exits if there
+// is no usable key. It is called before anything reads a secret.
+func OpenSecretStore() *secrets.Store {
+	secretStore.once.Do(func() {
+		key, source, err := loadMasterKey()
+		if err != nil {
+			log.Fatalf("Failed to load the master key: %v", err)
+		}
+		store, err := secrets.Open(secretStorePath(), key)
+		if errors.Is(err, secrets.ErrWrongKey) {
+			log.Fatalf("Failed to open %s: %v: the key is from %s", secretStorePath(), err, source)
+		} else if err != nil {
+			log.Fatalf("Failed to open %s: %v", secretStorePath(), err)
+		}
+		secretStore.store = store
+	})
+	return secretStore.store
+}
+
+// loadMasterKey takes the key from -master_key_file, NSBOX_MASTER_KEY or
+// the systemd credential nsbox-master-key, in that order, and also returns
+// where the key came from. Without any of them, it uses a key in the user
+// config directory, so that the master key is at least kept out of the
+// workdir and its backups. It only generates that key for a new store: if
+// the store exists, the key that encrypted it must be given.
+func loadMasterKey() ([]byte, string, error) {
+	if *masterKeyFile != "" {
+		key, err := readMasterKey(*masterKeyFile)
+		return key, *masterKeyFile, err
+	}
+	if value, ok := os.LookupEnv("NSBOX_MASTER_KEY"); ok {
+		// Containers and scripts started by the portal do not need it.
+		os.Unsetenv("NSBOX_MASTER_KEY")
+		key, err := secrets.ParseKey([]byte(value))
+		return key, "NSBOX_MASTER_KEY", err
+	}
+	if dir := os.Getenv("CREDENTIALS_DIRECTORY"); dir != "" {
+		path := filepath.Join(dir, "nsbox-master-key")
+		if exists(path) {
+			key, err := readMasterKey(path)
+			return key, "the systemd credential nsbox-master-key", err
+		}
+	}
+
+	const sources = "-master_key_file, NSBOX_MASTER_KEY or the systemd credential nsbox-master-key"
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return nil, "", fmt.Errorf("%v, and none of %s is given", err, sources)
+	}
+	path := filepath.Join(configDir, "nsbox", "master.key")
+	if exists(path) {
+		log.Printf("Using the master key in %s", path)
+		key, err := readMasterKey(path)
+		return key, path, err
+	}
+	if exists(secretStorePath()) {
+		return nil, "", fmt.Errorf("%s exists but there is no master key for it: "+
+			"give the key that encrypted it with %s, or put it in %s", secretStorePath(), sources, path)
+	}
+	key, err := secrets.NewKey()
+	if err != nil {
+		return nil, "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, "", fmt.Errorf("os.MkdirAll(%s): %v", filepath.Dir(path), err)
+	}
+	if err := os.WriteFile(path, key, 0600); err != nil {
+		return nil, "", fmt.Errorf("os.WriteFile(%s): %v", path, err)
+	}
+	log.Printf("Generated the master key of the secret store in %s. "+
+		"Keep a copy of it with the backups of the workdir.", path)
+	return key, path, nil
+}
+
+func readMasterKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile(%s): %v", path, err)
+	}
+	key, err := secrets.ParseKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return key, nil
+}
+
+// ReadSecret returns the secret, moving it into the store first if it is
+// still in its file in the workdir. The error wraps secrets.ErrNotFound if
+// there is neither.
+func ReadSecret(name string) ([]byte, error) {
+	if err := migrateSecret(name); err != nil {
+		return nil, err
+	}
+	return OpenSecretStore().Get(name)
+}
+
+// ReadSecretString is ReadSecret for secrets that are a line of text.
+func ReadSecretString(name string) (string, error) {
+	value, err := ReadSecret(name)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(value)), nil
+}
+
+// WriteSecret stores the secret, replacing any file at its old path.
+func WriteSecret(name string, value []byte) error {
+	if err := OpenSecretStore().Put(name, value); err != nil {
+		return err
+	}
+	return removeSecretFile(name)
+}
+
+func hasSecret(name string) bool {
+	_, err := ReadSecret(name)
+	return err == nil
+}
+
+// migrateSecret moves the file of the secret into the store. The services
+// still write some of these files, such as Keycloak the admin password on
+// install and Redmine its admin API key after an upgrade, so files that
+// appear later replace what is in the store.
+func migrateSecret(name string) error {
+	path := filepath.Join(*workdir, filepath.FromSlash(name))
+	value, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("os.ReadFile(%s): %v", path, err)
+	}
+	if err := OpenSecretStore().Put(name, value); err != nil {
+		return err
+	}
+	log.Printf("Moved %s into the secret store", path)
+	return removeSecretFile(name)
+}
+
+func removeSecretFile(name string) error {
+	path := filepath.Join(*workdir, filepath.FromSlash(name))
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// MigrateSecrets moves all secret files that are left in the workdir into
+// the store.
+func MigrateSecrets() {
+	for _, name := range knownSecrets {
+		if err := migrateSecret(name); err != nil {
+			log.Printf("Failed to move %s into the secret store: %v", name, err)
+		}
+	}
+}
+
+// secretRuntimeDir is where secrets that other programs need as files are
+// written out while the portal runs, outside of the workdir.
+func secretRuntimeDir() (string, error) {
+	// systemd sets RUNTIME_DIRECTORY for RuntimeDirectory=.
+	dir, _, _ := strings.Cut(os.Getenv("RUNTIME_DIRECTORY"), ":")
+	if dir == "" {
+		if xdg := os.Getenv("XDG_RUNTIME_DIR"); xdg != "" {
+			dir = filepath.Join(xdg, "nsbox")
+		} else {
+			dir = filepath.Join(os.TempDir(), fmt.Sprintf("nsbox-%d", os.Getuid()))
+		}
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("os.MkdirAll(%s): %v", dir, err)
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// writeSecretFile replaces the file through a temporary file, so that
+// readers never see half of a secret.
+func writeSecretFile(path, content string) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0600); err != nil {
+		return fmt.Errorf("os.WriteFile(%s): %v", tmp, err)
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,279 @@
+// Package secrets keeps named secrets in a JSON file, each encrypted with
+// AES-256-GCM under a master key that is kept elsewhere.
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// KeySize is the size of master keys in bytes.
+const KeySize = 32
+
+// ErrNotFound is returned for a name that has no secret in the store.
+var ErrNotFound = errors.New("no such secret")
+
+// ErrWrongKey is returned when the master key is not the one the store was
+// created with.
+var ErrWrongKey = errors.New("the master key does not match the secret store")
+
+// The check value is encrypted under this name when a store is created.
+const checkName = "check"
+
+type Store struct {
+	path string
+	aead cipher.AEAD
+	// Guards the file within the process. Other processes such as 'portal
+	// rotate-secrets' are kept out by a lock on path+".lock".
+	mutex sync.Mutex
+}
+
+type storeFile struct {
+	// A known value encrypted under the master key, so that a wrong key is
+	// detected on open rather than when a secret is needed.
+	Check string `json:"check"`
+	// Base64 of the nonce followed by the ciphertext, by name. The name is
+	// authenticated too, so that values cannot be swapped.
+	Secrets map[string]string `json:"secrets"`
+}
+
+// NewKey returns a random master key.
+func NewKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ParseKey reads a master key in base64 or hex, or as raw bytes.
+func ParseKey(data []byte) ([]byte, error) {
+	text := strings.TrimSpace(string(data))
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == KeySize {
+		return key, nil
+	}
+	if key, err := hex.DecodeString(text); err == nil && len(key) == KeySize {
+		return key, nil
+	}
+	if len(data) == KeySize {
+		return data, nil
+	}
+	return nil, fmt.Errorf("a master key must be %d bytes, in base64, hex or raw", KeySize)
+}
+
+// Open opens the store in the file at path, creating the file if it does
+// not exist.
+func Open(path string, key []byte) (*Store, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("the master key has %d bytes instead of %d", len(key), KeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{path: path, aead: aead}
+	unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	f, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	if f.Check == "" {
+		if f.Check, err = s.seal(checkName, []byte(checkName)); err != nil {
+			return nil, err
+		}
+		return s, s.save(f)
+	}
+	if _, err := s.open(checkName, f.Check); err != nil {
+		return nil, ErrWrongKey
+	}
+	return s, nil
+}
+
+// Get returns the secret stored under name.
+func (s *Store) Get(name string) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	sealed, ok := f.Secrets[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	value, err := s.open(name, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("secret %s: %v", name, err)
+	}
+	return value, nil
+}
+
+// Put stores the secret under name, replacing any previous one.
+func (s *Store) Put(name string, value []byte) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	f, err := s.load()
+	if err != nil {
+		return err
+	}
+	sealed, err := s.seal(name, value)
+	if err != nil {
+		return err
+	}
+	f.Secrets[name] = sealed
+	return s.save(f)
+}
+
+func (s *Store) Delete(name string) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	f, err := s.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := f.Secrets[name]; !ok {
+		return fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	delete(f.Secrets, name)
+	return s.save(f)
+}
+
+// Names returns the names of the stored secrets in order.
+func (s *Store) Names() ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name := range f.Secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *Store) seal(name string, value []byte) (string, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := s.aead.Seal(nonce, nonce, value, []byte(name))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (s *Store) open(name, sealed string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < s.aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := data[:s.aead.NonceSize()], data[s.aead.NonceSize():]
+	return s.aead.Open(nil, nonce, ciphertext, []byte(name))
+}
+
+// lock takes the mutex and an exclusive flock on the lock file next to the
+// store around a load and save, so that concurrent changes from another
+// process are not lost. The file is replaced through a rename, so readers
+// do not need the lock.
+func (s *Store) lock() (func(), error) {
+	s.mutex.Lock()
+	path := s.path + ".lock"
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		s.mutex.Unlock()
+		return nil, fmt.Errorf("os.MkdirAll(%s): %v", filepath.Dir(path), err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		s.mutex.Unlock()
+		return nil, fmt.Errorf("os.OpenFile(%s): %v", path, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		s.mutex.Unlock()
+		return nil, fmt.Errorf("flock(%s): %v", path, err)
+	}
+	return func() {
+		// Closing the file releases the flock.
+		f.Close()
+		s.mutex.Unlock()
+	}, nil
+}
+
+// load reads the file every time, since other processes such as 'portal
+// rotate-secrets' may have changed it.
+func (s *Store) load() (*storeFile, error) {
+	f := &storeFile{}
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		f.Secrets = map[string]string{}
+		return f, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("os.ReadFile(%s): %v", s.path, err)
+	}
+	if err := json.Unmarshal(data, f); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal(%s): %v", s.path, err)
+	}
+	if f.Secrets == nil {
+		f.Secrets = map[string]string{}
+	}
+	return f, nil
+}
+
+func (s *Store) save(f *storeFile) error {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return fmt.Errorf("os.MkdirAll(%s): %v", filepath.Dir(s.path), err)
+	}
+	// Synced before the rename, so that a crash leaves either the old or
+	// the new file and never an empty one.
+	tmp := s.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("os.OpenFile(%s): %v", tmp, err)
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return fmt.Errorf("write %s: %v", tmp, err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("fsync %s: %v", tmp, err)
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,194 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func newTestStore(t *testing.T) (*Store, string, []byte) {
+	key, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "portal", "secrets.json")
+	s, err := Open(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, path, key
+}
+
+func TestPutGet(t *testing.T) {
+	s, path, key := newTestStore(t)
+	if err := s.Put("a.txt", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("b.txt", []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("a.txt", []byte("replaced")); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("replaced")) || bytes.Contains(data, []byte("second")) {
+		t.Errorf("%s contains a secret in plaintext:\n%s", path, data)
+	}
+
+	// A new Store reads what the first one wrote.
+	s, err = Open(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"a.txt": "replaced", "b.txt": "second"} {
+		got, err := s.Get(name)
+		if err != nil {
+			t.Fatalf("Get(%s): %v", name, err)
+		}
+		if string(got) != want {
+			t.Errorf("Get(%s) = %q, want %q", name, got, want)
+		}
+	}
+	names, err := s.Names()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a.txt", "b.txt"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Names() = %v, want %v", names, want)
+	}
+
+	if err := s.Delete("a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("a.txt"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get(a.txt) after Delete: %v, want ErrNotFound", err)
+	}
+	if err := s.Delete("a.txt"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Delete(a.txt) twice: %v, want ErrNotFound", err)
+	}
+}
+
+// Two stores on the same file stand in for the portal and 'portal
+// rotate-secrets', which only share the lock file.
+func TestConcurrentStores(t *testing.T) {
+	s, path, key := newTestStore(t)
+	other, err := Open(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 20
+	var wg sync.WaitGroup
+	for i, store := range []*Store{s, other} {
+		wg.Add(1)
+		go func(i int, store *Store) {
+			defer wg.Done()
+			for j := 0; j < n; j++ {
+				if err := store.Put(fmt.Sprintf("%d-%d", i, j), []byte("value")); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i, store)
+	}
+	wg.Wait()
+	names, err := s.Names()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2*n {
+		t.Errorf("%d secrets after concurrent Puts, want %d", len(names), 2*n)
+	}
+}
+
+func TestOpenWrongKey(t *testing.T) {
+	s, path, _ := newTestStore(t)
+	if err := s.Put("a.txt", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path, otherKey); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("Open() with another key: %v, want ErrWrongKey", err)
+	}
+	if _, err := Open(path, otherKey[:16]); err == nil {
+		t.Error("Open() with a short key succeeded")
+	}
+}
+
+func TestSwappedSecret(t *testing.T) {
+	s, path, _ := newTestStore(t)
+	if err := s.Put("a.txt", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("b.txt", []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Move the ciphertext of a.txt to b.txt in the file.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var f storeFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		t.Fatal(err)
+	}
+	f.Secrets["b.txt"] = f.Secrets["a.txt"]
+	if err := s.save(&f); err != nil {
+		t.Fatal(err)
+	}
+
+	if value, err := s.Get("b.txt"); err == nil {
+		t.Errorf("Get(b.txt) = %q after the swap, want an error", value)
+	}
+	if value, err := s.Get("a.txt"); err != nil || string(value) != "a" {
+		t.Errorf("Get(a.txt) = %q, %v", value, err)
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	key, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"base64", []byte(base64.StdEncoding.EncodeToString(key) + "\n"), true},
+		{"hex", []byte(hex.EncodeToString(key) + "\n"), true},
+		{"raw", key, true},
+		{"short base64", []byte(base64.StdEncoding.EncodeToString(key[:16])), false},
+		{"long hex", []byte(hex.EncodeToString(append(key, 0))), false},
+		{"short raw", key[:31], false},
+		{"empty", nil, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseKey(tt.data)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%s: ParseKey() = %x, want an error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: ParseKey(): %v", tt.name, err)
+		} else if !bytes.Equal(got, key) {
+			t.Errorf("%s: ParseKey() = %x, want %x", tt.name, got, key)
+		}
+	}
+}
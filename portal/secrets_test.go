@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadMasterKeyFallback(t *testing.T) {
+	oldWorkdir := *workdir
+	*workdir = t.TempDir()
+	t.Cleanup(func() { *workdir = oldWorkdir })
+	configDir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", configDir)
+	t.Setenv("CREDENTIALS_DIRECTORY", "")
+	// t.Setenv restores the variable after the test.
+	t.Setenv("NSBOX_MASTER_KEY", "")
+	os.Unsetenv("NSBOX_MASTER_KEY")
+	keyPath := filepath.Join(configDir, "nsbox", "master.key")
+
+	// An existing store is not given a new key.
+	if err := os.MkdirAll(filepath.Dir(secretStorePath()), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(secretStorePath(), []byte("{}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := loadMasterKey(); err == nil || !strings.Contains(err.Error(), "no master key") {
+		t.Errorf("loadMasterKey() with an existing store: %v, want an error", err)
+	}
+	if exists(keyPath) {
+		t.Errorf("%s was generated for an existing store", keyPath)
+	}
+
+	// A new store is.
+	if err := os.Remove(secretStorePath()); err != nil {
+		t.Fatal(err)
+	}
+	key, source, err := loadMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source != keyPath {
+		t.Errorf("loadMasterKey() source = %s, want %s", source, keyPath)
+	}
+	again, _, err := loadMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, again) {
+		t.Error("loadMasterKey() generated a second key")
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"naive.systems/box/portal/gerrit"
+)
+
+// UserSessions are the sessions of a user and the credentials that let them
+// in without one.
+type UserSessions struct {
+	Username string
+	Builtin  bool
+
+	Keycloak    []*sessionRow
+	KeycloakErr error
+
+	SSHKeys   []*gerrit.SSHKey
+	GerritErr error
+
+	RedmineTokens []*RedmineToken
+	RedmineErr    error
+
+	APITokens    []*APIToken
+	APITokensErr error
+}
+
+// sessionRow is a Keycloak session as shown on the sessions page.
+type sessionRow struct {
+	IPAddress  string
+	Start      string
+	LastAccess string
+	Clients    string
+}
+
+func sessionTime(ms int64) string {
+	return time.UnixMilli(ms).UTC().Format("2006-01-02 15:04:05")
+}
+
+func GetUserSessions(username string) *UserSessions {
+	s := &UserSessions{Username: username, Builtin: isBuiltinUser(username)}
+
+	if user, err := GetKeycloakUser(username); err != nil {
+		s.KeycloakErr = err
+	} else if kc, err := KeycloakAdminClient(); err != nil {
+		s.KeycloakErr = err
+	} else {
+		sessions, err := kc.ListUserSessions(user.ID)
+		s.KeycloakErr = err
+		for _, session := range sessions {
+			var clients []string
+			for _, clientID := range session.Clients {
+				clients = append(clients, clientID)
+			}
+			sort.Strings(clients)
+			s.Keycloak = append(s.Keycloak, &sessionRow{
+				IPAddress:  session.IPAddress,
+				Start:      sessionTime(session.Start),
+				LastAccess: sessionTime(session.LastAccess),
+				Clients:    strings.Join(clients, ", "),
+			})
+		}
+	}
+
+	if client, err := NewGerritAdminClient(); err != nil {
+		s.GerritErr = err
+	} else {
+		s.SSHKeys, s.GerritErr = client.ListSSHKeys(username)
+	}
+
+	if user, err := FindRedmineUser(username); err != nil {
+		s.RedmineErr = err
+	} else {
+		s.RedmineTokens, s.RedmineErr = RedmineUserTokens(user.Login, false)
+	}
+
+	s.APITokens, s.APITokensErr = ListAPITokens(username)
+
+	for _, err := range []*error{&s.KeycloakErr, &s.GerritErr, &s.RedmineErr} {
+		if isNotFound(*err) {
+			*err = errors.New("no such account")
+		}
+	}
+	return s
+}
+
+// RevokeUserSessions logs the user out everywhere and removes the
+// credentials that work without a login: Gerrit SSH keys and HTTP
+// password, Redmine API key and other tokens, and portal API tokens.
+// Keycloak tells httpd to drop the sessions it has cached, so that they do
+// not last until OIDCSessionMaxDuration.
+func RevokeUserSessions(username string) []SystemResult {
+	results := []SystemResult{{System: "Keycloak"}, {System: "Gerrit"}, {System: "Redmine"}}
+
+	if user, err := GetKeycloakUser(username); err != nil {
+		results[0].Err = err
+	} else if kc, err := KeycloakAdminClient(); err != nil {
+		results[0].Err = err
+	} else if sessions, err := kc.ListUserSessions(user.ID); err != nil {
+		results[0].Err = err
+	} else if err := kc.LogoutUser(user.ID); err != nil {
+		results[0].Err = err
+	} else {
+		results[0].Message = fmt.Sprintf("ended %d sessions", len(sessions))
+	}
+
+	if client, err := NewGerritAdminClient(); err != nil {
+		results[1].Err = err
+	} else if keys, err := client.ListSSHKeys(username); err != nil {
+		results[1].Err = err
+	} else {
+		for _, key := range keys {
+			if err := client.DeleteSSHKey(username, key.Seq); err != nil {
+				results[1].Err = err
+				break
+			}
+		}
+		if results[1].Err == nil {
+			results[1].Err = client.DeleteHTTPPassword(username)
+			results[1].Message = fmt.Sprintf("removed %d SSH keys and the HTTP password", len(keys))
+		}
+	}
+
+	if user, err := FindRedmineUser(username); err != nil {
+		results[2].Err = err
+	} else if tokens, err := RedmineUserTokens(user.Login, true); err != nil {
+		results[2].Err = err
+	} else {
+		results[2].Message = fmt.Sprintf("removed %d tokens, including the API key", len(tokens))
+	}
+
+	results = append(results, SystemResult{System: "Portal", Message: "API tokens revoked",
+		Err: RevokeUserAPITokens(username)})
+
+	return finishResults(results, "")
+}
+
+func handleUserSessions(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	username := r.URL.Query().Get("username")
+	if username == "" {
+		http.Error(w, "username is required", http.StatusBadRequest)
+		return
+	}
+	render(w, r, "user_sessions", "Sessions of "+username, GetUserSessions(username))
+}
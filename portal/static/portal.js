@@ -0,0 +1,8 @@
+// Forms with a data-confirm attribute ask before they are submitted. Inline
+// event handlers are not allowed by the Content-Security-Policy.
+document.addEventListener("submit", function (event) {
+	var message = event.target.getAttribute("data-confirm");
+	if (message && !window.confirm(message)) {
+		event.preventDefault();
+	}
+});
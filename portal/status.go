@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServiceStatus is whether one of the services run by the portal responds.
+type ServiceStatus struct {
+	Name   string `json:"name"`
+	Up     bool   `json:"up"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type serviceCheck struct {
+	name  string
+	check func() (string, error)
+}
+
+var serviceChecks = []serviceCheck{
+	{"Keycloak", func() (string, error) {
+		status, err := GetKeycloakStatus()
+		if err == nil && status != "UP" {
+			err = fmt.Errorf("status %s", status)
+		}
+		return status, err
+	}},
+	{"Gerrit", GetGerritVersion},
+	{"Redmine", func() (string, error) { return probeHTTP("http://" + *bindIP + ":3000/") }},
+	{"Buildbot", func() (string, error) { return probeHTTP("http://127.0.0.1:8010/") }},
+	{"Mailpit", func() (string, error) { return probeHTTP("http://" + *bindIP + ":8025/") }},
+	{"httpd", func() (string, error) { return containerState("httpd") }},
+	// Password resets and onboarding emails are sent by Keycloak.
+	{"Keycloak email", func() (string, error) {
+		if err := CheckKeycloakSMTPRelay(); err != nil {
+			return "", err
+		}
+		return "SMTP relay reachable", nil
+	}},
+}
+
+// ServiceStatuses checks all services in parallel.
+func ServiceStatuses() []*ServiceStatus {
+	statuses := make([]*ServiceStatus, len(serviceChecks))
+	var wg sync.WaitGroup
+	for i, c := range serviceChecks {
+		i, c := i, c
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			detail, err := c.check()
+			statuses[i] = &ServiceStatus{Name: c.name, Up: err == nil, Detail: detail}
+			if err != nil {
+				statuses[i].Detail = err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+	return statuses
+}
+
+// probeHTTP treats any response other than a server error as up. Most of the
+// services answer unauthenticated requests with a redirect or 401/403.
+func probeHTTP(url string) (string, error) {
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return "", fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return resp.Status, nil
+}
+
+func containerState(name string) (string, error) {
+	out, err := exec.Command("podman", "container", "inspect", "--format", "{{.State.Status}}", name).Output()
+	if err != nil {
+		return "", fmt.Errorf("podman container inspect %s: %v", name, err)
+	}
+	state := strings.TrimSpace(string(out))
+	if state != "running" {
+		return state, fmt.Errorf("container %s is %s", name, state)
+	}
+	return state, nil
+}
@@ -0,0 +1,674 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"naive.systems/box/portal/gerrit"
+)
+
+/*
+Teams are defined in ${workdir}/portal/teams.json and mirrored as a Keycloak
+group, a Gerrit internal group and a Redmine group with the same name, so
+that access rules in every system can refer to the same team names. The file
+is the source of truth: membership changes are applied to it first and then
+propagated, and drift is anything in the systems that differs from it.
+*/
+
+type Team struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Members     []string `json:"members"`
+}
+
+type teamsFile struct {
+	Teams []*Team `json:"teams"`
+}
+
+var teamsMutex sync.Mutex
+
+var ErrNoSuchTeam = errors.New("no such team")
+
+// ErrGroupExists is returned for a new team whose group already exists in
+// one of the systems.
+var ErrGroupExists = errors.New("group already exists")
+
+var validTeamName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Groups that Gerrit creates itself, which a team must never take over.
+var reservedTeamNames = []string{
+	"Administrators",
+	"Anonymous Users",
+	"Change Owner",
+	"Non-Interactive Users",
+	"Project Owners",
+	"Registered Users",
+	"Service Users",
+}
+
+func isReservedTeamName(name string) bool {
+	for _, reserved := range reservedTeamNames {
+		if strings.EqualFold(name, reserved) {
+			return true
+		}
+	}
+	return false
+}
+
+func teamsPath() string {
+	return filepath.Join(*workdir, "portal", "teams.json")
+}
+
+func loadTeams() ([]*Team, error) {
+	bytes, err := os.ReadFile(teamsPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile(%s): %v", teamsPath(), err)
+	}
+	var f teamsFile
+	if err := json.Unmarshal(bytes, &f); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal(%s): %v", teamsPath(), err)
+	}
+	return f.Teams, nil
+}
+
+func saveTeams(teams []*Team) error {
+	sort.Slice(teams, func(i, j int) bool {
+		return teams[i].Name < teams[j].Name
+	})
+	for _, t := range teams {
+		sort.Strings(t.Members)
+	}
+	bytes, err := json.MarshalIndent(teamsFile{Teams: teams}, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(teamsPath())
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("os.MkdirAll(%s): %v", dir, err)
+	}
+	tmp := teamsPath() + ".tmp"
+	if err := os.WriteFile(tmp, bytes, 0600); err != nil {
+		return fmt.Errorf("os.WriteFile(%s): %v", tmp, err)
+	}
+	return os.Rename(tmp, teamsPath())
+}
+
+func ListTeams() ([]*Team, error) {
+	teamsMutex.Lock()
+	defer teamsMutex.Unlock()
+	return loadTeams()
+}
+
+func GetTeam(name string) (*Team, error) {
+	teams, err := ListTeams()
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range teams {
+		if t.Name == name {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrNoSuchTeam, name)
+}
+
+// updateTeams applies f to the stored teams and saves the result.
+func updateTeams(f func(teams []*Team) ([]*Team, error)) error {
+	teamsMutex.Lock()
+	defer teamsMutex.Unlock()
+	teams, err := loadTeams()
+	if err != nil {
+		return err
+	}
+	teams, err = f(teams)
+	if err != nil {
+		return err
+	}
+	return saveTeams(teams)
+}
+
+func CreateTeam(name, description string) ([]SystemResult, error) {
+	if !validTeamName.MatchString(name) {
+		return nil, fmt.Errorf("invalid team name: %s", name)
+	}
+	if isReservedTeamName(name) {
+		return nil, fmt.Errorf("%s is reserved for a built-in group", name)
+	}
+	if IsTeam(name) {
+		return nil, fmt.Errorf("team %s already exists", name)
+	}
+	if err := checkNewTeamGroups(name); err != nil {
+		return nil, err
+	}
+	err := updateTeams(func(teams []*Team) ([]*Team, error) {
+		for _, t := range teams {
+			if t.Name == name {
+				return nil, fmt.Errorf("team %s already exists", name)
+			}
+		}
+		return append(teams, &Team{Name: name, Description: description, Members: []string{}}), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return SyncTeam(name)
+}
+
+// checkNewTeamGroups refuses a new team if a group with its name exists in
+// any system. The team would take over such a group, with members and
+// access rights that the portal never gave it, and SyncTeam and DeleteTeam
+// would remove its members.
+func checkNewTeamGroups(name string) error {
+	if _, err := GetKeycloakGroup(name); err == nil {
+		return fmt.Errorf("%w in Keycloak: %s", ErrGroupExists, name)
+	} else if !isNotFound(err) {
+		return err
+	}
+
+	client, err := NewGerritAdminClient()
+	if err != nil {
+		return err
+	}
+	if _, err := client.GetGroup(name); err == nil {
+		return fmt.Errorf("%w in Gerrit: %s", ErrGroupExists, name)
+	} else if !isNotFound(err) {
+		return err
+	}
+
+	if _, err := FindRedmineGroup(name); err == nil {
+		return fmt.Errorf("%w in Redmine: %s", ErrGroupExists, name)
+	} else if !isNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// DeleteTeam deletes the Keycloak and Redmine groups. Gerrit does not support
+// deleting groups, so the Gerrit group is emptied instead.
+func DeleteTeam(name string) ([]SystemResult, error) {
+	team, err := GetTeam(name)
+	if err != nil {
+		return nil, err
+	}
+	results := []SystemResult{{System: "Keycloak"}, {System: "Gerrit"}, {System: "Redmine"}}
+
+	if g, err := GetKeycloakGroup(name); err != nil {
+		results[0].Err = err
+	} else {
+		results[0].Err = DeleteKeycloakGroup(g.ID)
+	}
+
+	if client, err := NewGerritAdminClient(); err != nil {
+		results[1].Err = err
+	} else if members, err := client.ListGroupMembers(name); err != nil {
+		results[1].Err = err
+	} else {
+		for _, m := range members {
+			if err := client.RemoveMemberFromGroup(name, m.Username); err != nil {
+				results[1].Err = err
+				break
+			}
+		}
+		results[1].Message = "emptied (Gerrit does not support deleting groups)"
+	}
+
+	if g, err := FindRedmineGroup(name); err != nil {
+		results[2].Err = err
+	} else {
+		results[2].Err = DeleteRedmineGroup(g.ID)
+	}
+
+	err = updateTeams(func(teams []*Team) ([]*Team, error) {
+		var kept []*Team
+		for _, t := range teams {
+			if t != nil && t.Name != team.Name {
+				kept = append(kept, t)
+			}
+		}
+		return kept, nil
+	})
+	return finishResults(results, "deleted"), err
+}
+
+func IsTeam(name string) bool {
+	_, err := GetTeam(name)
+	return err == nil
+}
+
+func AddTeamMember(name, username string) ([]SystemResult, error) {
+	err := updateTeams(func(teams []*Team) ([]*Team, error) {
+		for _, t := range teams {
+			if t.Name != name {
+				continue
+			}
+			for _, m := range t.Members {
+				if m == username {
+					return teams, nil
+				}
+			}
+			t.Members = append(t.Members, username)
+			return teams, nil
+		}
+		return nil, fmt.Errorf("%w: %s", ErrNoSuchTeam, name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return syncTeamMember(name, username)
+}
+
+func RemoveTeamMember(name, username string) ([]SystemResult, error) {
+	err := updateTeams(func(teams []*Team) ([]*Team, error) {
+		for _, t := range teams {
+			if t.Name != name {
+				continue
+			}
+			var kept []string
+			for _, m := range t.Members {
+				if m != username {
+					kept = append(kept, m)
+				}
+			}
+			t.Members = kept
+			return teams, nil
+		}
+		return nil, fmt.Errorf("%w: %s", ErrNoSuchTeam, name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return syncTeamMember(name, username)
+}
+
+// syncTeamMember syncs the team after a change of its members and applies
+// the OTP policy to the member, which may require OTP for the team.
+func syncTeamMember(name, username string) ([]SystemResult, error) {
+	results, err := SyncTeam(name)
+	if err != nil {
+		return results, err
+	}
+	return append(results, EnforceOTPPolicy(AuditSystemActor, username)...), nil
+}
+
+// TeamDrift is the difference between a team and its group in one system.
+type TeamDrift struct {
+	System       string
+	MissingGroup bool
+	Missing      []string // members of the team that are not in the group
+	Extra        []string // members of the group that are not in the team
+	Err          error
+}
+
+func (d *TeamDrift) InSync() bool {
+	return d.Err == nil && !d.MissingGroup && len(d.Missing) == 0 && len(d.Extra) == 0
+}
+
+// Summary describes the drift in one line.
+func (d *TeamDrift) Summary() string {
+	switch {
+	case d.Err != nil:
+		return "Error: " + d.Err.Error()
+	case d.MissingGroup:
+		return "group does not exist"
+	case d.InSync():
+		return "in sync"
+	}
+	var parts []string
+	if len(d.Missing) > 0 {
+		parts = append(parts, "missing members: "+strings.Join(d.Missing, ", "))
+	}
+	if len(d.Extra) > 0 {
+		parts = append(parts, "unexpected members: "+strings.Join(d.Extra, ", "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// teamGroup is a group of a team in one system.
+type teamGroup interface {
+	members() ([]string, error)
+	add(username string) error
+	remove(username string) error
+}
+
+type keycloakTeamGroup struct{ group *KeycloakGroup }
+
+func (g *keycloakTeamGroup) members() ([]string, error) {
+	users, err := ListKeycloakGroupMembers(g.group.ID)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, u := range users {
+		names = append(names, u.Username)
+	}
+	return names, nil
+}
+
+func (g *keycloakTeamGroup) add(username string) error {
+	user, err := GetKeycloakUser(username)
+	if err != nil {
+		return err
+	}
+	return AddKeycloakGroupMember(g.group.ID, user.ID)
+}
+
+func (g *keycloakTeamGroup) remove(username string) error {
+	user, err := GetKeycloakUser(username)
+	if err != nil {
+		return err
+	}
+	return RemoveKeycloakGroupMember(g.group.ID, user.ID)
+}
+
+type gerritTeamGroup struct {
+	name   string
+	client *gerrit.Client
+}
+
+func (g *gerritTeamGroup) members() ([]string, error) {
+	accounts, err := g.client.ListGroupMembers(g.name)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, a := range accounts {
+		names = append(names, a.Username)
+	}
+	return names, nil
+}
+
+func (g *gerritTeamGroup) add(username string) error {
+	return g.client.AddMemberToGroup(g.name, username)
+}
+
+func (g *gerritTeamGroup) remove(username string) error {
+	return g.client.RemoveMemberFromGroup(g.name, username)
+}
+
+type redmineTeamGroup struct{ group *RedmineGroup }
+
+func (g *redmineTeamGroup) members() ([]string, error) {
+	group, err := GetRedmineGroup(g.group.ID)
+	if err != nil {
+		return nil, err
+	}
+	// Group members only have an ID and a name, so map IDs to logins.
+	users, err := ListRedmineUsers()
+	if err != nil {
+		return nil, err
+	}
+	logins := map[int]string{}
+	for _, u := range users {
+		logins[u.ID] = u.Login
+	}
+	var names []string
+	for _, u := range group.Users {
+		names = append(names, logins[u.ID])
+	}
+	return names, nil
+}
+
+func (g *redmineTeamGroup) add(username string) error {
+	user, err := FindRedmineUser(username)
+	if err != nil {
+		return err
+	}
+	return AddRedmineGroupMember(g.group.ID, user.ID)
+}
+
+func (g *redmineTeamGroup) remove(username string) error {
+	user, err := FindRedmineUser(username)
+	if err != nil {
+		return err
+	}
+	return RemoveRedmineGroupMember(g.group.ID, user.ID)
+}
+
+// teamGroups looks up (and with create, creates) the groups of a team. The
+// result has one entry per system, in the order Keycloak, Gerrit, Redmine;
+// a nil group comes with the error or with missing set.
+func teamGroups(team *Team, create bool) ([]teamGroup, []*TeamDrift) {
+	drifts := []*TeamDrift{{System: "Keycloak"}, {System: "Gerrit"}, {System: "Redmine"}}
+	groups := make([]teamGroup, 3)
+
+	kg, err := GetKeycloakGroup(team.Name)
+	if isNotFound(err) && create {
+		kg, err = CreateKeycloakGroup(team.Name)
+	}
+	if err == nil {
+		groups[0] = &keycloakTeamGroup{kg}
+	} else if isNotFound(err) {
+		drifts[0].MissingGroup = true
+	} else {
+		drifts[0].Err = err
+	}
+
+	if client, err := NewGerritAdminClient(); err != nil {
+		drifts[1].Err = err
+	} else {
+		_, err := client.GetGroup(team.Name)
+		if isNotFound(err) && create {
+			_, err = client.CreateGroup(team.Name, team.Description)
+		}
+		if err == nil {
+			groups[1] = &gerritTeamGroup{name: team.Name, client: client}
+		} else if isNotFound(err) {
+			drifts[1].MissingGroup = true
+		} else {
+			drifts[1].Err = err
+		}
+	}
+
+	rg, err := FindRedmineGroup(team.Name)
+	if isNotFound(err) && create {
+		rg, err = CreateRedmineGroup(team.Name)
+	}
+	if err == nil {
+		groups[2] = &redmineTeamGroup{rg}
+	} else if isNotFound(err) {
+		drifts[2].MissingGroup = true
+	} else {
+		drifts[2].Err = err
+	}
+
+	return groups, drifts
+}
+
+func diffMembers(want, have []string) (missing, extra []string) {
+	wantSet := map[string]bool{}
+	for _, m := range want {
+		wantSet[m] = true
+	}
+	haveSet := map[string]bool{}
+	for _, m := range have {
+		haveSet[m] = true
+		if !wantSet[m] {
+			extra = append(extra, m)
+		}
+	}
+	for _, m := range want {
+		if !haveSet[m] {
+			missing = append(missing, m)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(extra)
+	return missing, extra
+}
+
+// TeamDrifts compares a team with its groups without changing anything.
+func TeamDrifts(team *Team) []*TeamDrift {
+	groups, drifts := teamGroups(team, false)
+	for i, g := range groups {
+		if g == nil {
+			continue
+		}
+		have, err := g.members()
+		if err != nil {
+			drifts[i].Err = err
+			continue
+		}
+		drifts[i].Missing, drifts[i].Extra = diffMembers(team.Members, have)
+	}
+	return drifts
+}
+
+// SyncTeam creates missing groups and makes their members match the team.
+func SyncTeam(name string) ([]SystemResult, error) {
+	team, err := GetTeam(name)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("SyncTeam('%s')", name)
+
+	groups, drifts := teamGroups(team, true)
+	var results []SystemResult
+	for i, g := range groups {
+		r := SystemResult{System: drifts[i].System, Err: drifts[i].Err}
+		if g != nil {
+			r.Message, r.Err = syncTeamGroup(team, g)
+		}
+		results = append(results, r)
+	}
+	return finishResults(results, "in sync"), nil
+}
+
+func syncTeamGroup(team *Team, g teamGroup) (string, error) {
+	have, err := g.members()
+	if err != nil {
+		return "", err
+	}
+	missing, extra := diffMembers(team.Members, have)
+	var changes []string
+	for _, m := range missing {
+		if err := g.add(m); err != nil {
+			return "", fmt.Errorf("adding %s: %v", m, err)
+		}
+		changes = append(changes, "+"+m)
+	}
+	for _, m := range extra {
+		if err := g.remove(m); err != nil {
+			return "", fmt.Errorf("removing %s: %v", m, err)
+		}
+		changes = append(changes, "-"+m)
+	}
+	if len(changes) == 0 {
+		return "", nil
+	}
+	return "synced: " + strings.Join(changes, " "), nil
+}
+
+// teamDrifts is a team with its drift in every system.
+type teamDrifts struct {
+	Team   *Team
+	Drifts []*TeamDrift
+}
+
+func handleListTeams(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	teams, err := ListTeams()
+	if err != nil {
+		http.Error(w, "Failed to list teams: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	render(w, r, "teams", "Teams", teams)
+}
+
+func handleViewTeam(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	team, err := GetTeam(r.URL.Query().Get("name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	render(w, r, "team", "Team "+team.Name, &teamDrifts{team, TeamDrifts(team)})
+}
+
+func handleTeamsDrift(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	teams, err := ListTeams()
+	if err != nil {
+		http.Error(w, "Failed to list teams: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var drifts []*teamDrifts
+	for _, t := range teams {
+		drifts = append(drifts, &teamDrifts{t, TeamDrifts(t)})
+	}
+	render(w, r, "teams_drift", "Team drift report", drifts)
+}
+
+// handleTeamAction returns a handler for the POST forms of the team pages.
+// The audit target is the team, followed by the member if there is one.
+func handleTeamAction(action string, op func(r *http.Request) ([]SystemResult, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !checkMethod(w, r, http.MethodPost) {
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		name := strings.TrimSpace(r.FormValue("name"))
+		var results []SystemResult
+		err := CheckCanManageGroup(r, name)
+		if err == nil {
+			results, err = op(r)
+		}
+		target := name
+		if username := r.FormValue("username"); username != "" {
+			target += "/" + strings.TrimSpace(username)
+		}
+		next := "/teams/view?name=" + url.QueryEscape(name)
+		if err != nil {
+			Audit(auditActor(r), action, target, err, "")
+			if action == "team.create" {
+				next = "/teams"
+			}
+			redirectWithFlash(w, r, next, FlashError, err.Error())
+			return
+		}
+		AuditResults(auditActor(r), action, target, results)
+		if action == "team.delete" {
+			next = "/teams"
+		}
+		redirectWithResults(w, r, next, results)
+	}
+}
+
+var (
+	handleCreateTeam = handleTeamAction("team.create", func(r *http.Request) ([]SystemResult, error) {
+		return CreateTeam(strings.TrimSpace(r.FormValue("name")), r.FormValue("description"))
+	})
+	handleDeleteTeam = handleTeamAction("team.delete", func(r *http.Request) ([]SystemResult, error) {
+		return DeleteTeam(r.FormValue("name"))
+	})
+	handleSyncTeam = handleTeamAction("team.sync", func(r *http.Request) ([]SystemResult, error) {
+		return SyncTeam(r.FormValue("name"))
+	})
+	handleAddTeamMember = handleTeamAction("team.add_member", func(r *http.Request) ([]SystemResult, error) {
+		return AddTeamMember(r.FormValue("name"), strings.TrimSpace(r.FormValue("username")))
+	})
+	handleRemoveTeamMember = handleTeamAction("team.remove_member", func(r *http.Request) ([]SystemResult, error) {
+		return RemoveTeamMember(r.FormValue("name"), r.FormValue("username"))
+	})
+)
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCreateTeamRefusesExistingGroups(t *testing.T) {
+	useTestWorkdir(t)
+	realm := useFakeRealm(t, nil, map[string][]string{
+		"ops": nil,
+	})
+
+	for _, name := range []string{"Administrators", "administrators"} {
+		if _, err := CreateTeam(name, ""); err == nil {
+			t.Errorf("CreateTeam(%s) succeeded", name)
+		}
+	}
+	if len(realm.requests) > 0 {
+		t.Errorf("reserved names were looked up: %v", realm.requests)
+	}
+
+	if _, err := CreateTeam("ops", ""); !errors.Is(err, ErrGroupExists) {
+		t.Errorf("CreateTeam(ops) = %v, want ErrGroupExists", err)
+	}
+	teams, err := ListTeams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(teams) != 0 {
+		t.Errorf("teams = %v, want none", teams)
+	}
+}
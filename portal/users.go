@@ -0,0 +1,398 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"naive.systems/box/portal/gerrit"
+	"naive.systems/box/portal/keycloak"
+)
+
+// ErrUserNotFound is wrapped by lookups when a system has no such user.
+var ErrUserNotFound = errors.New("user not found")
+
+// ErrNotFound is wrapped by lookups of anything else that does not exist.
+var ErrNotFound = errors.New("not found")
+
+func isNotFound(err error) bool {
+	return errors.Is(err, ErrUserNotFound) || errors.Is(err, ErrNotFound) ||
+		errors.Is(err, gerrit.ErrNotFound) || errors.Is(err, keycloak.ErrNotFound)
+}
+
+// Accounts created by the portal itself, which must not be disabled or
+// deleted through the user management pages.
+func isBuiltinUser(username string) bool {
+	return username == "admin" || username == "buildbot"
+}
+
+// SystemResult is the outcome of a user operation in one backend.
+type SystemResult struct {
+	System  string
+	Message string
+	Err     error
+}
+
+// UserAccounts is a user's state in each backend. A nil account means that
+// the lookup failed; the corresponding error tells why.
+type UserAccounts struct {
+	Username string
+
+	Keycloak    *KeycloakUser
+	KeycloakErr error
+
+	Gerrit       *gerrit.Account
+	GerritActive bool
+	GerritErr    error
+
+	Redmine    *RedmineUser
+	RedmineErr error
+}
+
+func GetUserAccounts(username string) *UserAccounts {
+	ua := &UserAccounts{Username: username}
+	ua.Keycloak, ua.KeycloakErr = GetKeycloakUser(username)
+	ua.Redmine, ua.RedmineErr = FindRedmineUser(username)
+
+	client, err := NewGerritAdminClient()
+	if err != nil {
+		ua.GerritErr = err
+		return ua
+	}
+	ua.Gerrit, ua.GerritErr = client.GetAccount(username)
+	if ua.GerritErr == nil {
+		ua.GerritActive, ua.GerritErr = client.IsAccountActive(username)
+	}
+	return ua
+}
+
+// UpdateUser sets the names and the email of the user in every backend.
+func UpdateUser(username, firstName, lastName, email string) []SystemResult {
+	results := []SystemResult{{System: "Keycloak"}, {System: "Gerrit"}, {System: "Redmine"}}
+
+	if user, err := GetKeycloakUser(username); err != nil {
+		results[0].Err = err
+	} else {
+		results[0].Err = UpdateKeycloakUser(user.ID, firstName, lastName, email)
+	}
+
+	if client, err := NewGerritAdminClient(); err != nil {
+		results[1].Err = err
+	} else if err := client.SetAccountName(username, firstName+" "+lastName); err != nil {
+		results[1].Err = err
+	} else {
+		results[1].Err = client.SetAccountEmail(username, email)
+	}
+
+	if user, err := FindRedmineUser(username); err != nil {
+		results[2].Err = err
+	} else {
+		results[2].Err = UpdateRedmineUser(user.ID, map[string]any{
+			"firstname": firstName,
+			"lastname":  lastName,
+			"mail":      email,
+		})
+	}
+
+	return finishResults(results, "updated")
+}
+
+// SetUserEnabled blocks or restores login in Keycloak, the Gerrit account
+// and the Redmine account of the user.
+func SetUserEnabled(username string, enabled bool) []SystemResult {
+	results := []SystemResult{{System: "Keycloak"}, {System: "Gerrit"}, {System: "Redmine"}}
+
+	if user, err := GetKeycloakUser(username); err != nil {
+		results[0].Err = err
+	} else {
+		results[0].Err = SetKeycloakUserEnabled(user.ID, enabled)
+	}
+
+	if client, err := NewGerritAdminClient(); err != nil {
+		results[1].Err = err
+	} else {
+		results[1].Err = client.SetAccountActive(username, enabled)
+	}
+
+	if user, err := FindRedmineUser(username); err != nil {
+		results[2].Err = err
+	} else {
+		results[2].Err = SetRedmineUserLocked(user.ID, !enabled)
+	}
+
+	if enabled {
+		return finishResults(results, "enabled")
+	}
+	return finishResults(results, "disabled")
+}
+
+// DeleteUser removes the user from Keycloak and Redmine. Gerrit does not
+// support deleting accounts, so the Gerrit account is deactivated instead.
+func DeleteUser(username string) []SystemResult {
+	results := []SystemResult{{System: "Keycloak"}, {System: "Gerrit"}, {System: "Redmine"}}
+
+	if user, err := GetKeycloakUser(username); err != nil {
+		results[0].Err = err
+	} else {
+		results[0].Err = DeleteKeycloakUser(user.ID)
+	}
+
+	if client, err := NewGerritAdminClient(); err != nil {
+		results[1].Err = err
+	} else if err := client.SetAccountActive(username, false); err != nil {
+		results[1].Err = err
+	} else {
+		results[1].Message = "deactivated (Gerrit does not support deleting accounts)"
+	}
+
+	if user, err := FindRedmineUser(username); err != nil {
+		results[2].Err = err
+	} else {
+		results[2].Err = DeleteRedmineUser(user.ID)
+	}
+
+	results = append(results, SystemResult{System: "Portal", Message: "API tokens revoked",
+		Err: RevokeUserAPITokens(username)})
+
+	return finishResults(results, "deleted")
+}
+
+// finishResults fills in the default message of successful results, treats
+// missing accounts as nothing to do and logs every outcome.
+func finishResults(results []SystemResult, done string) []SystemResult {
+	for i := range results {
+		r := &results[i]
+		if isNotFound(r.Err) {
+			r.Message = "no such account"
+			r.Err = nil
+		}
+		if r.Err == nil && r.Message == "" {
+			r.Message = done
+		}
+		if r.Err != nil {
+			log.Printf("%s: %v", r.System, r.Err)
+		} else {
+			log.Printf("%s: %s", r.System, r.Message)
+		}
+	}
+	return results
+}
+
+// resultsError returns the first error in results.
+func resultsError(results []SystemResult) error {
+	for _, r := range results {
+		if r.Err != nil {
+			return fmt.Errorf("%s: %v", r.System, r.Err)
+		}
+	}
+	return nil
+}
+
+// checkMethod writes an error response and returns false unless the request
+// uses the given method. Roles are checked by requireRole.
+func checkMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+func handleListUsers(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	users, err := ListKeycloakUsers()
+	if err != nil {
+		http.Error(w, "Failed to list users: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+
+	render(w, r, "users", "Users", users)
+}
+
+func handleViewUser(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	username := r.URL.Query().Get("username")
+	if username == "" {
+		http.Error(w, "username is required", http.StatusBadRequest)
+		return
+	}
+	ua := GetUserAccounts(username)
+	render(w, r, "user", username, struct {
+		Username string
+		Accounts []accountRow
+		Builtin  bool
+		Actions  []userAction
+	}{username, ua.Rows(), isBuiltinUser(username), userActions})
+}
+
+// Rows returns the account of the user in each system.
+func (ua *UserAccounts) Rows() []accountRow {
+	var accounts []accountRow
+	if ua.Keycloak != nil {
+		status := "enabled"
+		if !ua.Keycloak.Enabled {
+			status = "disabled"
+		}
+		accounts = append(accounts, accountRow{"Keycloak", ua.Keycloak.FirstName + " " + ua.Keycloak.LastName, ua.Keycloak.Email, status, nil})
+	} else {
+		accounts = append(accounts, accountRow{System: "Keycloak", Err: ua.KeycloakErr})
+	}
+	if ua.Gerrit != nil {
+		status := "active"
+		if !ua.GerritActive {
+			status = "inactive"
+		}
+		accounts = append(accounts, accountRow{"Gerrit", ua.Gerrit.Name, ua.Gerrit.Email, status, nil})
+	} else {
+		accounts = append(accounts, accountRow{System: "Gerrit", Err: ua.GerritErr})
+	}
+	if ua.Redmine != nil {
+		status := "active"
+		switch ua.Redmine.Status {
+		case RedmineStatusRegistered:
+			status = "registered"
+		case RedmineStatusLocked:
+			status = "locked"
+		}
+		accounts = append(accounts, accountRow{"Redmine", ua.Redmine.FirstName + " " + ua.Redmine.LastName, ua.Redmine.Mail, status, nil})
+	} else {
+		accounts = append(accounts, accountRow{System: "Redmine", Err: ua.RedmineErr})
+	}
+	return accounts
+}
+
+// accountRow is the account of a user in one system.
+type accountRow struct {
+	System string
+	Name   string
+	Email  string
+	Status string
+	Err    error
+}
+
+type userAction struct {
+	Path, Label, Confirm string
+}
+
+var userActions = []userAction{
+	{"disable", "Disable", "Disable this user?"},
+	{"enable", "Enable", "Enable this user?"},
+	{"delete", "Delete", "Delete this user?"},
+	{"reset-password", "Send password reset email", "Email this user a link to set a new password?"},
+	{"reset-otp", "Reset two-factor authentication", "Remove the OTP devices of this user?"},
+}
+
+func handleEditUser(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	username := r.URL.Query().Get("username")
+	if username == "" {
+		http.Error(w, "username is required", http.StatusBadRequest)
+		return
+	}
+	user, err := GetKeycloakUser(username)
+	if isNotFound(err) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to look up user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	render(w, r, "user_edit", "Edit "+username, user)
+}
+
+func handleUpdateUser(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodPost) {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	username := r.FormValue("username")
+	firstName := r.FormValue("first_name")
+	lastName := r.FormValue("last_name")
+	email := r.FormValue("email")
+	if username == "" {
+		http.Error(w, "username is required", http.StatusBadRequest)
+		return
+	}
+	if !checkCanManage(w, CheckCanManageUser(r, username)) {
+		return
+	}
+	edit := "/users/edit?username=" + url.QueryEscape(username)
+	if firstName == "" || lastName == "" || email == "" {
+		redirectWithFlash(w, r, edit, FlashError, "All fields are required")
+		return
+	}
+	if err := CheckEmail(email); err != nil {
+		redirectWithFlash(w, r, edit, FlashError, err.Error())
+		return
+	}
+	results := UpdateUser(username, firstName, lastName, email)
+	AuditResults(auditActor(r), "user.update", username, results)
+	redirectWithResults(w, r, "/users/view?username="+url.QueryEscape(username), results)
+}
+
+// SendPasswordResetEmail makes Keycloak email the user a link to set a new
+// password and to verify the email address.
+func SendPasswordResetEmail(username string) []SystemResult {
+	results := []SystemResult{{System: "Keycloak"}}
+	user, err := GetKeycloakUser(username)
+	if err != nil {
+		results[0].Err = err
+	} else {
+		results[0].Err = SendKeycloakActionsEmail(user.ID, []string{"UPDATE_PASSWORD", "VERIFY_EMAIL"}, 0)
+		results[0].Message = "email sent to " + user.Email
+	}
+	return finishResults(results, "")
+}
+
+// handleUserAction returns a handler for the disable, enable, delete,
+// password reset and OTP reset buttons on the user page, and the revoke
+// button on the sessions page.
+func handleUserAction(action, auditAction string, op func(username string) []SystemResult) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !checkMethod(w, r, http.MethodPost) {
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		username := r.FormValue("username")
+		if username == "" {
+			http.Error(w, "username is required", http.StatusBadRequest)
+			return
+		}
+		if isBuiltinUser(username) {
+			http.Error(w, "Built-in users cannot be changed here", http.StatusBadRequest)
+			return
+		}
+		if !checkCanManage(w, CheckCanManageUser(r, username)) {
+			return
+		}
+		log.Printf("%s user '%s'", action, username)
+		results := op(username)
+		AuditResults(auditActor(r), auditAction, username, results)
+		next := "/users/view?username=" + url.QueryEscape(username)
+		switch auditAction {
+		case "user.delete":
+			next = "/users"
+		case "user.revoke_sessions":
+			next = "/users/sessions?username=" + url.QueryEscape(username)
+		}
+		redirectWithResults(w, r, next, results)
+	}
+}
@@ -0,0 +1,29 @@
+require 'optparse'
+
+options = {}
+OptionParser.new do |opts|
+  opts.banner = "Usage: rename_host.rb [options]"
+  opts.on("--old-hostname HOSTNAME", "The previous hostname") do |value|
+    options[:old_hostname] = value
+  end
+  opts.on("--new-hostname HOSTNAME", "The new hostname") do |value|
+    options[:new_hostname] = value
+  end
+end.parse!
+
+old_hostname = options[:old_hostname]
+new_hostname = options[:new_hostname]
+
+# update_settings.rb only changes the defaults in config/settings.yml. Settings
+# that have been saved in the database take precedence, so rewrite those here.
+{
+  'host_name' => [old_hostname + ':9441', new_hostname + ':9441'],
+  'email_domains_allowed' => [old_hostname, new_hostname],
+  'mail_from' => ['redmine@' + old_hostname, 'redmine@' + new_hostname],
+}.each do |name, (old_value, new_value)|
+  setting = Setting.find_by(name: name)
+  next if setting.nil? || setting.value != old_value
+  setting.value = new_value
+  setting.save!
+  puts "Updated setting #{name}: #{old_value} => #{new_value}"
+end
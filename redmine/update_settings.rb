@@ -1,12 +1,15 @@
 require 'yaml'
 require 'optparse'
 
-options = {}
+options = {email_domains: ''}
 OptionParser.new do |opts|
   opts.banner = "Usage: update_settings.rb [options]"
   opts.on("--hostname HOSTNAME", "Set the hostname") do |value|
     options[:hostname] = value
   end
+  opts.on("--email-domains DOMAINS", "Comma-separated domains allowed in email addresses (default: any)") do |value|
+    options[:email_domains] = value
+  end
 end.parse!
 
 file_path = 'config/settings.yml'
@@ -44,7 +47,7 @@ settings['default_projects_public']['default'] = 0
 ## Maximum number of additional email addresses
 settings['max_additional_emails']['default'] = 0
 ## Allowed email domains
-settings['email_domains_allowed']['default'] = options[:hostname]
+settings['email_domains_allowed']['default'] = options[:email_domains]
 ## Allow users to delete their own account
 settings['unsubscribe']['default'] = 0
 
@@ -0,0 +1,23 @@
+require 'json'
+require 'optparse'
+
+options = {}
+OptionParser.new do |opts|
+  opts.banner = "Usage: user_tokens.rb [options]"
+  opts.on("--login LOGIN", "The login of the user") do |value|
+    options[:login] = value
+  end
+  opts.on("--revoke", "Delete the tokens after listing them") do
+    options[:revoke] = true
+  end
+end.parse!
+
+user = User.find_by_login(options[:login])
+abort "No such user: #{options[:login]}" if user.nil?
+
+# The API key, the Atom key, session and autologin tokens, and pending
+# password recovery links are all tokens. Redmine creates a new API key
+# the next time one is needed.
+tokens = Token.where(user_id: user.id).order(:created_on).to_a
+puts JSON.generate(tokens.map { |t| { action: t.action, created_on: t.created_on.utc.iso8601 } })
+Token.where(id: tokens.map(&:id)).delete_all if options[:revoke]